@@ -64,6 +64,9 @@ var (
 	// ShardDDLOptimismOperationKeyAdapter used to store shard DDL operation in optimistic model.
 	// k/v: Encode(task-name, sourc-id, upstream-schema-name, upstream-table-name) -> shard DDL operation.
 	ShardDDLOptimismOperationKeyAdapter KeyAdapter = keyHexEncoderDecoder("/dm-master/shardddl-optimism/operation/")
+	// ShardDDLOptimismTableKeeperCheckpointKeyAdapter used to store the checkpoint (snapshot) of the table keeper in optimistic model.
+	// k/v: Encode() -> all source tables kept in the table keeper.
+	ShardDDLOptimismTableKeeperCheckpointKeyAdapter KeyAdapter = keyEncoderDecoder("/dm-master/shardddl-optimism/table-keeper-checkpoint/")
 )
 
 func keyAdapterKeysLen(s KeyAdapter) int {
@@ -196,6 +196,7 @@ func (o *Optimist) rebuildLocks() (revSource, revInfo, revOperation int64, err e
 	// we do not log `stm`, `ifm` and `opm` now, because they may too long in optimism mode.
 	o.logger.Info("get history initial source tables", zap.Int64("revision", revSource))
 	o.tk.Init(stm) // re-initialize again with valid tables.
+	o.tk.SetRevision(revSource)
 
 	// get the history shard DDL info.
 	ifm, revInfo, err := optimism.GetAllInfo(o.cli)
@@ -212,6 +213,11 @@ func (o *Optimist) rebuildLocks() (revSource, revInfo, revOperation int64, err e
 	}
 	o.logger.Info("get history shard DDL lock operation", zap.Int64("revision", revOperation))
 
+	// check the consistency of the history data, only for diagnosing.
+	if findings := optimism.ValidateBootstrap(ifm, opm, stm); len(findings) > 0 {
+		o.logger.Warn("inconsistent history shard DDL info, lock operation or source tables found", zap.Strings("findings", findings))
+	}
+
 	// recover the shard DDL lock based on history shard DDL info & lock operation.
 	err = o.recoverLocks(ifm, opm)
 	if err != nil {
@@ -460,6 +466,17 @@ func (o *Optimist) handleLock(info optimism.Info, sts []optimism.SourceTables, s
 
 	lock := o.lk.FindLock(lockID)
 	if lock == nil {
+		if err == nil {
+			// no lock created for no-op DDLs, but the operation is still needed for the DM-worker to continue.
+			op := optimism.NewOperation(lockID, info.Task, info.Source, info.UpSchema, info.UpTable, newDDLs, cfStage, false)
+			rev, succ, _, err2 := optimism.PutOperation(o.cli, skipDone, op)
+			if err2 != nil {
+				return err2
+			}
+			o.logger.Info("put shard DDL operation for no-op DDLs without a lock", zap.String("lock", lockID),
+				zap.Stringer("operation", op), zap.Bool("already exist", !succ), zap.Int64("revision", rev))
+			return nil
+		}
 		// this should not happen.
 		o.logger.Warn("lock not found after try sync for shard DDL info", zap.String("lock", lockID), zap.Stringer("info", info))
 		return nil
@@ -477,7 +494,7 @@ func (o *Optimist) handleLock(info optimism.Info, sts []optimism.SourceTables, s
 	}
 
 	op := optimism.NewOperation(lockID, lock.Task, info.Source, info.UpSchema, info.UpTable, newDDLs, cfStage, false)
-	rev, succ, err := optimism.PutOperation(o.cli, skipDone, op)
+	rev, succ, _, err := optimism.PutOperation(o.cli, skipDone, op)
 	if err != nil {
 		return err
 	}
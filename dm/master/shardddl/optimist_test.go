@@ -266,7 +266,7 @@ func (t *testOptimist) testOptimist(c *C, restart int) {
 	// mark op11 as done.
 	op11c := op11
 	op11c.Done = true
-	_, putted, err := optimism.PutOperation(etcdTestCli, false, op11c)
+	_, putted, _, err := optimism.PutOperation(etcdTestCli, false, op11c)
 	c.Assert(err, IsNil)
 	c.Assert(putted, IsTrue)
 	c.Assert(utils.WaitSomething(backOff, waitTime, func() bool {
@@ -281,7 +281,7 @@ func (t *testOptimist) testOptimist(c *C, restart int) {
 	// mark op12 as done, the lock should be resolved.
 	op12c := op12
 	op12c.Done = true
-	_, putted, err = optimism.PutOperation(etcdTestCli, false, op12c)
+	_, putted, _, err = optimism.PutOperation(etcdTestCli, false, op12c)
 	c.Assert(err, IsNil)
 	c.Assert(putted, IsTrue)
 	c.Assert(utils.WaitSomething(backOff, waitTime, func() bool {
@@ -433,7 +433,7 @@ func (t *testOptimist) testOptimist(c *C, restart int) {
 	// mark op21 as done.
 	op21c := op21
 	op21c.Done = true
-	_, putted, err = optimism.PutOperation(etcdTestCli, false, op21c)
+	_, putted, _, err = optimism.PutOperation(etcdTestCli, false, op21c)
 	c.Assert(err, IsNil)
 	c.Assert(putted, IsTrue)
 	c.Assert(utils.WaitSomething(backOff, waitTime, func() bool {
@@ -453,7 +453,7 @@ func (t *testOptimist) testOptimist(c *C, restart int) {
 	// mark op23 as done.
 	op23c := op23
 	op23c.Done = true
-	_, putted, err = optimism.PutOperation(etcdTestCli, false, op23c)
+	_, putted, _, err = optimism.PutOperation(etcdTestCli, false, op23c)
 	c.Assert(err, IsNil)
 	c.Assert(putted, IsTrue)
 	c.Assert(utils.WaitSomething(backOff, waitTime, func() bool {
@@ -40,6 +40,34 @@ const (
 	DefaultRevokeLeaseTimeout = 3 * time.Second
 )
 
+// KVClient is the minimal etcd client interface used to read, write and watch key-values.
+// `*clientv3.Client` satisfies it, and a fake implementation can be used in tests.
+type KVClient interface {
+	// Get retrieves keys.
+	Get(ctx context.Context, key string, opts ...clientv3.OpOption) (*clientv3.GetResponse, error)
+	// Put puts a key-value pair.
+	Put(ctx context.Context, key, val string, opts ...clientv3.OpOption) (*clientv3.PutResponse, error)
+	// Delete deletes a key or a range of keys.
+	Delete(ctx context.Context, key string, opts ...clientv3.OpOption) (*clientv3.DeleteResponse, error)
+	// Txn creates a transaction.
+	Txn(ctx context.Context) clientv3.Txn
+	// Watch watches on a key or a range of keys.
+	Watch(ctx context.Context, key string, opts ...clientv3.OpOption) clientv3.WatchChan
+	// Ctx is the context of the client, it's canceled when the client closed.
+	Ctx() context.Context
+}
+
+var _ KVClient = &clientv3.Client{}
+
+// LeaseKVClient is the etcd client interface with the lease API, used to put key-values with leases.
+// `*clientv3.Client` satisfies it.
+type LeaseKVClient interface {
+	KVClient
+	clientv3.Lease
+}
+
+var _ LeaseKVClient = &clientv3.Client{}
+
 var etcdDefaultTxnRetryParam = retry.Params{
 	RetryCount:         5,
 	FirstRetryDuration: time.Second,
@@ -90,8 +118,13 @@ func AddMember(client *clientv3.Client, peerAddrs []string) (*clientv3.MemberAdd
 
 // DoOpsInOneTxnWithRetry do multiple etcd operations in one txn.
 // TODO: add unit test to test encountered an retryable error first but then recovered
-func DoOpsInOneTxnWithRetry(cli *clientv3.Client, ops ...clientv3.Op) (*clientv3.TxnResponse, int64, error) {
-	ctx, cancel := context.WithTimeout(cli.Ctx(), DefaultRequestTimeout)
+func DoOpsInOneTxnWithRetry(cli KVClient, ops ...clientv3.Op) (*clientv3.TxnResponse, int64, error) {
+	return DoOpsInOneTxnWithRetryCtx(cli.Ctx(), cli, ops...)
+}
+
+// DoOpsInOneTxnWithRetryCtx is the same as `DoOpsInOneTxnWithRetry` but honors the deadline/cancellation of `ctx`.
+func DoOpsInOneTxnWithRetryCtx(ctx context.Context, cli KVClient, ops ...clientv3.Op) (*clientv3.TxnResponse, int64, error) {
+	ctx, cancel := context.WithTimeout(ctx, DefaultRequestTimeout)
 	defer cancel()
 	tctx := tcontext.NewContext(ctx, log.L())
 	ret, _, err := etcdDefaultTxnStrategy.Apply(tctx, etcdDefaultTxnRetryParam, func(t *tcontext.Context) (ret interface{}, err error) {
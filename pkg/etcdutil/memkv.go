@@ -0,0 +1,523 @@
+// Copyright 2020 PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package etcdutil
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"reflect"
+	"sort"
+	"sync"
+
+	"go.etcd.io/etcd/clientv3"
+	v3rpc "go.etcd.io/etcd/etcdserver/api/v3rpc/rpctypes"
+	pb "go.etcd.io/etcd/etcdserver/etcdserverpb"
+	"go.etcd.io/etcd/mvcc/mvccpb"
+)
+
+// NewMemClient creates an etcd client backed by an in-memory KV store without any real etcd cluster.
+// only the `KV` and `Watcher` interfaces are implemented, so it's mainly used for unit tests.
+// the returned client can be used as a `KVClient`.
+// NOTE: some features are not supported now:
+// - `WithSort` option is ignored, keys are always returned in ascending order.
+// - nested transactions (`OpTxn`) are not supported.
+// - PrevKV is always attached to watched events.
+func NewMemClient() *clientv3.Client {
+	m := newMemKV()
+	cli := clientv3.NewCtxClient(context.Background())
+	cli.KV = m
+	cli.Watcher = m
+	return cli
+}
+
+// memKV implements `clientv3.KV` and `clientv3.Watcher` in memory.
+type memKV struct {
+	mu sync.Mutex
+
+	rev       int64                       // the current revision.
+	compacted int64                       // the compacted revision.
+	kvs       map[string]*mvccpb.KeyValue // key -> the latest key-value.
+	history   []*clientv3.Event           // all events happened, used to start watching from an old revision.
+	watchers  map[*memWatcher]struct{}    // all active watchers.
+	closed    chan struct{}               // closed when the watcher is closed.
+	closeOnce sync.Once
+}
+
+func newMemKV() *memKV {
+	return &memKV{
+		rev:      1, // the same as a new etcd cluster.
+		kvs:      make(map[string]*mvccpb.KeyValue),
+		watchers: make(map[*memWatcher]struct{}),
+		closed:   make(chan struct{}),
+	}
+}
+
+// Put implements `clientv3.KV.Put`.
+func (m *memKV) Put(ctx context.Context, key, val string, opts ...clientv3.OpOption) (*clientv3.PutResponse, error) {
+	resp, err := m.Do(ctx, clientv3.OpPut(key, val, opts...))
+	return resp.Put(), err
+}
+
+// Get implements `clientv3.KV.Get`.
+func (m *memKV) Get(ctx context.Context, key string, opts ...clientv3.OpOption) (*clientv3.GetResponse, error) {
+	resp, err := m.Do(ctx, clientv3.OpGet(key, opts...))
+	return resp.Get(), err
+}
+
+// Delete implements `clientv3.KV.Delete`.
+func (m *memKV) Delete(ctx context.Context, key string, opts ...clientv3.OpOption) (*clientv3.DeleteResponse, error) {
+	resp, err := m.Do(ctx, clientv3.OpDelete(key, opts...))
+	return resp.Del(), err
+}
+
+// Compact implements `clientv3.KV.Compact`.
+// NOTE: the history is still kept, but reading or watching from a revision before the compacted one is rejected.
+func (m *memKV) Compact(ctx context.Context, rev int64, opts ...clientv3.CompactOption) (*clientv3.CompactResponse, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	switch {
+	case rev > m.rev:
+		return nil, v3rpc.ErrFutureRev
+	case rev < m.compacted:
+		return nil, v3rpc.ErrCompacted
+	}
+	m.compacted = rev
+	return &clientv3.CompactResponse{Header: &pb.ResponseHeader{Revision: m.rev}}, nil
+}
+
+// Do implements `clientv3.KV.Do`.
+func (m *memKV) Do(ctx context.Context, op clientv3.Op) (clientv3.OpResponse, error) {
+	if op.IsTxn() {
+		cmps, thenOps, elseOps := op.Txn()
+		resp, err := m.Txn(ctx).If(cmps...).Then(thenOps...).Else(elseOps...).Commit()
+		if err != nil {
+			return clientv3.OpResponse{}, err
+		}
+		return resp.OpResponse(), nil
+	}
+
+	resp, err := m.Txn(ctx).Then(op).Commit()
+	if err != nil {
+		return clientv3.OpResponse{}, err
+	}
+	switch r := resp.Responses[0].Response.(type) {
+	case *pb.ResponseOp_ResponseRange:
+		return (*clientv3.GetResponse)(r.ResponseRange).OpResponse(), nil
+	case *pb.ResponseOp_ResponsePut:
+		return (*clientv3.PutResponse)(r.ResponsePut).OpResponse(), nil
+	case *pb.ResponseOp_ResponseDeleteRange:
+		return (*clientv3.DeleteResponse)(r.ResponseDeleteRange).OpResponse(), nil
+	default:
+		return clientv3.OpResponse{}, fmt.Errorf("unsupported response type %T", r)
+	}
+}
+
+// Txn implements `clientv3.KV.Txn`.
+func (m *memKV) Txn(ctx context.Context) clientv3.Txn {
+	return &memTxn{m: m, ctx: ctx}
+}
+
+// memTxn implements `clientv3.Txn` for memKV.
+type memTxn struct {
+	m   *memKV
+	ctx context.Context
+
+	cmps    []clientv3.Cmp
+	thenOps []clientv3.Op
+	elseOps []clientv3.Op
+}
+
+// If implements `clientv3.Txn.If`.
+func (t *memTxn) If(cs ...clientv3.Cmp) clientv3.Txn {
+	t.cmps = append(t.cmps, cs...)
+	return t
+}
+
+// Then implements `clientv3.Txn.Then`.
+func (t *memTxn) Then(ops ...clientv3.Op) clientv3.Txn {
+	t.thenOps = append(t.thenOps, ops...)
+	return t
+}
+
+// Else implements `clientv3.Txn.Else`.
+func (t *memTxn) Else(ops ...clientv3.Op) clientv3.Txn {
+	t.elseOps = append(t.elseOps, ops...)
+	return t
+}
+
+// Commit implements `clientv3.Txn.Commit`.
+func (t *memTxn) Commit() (*clientv3.TxnResponse, error) {
+	if err := t.ctx.Err(); err != nil {
+		return nil, err
+	}
+	return t.m.commit(t.cmps, t.thenOps, t.elseOps)
+}
+
+// commit applies a transaction atomically.
+func (m *memKV) commit(cmps []clientv3.Cmp, thenOps, elseOps []clientv3.Op) (*clientv3.TxnResponse, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	succeeded := true
+	for _, cmp := range cmps {
+		if !m.compare(cmp) {
+			succeeded = false
+			break
+		}
+	}
+	ops := thenOps
+	if !succeeded {
+		ops = elseOps
+	}
+
+	// check all operations before applying any of them to keep the transaction atomic.
+	for _, op := range ops {
+		switch {
+		case op.IsGet():
+			if err := m.checkRev(op.Rev()); err != nil {
+				return nil, err
+			}
+		case op.IsPut(), op.IsDelete():
+		default:
+			return nil, fmt.Errorf("unsupported operation in transaction, key %s", op.KeyBytes())
+		}
+	}
+
+	// all write operations in one transaction share the same revision.
+	var (
+		header   = &pb.ResponseHeader{}
+		writeRev = m.rev + 1
+		events   []*clientv3.Event
+		resps    = make([]*pb.ResponseOp, 0, len(ops))
+	)
+	for _, op := range ops {
+		switch {
+		case op.IsGet():
+			rr := m.rangeKeys(op)
+			rr.Header = header
+			resps = append(resps, &pb.ResponseOp{Response: &pb.ResponseOp_ResponseRange{ResponseRange: rr}})
+		case op.IsPut():
+			key := string(op.KeyBytes())
+			prev := m.kvs[key]
+			kv := &mvccpb.KeyValue{
+				Key:            op.KeyBytes(),
+				Value:          op.ValueBytes(),
+				CreateRevision: writeRev,
+				ModRevision:    writeRev,
+				Version:        1,
+			}
+			if prev != nil {
+				kv.CreateRevision = prev.CreateRevision
+				kv.Version = prev.Version + 1
+			}
+			m.kvs[key] = kv
+			events = append(events, &clientv3.Event{Type: mvccpb.PUT, Kv: kv, PrevKv: prev})
+			resps = append(resps, &pb.ResponseOp{Response: &pb.ResponseOp_ResponsePut{
+				ResponsePut: &pb.PutResponse{Header: header}}})
+		case op.IsDelete():
+			keys := m.matchedKeys(op.KeyBytes(), op.RangeBytes())
+			for _, key := range keys {
+				prev := m.kvs[key]
+				delete(m.kvs, key)
+				events = append(events, &clientv3.Event{
+					Type:   mvccpb.DELETE,
+					Kv:     &mvccpb.KeyValue{Key: []byte(key), ModRevision: writeRev},
+					PrevKv: prev,
+				})
+			}
+			resps = append(resps, &pb.ResponseOp{Response: &pb.ResponseOp_ResponseDeleteRange{
+				ResponseDeleteRange: &pb.DeleteRangeResponse{Header: header, Deleted: int64(len(keys))}}})
+		}
+	}
+
+	if len(events) > 0 {
+		m.rev = writeRev
+		m.history = append(m.history, events...)
+		for w := range m.watchers {
+			w.push(events)
+		}
+	}
+	header.Revision = m.rev
+
+	return &clientv3.TxnResponse{Header: header, Succeeded: succeeded, Responses: resps}, nil
+}
+
+// compare checks whether the comparison succeeds, the same as etcd,
+// a comparison for a range succeeds only if all keys in the range satisfy it.
+func (m *memKV) compare(cmp clientv3.Cmp) bool {
+	pc := pb.Compare(cmp)
+	keys := m.matchedKeys(pc.Key, pc.RangeEnd)
+	if len(keys) == 0 {
+		if pc.Target == pb.Compare_VALUE {
+			return false
+		}
+		return compareKV(&pc, &mvccpb.KeyValue{})
+	}
+	for _, key := range keys {
+		if !compareKV(&pc, m.kvs[key]) {
+			return false
+		}
+	}
+	return true
+}
+
+// compareKV checks whether the key-value satisfies the comparison.
+func compareKV(pc *pb.Compare, kv *mvccpb.KeyValue) bool {
+	var result int
+	switch pc.Target {
+	case pb.Compare_VALUE:
+		result = bytes.Compare(kv.Value, pc.GetValue())
+	case pb.Compare_VERSION:
+		result = compareInt64(kv.Version, pc.GetVersion())
+	case pb.Compare_CREATE:
+		result = compareInt64(kv.CreateRevision, pc.GetCreateRevision())
+	case pb.Compare_MOD:
+		result = compareInt64(kv.ModRevision, pc.GetModRevision())
+	case pb.Compare_LEASE:
+		result = compareInt64(kv.Lease, pc.GetLease())
+	}
+
+	switch pc.Result {
+	case pb.Compare_EQUAL:
+		return result == 0
+	case pb.Compare_NOT_EQUAL:
+		return result != 0
+	case pb.Compare_GREATER:
+		return result > 0
+	case pb.Compare_LESS:
+		return result < 0
+	}
+	return false
+}
+
+func compareInt64(a, b int64) int {
+	switch {
+	case a < b:
+		return -1
+	case a > b:
+		return 1
+	default:
+		return 0
+	}
+}
+
+// checkRev checks whether key-values at the revision can be read.
+func (m *memKV) checkRev(rev int64) error {
+	switch {
+	case rev > m.rev:
+		return v3rpc.ErrFutureRev
+	case rev > 0 && rev < m.compacted:
+		return v3rpc.ErrCompacted
+	}
+	return nil
+}
+
+// rangeKeys gets key-values for a GET operation.
+func (m *memKV) rangeKeys(op clientv3.Op) *pb.RangeResponse {
+	kvs := m.kvs
+	if rev := op.Rev(); rev > 0 && rev != m.rev {
+		kvs = m.kvsAtRev(rev)
+	}
+
+	rr := &pb.RangeResponse{}
+	limit := opLimit(op)
+	for _, key := range matchedKeys(kvs, op.KeyBytes(), op.RangeBytes()) {
+		rr.Count++
+		if op.IsCountOnly() {
+			continue
+		}
+		if limit > 0 && int64(len(rr.Kvs)) >= limit {
+			rr.More = true
+			continue
+		}
+		kv := *kvs[key]
+		if op.IsKeysOnly() {
+			kv.Value = nil
+		}
+		rr.Kvs = append(rr.Kvs, &kv)
+	}
+	return rr
+}
+
+// opLimit returns the limit set by `WithLimit` for a GET operation, 0 means no limit.
+// `clientv3.Op` doesn't export the limit, so it's read by reflection.
+func opLimit(op clientv3.Op) int64 {
+	return reflect.ValueOf(op).FieldByName("limit").Int()
+}
+
+// kvsAtRev rebuilds key-values at the specified revision from the history.
+func (m *memKV) kvsAtRev(rev int64) map[string]*mvccpb.KeyValue {
+	kvs := make(map[string]*mvccpb.KeyValue)
+	for _, ev := range m.history {
+		if ev.Kv.ModRevision > rev {
+			break
+		}
+		if ev.Type == mvccpb.PUT {
+			kvs[string(ev.Kv.Key)] = ev.Kv
+		} else {
+			delete(kvs, string(ev.Kv.Key))
+		}
+	}
+	return kvs
+}
+
+// matchedKeys returns the sorted keys in the current key-values matching `[key, end)`.
+func (m *memKV) matchedKeys(key, end []byte) []string {
+	return matchedKeys(m.kvs, key, end)
+}
+
+// matchedKeys returns the sorted keys in key-values matching `[key, end)`.
+func matchedKeys(kvs map[string]*mvccpb.KeyValue, key, end []byte) []string {
+	keys := make([]string, 0)
+	for k := range kvs {
+		if inRange([]byte(k), key, end) {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// inRange checks whether `k` is in `[key, end)`, the same as etcd,
+// an empty `end` means only `key` itself, and `\x00` means all keys >= `key`.
+func inRange(k, key, end []byte) bool {
+	switch {
+	case len(end) == 0:
+		return bytes.Equal(k, key)
+	case len(end) == 1 && end[0] == 0:
+		return bytes.Compare(k, key) >= 0
+	default:
+		return bytes.Compare(k, key) >= 0 && bytes.Compare(k, end) < 0
+	}
+}
+
+// Watch implements `clientv3.Watcher.Watch`.
+func (m *memKV) Watch(ctx context.Context, key string, opts ...clientv3.OpOption) clientv3.WatchChan {
+	op := clientv3.OpGet(key, opts...) // only used to extract the range and revision.
+	w := &memWatcher{
+		key:    op.KeyBytes(),
+		end:    op.RangeBytes(),
+		ch:     make(chan clientv3.WatchResponse),
+		notify: make(chan struct{}, 1),
+	}
+
+	m.mu.Lock()
+	rev := op.Rev()
+	if rev > 0 && rev < m.compacted {
+		compacted := m.compacted
+		m.mu.Unlock()
+		ch := make(chan clientv3.WatchResponse, 1)
+		ch <- clientv3.WatchResponse{CompactRevision: compacted, Canceled: true}
+		close(ch)
+		return ch
+	}
+	if rev > 0 {
+		for i, ev := range m.history {
+			if ev.Kv.ModRevision >= rev {
+				w.push(m.history[i:])
+				break
+			}
+		}
+	}
+	m.watchers[w] = struct{}{}
+	m.mu.Unlock()
+
+	go func() {
+		w.run(ctx, m.closed)
+		m.mu.Lock()
+		delete(m.watchers, w)
+		m.mu.Unlock()
+	}()
+	return w.ch
+}
+
+// RequestProgress implements `clientv3.Watcher.RequestProgress`.
+// NOTE: progress notify is not supported now.
+func (m *memKV) RequestProgress(ctx context.Context) error {
+	return nil
+}
+
+// Close implements `clientv3.Watcher.Close`.
+func (m *memKV) Close() error {
+	m.closeOnce.Do(func() {
+		close(m.closed)
+	})
+	return nil
+}
+
+// memWatcher is a watcher for a range of keys in memKV.
+type memWatcher struct {
+	key []byte
+	end []byte
+	ch  chan clientv3.WatchResponse
+
+	mu      sync.Mutex
+	pending []*clientv3.Event
+	notify  chan struct{}
+}
+
+// push pushes matched events into the pending queue, it never blocks.
+func (w *memWatcher) push(events []*clientv3.Event) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	for _, ev := range events {
+		if inRange(ev.Kv.Key, w.key, w.end) {
+			w.pending = append(w.pending, ev)
+		}
+	}
+	if len(w.pending) > 0 {
+		select {
+		case w.notify <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// run sends pending events to the watch channel until the context is done or the watcher is closed.
+func (w *memWatcher) run(ctx context.Context, closed <-chan struct{}) {
+	defer close(w.ch)
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-closed:
+			return
+		case <-w.notify:
+		}
+
+		w.mu.Lock()
+		events := w.pending
+		w.pending = nil
+		w.mu.Unlock()
+		if len(events) == 0 {
+			continue
+		}
+
+		resp := clientv3.WatchResponse{
+			Header: pb.ResponseHeader{Revision: events[len(events)-1].Kv.ModRevision},
+			Events: events,
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-closed:
+			return
+		case w.ch <- resp:
+		}
+	}
+}
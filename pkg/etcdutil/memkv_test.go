@@ -0,0 +1,205 @@
+// Copyright 2020 PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package etcdutil
+
+import (
+	"context"
+	"time"
+
+	. "github.com/pingcap/check"
+	"go.etcd.io/etcd/clientv3"
+	v3rpc "go.etcd.io/etcd/etcdserver/api/v3rpc/rpctypes"
+	"go.etcd.io/etcd/mvcc/mvccpb"
+)
+
+var _ = Suite(&testMemKVSuite{})
+
+type testMemKVSuite struct{}
+
+func (t *testMemKVSuite) TestKV(c *C) {
+	var (
+		cli = NewMemClient()
+		ctx = context.Background()
+	)
+	defer cli.Close()
+
+	// put and get.
+	putResp, err := cli.Put(ctx, "/a/1", "v1")
+	c.Assert(err, IsNil)
+	rev1 := putResp.Header.Revision
+	c.Assert(rev1, Equals, int64(2))
+	_, err = cli.Put(ctx, "/a/2", "v2")
+	c.Assert(err, IsNil)
+	putResp, err = cli.Put(ctx, "/a/1", "v1-new")
+	c.Assert(err, IsNil)
+	rev3 := putResp.Header.Revision
+	c.Assert(rev3, Equals, rev1+2)
+	_, err = cli.Put(ctx, "/b", "v3")
+	c.Assert(err, IsNil)
+
+	getResp, err := cli.Get(ctx, "/a/1")
+	c.Assert(err, IsNil)
+	c.Assert(getResp.Kvs, HasLen, 1)
+	c.Assert(string(getResp.Kvs[0].Value), Equals, "v1-new")
+	c.Assert(getResp.Kvs[0].CreateRevision, Equals, rev1)
+	c.Assert(getResp.Kvs[0].ModRevision, Equals, rev3)
+	c.Assert(getResp.Kvs[0].Version, Equals, int64(2))
+
+	// get with prefix.
+	getResp, err = cli.Get(ctx, "/a/", clientv3.WithPrefix())
+	c.Assert(err, IsNil)
+	c.Assert(getResp.Count, Equals, int64(2))
+	c.Assert(string(getResp.Kvs[0].Key), Equals, "/a/1")
+	c.Assert(string(getResp.Kvs[1].Key), Equals, "/a/2")
+	c.Assert(getResp.More, IsFalse)
+
+	// get with limit.
+	getResp, err = cli.Get(ctx, "/a/", clientv3.WithPrefix(), clientv3.WithLimit(1))
+	c.Assert(err, IsNil)
+	c.Assert(getResp.Count, Equals, int64(2))
+	c.Assert(getResp.Kvs, HasLen, 1)
+	c.Assert(string(getResp.Kvs[0].Key), Equals, "/a/1")
+	c.Assert(getResp.More, IsTrue)
+
+	// get from an old revision.
+	getResp, err = cli.Get(ctx, "/a/1", clientv3.WithRev(rev1))
+	c.Assert(err, IsNil)
+	c.Assert(string(getResp.Kvs[0].Value), Equals, "v1")
+	_, err = cli.Get(ctx, "/a/1", clientv3.WithRev(rev3+100))
+	c.Assert(err, Equals, v3rpc.ErrFutureRev)
+
+	// delete with prefix.
+	delResp, err := cli.Delete(ctx, "/a/", clientv3.WithPrefix())
+	c.Assert(err, IsNil)
+	c.Assert(delResp.Deleted, Equals, int64(2))
+	getResp, err = cli.Get(ctx, "", clientv3.WithPrefix())
+	c.Assert(err, IsNil)
+	c.Assert(getResp.Kvs, HasLen, 1)
+	c.Assert(string(getResp.Kvs[0].Key), Equals, "/b")
+
+	// compact.
+	_, err = cli.Compact(ctx, rev3)
+	c.Assert(err, IsNil)
+	_, err = cli.Get(ctx, "/a/1", clientv3.WithRev(rev1))
+	c.Assert(err, Equals, v3rpc.ErrCompacted)
+	getResp, err = cli.Get(ctx, "/a/1", clientv3.WithRev(rev3)) // the compacted revision itself can still be read.
+	c.Assert(err, IsNil)
+	c.Assert(string(getResp.Kvs[0].Value), Equals, "v1-new")
+	_, err = cli.Compact(ctx, rev1)
+	c.Assert(err, Equals, v3rpc.ErrCompacted)
+
+	// canceled context.
+	cctx, cancel := context.WithCancel(ctx)
+	cancel()
+	_, err = cli.Get(cctx, "/b")
+	c.Assert(err, Equals, context.Canceled)
+}
+
+func (t *testMemKVSuite) TestTxn(c *C) {
+	var (
+		cli = NewMemClient()
+		ctx = context.Background()
+	)
+	defer cli.Close()
+
+	// put if not exist.
+	notExist := clientv3.Compare(clientv3.CreateRevision("/k"), "=", 0)
+	resp, err := cli.Txn(ctx).If(notExist).Then(clientv3.OpPut("/k", "v1")).Commit()
+	c.Assert(err, IsNil)
+	c.Assert(resp.Succeeded, IsTrue)
+	rev := resp.Header.Revision
+
+	resp, err = cli.Txn(ctx).If(notExist).Then(clientv3.OpPut("/k", "v2")).Else(clientv3.OpGet("/k")).Commit()
+	c.Assert(err, IsNil)
+	c.Assert(resp.Succeeded, IsFalse)
+	c.Assert(resp.Header.Revision, Equals, rev) // not changed.
+	kvs := resp.Responses[0].GetResponseRange().Kvs
+	c.Assert(kvs, HasLen, 1)
+	c.Assert(string(kvs[0].Value), Equals, "v1")
+
+	// compare value and mod revision.
+	resp, err = cli.Txn(ctx).If(
+		clientv3.Compare(clientv3.Value("/k"), "=", "v1"),
+		clientv3.Compare(clientv3.ModRevision("/k"), "=", rev),
+	).Then(clientv3.OpPut("/k", "v2"), clientv3.OpPut("/k2", "v2"), clientv3.OpGet("/k")).Commit()
+	c.Assert(err, IsNil)
+	c.Assert(resp.Succeeded, IsTrue)
+	c.Assert(resp.Header.Revision, Equals, rev+1) // all writes in one txn share one revision.
+	c.Assert(string(resp.Responses[2].GetResponseRange().Kvs[0].Value), Equals, "v2")
+
+	// compare value for a not existing key always fails.
+	resp, err = cli.Txn(ctx).If(clientv3.Compare(clientv3.Value("/not-exist"), "!=", "v")).Commit()
+	c.Assert(err, IsNil)
+	c.Assert(resp.Succeeded, IsFalse)
+
+	// an invalid operation rejects the whole txn.
+	_, err = cli.Txn(ctx).Then(clientv3.OpPut("/k3", "v3"), clientv3.OpGet("/k", clientv3.WithRev(rev+100))).Commit()
+	c.Assert(err, Equals, v3rpc.ErrFutureRev)
+	getResp, err := cli.Get(ctx, "/k3")
+	c.Assert(err, IsNil)
+	c.Assert(getResp.Kvs, HasLen, 0)
+}
+
+func (t *testMemKVSuite) TestWatch(c *C) {
+	var (
+		cli     = NewMemClient()
+		ctx     = context.Background()
+		timeout = time.Second
+	)
+	defer cli.Close()
+
+	resp, err := cli.Put(ctx, "/w/1", "v1")
+	c.Assert(err, IsNil)
+	rev1 := resp.Header.Revision
+	_, err = cli.Put(ctx, "/other", "v")
+	c.Assert(err, IsNil)
+
+	// watch from an old revision.
+	wctx, cancel := context.WithCancel(ctx)
+	wch := cli.Watch(wctx, "/w/", clientv3.WithPrefix(), clientv3.WithRev(rev1))
+	_, err = cli.Delete(ctx, "/w/1")
+	c.Assert(err, IsNil)
+
+	var events []*clientv3.Event
+	for len(events) < 2 {
+		select {
+		case wresp := <-wch:
+			c.Assert(wresp.Err(), IsNil)
+			events = append(events, wresp.Events...)
+		case <-time.After(timeout):
+			c.Fatal("watch timeout")
+		}
+	}
+	c.Assert(events, HasLen, 2)
+	c.Assert(events[0].Type, Equals, mvccpb.PUT)
+	c.Assert(string(events[0].Kv.Value), Equals, "v1")
+	c.Assert(events[1].Type, Equals, mvccpb.DELETE)
+	c.Assert(string(events[1].PrevKv.Value), Equals, "v1")
+
+	// the channel is closed after the context canceled.
+	cancel()
+	select {
+	case _, ok := <-wch:
+		c.Assert(ok, IsFalse)
+	case <-time.After(timeout):
+		c.Fatal("watch channel not closed")
+	}
+
+	// watch from a compacted revision.
+	_, err = cli.Compact(ctx, rev1+1)
+	c.Assert(err, IsNil)
+	wresp := <-cli.Watch(ctx, "/w/", clientv3.WithPrefix(), clientv3.WithRev(rev1))
+	c.Assert(wresp.Canceled, IsTrue)
+	c.Assert(wresp.Err(), Equals, v3rpc.ErrCompacted)
+}
@@ -0,0 +1,88 @@
+// Copyright 2020 PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package optimism
+
+import (
+	"bytes"
+	"encoding/gob"
+	"encoding/json"
+	"fmt"
+	"strings"
+)
+
+// Codec represents the encoding of values (Info, Operation and SourceTables) put into etcd.
+type Codec int
+
+// Codec list.
+const (
+	// CodecJSON encodes values as JSON, this is the default codec.
+	CodecJSON Codec = iota
+	// CodecGob encodes values as gob prefixed with a format marker,
+	// it's more compact and faster to decode than JSON, especially for values with table infos.
+	CodecGob
+)
+
+// gobMarker is the first byte of values encoded by `CodecGob`.
+// values encoded by `CodecJSON` always start with `{`, so the codec of a value can be told by its first byte.
+const gobMarker byte = 0x01
+
+// valueCodec is the codec used to encode values put into etcd.
+var valueCodec = CodecJSON
+
+// String implements Stringer interface.
+func (c Codec) String() string {
+	switch c {
+	case CodecJSON:
+		return "json"
+	case CodecGob:
+		return "gob"
+	}
+	return fmt.Sprintf("unknown codec %d", int(c))
+}
+
+// SetCodec sets the codec used to encode values put into etcd, it should be called at package init.
+// values are always decoded by their format marker, so values encoded by any codec (e.g. JSON values
+// written by an older DM-master) can still be read after the codec changed.
+// NOTE: DM-master and DM-workers should use codecs known by each other.
+func SetCodec(c Codec) {
+	valueCodec = c
+}
+
+// encodeGob encodes the value as gob prefixed with `gobMarker`.
+func encodeGob(v interface{}) (string, error) {
+	var buf bytes.Buffer
+	buf.WriteByte(gobMarker)
+	if err := gob.NewEncoder(&buf).Encode(v); err != nil {
+		return "", err
+	}
+	return buf.String(), nil
+}
+
+// isGobValue returns whether the value is encoded by `CodecGob`.
+func isGobValue(s string) bool {
+	return len(s) > 0 && s[0] == gobMarker
+}
+
+// decodeGob decodes the value encoded by `encodeGob`.
+func decodeGob(s string, v interface{}) error {
+	return gob.NewDecoder(strings.NewReader(s[1:])).Decode(v)
+}
+
+// decodeValue decodes the value encoded by any codec, no upgrade is done for the decoded value.
+func decodeValue(s string, v interface{}) error {
+	if isGobValue(s) {
+		return decodeGob(s, v)
+	}
+	return json.Unmarshal([]byte(s), v)
+}
@@ -0,0 +1,174 @@
+// Copyright 2020 PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package optimism
+
+import (
+	. "github.com/pingcap/check"
+	"github.com/pingcap/parser"
+	"github.com/pingcap/tidb/util/mock"
+
+	"github.com/pingcap/dm/pkg/etcdutil"
+)
+
+func (t *testForEtcd) TestCodecRoundTrip(c *C) {
+	defer SetCodec(CodecJSON)
+
+	var (
+		p           = parser.New()
+		se          = mock.NewContext()
+		tblID int64 = 111
+		ti1         = createTableInfo(c, p, se, tblID, `CREATE TABLE bar (id INT PRIMARY KEY, c1 VARCHAR(10) DEFAULT 'x', KEY idx_c1 (c1))`)
+		ti2         = createTableInfo(c, p, se, tblID, `CREATE TABLE bar (id INT PRIMARY KEY, c1 VARCHAR(10) DEFAULT 'x', c2 INT, KEY idx_c1 (c1))`)
+		info        = NewInfo("test", "mysql-replica-1", "db-1", "tbl-1", "db", "tbl", []string{"ALTER TABLE tbl ADD COLUMN c2 INT"}, ti1, ti2)
+		op          = NewOperation("test-ID", "test", "mysql-replica-1", "db-1", "tbl-1", []string{}, ConflictNone, true)
+		st          = NewSourceTables("test", "mysql-replica-1", map[string]map[string]struct{}{"db-1": {"tbl-1": struct{}{}, "tbl-2": struct{}{}}, "db-2": {}})
+	)
+	info.Seq = 2
+
+	c.Assert(CodecJSON.String(), Equals, "json")
+	c.Assert(CodecGob.String(), Equals, "gob")
+	c.Assert(Codec(100).String(), Equals, "unknown codec 100")
+
+	for _, codec := range []Codec{CodecJSON, CodecGob} {
+		SetCodec(codec)
+
+		s, err := info.encode()
+		c.Assert(err, IsNil)
+		c.Assert(isGobValue(s), Equals, codec == CodecGob)
+		info2, err := infoFromValue(s)
+		c.Assert(err, IsNil)
+		c.Assert(info2, DeepEquals, info)
+
+		s, err = op.encode()
+		c.Assert(err, IsNil)
+		c.Assert(isGobValue(s), Equals, codec == CodecGob)
+		op2, err := operationFromValue(s)
+		c.Assert(err, IsNil)
+		c.Assert(op2, DeepEquals, op)
+		// the represent is deterministic.
+		s2, err := op.encode()
+		c.Assert(err, IsNil)
+		c.Assert(s2, Equals, s)
+
+		s, err = st.encode()
+		c.Assert(err, IsNil)
+		c.Assert(isGobValue(s), Equals, codec == CodecGob)
+		st2, err := sourceTablesFromValue(s)
+		c.Assert(err, IsNil)
+		c.Assert(st2, DeepEquals, st)
+	}
+
+	// the gob represent is more compact.
+	SetCodec(CodecJSON)
+	sJSON, err := info.encode()
+	c.Assert(err, IsNil)
+	SetCodec(CodecGob)
+	sGob, err := info.encode()
+	c.Assert(err, IsNil)
+	c.Assert(len(sGob), Less, len(sJSON))
+
+	// invalid gob value.
+	_, err = infoFromValue(string(gobMarker) + "invalid")
+	c.Assert(err, NotNil)
+}
+
+func (t *testForEtcd) TestCodecCrossFormat(c *C) {
+	defer SetCodec(CodecJSON)
+
+	var (
+		cli    = etcdutil.NewMemClient()
+		task   = "test-codec-cross-format"
+		source = "mysql-replica-1"
+		i1     = NewInfo(task, source, "db-1", "tbl-1", "db", "tbl", []string{"ALTER TABLE tbl ADD COLUMN c1 INT"}, nil, nil)
+		i2     = NewInfo(task, source, "db-1", "tbl-2", "db", "tbl", []string{"ALTER TABLE tbl ADD COLUMN c1 INT"}, nil, nil)
+		op1    = NewOperation("test-ID", task, source, "db-1", "tbl-1", []string{"ALTER TABLE tbl ADD COLUMN c1 INT"}, ConflictNone, false)
+		op2    = NewOperation("test-ID", task, source, "db-1", "tbl-2", []string{"ALTER TABLE tbl ADD COLUMN c1 INT"}, ConflictNone, false)
+		st1    = NewSourceTables(task, source, map[string]map[string]struct{}{"db-1": {"tbl-1": struct{}{}}})
+		st2    = NewSourceTables(task, "mysql-replica-2", map[string]map[string]struct{}{"db-2": {"tbl-1": struct{}{}}})
+	)
+	defer cli.Close()
+
+	// put values with different codecs.
+	for _, codec := range []Codec{CodecJSON, CodecGob} {
+		SetCodec(codec)
+		info, op, st := i1, op1, st1
+		if codec == CodecGob {
+			info, op, st = i2, op2, st2
+		}
+		_, err := PutInfo(cli, info)
+		c.Assert(err, IsNil)
+		_, putted, _, err := PutOperation(cli, false, op)
+		c.Assert(err, IsNil)
+		c.Assert(putted, IsTrue)
+		_, err = PutSourceTables(cli, st)
+		c.Assert(err, IsNil)
+	}
+
+	// all values can be read with any codec.
+	for _, codec := range []Codec{CodecJSON, CodecGob} {
+		SetCodec(codec)
+		ifm, _, err := GetAllInfo(cli)
+		c.Assert(err, IsNil)
+		c.Assert(ifm[task][source]["db-1"]["tbl-1"], DeepEquals, i1)
+		c.Assert(ifm[task][source]["db-1"]["tbl-2"], DeepEquals, i2)
+
+		opm, _, err := GetAllOperations(cli)
+		c.Assert(err, IsNil)
+		c.Assert(opm[task][source]["db-1"]["tbl-1"], DeepEquals, op1)
+		c.Assert(opm[task][source]["db-1"]["tbl-2"], DeepEquals, op2)
+
+		stm, _, err := GetAllSourceTables(cli)
+		c.Assert(err, IsNil)
+		c.Assert(stm[task][st1.Source], DeepEquals, st1)
+		c.Assert(stm[task][st2.Source], DeepEquals, st2)
+	}
+
+	// the done operation put with the gob codec is skipped.
+	SetCodec(CodecGob)
+	op2.Done = true
+	_, putted, _, err := PutOperation(cli, true, op2)
+	c.Assert(err, IsNil)
+	c.Assert(putted, IsTrue)
+	_, putted, _, err = PutOperation(cli, true, op2)
+	c.Assert(err, IsNil)
+	c.Assert(putted, IsFalse)
+
+	// the done operation put with another codec is also skipped.
+	for _, codec := range []Codec{CodecJSON, CodecGob} {
+		SetCodec(codec)
+		op := op2
+		op.Done = false
+		_, putted, _, err = PutOperation(cli, true, op)
+		c.Assert(err, IsNil)
+		c.Assert(putted, IsFalse)
+	}
+	SetCodec(CodecJSON)
+	op1.Done = true
+	_, putted, _, err = PutOperation(cli, false, op1)
+	c.Assert(err, IsNil)
+	c.Assert(putted, IsTrue)
+	SetCodec(CodecGob)
+	op1.Done = false
+	_, putted, _, err = PutOperation(cli, true, op1)
+	c.Assert(err, IsNil)
+	c.Assert(putted, IsFalse)
+}
+
+func (t *testForEtcd) TestInfoMemEtcdGob(c *C) {
+	SetCodec(CodecGob)
+	defer SetCodec(CodecJSON)
+	cli := etcdutil.NewMemClient()
+	defer cli.Close()
+	testInfoEtcd(c, cli)
+}
@@ -15,8 +15,12 @@ package optimism
 
 import (
 	"context"
+	"encoding/binary"
 	"encoding/json"
 	"fmt"
+	"hash/fnv"
+	"sync"
+	"time"
 
 	"github.com/pingcap/parser/model"
 	"go.etcd.io/etcd/clientv3"
@@ -28,6 +32,13 @@ import (
 
 // TODO: much of the code in optimistic mode is very similar to pessimistic mode, we can try to combine them together.
 
+// CurrentInfoVersion is the version of the JSON represent of Info written now.
+// versions:
+//   - 0: Info written before the version introduced, without the `version` field.
+//   - 1: add the `version` field.
+// NOTE: increase the version and handle the old versions in `upgrade` when changing the JSON represent of Info.
+const CurrentInfoVersion = 1
+
 // Info represents the shard DDL information.
 // This information should be persistent in etcd so can be retrieved after the DM-master leader restarted or changed.
 // NOTE: `Task`, `Source`, `UpSchema` and `DownTable` are redundant in the etcd key path for convenient.
@@ -47,6 +58,13 @@ type Info struct {
 	TableInfoBefore *model.TableInfo `json:"table-info-before"` // the tracked table schema before applying the DDLs
 	TableInfoAfter  *model.TableInfo `json:"table-info-after"`  // the tracked table schema after applying the DDLs
 
+	// the monotonic sequence number of the info for the table, used to detect out-of-order DDLs.
+	// 0 means not set, and it's not checked.
+	Seq uint64 `json:"seq,omitempty"`
+
+	// the version of the JSON represent, see `CurrentInfoVersion`.
+	Version int `json:"version"`
+
 	// only used to report to the caller of the watcher, do not marsh it.
 	// if it's true, it means the Info has been deleted in etcd.
 	IsDeleted bool `json:"-"`
@@ -65,6 +83,7 @@ func NewInfo(task, source, upSchema, upTable, downSchema, downTable string,
 		DDLs:            DDLs,
 		TableInfoBefore: tableInfoBefore,
 		TableInfoAfter:  tableInfoAfter,
+		Version:         CurrentInfoVersion,
 	}
 }
 
@@ -75,7 +94,11 @@ func (i Info) String() string {
 }
 
 // toJSON returns the string of JSON represent.
+// the current version is used if the version is not set.
 func (i Info) toJSON() (string, error) {
+	if i.Version == 0 {
+		i.Version = CurrentInfoVersion
+	}
 	data, err := json.Marshal(i)
 	if err != nil {
 		return "", err
@@ -83,12 +106,81 @@ func (i Info) toJSON() (string, error) {
 	return string(data), nil
 }
 
+// Hash returns a hash of the meaningful content of the info, it's often used to detect duplicate or changed infos cheaply.
+// table infos are hashed by their content rather than the pointers, and nil/empty DDLs are hashed equally.
+// NOTE: `Version` and `IsDeleted` are not hashed, because they are not the content of the info.
+func (i Info) Hash() uint64 {
+	h := fnv.New64a()
+	write := func(b []byte) {
+		// write the length before the bytes to avoid ambiguity like ("ab", "c") and ("a", "bc").
+		_ = binary.Write(h, binary.BigEndian, uint64(len(b)))
+		_, _ = h.Write(b)
+	}
+	for _, s := range []string{i.Task, i.Source, i.UpSchema, i.UpTable, i.DownSchema, i.DownTable} {
+		write([]byte(s))
+	}
+	_ = binary.Write(h, binary.BigEndian, uint64(len(i.DDLs)))
+	for _, ddl := range i.DDLs {
+		write([]byte(ddl))
+	}
+	for _, ti := range []*model.TableInfo{i.TableInfoBefore, i.TableInfoAfter} {
+		data, _ := json.Marshal(ti) // nil table info is marshaled as `null`.
+		write(data)
+	}
+	_ = binary.Write(h, binary.BigEndian, i.Seq)
+	return h.Sum64()
+}
+
 // infoFromJSON constructs Info from its JSON represent.
+// Info written with an older version is upgraded to the current version.
 func infoFromJSON(s string) (i Info, err error) {
-	err = json.Unmarshal([]byte(s), &i)
+	if err = json.Unmarshal([]byte(s), &i); err == nil {
+		i.upgrade()
+	}
+	return
+}
+
+// encode returns the represent of Info put into etcd, encoded by the codec set by `SetCodec`.
+func (i Info) encode() (string, error) {
+	if valueCodec != CodecGob {
+		return i.toJSON()
+	}
+	if i.Version == 0 {
+		i.Version = CurrentInfoVersion
+	}
+	i.IsDeleted = false
+	return encodeGob(i)
+}
+
+// infoFromValue constructs Info from its represent in etcd, which may be encoded by any codec.
+func infoFromValue(s string) (i Info, err error) {
+	if !isGobValue(s) {
+		return infoFromJSON(s)
+	}
+	if err = decodeGob(s, &i); err == nil {
+		i.upgrade()
+		if i.DDLs == nil {
+			i.DDLs = []string{} // gob doesn't keep empty slices.
+		}
+	}
 	return
 }
 
+// upgrade upgrades Info decoded from an older version to the current version,
+// fields missing in the older version are defaulted. it returns whether upgraded.
+// NOTE: Info with a newer version (written by a newer DM-master) is kept as is.
+func (i *Info) upgrade() bool {
+	if i.Version >= CurrentInfoVersion {
+		return false
+	}
+	// 0 -> 1: `seq` missing means not set, which is also the zero value.
+	if i.DDLs == nil {
+		i.DDLs = []string{}
+	}
+	i.Version = CurrentInfoVersion
+	return true
+}
+
 // PutInfo puts the shard DDL info into etcd.
 // NOTE:
 //   In some cases before the lock resolved, the same DDL info may be PUT multiple times:
@@ -99,7 +191,7 @@ func infoFromJSON(s string) (i Info, err error) {
 //     1. DM-master can construct the lock and do the coordination correctly.
 //     2. DM-worker can re-PUT and comply with the coordination correctly.
 // This function should often be called by DM-worker.
-func PutInfo(cli *clientv3.Client, info Info) (int64, error) {
+func PutInfo(cli etcdutil.KVClient, info Info) (int64, error) {
 	op, err := putInfoOp(info)
 	if err != nil {
 		return 0, err
@@ -108,22 +200,116 @@ func PutInfo(cli *clientv3.Client, info Info) (int64, error) {
 	return rev, nil
 }
 
+// InfoExists checks whether the shard DDL info of the upstream table exists in etcd,
+// only the count of the key is requested, so the value is not transferred and decoded.
+// it returns whether the info exists and the revision of etcd.
+func InfoExists(cli etcdutil.KVClient, task, source, upSchema, upTable string) (bool, int64, error) {
+	return keyExists(cli, infoKey(task, source, upSchema, upTable))
+}
+
+// keyExists checks whether the key exists in etcd with a count-only GET operation.
+func keyExists(cli etcdutil.KVClient, key string) (bool, int64, error) {
+	respTxn, rev, err := etcdutil.DoOpsInOneTxnWithRetry(cli, clientv3.OpGet(key, clientv3.WithCountOnly()))
+	if err != nil {
+		return false, 0, err
+	}
+	return respTxn.Responses[0].GetResponseRange().Count > 0, rev, nil
+}
+
 // GetAllInfo gets all shard DDL info in etcd currently.
 // This function should often be called by DM-master.
 // k/k/k/k/v: task-name -> source-ID -> upstream-schema-name -> upstream-table-name -> shard DDL info.
 // ugly code, but have no better idea now.
-func GetAllInfo(cli *clientv3.Client) (map[string]map[string]map[string]map[string]Info, int64, error) {
-	respTxn, _, err := etcdutil.DoOpsInOneTxnWithRetry(cli, clientv3.OpGet(common.ShardDDLOptimismInfoKeyAdapter.Path(), clientv3.WithPrefix()))
+func GetAllInfo(cli etcdutil.KVClient) (map[string]map[string]map[string]map[string]Info, int64, error) {
+	return GetAllInfoCtx(cli.Ctx(), cli)
+}
+
+// GetAllInfoCtx is the same as `GetAllInfo` but honors the deadline/cancellation of `ctx`.
+func GetAllInfoCtx(ctx context.Context, cli etcdutil.KVClient) (map[string]map[string]map[string]map[string]Info, int64, error) {
+	ifm, _, rev, err := getAllInfo(ctx, cli, false)
+	return ifm, rev, err
+}
+
+// GetInfosForLock gets shard DDL info belonging to the lock in etcd currently, sorted by their keys.
+// only info of the task derived from the lock ID is read, then filtered by the lock ID computed from each info,
+// so it's cheaper than `GetAllInfo` when cleaning up a single lock.
+// `ErrShardDDLOptimismInvalidLockID` is returned if the lock ID is not generated for the optimistic shard DDL lock.
+func GetInfosForLock(cli etcdutil.KVClient, lockID string) ([]Info, int64, error) {
+	task, err := taskFromLockID(lockID)
+	if err != nil {
+		return nil, 0, err
+	}
+	// end the prefix with `/`, otherwise info of tasks whose (hex encoded) name has the same prefix is also read.
+	respTxn, _, err := etcdutil.DoOpsInOneTxnWithRetry(cli, clientv3.OpGet(infoKey(task, "", "", "")+"/", clientv3.WithPrefix()))
 	if err != nil {
 		return nil, 0, err
 	}
 	resp := respTxn.Responses[0].GetResponseRange()
 
-	ifm := make(map[string]map[string]map[string]map[string]Info)
+	infos := make([]Info, 0, len(resp.Kvs))
 	for _, kv := range resp.Kvs {
-		info, err2 := infoFromJSON(string(kv.Value))
-		if err2 != nil {
-			return nil, 0, err2
+		info, err := infoFromValue(string(kv.Value))
+		if err != nil {
+			return nil, 0, err
+		}
+		if genDDLLockID(info) == lockID {
+			infos = append(infos, info)
+		}
+	}
+	return infos, resp.Header.Revision, nil
+}
+
+// DecodeError represents a key-value in etcd whose value can't be decoded.
+type DecodeError struct {
+	Key   string // the key in etcd
+	Value []byte // the raw value in etcd
+	Err   error  // the error occurred when decoding
+}
+
+// Error implements error interface.
+func (e DecodeError) Error() string {
+	return fmt.Sprintf("fail to decode the value of key %s: %v", e.Key, e.Err)
+}
+
+// GetAllInfoTolerant is the same as `GetAllInfo`, but undecodable key-values are skipped instead of failing the whole call.
+// the skipped key-values are returned as `DecodeError`s, so that they can be inspected and repaired later,
+// and the good shard DDL info and the revision are still returned.
+func GetAllInfoTolerant(cli etcdutil.KVClient) (map[string]map[string]map[string]map[string]Info, []DecodeError, int64, error) {
+	return getAllInfo(cli.Ctx(), cli, true)
+}
+
+// getAllInfo gets all shard DDL info in etcd currently.
+// if `tolerant` is true, undecodable key-values are skipped and returned as `DecodeError`s,
+// otherwise an error is returned for the first undecodable one.
+func getAllInfo(ctx context.Context, cli etcdutil.KVClient, tolerant bool) (
+	map[string]map[string]map[string]map[string]Info, []DecodeError, int64, error) {
+	respTxn, _, err := etcdutil.DoOpsInOneTxnWithRetryCtx(ctx, cli, clientv3.OpGet(common.ShardDDLOptimismInfoKeyAdapter.Path(), clientv3.WithPrefix()))
+	if err != nil {
+		return nil, nil, 0, err
+	}
+	resp := respTxn.Responses[0].GetResponseRange()
+
+	ifm, decodeErrs, err := infosFromKVs(resp.Kvs, tolerant)
+	if err != nil {
+		return nil, nil, 0, err
+	}
+	return ifm, decodeErrs, resp.Header.Revision, nil
+}
+
+// infosFromKVs decodes shard DDL info from key-values got from etcd.
+// if `tolerant` is true, key-values which can't be decoded are skipped and reported as DecodeError.
+func infosFromKVs(kvs []*mvccpb.KeyValue, tolerant bool) (
+	map[string]map[string]map[string]map[string]Info, []DecodeError, error) {
+	var decodeErrs []DecodeError
+	ifm := make(map[string]map[string]map[string]map[string]Info)
+	for _, kv := range kvs {
+		info, err := infoFromValue(string(kv.Value))
+		if err != nil {
+			if !tolerant {
+				return nil, nil, err
+			}
+			decodeErrs = append(decodeErrs, DecodeError{Key: string(kv.Key), Value: kv.Value, Err: err})
+			continue
 		}
 
 		if _, ok := ifm[info.Task]; !ok {
@@ -137,13 +323,12 @@ func GetAllInfo(cli *clientv3.Client) (map[string]map[string]map[string]map[stri
 		}
 		ifm[info.Task][info.Source][info.UpSchema][info.UpTable] = info
 	}
-
-	return ifm, resp.Header.Revision, nil
+	return ifm, decodeErrs, nil
 }
 
 // WatchInfo watches PUT & DELETE operations for info.
 // This function should often be called by DM-master.
-func WatchInfo(ctx context.Context, cli *clientv3.Client, revision int64,
+func WatchInfo(ctx context.Context, cli etcdutil.KVClient, revision int64,
 	outCh chan<- Info, errCh chan<- error) {
 	// NOTE: WithPrevKV used to get a valid `ev.PrevKv` for deletion.
 	ch := cli.Watch(ctx, common.ShardDDLOptimismInfoKeyAdapter.Path(),
@@ -170,9 +355,9 @@ func WatchInfo(ctx context.Context, cli *clientv3.Client, revision int64,
 
 				switch ev.Type {
 				case mvccpb.PUT:
-					info, err = infoFromJSON(string(ev.Kv.Value))
+					info, err = infoFromValue(string(ev.Kv.Value))
 				case mvccpb.DELETE:
-					info, err = infoFromJSON(string(ev.PrevKv.Value))
+					info, err = infoFromValue(string(ev.PrevKv.Value))
 					info.IsDeleted = true
 				default:
 					// this should not happen.
@@ -197,28 +382,102 @@ func WatchInfo(ctx context.Context, cli *clientv3.Client, revision int64,
 	}
 }
 
+// WatchInfoBatched is the same as `WatchInfo` but coalesces info into batches to reduce the churn for consumers.
+// info arrived within `interval` after the first one of a batch are sent together,
+// and only the latest info of each table is kept in the batch (in the order of the first arrival of tables).
+// This function should often be called by DM-master.
+func WatchInfoBatched(ctx context.Context, cli etcdutil.KVClient, revision int64, interval time.Duration,
+	outCh chan<- []Info, errCh chan<- error) {
+	ctx, cancel := context.WithCancel(ctx)
+	infoCh := make(chan Info, 10)
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		WatchInfo(ctx, cli, revision, infoCh, errCh)
+		close(infoCh)
+	}()
+	defer func() {
+		cancel()
+		wg.Wait()
+	}()
+
+	var (
+		batch  []Info
+		index  = make(map[string]int) // etcd key of the info -> index in the batch.
+		timer  *time.Timer
+		timerC <-chan time.Time
+	)
+	defer func() {
+		if timer != nil {
+			timer.Stop()
+		}
+	}()
+	flush := func() bool {
+		select {
+		case outCh <- batch:
+		case <-ctx.Done():
+			return false
+		}
+		batch = nil
+		index = make(map[string]int)
+		timer, timerC = nil, nil
+		return true
+	}
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case info, ok := <-infoCh:
+			if !ok {
+				// the watcher exited, send the pending batch before returning.
+				if len(batch) > 0 {
+					flush()
+				}
+				return
+			}
+			key := common.ShardDDLOptimismInfoKeyAdapter.Encode(info.Task, info.Source, info.UpSchema, info.UpTable)
+			if i, ok2 := index[key]; ok2 {
+				batch[i] = info // the latest one wins.
+			} else {
+				index[key] = len(batch)
+				batch = append(batch, info)
+			}
+			if timer == nil {
+				timer = time.NewTimer(interval)
+				timerC = timer.C
+			}
+		case <-timerC:
+			if !flush() {
+				return
+			}
+		}
+	}
+}
+
 // putInfoOp returns a PUT etcd operation for Info.
 func putInfoOp(info Info) (clientv3.Op, error) {
-	value, err := info.toJSON()
+	value, err := info.encode()
 	if err != nil {
 		return clientv3.Op{}, err
 	}
-	key := common.ShardDDLOptimismInfoKeyAdapter.Encode(info.Task, info.Source, info.UpSchema, info.UpTable)
+	key := infoKey(info.Task, info.Source, info.UpSchema, info.UpTable)
 	return clientv3.OpPut(key, value), nil
 }
 
 // deleteInfoOp returns a DELETE etcd operation for info.
 // This operation should often be sent by DM-worker.
 func deleteInfoOp(info Info) clientv3.Op {
-	return clientv3.OpDelete(common.ShardDDLOptimismInfoKeyAdapter.Encode(
-		info.Task, info.Source, info.UpSchema, info.UpTable))
+	return clientv3.OpDelete(infoKey(info.Task, info.Source, info.UpSchema, info.UpTable))
 }
 
 // ClearTestInfoOperation is used to clear all shard DDL information in optimism mode.
-func ClearTestInfoOperation(cli *clientv3.Client) error {
+func ClearTestInfoOperation(cli etcdutil.KVClient) error {
 	clearSource := clientv3.OpDelete(common.ShardDDLOptimismSourceTablesKeyAdapter.Path(), clientv3.WithPrefix())
 	clearInfo := clientv3.OpDelete(common.ShardDDLOptimismInfoKeyAdapter.Path(), clientv3.WithPrefix())
 	clearOp := clientv3.OpDelete(common.ShardDDLOptimismOperationKeyAdapter.Path(), clientv3.WithPrefix())
-	_, err := cli.Txn(context.Background()).Then(clearSource, clearInfo, clearOp).Commit()
+	clearCheckpoint := clientv3.OpDelete(common.ShardDDLOptimismTableKeeperCheckpointKeyAdapter.Path(), clientv3.WithPrefix())
+	_, err := cli.Txn(context.Background()).Then(clearSource, clearInfo, clearOp, clearCheckpoint).Commit()
 	return err
 }
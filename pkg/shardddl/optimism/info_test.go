@@ -28,6 +28,10 @@ import (
 	"github.com/pingcap/tidb/util/mock"
 	"go.etcd.io/etcd/clientv3"
 	"go.etcd.io/etcd/integration"
+
+	"github.com/pingcap/dm/dm/common"
+	"github.com/pingcap/dm/pkg/etcdutil"
+	"github.com/pingcap/dm/pkg/terror"
 )
 
 var (
@@ -77,17 +81,100 @@ func (t *testForEtcd) TestInfoJSON(c *C) {
 
 	j, err := i1.toJSON()
 	c.Assert(err, IsNil)
-	c.Assert(j, Equals, `{"task":"test","source":"mysql-replica-1","up-schema":"db-1","up-table":"tbl-1","down-schema":"db","down-table":"tbl","ddls":["ALTER TABLE tbl ADD COLUMN c1 INT","ALTER TABLE tbl ADD COLUMN c2 INT"],"table-info-before":null,"table-info-after":null}`)
+	c.Assert(j, Equals, `{"task":"test","source":"mysql-replica-1","up-schema":"db-1","up-table":"tbl-1","down-schema":"db","down-table":"tbl","ddls":["ALTER TABLE tbl ADD COLUMN c1 INT","ALTER TABLE tbl ADD COLUMN c2 INT"],"table-info-before":null,"table-info-after":null,"version":1}`)
 	c.Assert(j, Equals, i1.String())
 
 	i2, err := infoFromJSON(j)
 	c.Assert(err, IsNil)
 	c.Assert(i2, DeepEquals, i1)
+
+	// the current version is used if not set.
+	i3 := i1
+	i3.Version = 0
+	j3, err := i3.toJSON()
+	c.Assert(err, IsNil)
+	c.Assert(j3, Equals, j)
+
+	// upgrade info written before the version introduced.
+	i4, err := infoFromJSON(`{"task":"test","source":"mysql-replica-1","up-schema":"db-1","up-table":"tbl-1","down-schema":"db","down-table":"tbl","ddls":null,"table-info-before":null,"table-info-after":null}`)
+	c.Assert(err, IsNil)
+	c.Assert(i4.Version, Equals, CurrentInfoVersion)
+	c.Assert(i4.DDLs, DeepEquals, []string{})
+	c.Assert(i4.Seq, Equals, uint64(0))
+
+	// info with a newer version is kept as is.
+	i5, err := infoFromJSON(`{"task":"test","ddls":null,"new-field":"xxx","version":100}`)
+	c.Assert(err, IsNil)
+	c.Assert(i5.Version, Equals, 100)
+	c.Assert(i5.DDLs, IsNil)
+}
+
+func (t *testForEtcd) TestInfoHash(c *C) {
+	var (
+		p           = parser.New()
+		se          = mock.NewContext()
+		tblID int64 = 111
+		sql1        = "CREATE TABLE bar (id INT PRIMARY KEY)"
+		sql2        = "CREATE TABLE bar (id INT PRIMARY KEY, c1 INT)"
+		i1          = NewInfo("test", "mysql-replica-1", "db-1", "tbl-1", "db", "tbl",
+			[]string{"ALTER TABLE tbl ADD COLUMN c1 INT"}, createTableInfo(c, p, se, tblID, sql1), createTableInfo(c, p, se, tblID, sql2))
+		// the same content with different table info pointers.
+		i2 = NewInfo("test", "mysql-replica-1", "db-1", "tbl-1", "db", "tbl",
+			[]string{"ALTER TABLE tbl ADD COLUMN c1 INT"}, createTableInfo(c, p, se, tblID, sql1), createTableInfo(c, p, se, tblID, sql2))
+	)
+	c.Assert(i1.TableInfoBefore != i2.TableInfoBefore, IsTrue)
+	c.Assert(i1.Hash(), Equals, i2.Hash())
+
+	// round-trip through etcd values keeps the hash.
+	j, err := i1.toJSON()
+	c.Assert(err, IsNil)
+	i3, err := infoFromJSON(j)
+	c.Assert(err, IsNil)
+	c.Assert(i3.Hash(), Equals, i1.Hash())
+
+	// `Version` and `IsDeleted` are not hashed.
+	i3.Version = 0
+	i3.IsDeleted = true
+	c.Assert(i3.Hash(), Equals, i1.Hash())
+
+	// nil and empty DDLs are hashed equally.
+	i4, i5 := i1, i1
+	i4.DDLs = nil
+	i5.DDLs = []string{}
+	c.Assert(i4.Hash(), Equals, i5.Hash())
+	c.Assert(i4.Hash(), Not(Equals), i1.Hash())
+
+	// different content has different hashes.
+	others := []func(i *Info){
+		func(i *Info) { i.Task = "test-2" },
+		func(i *Info) { i.Source = "mysql-replica-2" },
+		func(i *Info) { i.UpSchema, i.UpTable = "db-1tbl", "-1" },
+		func(i *Info) { i.DownTable = "tbl-2" },
+		func(i *Info) { i.DDLs = []string{"ALTER TABLE tbl ADD COLUMN c1 BIGINT"} },
+		func(i *Info) { i.DDLs = append(i.DDLs, i.DDLs...) },
+		func(i *Info) { i.TableInfoBefore = nil },
+		func(i *Info) { i.TableInfoBefore, i.TableInfoAfter = i.TableInfoAfter, i.TableInfoBefore },
+		func(i *Info) { i.Seq = 1 },
+	}
+	for idx, modify := range others {
+		other := NewInfo(i1.Task, i1.Source, i1.UpSchema, i1.UpTable, i1.DownSchema, i1.DownTable, i1.DDLs, i1.TableInfoBefore, i1.TableInfoAfter)
+		modify(&other)
+		c.Assert(other.Hash(), Not(Equals), i1.Hash(), Commentf("case %d", idx))
+	}
 }
 
 func (t *testForEtcd) TestInfoEtcd(c *C) {
 	defer clearTestInfoOperation(c)
+	testInfoEtcd(c, etcdTestCli)
+}
 
+func (t *testForEtcd) TestInfoMemEtcd(c *C) {
+	cli := etcdutil.NewMemClient()
+	defer cli.Close()
+	testInfoEtcd(c, cli)
+}
+
+func testInfoEtcd(c *C, cli etcdutil.KVClient) {
 	var (
 		watchTimeout       = 2 * time.Second
 		source1            = "mysql-replica-1"
@@ -111,14 +198,14 @@ func (t *testForEtcd) TestInfoEtcd(c *C) {
 	)
 
 	// put the same key twice.
-	rev1, err := PutInfo(etcdTestCli, i11)
+	rev1, err := PutInfo(cli, i11)
 	c.Assert(err, IsNil)
-	rev2, err := PutInfo(etcdTestCli, i11)
+	rev2, err := PutInfo(cli, i11)
 	c.Assert(err, IsNil)
 	c.Assert(rev2, Greater, rev1)
 
 	// get with only 1 info.
-	ifm, rev3, err := GetAllInfo(etcdTestCli)
+	ifm, rev3, err := GetAllInfo(cli)
 	c.Assert(err, IsNil)
 	c.Assert(rev3, Equals, rev2)
 	c.Assert(ifm, HasLen, 1)
@@ -129,9 +216,9 @@ func (t *testForEtcd) TestInfoEtcd(c *C) {
 	c.Assert(ifm[task1][source1][upSchema][upTable], DeepEquals, i11)
 
 	// put another key and get again with 2 info.
-	rev4, err := PutInfo(etcdTestCli, i12)
+	rev4, err := PutInfo(cli, i12)
 	c.Assert(err, IsNil)
-	ifm, _, err = GetAllInfo(etcdTestCli)
+	ifm, _, err = GetAllInfo(cli)
 	c.Assert(err, IsNil)
 	c.Assert(ifm, HasLen, 1)
 	c.Assert(ifm, HasKey, task1)
@@ -148,13 +235,13 @@ func (t *testForEtcd) TestInfoEtcd(c *C) {
 		defer wg.Done()
 		ctx, cancel := context.WithTimeout(context.Background(), watchTimeout)
 		defer cancel()
-		WatchInfo(ctx, etcdTestCli, rev4+1, wch, ech) // revision+1
-		close(wch)                                    // close the chan
+		WatchInfo(ctx, cli, rev4+1, wch, ech) // revision+1
+		close(wch)                            // close the chan
 		close(ech)
 	}()
 
 	// put another key for a different task.
-	_, err = PutInfo(etcdTestCli, i21)
+	_, err = PutInfo(cli, i21)
 	c.Assert(err, IsNil)
 	wg.Wait()
 
@@ -165,11 +252,11 @@ func (t *testForEtcd) TestInfoEtcd(c *C) {
 
 	// delete i12.
 	deleteOp := deleteInfoOp(i12)
-	resp, err := etcdTestCli.Txn(context.Background()).Then(deleteOp).Commit()
+	resp, err := cli.Txn(context.Background()).Then(deleteOp).Commit()
 	c.Assert(err, IsNil)
 
 	// get again.
-	ifm, _, err = GetAllInfo(etcdTestCli)
+	ifm, _, err = GetAllInfo(cli)
 	c.Assert(err, IsNil)
 	c.Assert(ifm, HasLen, 2)
 	c.Assert(ifm, HasKey, task1)
@@ -183,7 +270,7 @@ func (t *testForEtcd) TestInfoEtcd(c *C) {
 	wch = make(chan Info, 10)
 	ech = make(chan error, 10)
 	ctx, cancel := context.WithTimeout(context.Background(), watchTimeout)
-	WatchInfo(ctx, etcdTestCli, resp.Header.Revision, wch, ech)
+	WatchInfo(ctx, cli, resp.Header.Revision, wch, ech)
 	cancel()
 	close(wch)
 	close(ech)
@@ -194,3 +281,243 @@ func (t *testForEtcd) TestInfoEtcd(c *C) {
 	c.Assert(info, DeepEquals, i12c)
 	c.Assert(len(ech), Equals, 0)
 }
+
+func (t *testForEtcd) TestWatchInfoBatched(c *C) {
+	var (
+		cli      = etcdutil.NewMemClient()
+		interval = 200 * time.Millisecond
+		timeout  = 2 * time.Second
+		DDLs1    = []string{"ALTER TABLE bar ADD COLUMN c1 INT"}
+		DDLs2    = []string{"ALTER TABLE bar ADD COLUMN c2 INT"}
+		i11      = NewInfo("task", "mysql-replica-1", "foo_1", "bar_1", "foo", "bar", DDLs1, nil, nil)
+		i12      = NewInfo("task", "mysql-replica-1", "foo_1", "bar_1", "foo", "bar", DDLs2, nil, nil)
+		i2       = NewInfo("task", "mysql-replica-2", "foo_1", "bar_1", "foo", "bar", DDLs1, nil, nil)
+		wch      = make(chan []Info, 10)
+		ech      = make(chan error, 10)
+	)
+	defer cli.Close()
+
+	rev, err := PutInfo(cli, i11)
+	c.Assert(err, IsNil)
+	_, err = PutInfo(cli, i2)
+	c.Assert(err, IsNil)
+	_, err = PutInfo(cli, i12)
+	c.Assert(err, IsNil)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		WatchInfoBatched(ctx, cli, rev, interval, wch, ech)
+	}()
+
+	// events arrived within the interval are coalesced, the latest info for the same table wins.
+	select {
+	case batch := <-wch:
+		c.Assert(batch, DeepEquals, []Info{i12, i2})
+	case <-time.After(timeout):
+		c.Fatal("watch batch timeout")
+	}
+
+	// delete an info in a new batch.
+	_, err = cli.Txn(context.Background()).Then(deleteInfoOp(i2)).Commit()
+	c.Assert(err, IsNil)
+	select {
+	case batch := <-wch:
+		i2c := i2
+		i2c.IsDeleted = true
+		c.Assert(batch, DeepEquals, []Info{i2c})
+	case <-time.After(timeout):
+		c.Fatal("watch batch timeout")
+	}
+
+	cancel()
+	wg.Wait()
+	c.Assert(len(wch), Equals, 0)
+	c.Assert(len(ech), Equals, 0)
+}
+
+func (t *testForEtcd) TestGetAllInfoCtx(c *C) {
+	defer clearTestInfoOperation(c)
+
+	info := NewInfo("test", "mysql-replica-1", "db-1", "tbl-1", "db", "tbl",
+		[]string{"ALTER TABLE tbl ADD COLUMN c1 INT"}, nil, nil)
+	_, err := PutInfo(etcdTestCli, info)
+	c.Assert(err, IsNil)
+
+	// get with a valid context.
+	ifm, _, err := GetAllInfoCtx(context.Background(), etcdTestCli)
+	c.Assert(err, IsNil)
+	c.Assert(ifm[info.Task][info.Source][info.UpSchema][info.UpTable], DeepEquals, info)
+
+	// get with a canceled context.
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	ifm, _, err = GetAllInfoCtx(ctx, etcdTestCli)
+	c.Assert(err, NotNil)
+	c.Assert(ifm, IsNil)
+
+	// functions without a context honor the context of the client.
+	closing := &ctxClient{KVClient: etcdTestCli, ctx: ctx}
+	_, _, err = GetAllInfo(closing)
+	c.Assert(err, NotNil)
+	_, _, _, err = GetAllInfoTolerant(closing)
+	c.Assert(err, NotNil)
+	_, _, err = GetAllOperations(closing)
+	c.Assert(err, NotNil)
+	_, _, err = GetAllSourceTables(closing)
+	c.Assert(err, NotNil)
+}
+
+// ctxClient is an etcd client with the specified context, e.g. a canceled one to simulate the client closed.
+type ctxClient struct {
+	etcdutil.KVClient
+	ctx context.Context
+}
+
+func (cc *ctxClient) Ctx() context.Context {
+	return cc.ctx
+}
+
+func (t *testForEtcd) TestGetAllInfoTolerant(c *C) {
+	defer clearTestInfoOperation(c)
+
+	var (
+		info = NewInfo("test", "mysql-replica-1", "db-1", "tbl-1", "db", "tbl",
+			[]string{"ALTER TABLE tbl ADD COLUMN c1 INT"}, nil, nil)
+		badKey   = common.ShardDDLOptimismInfoKeyAdapter.Encode("test", "mysql-replica-1", "db-1", "tbl-2")
+		badValue = "not-a-json"
+	)
+	_, err := PutInfo(etcdTestCli, info)
+	c.Assert(err, IsNil)
+	_, err = etcdTestCli.Put(context.Background(), badKey, badValue)
+	c.Assert(err, IsNil)
+
+	// fail to get all info without tolerance.
+	ifm, _, err := GetAllInfo(etcdTestCli)
+	c.Assert(err, NotNil)
+	c.Assert(ifm, IsNil)
+
+	// get the good info and the bad key-value with tolerance.
+	ifm, decodeErrs, rev, err := GetAllInfoTolerant(etcdTestCli)
+	c.Assert(err, IsNil)
+	c.Assert(rev, Greater, int64(0))
+	c.Assert(ifm, HasLen, 1)
+	c.Assert(ifm[info.Task][info.Source][info.UpSchema], HasLen, 1)
+	c.Assert(ifm[info.Task][info.Source][info.UpSchema][info.UpTable], DeepEquals, info)
+	c.Assert(decodeErrs, HasLen, 1)
+	c.Assert(decodeErrs[0].Key, Equals, badKey)
+	c.Assert(string(decodeErrs[0].Value), Equals, badValue)
+	c.Assert(decodeErrs[0].Err, NotNil)
+	c.Assert(decodeErrs[0].Error(), Matches, "fail to decode the value of key .*"+badKey+".*")
+
+	// no decode errors after the bad key-value repaired.
+	_, err = etcdTestCli.Delete(context.Background(), badKey)
+	c.Assert(err, IsNil)
+	ifm, decodeErrs, _, err = GetAllInfoTolerant(etcdTestCli)
+	c.Assert(err, IsNil)
+	c.Assert(ifm, HasLen, 1)
+	c.Assert(decodeErrs, HasLen, 0)
+}
+
+func (t *testForEtcd) TestInfoExists(c *C) {
+	defer clearTestInfoOperation(c)
+
+	info := NewInfo("test", "mysql-replica-1", "db-1", "tbl-1", "db", "tbl",
+		[]string{"ALTER TABLE tbl ADD COLUMN c1 INT"}, nil, nil)
+
+	// not exists.
+	exist, rev, err := InfoExists(etcdTestCli, info.Task, info.Source, info.UpSchema, info.UpTable)
+	c.Assert(err, IsNil)
+	c.Assert(exist, IsFalse)
+	c.Assert(rev, Greater, int64(0))
+
+	// exists after PUT.
+	putRev, err := PutInfo(etcdTestCli, info)
+	c.Assert(err, IsNil)
+	exist, rev, err = InfoExists(etcdTestCli, info.Task, info.Source, info.UpSchema, info.UpTable)
+	c.Assert(err, IsNil)
+	c.Assert(exist, IsTrue)
+	c.Assert(rev, Equals, putRev)
+
+	// other tables not exist.
+	exist, _, err = InfoExists(etcdTestCli, info.Task, info.Source, info.UpSchema, "tbl-2")
+	c.Assert(err, IsNil)
+	c.Assert(exist, IsFalse)
+
+	// not exists after DELETE.
+	_, err = etcdTestCli.Delete(context.Background(), common.ShardDDLOptimismInfoKeyAdapter.Encode(
+		info.Task, info.Source, info.UpSchema, info.UpTable))
+	c.Assert(err, IsNil)
+	exist, _, err = InfoExists(etcdTestCli, info.Task, info.Source, info.UpSchema, info.UpTable)
+	c.Assert(err, IsNil)
+	c.Assert(exist, IsFalse)
+}
+
+func (t *testForEtcd) TestGetInfosForLock(c *C) {
+	var (
+		cli    = etcdutil.NewMemClient()
+		source = "mysql-replica-1"
+		DDLs   = []string{"ALTER TABLE bar ADD COLUMN c1 INT"}
+		i11    = NewInfo("task-1", source, "foo", "bar_1", "foo", "bar", DDLs, nil, nil)
+		i12    = NewInfo("task-1", source, "foo", "bar_2", "foo", "bar", DDLs, nil, nil)
+		i13    = NewInfo("task-1", source, "foo", "baz_1", "foo", "baz", DDLs, nil, nil)
+		i21    = NewInfo("task-11", source, "foo", "bar_1", "foo", "bar", DDLs, nil, nil)
+		lockID = genDDLLockID(i11)
+	)
+	defer cli.Close()
+
+	// the task is derived from the lock ID.
+	task, err := taskFromLockID(lockID)
+	c.Assert(err, IsNil)
+	c.Assert(task, Equals, "task-1")
+	task, err = taskFromLockID("task-`foo-`.`bar`")
+	c.Assert(err, IsNil)
+	c.Assert(task, Equals, "task")
+	for _, invalid := range []string{"", "task", "-`foo`.`bar`", "task-`foo`.bar"} {
+		_, err = taskFromLockID(invalid)
+		c.Assert(terror.ErrShardDDLOptimismInvalidLockID.Equal(err), IsTrue)
+	}
+	_, _, err = GetInfosForLock(cli, "invalid")
+	c.Assert(terror.ErrShardDDLOptimismInvalidLockID.Equal(err), IsTrue)
+
+	// no info.
+	infos, _, err := GetInfosForLock(cli, lockID)
+	c.Assert(err, IsNil)
+	c.Assert(infos, HasLen, 0)
+
+	// only info of the lock is got, even for a task with the same prefix.
+	var rev int64
+	for _, info := range []Info{i11, i12, i13, i21} {
+		rev, err = PutInfo(cli, info)
+		c.Assert(err, IsNil)
+	}
+	infos, rev2, err := GetInfosForLock(cli, lockID)
+	c.Assert(err, IsNil)
+	c.Assert(rev2, Equals, rev)
+	c.Assert(infos, DeepEquals, []Info{i11, i12})
+	infos, _, err = GetInfosForLock(cli, genDDLLockID(i21))
+	c.Assert(err, IsNil)
+	c.Assert(infos, DeepEquals, []Info{i21})
+
+	// info of the task with the same prefix is not read at all.
+	_, err = cli.Put(context.Background(), infoKey("task-11", source, "foo", "bar_2"), "invalid")
+	c.Assert(err, IsNil)
+	infos, _, err = GetInfosForLock(cli, lockID)
+	c.Assert(err, IsNil)
+	c.Assert(infos, DeepEquals, []Info{i11, i12})
+	_, err = cli.Delete(context.Background(), infoKey("task-11", source, "foo", "bar_2"))
+	c.Assert(err, IsNil)
+
+	// with the sharded keys.
+	SetKeyShards(4)
+	defer SetKeyShards(0)
+	_, err = DeleteInfosOperations(cli, []Info{i11, i12, i13, i21}, nil)
+	c.Assert(err, IsNil)
+	_, err = PutInfo(cli, i12)
+	c.Assert(err, IsNil)
+	infos, _, err = GetInfosForLock(cli, lockID)
+	c.Assert(err, IsNil)
+	c.Assert(infos, DeepEquals, []Info{i12})
+}
@@ -14,130 +14,1625 @@
 package optimism
 
 import (
+	"context"
+	"encoding/json"
 	"fmt"
+	"io"
+	"net/http"
+	"reflect"
 	"sort"
+	"strings"
 	"sync"
+	"sync/atomic"
+	"time"
 
+	"github.com/pingcap/parser"
+	"github.com/pingcap/parser/ast"
+	"github.com/pingcap/parser/charset"
 	"github.com/pingcap/tidb-tools/pkg/dbutil"
+	"go.etcd.io/etcd/clientv3"
+	"go.uber.org/zap"
+	"golang.org/x/time/rate"
+
+	"github.com/pingcap/dm/dm/common"
+	"github.com/pingcap/dm/pkg/etcdutil"
+	"github.com/pingcap/dm/pkg/log"
+	"github.com/pingcap/dm/pkg/terror"
+	"github.com/pingcap/dm/pkg/utils"
 )
 
 // LockKeeper used to keep and handle DDL lock conveniently.
 // The lock information do not need to be persistent, and can be re-constructed from the shard DDL info.
 type LockKeeper struct {
-	mu    sync.RWMutex
-	locks map[string]*Lock // lockID -> Lock
+	mu     sync.RWMutex
+	locks  map[string]*Lock // lockID -> Lock
+	parser DDLParser        // used to parse and normalize DDLs in shard DDL info
+
+	rewriter DDLRewriter // used to rewrite DDLs in shard DDL info before parsing them, nil means identity
+
+	sink   func(LockEvent) // the optional sink for lock events
+	sinkMu sync.Mutex      // used to send lock events in order
+	events []LockEvent     // lock events recorded but not sent to the sink yet
+
+	dedupWindow time.Duration         // the window to deduplicate identical infos in `TrySyncResult`, 0 means disabled
+	dedup       map[string]dedupEntry // the key of the info in etcd -> the latest result for the table
+
+	taskConfigs map[string]TaskConfig    // task name -> the configuration for the task
+	limiters    map[string]*rate.Limiter // task name -> the limiter of creating locks, see `TaskConfig.LockCreationRate`
+
+	policy ConflictPolicy // the policy to handle conflicts detected when trying to sync locks
+
+	clock Clock // used to get the current time for time-based features, see `SetClock`
+
+	deadSources map[string]struct{} // sources marked dead, see `SetSourceLiveness`
+
+	downCharset   string // the charset of `downCollation`
+	downCollation string // the downstream collation to normalize table infos to, see `SetDownstreamCollation`
+
+	paused bool // whether trying to sync locks of all tasks is paused, see `PauseAll`
+
+	preResolve  func(l *Lock)       // the hook called when a lock becomes resolvable, see `SetPreResolve`
+	postResolve func(lockID string) // the hook called after a resolved lock removed, see `SetPostResolve`
+	resolvable  map[string]struct{} // IDs of locks which have become resolvable (synced) and not changed since then
+	hooks       []func()            // resolution hooks queued when holding the keeper's lock, called after released
+}
+
+// TaskConfig represents the per-task configuration of the keeper, the zero value keeps the default behavior.
+type TaskConfig struct {
+	// Paused indicates whether trying to sync locks of the task is paused,
+	// `ErrShardDDLOptimismTaskPaused` is returned for infos of the task if paused.
+	Paused bool
+	// SkipDDL is used to filter DDLs in infos of the task before trying to sync locks,
+	// DDLs for which it returns true are skipped, nil means no DDLs are skipped.
+	SkipDDL func(ddl string) bool
+	// MaxLocks is the max number of locks of the task, 0 means unlimited.
+	// `ErrShardDDLOptimismTooManyLocks` is returned when trying to create more locks.
+	MaxLocks int
+	// StaleTimeout overrides the timeout passed to `EscalateStale` for locks of the task if > 0.
+	StaleTimeout time.Duration
+	// MaxColumns is the max number of columns in the joined table info of locks of the task,
+	// 0 means `DefaultMaxColumns`, see `Lock.SetMaxColumns`.
+	MaxColumns int
+	// LockCreationRate is the max rate (locks per second) of creating locks of the task, 0 means unlimited.
+	// `ErrShardDDLOptimismRateLimited` is returned when creating locks faster, the caller can retry later.
+	LockCreationRate float64
+	// LockCreationBurst is the max number of locks of the task can be created at once, 1 is used if <= 0.
+	LockCreationBurst int
+}
+
+// dedupEntry represents the result of trying to sync the lock for an info, used to deduplicate identical infos.
+type dedupEntry struct {
+	hash uint64     // the hash of the info, see `Info.Hash`
+	res  SyncResult // the result of trying to sync the lock
+	err  error      // the error of trying to sync the lock
+	at   time.Time  // the time when trying to sync the lock
 }
 
 // NewLockKeeper creates a new LockKeeper instance.
 func NewLockKeeper() *LockKeeper {
 	return &LockKeeper{
-		locks: make(map[string]*Lock),
+		locks:  make(map[string]*Lock),
+		parser: newTiDBDDLParser(),
+		dedup:  make(map[string]dedupEntry),
+
+		taskConfigs: make(map[string]TaskConfig),
+		limiters:    make(map[string]*rate.Limiter),
+
+		clock:       realClock{},
+		deadSources: make(map[string]struct{}),
+		resolvable:  make(map[string]struct{}),
+	}
+}
+
+// Clock provides the current time for time-based features (like the dedup window, the rate limit and stale detection),
+// it's often used to inject a fake clock in tests.
+type Clock interface {
+	// Now returns the current time.
+	Now() time.Time
+}
+
+// realClock is the default Clock using the system time.
+type realClock struct{}
+
+// Now implements Clock.Now.
+func (realClock) Now() time.Time {
+	return time.Now()
+}
+
+// SetClock sets the clock used by the keeper and its locks to get the current time,
+// the default one using the system time is used if `clock` is nil.
+// NOTE: times recorded before (like when locks became unresolved) are not changed.
+func (lk *LockKeeper) SetClock(clock Clock) {
+	lk.mu.Lock()
+	defer lk.mu.Unlock()
+
+	if clock == nil {
+		clock = realClock{}
+	}
+	lk.clock = clock
+	for _, l := range lk.locks {
+		l.setClock(clock)
+	}
+}
+
+// DDLParser parses and normalizes DDLs in shard DDL info before trying to sync the lock.
+type DDLParser interface {
+	// Parse parses a DDL statement.
+	Parse(ddl string) (ast.StmtNode, error)
+	// Normalize returns the normalized DDL statement which is used to sync the lock.
+	Normalize(ddl string) (string, error)
+}
+
+// tidbDDLParser is the default DDLParser using the TiDB parser.
+// it does not rewrite DDLs, `Normalize` returns DDLs as they are since they have been checked by `Parse`.
+type tidbDDLParser struct {
+	mu sync.Mutex // the TiDB parser is not goroutine-safe.
+	p  *parser.Parser
+}
+
+func newTiDBDDLParser() *tidbDDLParser {
+	return &tidbDDLParser{p: parser.New()}
+}
+
+// Parse implements DDLParser.Parse.
+func (tp *tidbDDLParser) Parse(ddl string) (ast.StmtNode, error) {
+	tp.mu.Lock()
+	defer tp.mu.Unlock()
+	return tp.p.ParseOneStmt(ddl, "", "")
+}
+
+// Normalize implements DDLParser.Normalize.
+func (tp *tidbDDLParser) Normalize(ddl string) (string, error) {
+	return ddl, nil
+}
+
+// SetDDLParser sets the parser used to parse and normalize DDLs in shard DDL info,
+// the default one using the TiDB parser is used if `p` is nil.
+func (lk *LockKeeper) SetDDLParser(p DDLParser) {
+	lk.mu.Lock()
+	defer lk.mu.Unlock()
+
+	if p == nil {
+		p = newTiDBDDLParser()
+	}
+	lk.parser = p
+}
+
+// DDLRewriter rewrites an upstream DDL before trying to sync the lock,
+// e.g. strip `AUTO_INCREMENT` or remap the charset for the downstream.
+// the rewritten DDL is used for both comparing with other tables and executing to the downstream.
+type DDLRewriter func(ddl string) (string, error)
+
+// SetDDLRewriter sets the rewriter used to rewrite DDLs in shard DDL info,
+// DDLs are not rewritten if `r` is nil.
+func (lk *LockKeeper) SetDDLRewriter(r DDLRewriter) {
+	lk.mu.Lock()
+	defer lk.mu.Unlock()
+	lk.rewriter = r
+}
+
+// SetDownstreamCollation sets the collation of the downstream, empty (the default) means no normalization.
+// if set, charsets and collations of tables and their non-binary string columns in table infos of shard DDL info
+// are normalized to the collation (and its charset) before trying to sync locks, so tables with different
+// upstream default collations (e.g. `utf8mb4_bin` and `utf8mb4_general_ci`) converge to the downstream collation
+// instead of conflicting on the same columns.
+// NOTE: only table infos are normalized, DDLs are not rewritten (see `SetDDLRewriter` to rewrite them),
+// so they are executed with the charset and collation specified in them (or the default of the downstream).
+// NOTE: tables already in locks are not changed, so it should be set before trying to sync any lock.
+// `ErrShardDDLOptimismUnknownCollation` is returned if the collation is unknown.
+func (lk *LockKeeper) SetDownstreamCollation(collation string) error {
+	charsetName := ""
+	if collation != "" {
+		coll, err := charset.GetCollationByName(collation)
+		if err != nil {
+			return terror.ErrShardDDLOptimismUnknownCollation.Delegate(err, collation)
+		}
+		charsetName, collation = coll.CharsetName, coll.Name
+	}
+
+	lk.mu.Lock()
+	defer lk.mu.Unlock()
+	lk.downCharset, lk.downCollation = charsetName, collation
+	return nil
+}
+
+// normalizeCollation normalizes table infos in the info to the downstream collation, see `SetDownstreamCollation`.
+func (lk *LockKeeper) normalizeCollation(info Info) Info {
+	if lk.downCollation == "" {
+		return info
+	}
+	info.TableInfoBefore = normalizeCollation(info.TableInfoBefore, lk.downCharset, lk.downCollation)
+	info.TableInfoAfter = normalizeCollation(info.TableInfoAfter, lk.downCharset, lk.downCollation)
+	return info
+}
+
+// SetSourceLiveness marks the source as alive or dead (e.g. its DM-worker is permanently offline).
+// tables of dead sources are skipped when deciding whether locks are synced or resolved,
+// so a dead source does not block the resolution of every lock. sources are alive by default,
+// and a dead source is marked alive again automatically once it tries to sync any lock (e.g. after reconnected).
+// NOTE: tables of dead sources are still kept in locks, and still take part in joining the schema.
+func (lk *LockKeeper) SetSourceLiveness(source string, alive bool) {
+	lk.mu.Lock()
+	defer lk.unlockAndEmit()
+	lk.setSourceLiveness(source, alive)
+}
+
+// IsSourceAlive returns whether the source is alive, see `SetSourceLiveness`.
+func (lk *LockKeeper) IsSourceAlive(source string) bool {
+	lk.mu.RLock()
+	defer lk.mu.RUnlock()
+	_, dead := lk.deadSources[source]
+	return !dead
+}
+
+// setSourceLiveness marks the source as alive or dead for all locks, it should be called when holding the keeper's lock.
+// locks which become synced or resolved after the source marked dead are notified as lock events.
+func (lk *LockKeeper) setSourceLiveness(source string, alive bool) {
+	if alive {
+		delete(lk.deadSources, source)
+	} else {
+		lk.deadSources[source] = struct{}{}
+	}
+	for _, lockID := range sortedKeys(lk.locks) {
+		l := lk.locks[lockID]
+		synced, _ := l.IsSynced()
+		resolved := l.IsResolved()
+		if l.setSourceAlive(source, alive) {
+			lk.recordTransitions(l, source, synced, resolved)
+		}
+	}
+}
+
+// recordTransitions records lock events for the lock if it becomes synced or resolved since `synced` and `resolved` got,
+// and tracks whether it's resolvable, it should be called when holding the keeper's lock after the lock changed.
+func (lk *LockKeeper) recordTransitions(l *Lock, source string, synced, resolved bool) {
+	lk.trackResolvable(l)
+	if synced2, _ := l.IsSynced(); synced2 && !synced {
+		lk.recordEvent(LockEventSynced, l.ID, source, nil)
+	}
+	if l.IsResolved() && !resolved {
+		lk.recordEvent(LockEventResolved, l.ID, source, nil)
+	}
+}
+
+// SyncResult represents the result of trying to sync the lock.
+type SyncResult struct {
+	LockID         string        // the ID of the lock
+	DDLs           []string      // DDLs need to apply to the downstream
+	Resolved       bool          // whether the lock has resolved (all operations have done)
+	PendingSources []string      // sources which have tables not synced yet, sorted
+	Conflict       *ConflictInfo // the detected conflict, nil if no conflict
+	Warnings       []string      // advisory messages for noteworthy but valid decisions, see `Lock.Warnings`
+}
+
+// ConflictAction represents the action to take for a conflict detected when trying to sync the lock.
+type ConflictAction int
+
+// actions for the conflict.
+const (
+	// ConflictActionEscalate reports the conflict as an error for manual intervention, it's the default action.
+	ConflictActionEscalate ConflictAction = iota
+	// ConflictActionSkip skips DDLs causing the conflict, the table is restored to the state before trying to sync.
+	ConflictActionSkip
+	// ConflictActionForce executes DDLs causing the conflict to the downstream as they are.
+	ConflictActionForce
+)
+
+// String implements Stringer interface.
+func (a ConflictAction) String() string {
+	switch a {
+	case ConflictActionEscalate:
+		return "escalate"
+	case ConflictActionSkip:
+		return "skip"
+	case ConflictActionForce:
+		return "force"
+	}
+	return fmt.Sprintf("unknown conflict action %d", int(a))
+}
+
+// ConflictPolicy maps the type of a conflict to the action to take, `ConflictActionEscalate` is taken for types not in the policy.
+type ConflictPolicy map[ConflictType]ConflictAction
+
+// SetConflictPolicy sets the policy to handle conflicts detected in `TrySyncResult` (and `TrySync`),
+// all conflicts are escalated (reported as errors) if `p` is nil, this is also the default behavior.
+// NOTE: the conflict is still reported in the result (with the action taken) for conflicts skipped or forced,
+// but no error is returned for them.
+func (lk *LockKeeper) SetConflictPolicy(p ConflictPolicy) {
+	lk.mu.Lock()
+	defer lk.mu.Unlock()
+
+	lk.policy = make(ConflictPolicy, len(p))
+	for ct, action := range p {
+		lk.policy[ct] = action
+	}
+}
+
+// LockEventType represents the type of a LockEvent.
+type LockEventType string
+
+// types of the lock event.
+const (
+	LockEventCreated   LockEventType = "created"   // the lock is created.
+	LockEventSynced    LockEventType = "synced"    // the lock is synced after trying to sync it.
+	LockEventConflict  LockEventType = "conflict"  // a conflict is detected when trying to sync the lock.
+	LockEventResolved  LockEventType = "resolved"  // the lock is resolved after trying to sync it.
+	LockEventRemoved   LockEventType = "removed"   // the lock is removed from the keeper.
+	LockEventEscalated LockEventType = "escalated" // the lock is unresolved for too long and requires manual intervention.
+	LockEventReopened  LockEventType = "reopened"  // the resolved lock is reopened as pending.
+	LockEventSkipped   LockEventType = "skipped"   // a DDL in the lock is skipped by `SkipDDL`.
+	LockEventReset     LockEventType = "reset"     // the sync state of the lock is reset by `ResetLock`.
+	LockEventTagged    LockEventType = "tagged"    // labels attached to the lock are replaced by `SetLockTags`.
+	LockEventModified  LockEventType = "modified"  // the lock is modified by `WithLock`.
+)
+
+// LockEvent represents a state change of a lock in the keeper, it's often used to trace locks for debugging.
+type LockEvent struct {
+	Type   LockEventType `json:"type"`    // the type of the event
+	LockID string        `json:"lock-id"` // the ID of the lock
+	Source string        `json:"source"`  // upstream source ID which caused the event, empty if not caused by a source
+	DDLs   []string      `json:"ddls"`    // DDLs in the shard DDL info which caused the event
+	Time   time.Time     `json:"time"`    // the time when the event happened
+}
+
+// SetEventSink sets the sink for lock events, nil means no sink.
+// events are sent to the sink in the order of happening and outside the keeper's lock,
+// but the sink MUST NOT call methods of the keeper which may generate lock events.
+func (lk *LockKeeper) SetEventSink(sink func(LockEvent)) {
+	lk.mu.Lock()
+	defer lk.mu.Unlock()
+
+	lk.sink = sink
+}
+
+// SetPreResolve sets the hook called when a lock becomes resolvable, i.e. all tables have synced to the joined schema,
+// so the DDLs are ready to be applied to the downstream. the hook is called once for each transition
+// (e.g. again after the lock changed by new DDLs and synced again), nil (the default) means no hook.
+// this hook and the post-resolve one (see `SetPostResolve`) are specific to the resolution lifecycle of locks,
+// see `SetEventSink` for all lock events.
+// NOTE: hooks are called outside the keeper's lock (after events sent to the sink), so they can call methods of the keeper,
+// but the lock passed to the hook may have been changed by others since then.
+func (lk *LockKeeper) SetPreResolve(hook func(l *Lock)) {
+	lk.mu.Lock()
+	defer lk.mu.Unlock()
+	lk.preResolve = hook
+}
+
+// SetPostResolve sets the hook called after a resolved lock removed from the keeper (i.e. cleaned up after resolved),
+// nil (the default) means no hook. locks removed before resolved or cleared silently do not call it, see `SetPreResolve`.
+func (lk *LockKeeper) SetPostResolve(hook func(lockID string)) {
+	lk.mu.Lock()
+	defer lk.mu.Unlock()
+	lk.postResolve = hook
+}
+
+// trackResolvable tracks whether the lock becomes resolvable (synced), and queues the pre-resolve hook if it does.
+// it should be called when holding the keeper's lock after the lock may have changed.
+func (lk *LockKeeper) trackResolvable(l *Lock) {
+	synced, _ := l.IsSynced()
+	_, tracked := lk.resolvable[l.ID]
+	switch {
+	case synced && !tracked:
+		lk.resolvable[l.ID] = struct{}{}
+		if hook := lk.preResolve; hook != nil {
+			lk.hooks = append(lk.hooks, func() { hook(l) })
+		}
+	case !synced && tracked:
+		delete(lk.resolvable, l.ID)
+	}
+}
+
+// trackRemoved queues the post-resolve hook if the removed lock has resolved,
+// it should be called when holding the keeper's lock after the lock removed.
+func (lk *LockKeeper) trackRemoved(l *Lock) {
+	delete(lk.resolvable, l.ID)
+	if hook, lockID := lk.postResolve, l.ID; hook != nil && l.IsResolved() {
+		lk.hooks = append(lk.hooks, func() { hook(lockID) })
+	}
+}
+
+// recordEvent records a lock event if the sink exists, it should be called when holding the keeper's lock.
+func (lk *LockKeeper) recordEvent(tp LockEventType, lockID, source string, ddls []string) {
+	if lk.sink == nil {
+		return
+	}
+	lk.events = append(lk.events, LockEvent{Type: tp, LockID: lockID, Source: source, DDLs: ddls, Time: lk.clock.Now()})
+}
+
+// unlockAndEmit releases the keeper's lock, then sends lock events recorded when holding the lock to the sink,
+// and calls resolution hooks queued when holding the lock, see `SetPreResolve`.
+func (lk *LockKeeper) unlockAndEmit() {
+	events, sink, hooks := lk.events, lk.sink, lk.hooks
+	lk.events, lk.hooks = nil, nil
+	if (len(events) == 0 || sink == nil) && len(hooks) == 0 {
+		lk.mu.Unlock()
+		return
+	}
+
+	// acquire `sinkMu` before releasing the keeper's lock to keep the order of events for concurrent callers.
+	lk.sinkMu.Lock()
+	lk.mu.Unlock()
+	if sink != nil {
+		for _, ev := range events {
+			sink(ev)
+		}
+	}
+	lk.sinkMu.Unlock()
+	// hooks may call methods of the keeper, so they are called after `sinkMu` released.
+	for _, hook := range hooks {
+		hook()
 	}
 }
 
 // TrySync tries to sync the lock.
 func (lk *LockKeeper) TrySync(info Info, sts []SourceTables) (string, []string, error) {
+	res, err := lk.TrySyncResult(info, sts)
+	return res.LockID, res.DDLs, err
+}
+
+// SetDedupWindow sets the window to deduplicate identical infos in `TrySyncResult` (and `TrySync`), 0 means disabled.
+// if the same info (for the same table with the same content, compared by `Info.Hash`) is tried to sync again within the window
+// after the previous one, the previous result is returned without re-applying it to the lock,
+// this is often used to avoid double-processing when the same info is delivered twice (like duplicate watch events).
+// NOTE: dedup is disabled by default, because re-trying the same info is valid after the lock changed (like operations done),
+// so the window should be short enough. results recorded before are discarded after the window changed.
+func (lk *LockKeeper) SetDedupWindow(window time.Duration) {
+	lk.mu.Lock()
+	defer lk.mu.Unlock()
+
+	lk.dedupWindow = window
+	lk.dedup = make(map[string]dedupEntry)
+}
+
+// SetTaskConfig sets the configuration for the task, it replaces the previous one as a whole.
+// the configuration is read when trying to sync locks (and escalating stale locks) of the task later.
+func (lk *LockKeeper) SetTaskConfig(task string, cfg TaskConfig) {
+	lk.mu.Lock()
+	defer lk.mu.Unlock()
+
+	lk.taskConfigs[task] = cfg
+	if cfg.LockCreationRate <= 0 {
+		delete(lk.limiters, task)
+		return
+	}
+	burst := cfg.LockCreationBurst
+	if burst <= 0 {
+		burst = 1
+	}
+	// keep the limiter (and its tokens) if the rate is not changed.
+	if lim, ok := lk.limiters[task]; ok && lim.Limit() == rate.Limit(cfg.LockCreationRate) && lim.Burst() == burst {
+		return
+	}
+	lk.limiters[task] = rate.NewLimiter(rate.Limit(cfg.LockCreationRate), burst)
+}
+
+// PauseAll pauses trying to sync locks of all tasks, e.g. during the maintenance of the cluster.
+// `ErrShardDDLOptimismPaused` is returned for all infos until `ResumeAll` is called, and no lock is changed for them.
+// this is a coarse switch independent of pausing a single task (see `TaskConfig.Paused`),
+// other operations (like queries, `SkipDDL` or removing locks) still work while paused.
+func (lk *LockKeeper) PauseAll() {
+	lk.mu.Lock()
+	defer lk.mu.Unlock()
+	lk.paused = true
+}
+
+// ResumeAll resumes trying to sync locks paused by `PauseAll`, tasks paused by their configurations are still paused.
+func (lk *LockKeeper) ResumeAll() {
+	lk.mu.Lock()
+	defer lk.mu.Unlock()
+	lk.paused = false
+}
+
+// IsPaused returns whether trying to sync locks of all tasks is paused by `PauseAll`.
+func (lk *LockKeeper) IsPaused() bool {
+	lk.mu.RLock()
+	defer lk.mu.RUnlock()
+	return lk.paused
+}
+
+// TaskConfig returns the configuration for the task, the zero value is returned if not set.
+func (lk *LockKeeper) TaskConfig(task string) TaskConfig {
+	lk.mu.RLock()
+	defer lk.mu.RUnlock()
+
+	return lk.taskConfigs[task]
+}
+
+// TrySyncResult tries to sync the lock and returns the structured result.
+// NOTE: if a conflict detected, both `Conflict` in the result and the error are returned,
+// unless the conflict is skipped or forced by the conflict policy, see `SetConflictPolicy`.
+// if `Seq` in the info is less than the latest one for the table, `ErrShardDDLOptimismOutOfOrderDDL` is returned.
+// if any DDL in the info can't be parsed or normalized, `ErrShardDDLOptimismParseDDL` is returned.
+// if the dedup window is set, the same result is returned for identical infos within the window, see `SetDedupWindow`.
+// `ErrShardDDLOptimismPaused` is returned if paused for all tasks, see `PauseAll`.
+// `ErrShardDDLOptimismLockIDCollision` is returned if the lock of the ID is for another task or downstream table.
+// the configuration for the task of the info is also applied, see `TaskConfig`.
+// if creating locks of the task faster than `LockCreationRate`, `ErrShardDDLOptimismRateLimited` is returned,
+// the caller can retry the info later.
+// noteworthy but valid decisions are reported in `Warnings` of the result, they never change the result itself.
+// no lock is created for DDLs which are all no-ops for the downstream, empty DDLs are returned for them directly,
+// so the lock of the returned ID may not exist.
+func (lk *LockKeeper) TrySyncResult(info Info, sts []SourceTables) (SyncResult, error) {
+	lk.mu.Lock()
+	defer lk.unlockAndEmit()
+
+	if lk.dedupWindow <= 0 || lk.paused || lk.taskConfigs[info.Task].Paused {
+		return lk.trySyncResult(info, sts)
+	}
+
+	key := common.ShardDDLOptimismInfoKeyAdapter.Encode(info.Task, info.Source, info.UpSchema, info.UpTable)
+	hash := info.Hash()
+	if e, ok := lk.dedup[key]; ok && e.hash == hash && lk.clock.Now().Sub(e.at) <= lk.dedupWindow {
+		return e.res.clone(), e.err
+	}
+
+	res, err := lk.trySyncResult(info, sts)
+	if !terror.ErrShardDDLOptimismRateLimited.Equal(err) { // the rate limited info should be retried.
+		lk.dedup[key] = dedupEntry{hash: hash, res: res.clone(), err: err, at: lk.clock.Now()}
+	}
+	return res, err
+}
+
+// clone returns a deep copy of the result.
+func (r SyncResult) clone() SyncResult {
+	clone := r
+	if r.DDLs != nil {
+		clone.DDLs = append([]string{}, r.DDLs...)
+	}
+	if r.PendingSources != nil {
+		clone.PendingSources = append([]string{}, r.PendingSources...)
+	}
+	if r.Warnings != nil {
+		clone.Warnings = append([]string{}, r.Warnings...)
+	}
+	if r.Conflict != nil {
+		conflict := *r.Conflict
+		clone.Conflict = &conflict
+	}
+	return clone
+}
+
+// forgetDedup discards results recorded for deduplication of the lock, it should be called when holding the keeper's lock.
+func (lk *LockKeeper) forgetDedup(lockID string) {
+	for key, e := range lk.dedup {
+		if e.res.LockID == lockID {
+			delete(lk.dedup, key)
+		}
+	}
+}
+
+// SyncItem represents an item to try to sync in `TrySyncBatch`.
+type SyncItem struct {
+	Info Info           // the shard DDL info
+	STs  []SourceTables // the source tables for the task of the info
+}
+
+// TrySyncBatch tries to sync the lock for an ordered batch of items, often used when replaying many infos.
+// the keeper's lock is only held once for the whole batch, and results are returned in the same order as items.
+// NOTE: a conflict detected for an item is reported in the result (`Conflict`) without aborting the rest,
+// but for other errors, the results for processed items and the error are returned.
+func (lk *LockKeeper) TrySyncBatch(items []SyncItem) ([]SyncResult, error) {
+	lk.mu.Lock()
+	defer lk.unlockAndEmit()
+
+	results := make([]SyncResult, 0, len(items))
+	for _, item := range items {
+		res, err := lk.trySyncResult(item.Info, item.STs)
+		results = append(results, res)
+		if err != nil && res.Conflict == nil {
+			return results, err
+		}
+	}
+	return results, nil
+}
+
+// trySyncResult tries to sync the lock without holding the keeper's lock.
+func (lk *LockKeeper) trySyncResult(info Info, sts []SourceTables) (SyncResult, error) {
 	var (
 		lockID = genDDLLockID(info)
 		l      *Lock
 		ok     bool
+		cfg    = lk.taskConfigs[info.Task]
+		orig   = info // the info may be changed below, but the original one is in etcd.
+	)
+
+	if lk.paused {
+		return SyncResult{LockID: lockID}, terror.ErrShardDDLOptimismPaused.Generate()
+	}
+	if cfg.Paused {
+		return SyncResult{LockID: lockID}, terror.ErrShardDDLOptimismTaskPaused.Generate(info.Task)
+	}
+	if _, ok := lk.deadSources[info.Source]; ok {
+		// the source reports again, e.g. the DM-worker reconnected.
+		log.L().Info("source marked dead reports shard DDL info, mark it alive", zap.String("source", info.Source), zap.String("lock", lockID))
+		lk.setSourceLiveness(info.Source, true)
+	}
+	if cfg.SkipDDL != nil {
+		ddls := make([]string, 0, len(info.DDLs))
+		for _, ddl := range info.DDLs {
+			if !cfg.SkipDDL(ddl) {
+				ddls = append(ddls, ddl)
+			}
+		}
+		info.DDLs = ddls
+	}
+
+	parsed, err := lk.normalizeDDLs(lockID, info.DDLs)
+	if err != nil {
+		return SyncResult{LockID: lockID}, err
+	}
+	if len(parsed) > 0 {
+		info.DDLs = ddlTexts(parsed)
+	}
+	info = lk.normalizeCollation(info)
+
+	// DDLs which are all no-ops for the downstream (e.g. TRUNCATE TABLE, comment-only changes) need no coordination,
+	// so no lock is created for them and they are not tracked as contributing DDLs, see `isNoOpDownstream`.
+	noOp := isNoOpDownstreamDDLs(parsed) || isCommentOnlyDDLs(parsed, info.TableInfoBefore, info.TableInfoAfter)
+	if _, ok = lk.locks[lockID]; !ok && noOp {
+		log.L().Info("no-op DDLs for the downstream skipped without a lock", zap.String("lock", lockID), zap.Stringer("info", info))
+		return SyncResult{
+			LockID: lockID,
+			DDLs:   []string{},
+			Warnings: []string{fmt.Sprintf("DDLs %v of table %s of source %s are no-ops for the downstream and skipped",
+				info.DDLs, dbutil.TableName(info.UpSchema, info.UpTable), info.Source)},
+		}, nil
+	}
+
+	if l, ok = lk.locks[lockID]; ok {
+		// NOTE: this should never happen for locks created by the keeper, but guard it to surface the collision
+		// instead of silently coordinating unrelated tables in the same lock, see `genDDLLockID`.
+		if down := dbutil.TableName(info.DownSchema, info.DownTable); l.Task != info.Task || l.downTable() != down {
+			log.L().Error("lock ID collision detected", zap.String("lock", lockID), zap.String("lock task", l.Task),
+				zap.String("lock downstream table", l.downTable()), zap.Stringer("info", info))
+			return SyncResult{LockID: lockID}, terror.ErrShardDDLOptimismLockIDCollision.Generate(lockID, l.Task, l.downTable(), info.Task, down)
+		}
+	} else {
+		if cfg.MaxLocks > 0 && lk.countLocks(info.Task) >= cfg.MaxLocks {
+			return SyncResult{LockID: lockID}, terror.ErrShardDDLOptimismTooManyLocks.Generate(lockID, info.Task, cfg.MaxLocks)
+		}
+		if lim, ok := lk.limiters[info.Task]; ok && !lim.AllowN(lk.clock.Now(), 1) {
+			return SyncResult{LockID: lockID}, terror.ErrShardDDLOptimismRateLimited.Generate(lockID, info.Task)
+		}
+		lk.locks[lockID] = newLock(lockID, info.Task, info.TableInfoBefore, sts, lk.clock)
+		l = lk.locks[lockID]
+		for source := range lk.deadSources {
+			l.setSourceAlive(source, false)
+		}
+		lk.recordEvent(LockEventCreated, lockID, info.Source, info.DDLs)
+	}
+	l.SetMaxColumns(cfg.MaxColumns)
+
+	state := l.saveTableState(info.Source, info.UpSchema, info.UpTable)
+	canonicals := canonicalDDLs(parsed) // ASTs may be rewritten when trying to sync.
+	if len(canonicals) != len(orig.DDLs) {
+		// some DDLs skipped, parse the original ones to keep canonical forms in the same order.
+		canonicals = canonicalDDLs(parseDDLs(lk.parser, orig.DDLs))
+	}
+	newDDLs, ct, err := l.trySync(info.Source, info.UpSchema, info.UpTable, parsed, info.TableInfoAfter, sts, info.Seq)
+	if (err == nil && !noOp) || ct != ConflictTypeNone {
+		// the info rejected without changing the lock (e.g. out of order) or with no-op DDLs is not tracked.
+		l.trackInfo(orig, canonicals)
+	}
+	var conflict *ConflictInfo
+	if err != nil && ct != ConflictTypeNone {
+		conflict = &ConflictInfo{
+			Source:   info.Source,
+			UpSchema: info.UpSchema,
+			UpTable:  info.UpTable,
+			DDLs:     info.DDLs,
+			Type:     ct,
+			Msg:      err.Error(),
+			Action:   lk.policy[ct],
+		}
+		switch conflict.Action {
+		case ConflictActionSkip:
+			l.restoreTableState(state)
+			newDDLs, err = []string{}, nil
+		case ConflictActionForce:
+			l.forceConflict()
+			newDDLs, err = info.DDLs, nil
+		}
+		if err == nil {
+			log.L().Warn("conflict handled by the policy", zap.String("lock", lockID), zap.Stringer("type", ct), zap.Stringer("action", conflict.Action),
+				zap.String("source", info.Source), zap.String("schema", info.UpSchema), zap.String("table", info.UpTable), zap.Strings("ddls", info.DDLs))
+		}
+	}
+	res := SyncResult{
+		LockID:         lockID,
+		DDLs:           newDDLs,
+		Resolved:       l.IsResolved(),
+		PendingSources: l.PendingSources(),
+		Conflict:       conflict,
+		Warnings:       l.Warnings(),
+	}
+	if conflict != nil {
+		lk.recordEvent(LockEventConflict, lockID, info.Source, info.DDLs)
+	} else if err == nil {
+		if synced, _ := l.IsSynced(); synced {
+			lk.recordEvent(LockEventSynced, lockID, info.Source, info.DDLs)
+		}
+		if res.Resolved {
+			lk.recordEvent(LockEventResolved, lockID, info.Source, info.DDLs)
+		}
+	}
+	lk.trackResolvable(l)
+	return res, err
+}
+
+// countLocks returns the number of locks of the task, it should be called when holding the keeper's lock.
+func (lk *LockKeeper) countLocks(task string) int {
+	cnt := 0
+	for _, l := range lk.locks {
+		if l.Task == task {
+			cnt++
+		}
+	}
+	return cnt
+}
+
+// normalizeDDLs rewrites, parses and normalizes DDLs with the keeper's rewriter and parser.
+// the normalized DDLs are returned with the ASTs parsed before normalized, so they are parsed only once when trying to sync the lock,
+// and `Normalize` of the parser must not change the meaning of DDLs.
+func (lk *LockKeeper) normalizeDDLs(lockID string, ddls []string) ([]parsedDDL, error) {
+	if len(ddls) == 0 {
+		return nil, nil
+	}
+	normalized := make([]parsedDDL, 0, len(ddls))
+	for _, ddl := range ddls {
+		if lk.rewriter != nil {
+			ddl2, err := lk.rewriter(ddl)
+			if err != nil {
+				return nil, terror.ErrShardDDLOptimismRewriteDDL.Delegate(err, ddl, lockID)
+			}
+			ddl = ddl2
+		}
+		stmt, err := lk.parser.Parse(ddl)
+		if err != nil {
+			return nil, terror.ErrShardDDLOptimismParseDDL.Delegate(err, ddl, lockID)
+		}
+		ddl2, err := lk.parser.Normalize(ddl)
+		if err != nil {
+			return nil, terror.ErrShardDDLOptimismParseDDL.Delegate(err, ddl, lockID)
+		}
+		normalized = append(normalized, parsedDDL{text: ddl2, stmt: stmt})
+	}
+	return normalized, nil
+}
+
+// RemoveSourceFromLocks removes a source from all locks of the task.
+// it returns the sorted IDs of locks which the source has been removed from.
+func (lk *LockKeeper) RemoveSourceFromLocks(task, source string) []string {
+	lk.mu.Lock()
+	defer lk.unlockAndEmit()
+
+	lockIDs := make([]string, 0)
+	for _, lockID := range sortedKeys(lk.locks) {
+		l := lk.locks[lockID]
+		if l.Task != task {
+			continue
+		}
+		synced, _ := l.IsSynced()
+		resolved := l.IsResolved()
+		if err := l.RemoveSource(source); err == nil {
+			lockIDs = append(lockIDs, lockID)
+			lk.recordTransitions(l, source, synced, resolved)
+		}
+	}
+	return lockIDs
+}
+
+// RemoveLock removes a lock.
+// the removed lock is marked, so callers who got it before removed can't sync it anymore,
+// `ErrShardDDLOptimismLockRemoved` is returned for them instead of losing changes silently.
+func (lk *LockKeeper) RemoveLock(lockID string) bool {
+	lk.mu.Lock()
+	defer lk.unlockAndEmit()
+
+	l, ok := lk.locks[lockID]
+	if ok {
+		delete(lk.locks, lockID)
+		l.markRemoved()
+		lk.forgetDedup(lockID)
+		lk.recordEvent(LockEventRemoved, lockID, "", nil)
+		lk.trackRemoved(l)
+	}
+	return ok
+}
+
+// RemoveLockIfDeleted removes a lock only after its shard DDL infos and operations deleted in etcd.
+// the keeper's lock is not held while deleting in etcd, so other locks can still be synced meanwhile.
+// infos and operations are deleted only if none of them has been changed in etcd since read,
+// and the lock is removed only if it has not been changed since the deletion started,
+// otherwise (e.g. a new shard DDL info arrived) the lock is kept and `false` is returned without an error.
+// if the deletion in etcd failed, the lock is kept in memory and the error is returned,
+// so that the in-memory and persistent views do not diverge.
+func (lk *LockKeeper) RemoveLockIfDeleted(cli etcdutil.KVClient, lockID string) (bool, error) {
+	lk.mu.RLock()
+	l, ok := lk.locks[lockID]
+	var (
+		gen   uint64
+		infos []Info
+		ops   []Operation
+	)
+	if ok {
+		gen = l.generation()
+		infos, ops = lockInfosOperations(l)
+	}
+	lk.mu.RUnlock()
+	if !ok {
+		return false, nil
+	}
+
+	deleted, _, err := deleteInfosOperationsIfNotModified(cli, infos, ops)
+	if err != nil {
+		return false, err
+	} else if !deleted {
+		log.L().Warn("shard DDL infos or operations of the lock changed in etcd during removing, keep the lock", zap.String("lock", lockID))
+		return false, nil
+	}
+
+	lk.mu.Lock()
+	defer lk.unlockAndEmit()
+
+	if lk.locks[lockID] != l || l.generation() != gen {
+		log.L().Warn("the lock changed during removing, keep the lock", zap.String("lock", lockID))
+		return false, nil
+	}
+	delete(lk.locks, lockID)
+	l.markRemoved()
+	lk.forgetDedup(lockID)
+	lk.recordEvent(LockEventRemoved, lockID, "", nil)
+	lk.trackRemoved(l)
+	return true, nil
+}
+
+// lockInfosOperations returns the shard DDL infos and operations used to delete them in etcd for a lock.
+// NOTE: only `task`, `source`, `schema`, `table` (and lock ID for operations) are set.
+func lockInfosOperations(l *Lock) ([]Info, []Operation) {
+	infos := make([]Info, 0)
+	ops := make([]Operation, 0)
+	for source, schemaTables := range l.Ready() {
+		for schema, tables := range schemaTables {
+			for table := range tables {
+				infos = append(infos, NewInfo(l.Task, source, schema, table, "", "", nil, nil, nil))
+				ops = append(ops, NewOperation(l.ID, l.Task, source, schema, table, nil, ConflictNone, false))
+			}
+		}
+	}
+	return infos, ops
+}
+
+// ResetLock resets the sync state of a lock without removing it, see `Lock.Reset`.
+// this is a softer recovery than `RemoveLock`, sources MUST re-send their shard DDL info after reset.
+func (lk *LockKeeper) ResetLock(lockID string) error {
+	lk.mu.Lock()
+	defer lk.unlockAndEmit()
+
+	l, ok := lk.locks[lockID]
+	if !ok {
+		return terror.ErrShardDDLOptimismLockNotFound.Generate(lockID)
+	}
+	synced, _ := l.IsSynced()
+	resolved := l.IsResolved()
+	l.Reset()
+	lk.forgetDedup(lockID)
+	lk.recordEvent(LockEventReset, lockID, "", nil)
+	lk.recordTransitions(l, "", synced, resolved)
+	return nil
+}
+
+// SetLockTags replaces labels attached to the lock with `tags` (e.g. a ticket ID during an incident),
+// nil or empty `tags` clears all labels. labels are included in views of the lock, see `Lock.View`.
+// NOTE: labels are in-memory only and never affect the coordination, they're discarded when the lock is removed.
+func (lk *LockKeeper) SetLockTags(lockID string, tags map[string]string) error {
+	lk.mu.Lock()
+	defer lk.unlockAndEmit()
+
+	l, ok := lk.locks[lockID]
+	if !ok {
+		return terror.ErrShardDDLOptimismLockNotFound.Generate(lockID)
+	}
+	l.setTags(tags)
+	lk.recordEvent(LockEventTagged, lockID, "", nil)
+	return nil
+}
+
+// Reopen transitions a resolved lock back to pending, so the DDLs can be re-coordinated and re-applied, see `Lock.Reopen`.
+// this supports recovering from the downstream execution failure without a full reset.
+// it fails if the lock is not resolved (some tables are still syncing).
+func (lk *LockKeeper) Reopen(lockID string) error {
+	lk.mu.Lock()
+	defer lk.unlockAndEmit()
+
+	l, ok := lk.locks[lockID]
+	if !ok {
+		return terror.ErrShardDDLOptimismLockNotFound.Generate(lockID)
+	}
+	if !l.Reopen() {
+		return terror.ErrShardDDLOptimismLockNotResolved.Generate(lockID)
+	}
+	lk.forgetDedup(lockID)
+	lk.recordEvent(LockEventReopened, lockID, "", nil)
+	return nil
+}
+
+// SkipDDL skips a DDL in a lock for all sources, so the DDL is not executed to the downstream.
+// tables whose latest shard DDL info contains the DDL are restored to the table info before the info
+// (other DDLs in the same info are skipped together, because the table info after only part of DDLs is unknown),
+// then the joined table info is re-computed from all tables, and these tables are marked as done if synced.
+// it returns the shard DDL infos and operations of these tables, they should be deleted in etcd by the caller,
+// see `DeleteInfosOperations`. the DDL is matched after normalized (see `SetDDLParser`) and canonicalized,
+// so an equivalent but differently-written DDL also matches, see `equivalentDDL`.
+// `ErrShardDDLOptimismDDLNotFound` is returned if no info contains the DDL, and nothing is changed if tables can't be joined after skipped.
+func (lk *LockKeeper) SkipDDL(lockID string, ddl string) ([]Info, []Operation, error) {
+	lk.mu.Lock()
+	defer lk.unlockAndEmit()
+
+	l, ok := lk.locks[lockID]
+	if !ok {
+		return nil, nil, terror.ErrShardDDLOptimismLockNotFound.Generate(lockID)
+	}
+	normalized, err := lk.normalizeDDLs(lockID, []string{ddl})
+	if err != nil {
+		return nil, nil, err
+	}
+
+	infos := make([]Info, 0)
+	for _, info := range l.ContributingInfos() {
+		ddls, err2 := lk.normalizeDDLs(lockID, info.DDLs)
+		if err2 != nil {
+			continue
+		}
+		for _, ddl2 := range ddls {
+			if equivalentDDL(ddl2, normalized[0]) {
+				infos = append(infos, info)
+				break
+			}
+		}
+	}
+	if len(infos) == 0 {
+		return nil, nil, terror.ErrShardDDLOptimismDDLNotFound.Generate(ddl, lockID)
+	}
+	normalizedInfos := make([]Info, 0, len(infos))
+	for _, info := range infos {
+		normalizedInfos = append(normalizedInfos, lk.normalizeCollation(info))
+	}
+	if err = l.skipInfos(normalizedInfos); err != nil {
+		return nil, nil, err
+	}
+
+	ops := make([]Operation, 0, len(infos))
+	for _, info := range infos {
+		ops = append(ops, NewOperation(lockID, info.Task, info.Source, info.UpSchema, info.UpTable, nil, ConflictNone, false))
+	}
+	lk.forgetDedup(lockID)
+	lk.recordEvent(LockEventSkipped, lockID, "", ddlTexts(normalized))
+	if synced, _ := l.IsSynced(); synced {
+		lk.recordEvent(LockEventSynced, lockID, "", ddlTexts(normalized))
+	}
+	if l.IsResolved() {
+		lk.recordEvent(LockEventResolved, lockID, "", ddlTexts(normalized))
+	}
+	lk.trackResolvable(l)
+	return infos, ops, nil
+}
+
+// WithLock runs `fn` with the lock while holding the keeper's lock,
+// so a read-modify sequence on the lock in `fn` is atomic with respect to `TrySync` and other methods of the keeper.
+// it returns the error returned by `fn`, or `ErrShardDDLOptimismLockNotFound` if the lock not exists.
+// the lock is recorded as modified (even if `fn` fails, because it may have changed the lock partially),
+// and it's also recorded as synced or resolved if it becomes so in `fn`.
+// NOTE: `fn` can call methods of the lock, but MUST NOT call any methods of the keeper, otherwise it deadlocks.
+func (lk *LockKeeper) WithLock(lockID string, fn func(l *Lock) error) error {
+	lk.mu.Lock()
+	defer lk.unlockAndEmit()
+
+	l, ok := lk.locks[lockID]
+	if !ok {
+		return terror.ErrShardDDLOptimismLockNotFound.Generate(lockID)
+	}
+	synced, _ := l.IsSynced()
+	resolved := l.IsResolved()
+	err := fn(l)
+	lk.recordEvent(LockEventModified, lockID, "", nil)
+	lk.recordTransitions(l, "", synced, resolved)
+	return err
+}
+
+// FindLock finds a lock.
+func (lk *LockKeeper) FindLock(lockID string) *Lock {
+	lk.mu.RLock()
+	defer lk.mu.RUnlock()
+
+	return lk.locks[lockID]
+}
+
+// FindLocks finds locks with lock IDs under one read lock acquisition,
+// IDs of non-existing locks are not included in the returned map.
+func (lk *LockKeeper) FindLocks(lockIDs []string) map[string]*Lock {
+	lk.mu.RLock()
+	defer lk.mu.RUnlock()
+
+	locks := make(map[string]*Lock, len(lockIDs))
+	for _, id := range lockIDs {
+		if l, ok := lk.locks[id]; ok {
+			locks[id] = l
+		}
+	}
+	return locks
+}
+
+// FindLockByInfo finds a lock with a shard DDL info.
+func (lk *LockKeeper) FindLockByInfo(info Info) *Lock {
+	return lk.FindLock(genDDLLockID(info))
+}
+
+// EscalateStale escalates locks which are unresolved for longer than `timeout` as requiring manual intervention,
+// and returns these locks newly escalated in this call (sorted by lock ID), an escalated event is emitted for each of them.
+// a lock is unresolved since it was created, reset or resolved last time, and a lock already escalated is not returned again
+// until it's resolved or reset. the escalation is opt-in, the caller should call this periodically (like a background sweep).
+// NOTE: nothing is escalated if `timeout` <= 0, except for locks of tasks with `StaleTimeout` configured.
+func (lk *LockKeeper) EscalateStale(timeout time.Duration) []*Lock {
+	lk.mu.Lock()
+	defer lk.unlockAndEmit()
+
+	var (
+		now   = lk.clock.Now()
+		locks []*Lock
 	)
+	for _, lockID := range sortedKeys(lk.locks) {
+		l := lk.locks[lockID]
+		lockTimeout := timeout
+		if cfg := lk.taskConfigs[l.Task]; cfg.StaleTimeout > 0 {
+			lockTimeout = cfg.StaleTimeout
+		}
+		if lockTimeout > 0 && l.tryEscalate(lockTimeout, now) {
+			locks = append(locks, l)
+			lk.recordEvent(LockEventEscalated, lockID, "", nil)
+		}
+	}
+	return locks
+}
+
+// MergeFrom imports locks in `other` which do not exist in the keeper,
+// and returns the sorted IDs of locks existing in both keepers, these locks are left untouched and need manual resolution.
+// this is a recovery tool (like reconciling two partial keepers after a split-brain), not a steady-state operation.
+// NOTE: imported locks are shared with `other` (not copied), so `other` should be discarded after merged.
+func (lk *LockKeeper) MergeFrom(other *LockKeeper) []string {
+	locks := other.Locks() // get a snapshot before locking the keeper to avoid deadlock.
+
+	lk.mu.Lock()
+	defer lk.unlockAndEmit()
+
+	conflicts := make([]string, 0)
+	for _, lockID := range sortedKeys(locks) {
+		if _, ok := lk.locks[lockID]; ok {
+			conflicts = append(conflicts, lockID)
+			continue
+		}
+		lk.locks[lockID] = locks[lockID]
+		locks[lockID].setClock(lk.clock)
+		for source := range lk.deadSources {
+			locks[lockID].setSourceAlive(source, false)
+		}
+		lk.recordEvent(LockEventCreated, lockID, "", nil)
+		lk.trackResolvable(locks[lockID])
+	}
+	return conflicts
+}
+
+// DownTarget represents a downstream/target table.
+type DownTarget struct {
+	Schema string // downstream/target schema name
+	Table  string // downstream/target table name
+}
+
+// DownTargetsForTask returns all downstream tables of locks for the task,
+// sorted by the schema name and then the table name, without duplicates.
+// this is often used to validate the routing coverage of the task.
+func (lk *LockKeeper) DownTargetsForTask(task string) []DownTarget {
+	lk.mu.RLock()
+	defer lk.mu.RUnlock()
+
+	set := make(map[DownTarget]struct{})
+	for _, l := range lk.locks {
+		if l.Task != task {
+			continue
+		}
+		schema, table, err := utils.ExtractTable(l.downTable())
+		if err != nil {
+			continue // NOTE: this should not happen because the lock ID is generated by `genDDLLockID`.
+		}
+		set[DownTarget{Schema: schema, Table: table}] = struct{}{}
+	}
+
+	targets := make([]DownTarget, 0, len(set))
+	for target := range set {
+		targets = append(targets, target)
+	}
+	sort.Slice(targets, func(i, j int) bool {
+		if targets[i].Schema != targets[j].Schema {
+			return targets[i].Schema < targets[j].Schema
+		}
+		return targets[i].Table < targets[j].Table
+	})
+	return targets
+}
+
+// StartHeartbeat puts `key` with a lease of `ttl` seconds into etcd and keeps the lease alive in the background,
+// so other components can watch the key to know whether the keeper is still maintained (e.g. for failover detection).
+// the value of the key is the time (of the keeper's clock, see `SetClock`) when the heartbeat started.
+// the heartbeat stops when `ctx` canceled (or the lease can't be kept alive), and the lease is revoked so the key is deleted.
+// it returns an error if failed to start the heartbeat.
+func (lk *LockKeeper) StartHeartbeat(ctx context.Context, cli etcdutil.LeaseKVClient, key string, ttl int64) error {
+	lk.mu.RLock()
+	now := lk.clock.Now()
+	lk.mu.RUnlock()
+
+	cliCtx, cancel := context.WithTimeout(ctx, etcdutil.DefaultRequestTimeout)
+	defer cancel()
+	lease, err := cli.Grant(cliCtx, ttl)
+	if err != nil {
+		return err
+	}
+	if _, err = cli.Put(cliCtx, key, now.Format(time.RFC3339Nano), clientv3.WithLease(lease.ID)); err != nil {
+		revokeLease(cli, lease.ID)
+		return err
+	}
+	ch, err := cli.KeepAlive(ctx, lease.ID)
+	if err != nil {
+		revokeLease(cli, lease.ID)
+		return err
+	}
+
+	go func() {
+		defer revokeLease(cli, lease.ID)
+		for {
+			select {
+			case _, ok := <-ch:
+				if !ok {
+					log.L().Warn("keep alive channel for the lock keeper heartbeat is closed", zap.String("key", key))
+					return
+				}
+			case <-ctx.Done():
+				log.L().Info("ctx is canceled, the lock keeper heartbeat will exit now", zap.String("key", key))
+				return
+			}
+		}
+	}()
+	return nil
+}
+
+// revokeLease revokes the lease, the context of `cli` is used because the caller's one may have been canceled.
+func revokeLease(cli etcdutil.LeaseKVClient, id clientv3.LeaseID) {
+	ctx, cancel := context.WithTimeout(cli.Ctx(), etcdutil.DefaultRevokeLeaseTimeout)
+	defer cancel()
+	if _, err := cli.Revoke(ctx, id); err != nil {
+		log.L().Warn("fail to revoke the lease", zap.Int64("lease", int64(id)), zap.Error(err))
+	}
+}
+
+// Locks return a copy of all Locks.
+func (lk *LockKeeper) Locks() map[string]*Lock {
+	lk.mu.RLock()
+	defer lk.mu.RUnlock()
+
+	locks := make(map[string]*Lock, len(lk.locks))
+	for k, v := range lk.locks {
+		locks[k] = v
+	}
+	return locks
+}
 
-	lk.mu.Lock()
-	defer lk.mu.Unlock()
+// SnapshotLocks returns immutable snapshots of all Locks, sorted by lock ID.
+// snapshots are built quickly while holding the read lock of the keeper,
+// so slow consumers (like dumping to a slow writer) can work on them without blocking the keeper.
+func (lk *LockKeeper) SnapshotLocks() []*LockView {
+	lk.mu.RLock()
+	defer lk.mu.RUnlock()
 
-	if l, ok = lk.locks[lockID]; !ok {
-		lk.locks[lockID] = NewLock(lockID, info.Task, info.TableInfoBefore, sts)
-		l = lk.locks[lockID]
+	views := make([]*LockView, 0, len(lk.locks))
+	for _, lockID := range sortedKeys(lk.locks) {
+		view := lk.locks[lockID].View()
+		views = append(views, &view)
 	}
-
-	newDDLs, err := l.TrySync(info.Source, info.UpSchema, info.UpTable, info.DDLs, info.TableInfoAfter, sts)
-	return lockID, newDDLs, err
+	return views
 }
 
-// RemoveLock removes a lock.
-func (lk *LockKeeper) RemoveLock(lockID string) bool {
-	lk.mu.Lock()
-	defer lk.mu.Unlock()
-
-	_, ok := lk.locks[lockID]
-	delete(lk.locks, lockID)
-	return ok
+// DebugHandler returns a HTTP handler rendering snapshots of all Locks as JSON, see `SnapshotLocks`.
+// it's often registered as a debug endpoint (like pprof) to inspect the live state.
+func (lk *LockKeeper) DebugHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		writeDebugJSON(w, lk.SnapshotLocks())
+	})
 }
 
-// FindLock finds a lock.
-func (lk *LockKeeper) FindLock(lockID string) *Lock {
+// LockIDs returns the sorted IDs of all Locks.
+func (lk *LockKeeper) LockIDs() []string {
 	lk.mu.RLock()
 	defer lk.mu.RUnlock()
 
-	return lk.locks[lockID]
+	return sortedKeys(lk.locks)
 }
 
-// FindLockByInfo finds a lock with a shard DDL info.
-func (lk *LockKeeper) FindLockByInfo(info Info) *Lock {
-	return lk.FindLock(genDDLLockID(info))
+// AllPendingDDLs returns pending DDLs of all locks in one pass, lock ID -> DDLs, see `Lock.PendingDDLs`.
+// locks without any pending DDLs are not included.
+func (lk *LockKeeper) AllPendingDDLs() map[string][]string {
+	lk.mu.RLock()
+	defer lk.mu.RUnlock()
+
+	ddls := make(map[string][]string)
+	for lockID, l := range lk.locks {
+		if pending := l.PendingDDLs(); len(pending) > 0 {
+			ddls[lockID] = pending
+		}
+	}
+	return ddls
 }
 
-// Locks return a copy of all Locks.
-func (lk *LockKeeper) Locks() map[string]*Lock {
+// LocksByState returns all Locks split into synced, pending and conflicted ones, each sorted by lock ID.
+// a lock is conflicted if a conflict detected in the latest sync,
+// otherwise it's synced if all tables are synced, or it's pending.
+func (lk *LockKeeper) LocksByState() (synced, pending, conflicted []*Lock) {
 	lk.mu.RLock()
 	defer lk.mu.RUnlock()
 
-	locks := make(map[string]*Lock, len(lk.locks))
-	for k, v := range lk.locks {
-		locks[k] = v
+	for _, lockID := range sortedKeys(lk.locks) {
+		l := lk.locks[lockID]
+		if l.Conflict() != ConflictTypeNone {
+			conflicted = append(conflicted, l)
+		} else if isSynced, _ := l.IsSynced(); isSynced {
+			synced = append(synced, l)
+		} else {
+			pending = append(pending, l)
+		}
 	}
-	return locks
+	return synced, pending, conflicted
 }
 
 // Clear clears all Locks.
+// if an event sink is set, a removed event is emitted for every lock (in the order of lock IDs),
+// so that subscribers can keep their derived state consistent after a bulk clear (like re-Start in failover).
 func (lk *LockKeeper) Clear() {
+	lk.clear(true)
+}
+
+// ClearSilently clears all Locks without emitting any event, even if an event sink is set.
+func (lk *LockKeeper) ClearSilently() {
+	lk.clear(false)
+}
+
+// clear clears all Locks, and emits removed events if `notify` is true.
+func (lk *LockKeeper) clear(notify bool) {
 	lk.mu.Lock()
-	defer lk.mu.Unlock()
+	defer lk.unlockAndEmit()
 
+	for _, lockID := range sortedKeys(lk.locks) {
+		lk.locks[lockID].markRemoved()
+		if notify {
+			lk.recordEvent(LockEventRemoved, lockID, "", nil)
+			lk.trackRemoved(lk.locks[lockID])
+		}
+	}
 	lk.locks = make(map[string]*Lock)
+	lk.resolvable = make(map[string]struct{})
+	lk.dedup = make(map[string]dedupEntry)
+}
+
+// SelfCheck re-constructs locks from shard DDL info, operations and source tables, and compares them with locks in the keeper.
+// it returns human-readable findings for discrepancies (missing locks, extra locks, different joined schema,
+// synced status, done status or pending DDLs).
+// NOTE: this is only a diagnostic, the keeper is NOT repaired. locks are re-constructed with the same configuration
+// (like the DDL parser and rewriter) as the keeper, see `emptyClone` and `reconstruct`.
+func (lk *LockKeeper) SelfCheck(ifm map[string]map[string]map[string]map[string]Info,
+	opm map[string]map[string]map[string]map[string]Operation, stm map[string]map[string]SourceTables) []string {
+	var (
+		expected = lk.emptyClone()
+		findings []string
+	)
+	_ = expected.reconstruct(ifm, opm, stm, func(info Info, _ SyncResult, err error) error {
+		findings = append(findings, fmt.Sprintf("fail to try sync shard DDL info %s: %v", info, err))
+		return nil
+	})
+
+	actual := lk.Locks()
+	for _, lockID := range sortedKeys(expected.locks) {
+		el := expected.locks[lockID]
+		al, ok := actual[lockID]
+		if !ok {
+			findings = append(findings, fmt.Sprintf("lock %s is missing", lockID))
+			continue
+		}
+		if ej, aj := el.Joined().String(), al.Joined().String(); ej != aj {
+			findings = append(findings, fmt.Sprintf("joined table info of lock %s mismatch, expected %s, got %s", lockID, ej, aj))
+		}
+		if er, ar := el.Ready(), al.Ready(); !reflect.DeepEqual(er, ar) {
+			findings = append(findings, fmt.Sprintf("synced status of lock %s mismatch, expected %v, got %v", lockID, er, ar))
+		}
+		if ed, ad := el.View().Done, al.View().Done; !reflect.DeepEqual(ed, ad) {
+			findings = append(findings, fmt.Sprintf("done status of lock %s mismatch, expected %v, got %v", lockID, ed, ad))
+		}
+		if ep, ap := el.PendingDDLs(), al.PendingDDLs(); !reflect.DeepEqual(ep, ap) {
+			findings = append(findings, fmt.Sprintf("pending DDLs of lock %s mismatch, expected %v, got %v", lockID, ep, ap))
+		}
+	}
+	for _, lockID := range sortedKeys(actual) {
+		if _, ok := expected.locks[lockID]; !ok {
+			findings = append(findings, fmt.Sprintf("lock %s is unexpected", lockID))
+		}
+	}
+	return findings
+}
+
+// emptyClone returns a new keeper without any lock but with the same configuration as the keeper,
+// including the DDL parser and rewriter, the downstream collation, the conflict policy, task configurations and dead sources.
+// pausing and rate limits are not kept because all infos are tried to sync at once when reconstructing locks,
+// and hooks, the event sink and the dedup window are not kept to avoid side effects.
+func (lk *LockKeeper) emptyClone() *LockKeeper {
+	lk.mu.RLock()
+	defer lk.mu.RUnlock()
+
+	clone := NewLockKeeper()
+	clone.parser = lk.parser
+	clone.rewriter = lk.rewriter
+	clone.clock = lk.clock
+	clone.downCharset = lk.downCharset
+	clone.downCollation = lk.downCollation
+	clone.policy = make(ConflictPolicy, len(lk.policy))
+	for ct, action := range lk.policy {
+		clone.policy[ct] = action
+	}
+	for task, cfg := range lk.taskConfigs {
+		cfg.Paused = false
+		cfg.LockCreationRate = 0
+		clone.taskConfigs[task] = cfg
+	}
+	for source := range lk.deadSources {
+		clone.deadSources[source] = struct{}{}
+	}
+	return clone
+}
+
+// reconstruct re-constructs locks in the keeper in the same way as DM-master recovering locks when starting,
+// i.e. trying to sync with all shard DDL info (in order of task, source, schema and table) and then marking done operations.
+// `onErr` is called for each info failed to sync (including conflicts detected), the reconstruction stops
+// and the error is returned if `onErr` returns an error.
+func (lk *LockKeeper) reconstruct(ifm map[string]map[string]map[string]map[string]Info,
+	opm map[string]map[string]map[string]map[string]Operation, stm map[string]map[string]SourceTables,
+	onErr func(info Info, res SyncResult, err error) error) error {
+	for _, task := range sortedKeys(ifm) {
+		sts := SourceTablesMapToSlice(stm[task])
+		for _, source := range sortedKeys(ifm[task]) {
+			for _, schema := range sortedKeys(ifm[task][source]) {
+				for _, table := range sortedKeys(ifm[task][source][schema]) {
+					info := ifm[task][source][schema][table]
+					if res, err := lk.TrySyncResult(info, sts); err != nil {
+						if err = onErr(info, res, err); err != nil {
+							return err
+						}
+					}
+				}
+			}
+		}
+	}
+	for _, task := range sortedKeys(opm) {
+		for _, source := range sortedKeys(opm[task]) {
+			for _, schema := range sortedKeys(opm[task][source]) {
+				for _, table := range sortedKeys(opm[task][source][schema]) {
+					op := opm[task][source][schema][table]
+					if l := lk.FindLock(op.ID); l != nil && op.Done {
+						l.TryMarkDone(op.Source, op.UpSchema, op.UpTable)
+					}
+				}
+			}
+		}
+	}
+	return nil
 }
 
 // genDDLLockID generates DDL lock ID from its info.
+// the ID is unambiguous because backquotes in the downstream schema and table names are escaped,
+// but locks may also be imported with IDs generated elsewhere (like `MergeFrom`), so `TrySync` still checks
+// whether the existing lock of the ID is for the same task and downstream table, see `ErrShardDDLOptimismLockIDCollision`.
 func genDDLLockID(info Info) string {
 	return fmt.Sprintf("%s-%s", info.Task, dbutil.TableName(info.DownSchema, info.DownTable))
 }
 
+// taskFromLockID returns the task name from the lock ID generated by `genDDLLockID`.
+func taskFromLockID(lockID string) (string, error) {
+	idx := strings.Index(lockID, "-`")
+	if idx <= 0 || !strings.HasSuffix(lockID, "`") {
+		return "", terror.ErrShardDDLOptimismInvalidLockID.Generate(lockID)
+	}
+	return lockID[:idx], nil
+}
+
+// GroupInfosByLock groups shard DDL info by the ID of the lock they belong to.
+// `ifm` is often the result of `GetAllInfo`, k/k/k/k/v: task-name -> source-ID -> upstream-schema-name -> upstream-table-name -> shard DDL info.
+// infos in each group are sorted by the source ID, upstream schema name and upstream table name.
+func GroupInfosByLock(ifm map[string]map[string]map[string]map[string]Info) map[string][]Info {
+	groups := make(map[string][]Info)
+	for _, sources := range ifm {
+		for _, schemas := range sources {
+			for _, tables := range schemas {
+				for _, info := range tables {
+					lockID := genDDLLockID(info)
+					groups[lockID] = append(groups[lockID], info)
+				}
+			}
+		}
+	}
+	for _, infos := range groups {
+		sort.Slice(infos, func(i, j int) bool {
+			if infos[i].Source != infos[j].Source {
+				return infos[i].Source < infos[j].Source
+			}
+			if infos[i].UpSchema != infos[j].UpSchema {
+				return infos[i].UpSchema < infos[j].UpSchema
+			}
+			return infos[i].UpTable < infos[j].UpTable
+		})
+	}
+	return groups
+}
+
+// GroupInfosBySource groups shard DDL info of the task by the source ID, often used to distribute work to the owning DM-workers.
+// `ifm` is often the result of `GetAllInfo`, see `GroupInfosByLock`.
+// infos in each group are sorted by the upstream schema name and upstream table name.
+func GroupInfosBySource(ifm map[string]map[string]map[string]map[string]Info, task string) map[string][]Info {
+	groups := make(map[string][]Info)
+	for source, schemas := range ifm[task] {
+		for _, schema := range sortedKeys(schemas) {
+			tables := schemas[schema]
+			for _, table := range sortedKeys(tables) {
+				groups[source] = append(groups[source], tables[table])
+			}
+		}
+	}
+	return groups
+}
+
 // TableKeeper used to keep initial tables for a task in optimism mode.
 type TableKeeper struct {
-	mu     sync.RWMutex
-	tables map[string]map[string]SourceTables // task-name -> source-ID -> tables.
+	// the generation of the keeper, it's increased atomically when the keeper changed, see `Generation`.
+	// NOTE: keep it as the first field to be 64-bit aligned for atomic operations.
+	generation uint64
+
+	mu       sync.RWMutex
+	tables   map[string]map[string]SourceTables // task-name -> source-ID -> tables.
+	drained  map[string]struct{}                // task-name -> struct{}, tasks which do not accept new tables.
+	revision int64                              // the revision of source tables in etcd reflected, see `Revision`.
 }
 
 // NewTableKeeper creates a new TableKeeper instance.
 func NewTableKeeper() *TableKeeper {
 	return &TableKeeper{
-		tables: make(map[string]map[string]SourceTables),
+		tables:  make(map[string]map[string]SourceTables),
+		drained: make(map[string]struct{}),
 	}
 }
 
-// Init (re-)initializes the keeper with initial source tables.
+// Generation returns the generation of the keeper, it's increased whenever the keeper changed by any mutator,
+// calls which change nothing (e.g. adding an existing table) do not increase it.
+// observers can poll the generation cheaply (without locking the keeper) and only do expensive work when it changed.
+func (tk *TableKeeper) Generation() uint64 {
+	return atomic.LoadUint64(&tk.generation)
+}
+
+// bump increases the generation of the keeper, it should be called when holding the keeper's lock.
+func (tk *TableKeeper) bump() {
+	atomic.AddUint64(&tk.generation, 1)
+}
+
+// Revision returns the revision of source tables in etcd reflected by the keeper,
+// i.e. the revision set by `SetRevision` or the one of the last source tables applied by `Update`, whichever is later.
+// the caller can resume watching source tables with `revision+1`.
+func (tk *TableKeeper) Revision() int64 {
+	tk.mu.RLock()
+	defer tk.mu.RUnlock()
+	return tk.revision
+}
+
+// SetRevision sets the revision of source tables in etcd reflected by the keeper,
+// it's often called after `Init` with the revision got by `GetAllSourceTables`.
+func (tk *TableKeeper) SetRevision(rev int64) {
+	tk.mu.Lock()
+	defer tk.mu.Unlock()
+	tk.revision = rev
+}
+
+// Init (re-)initializes the keeper with initial source tables, deep copies of them are kept.
+// the revision is reset to 0, see `SetRevision`.
+// the generation is increased only if the source tables are different from the current ones.
 func (tk *TableKeeper) Init(stm map[string]map[string]SourceTables) {
 	tk.mu.Lock()
 	defer tk.mu.Unlock()
 
-	tk.tables = make(map[string]map[string]SourceTables)
+	tables := make(map[string]map[string]SourceTables)
 	for task, sts := range stm {
-		if _, ok := tk.tables[task]; !ok {
-			tk.tables[task] = make(map[string]SourceTables)
+		if _, ok := tables[task]; !ok {
+			tables[task] = make(map[string]SourceTables)
 		}
 		for source, st := range sts {
-			tk.tables[task][source] = st
+			tables[task][source] = st.DeepCopy()
+		}
+	}
+	if !equalSourceTablesMap(tk.tables, tables) {
+		tk.bump()
+	}
+	tk.revision = 0
+	tk.tables = tables
+}
+
+// Clone returns a fully independent copy of the keeper, including source tables and drained tasks,
+// source tables are deep copied, see `SourceTables.DeepCopy`.
+func (tk *TableKeeper) Clone() *TableKeeper {
+	tk.mu.RLock()
+	defer tk.mu.RUnlock()
+
+	clone := NewTableKeeper()
+	clone.generation = atomic.LoadUint64(&tk.generation)
+	clone.revision = tk.revision
+	for task, sts := range tk.tables {
+		clone.tables[task] = make(map[string]SourceTables, len(sts))
+		for source, st := range sts {
+			clone.tables[task][source] = st.DeepCopy()
 		}
 	}
+	for task := range tk.drained {
+		clone.drained[task] = struct{}{}
+	}
+	return clone
+}
+
+// DrainTask drains the task, then subsequent `AddTable`, `AddTables` and `Update` (except deletion) for the task
+// are rejected, but `FindTables` keeps working. this is often used when stopping the task.
+func (tk *TableKeeper) DrainTask(task string) {
+	tk.mu.Lock()
+	defer tk.mu.Unlock()
+
+	if _, ok := tk.drained[task]; !ok {
+		tk.drained[task] = struct{}{}
+		tk.bump()
+	}
+}
+
+// UndrainTask reverses `DrainTask` for the task.
+func (tk *TableKeeper) UndrainTask(task string) {
+	tk.mu.Lock()
+	defer tk.mu.Unlock()
+
+	if _, ok := tk.drained[task]; ok {
+		delete(tk.drained, task)
+		tk.bump()
+	}
+}
+
+// IsDrained returns whether the task has been drained.
+func (tk *TableKeeper) IsDrained(task string) bool {
+	tk.mu.RLock()
+	defer tk.mu.RUnlock()
+
+	_, ok := tk.drained[task]
+	return ok
 }
 
 // Update adds/updates tables into the keeper or removes tables from the keeper.
 // it returns whether added/updated or removed.
+// NOTE: adding/updating tables for a drained task is rejected.
+// updating with the same tables (compared by `Hash` and then `Equal`) is skipped, and false is returned.
+// the keeper keeps a deep copy of `st`, so the caller can change `st` after updated.
+// the revision of the keeper is advanced to `st.Revision` (if later) even if nothing updated, see `Revision`.
 func (tk *TableKeeper) Update(st SourceTables) bool {
 	tk.mu.Lock()
 	defer tk.mu.Unlock()
 
+	if st.Revision > tk.revision {
+		tk.revision = st.Revision
+	}
+	st.Revision = 0 // only the keeper's revision is kept.
+
 	if st.IsDeleted {
 		if _, ok := tk.tables[st.Task]; !ok {
 			return false
@@ -146,19 +1641,28 @@ func (tk *TableKeeper) Update(st SourceTables) bool {
 			return false
 		}
 		delete(tk.tables[st.Task], st.Source)
+		tk.bump()
 		return true
 	}
 
+	if _, ok := tk.drained[st.Task]; ok {
+		return false
+	}
 	if _, ok := tk.tables[st.Task]; !ok {
 		tk.tables[st.Task] = make(map[string]SourceTables)
 	}
-	tk.tables[st.Task][st.Source] = st
+	// compare hashes first as a fast path, and confirm with `Equal` to avoid dropping changes for hash collisions.
+	if old, ok := tk.tables[st.Task][st.Source]; ok && old.Hash() == st.Hash() && old.Equal(st) {
+		return false
+	}
+	tk.tables[st.Task][st.Source] = st.DeepCopy()
+	tk.bump()
 	return true
 }
 
 // AddTable adds a table into the source tables.
 // it returns whether added (not exist before).
-// NOTE: we only add for existing task now.
+// NOTE: we only add for existing and not drained task now.
 func (tk *TableKeeper) AddTable(task, source, schema, table string) bool {
 	tk.mu.Lock()
 	defer tk.mu.Unlock()
@@ -166,12 +1670,49 @@ func (tk *TableKeeper) AddTable(task, source, schema, table string) bool {
 	if _, ok := tk.tables[task]; !ok {
 		return false
 	}
+	if _, ok := tk.drained[task]; ok {
+		return false
+	}
 	if _, ok := tk.tables[task][source]; !ok {
 		tk.tables[task][source] = NewSourceTables(task, source, map[string]map[string]struct{}{})
 	}
 	st := tk.tables[task][source]
 	added := st.AddTable(schema, table)
 	tk.tables[task][source] = st // assign the modified SourceTables.
+	if added {
+		tk.bump()
+	}
+	return added
+}
+
+// AddTables adds tables (schema name -> table names) into the source tables.
+// it returns the count of tables added (not exist before).
+// NOTE: we only add for existing task now, same as `AddTable`.
+func (tk *TableKeeper) AddTables(task, source string, tables map[string][]string) (added int) {
+	tk.mu.Lock()
+	defer tk.mu.Unlock()
+
+	if _, ok := tk.tables[task]; !ok {
+		return 0
+	}
+	if _, ok := tk.drained[task]; ok {
+		return 0
+	}
+	st, ok := tk.tables[task][source]
+	if !ok {
+		st = NewSourceTables(task, source, map[string]map[string]struct{}{})
+	}
+	for schema, tbls := range tables {
+		for _, table := range tbls {
+			if st.AddTable(schema, table) {
+				added++
+			}
+		}
+	}
+	if added > 0 {
+		tk.tables[task][source] = st // assign the modified SourceTables, the source is created only if any table added.
+		tk.bump()
+	}
 	return added
 }
 
@@ -190,10 +1731,129 @@ func (tk *TableKeeper) RemoveTable(task, source, schema, table string) bool {
 	st := tk.tables[task][source]
 	removed := st.RemoveTable(schema, table)
 	tk.tables[task][source] = st // assign the modified SourceTables.
+	if removed {
+		tk.bump()
+	}
 	return removed
 }
 
+// MoveTable moves a table from a source to another source under one lock acquisition (like during resharding),
+// so there is no window in which the table belongs to neither source.
+// it returns whether moved, nothing is changed if the table not exists in `fromSource`,
+// `fromSource` is the same as `toSource`, or the task is drained (tables can't be added into it).
+func (tk *TableKeeper) MoveTable(task, fromSource, toSource, schema, table string) bool {
+	tk.mu.Lock()
+	defer tk.mu.Unlock()
+
+	if fromSource == toSource {
+		return false
+	}
+	if _, ok := tk.drained[task]; ok {
+		return false
+	}
+	from, ok := tk.tables[task][fromSource]
+	if !ok || !from.RemoveTable(schema, table) {
+		return false
+	}
+	tk.tables[task][fromSource] = from // assign the modified SourceTables.
+
+	to, ok := tk.tables[task][toSource]
+	if !ok {
+		to = NewSourceTables(task, toSource, map[string]map[string]struct{}{})
+	}
+	to.AddTable(schema, table)
+	tk.tables[task][toSource] = to
+	tk.bump()
+	return true
+}
+
+// ApplyDiff adds and removes tables (in the form of `schema`.`table`, see `SourceTables.Diff`)
+// for the source under one lock acquisition, so other callers never see a partially applied diff.
+// it returns the count of tables actually added (not exist before) and removed (exist before),
+// tables with an invalid name are skipped.
+// NOTE: like `AddTables`, we only add for existing and not drained task, but removing is always allowed.
+func (tk *TableKeeper) ApplyDiff(task, source string, added, removed []string) (addedCnt, removedCnt int) {
+	tk.mu.Lock()
+	defer tk.mu.Unlock()
+
+	if _, ok := tk.tables[task]; !ok {
+		return 0, 0
+	}
+	st, ok := tk.tables[task][source]
+	if !ok {
+		st = NewSourceTables(task, source, map[string]map[string]struct{}{})
+	}
+	for _, name := range removed {
+		schema, table, err := utils.ExtractTable(name)
+		if err == nil && st.RemoveTable(schema, table) {
+			removedCnt++
+		}
+	}
+	if _, drained := tk.drained[task]; !drained {
+		for _, name := range added {
+			schema, table, err := utils.ExtractTable(name)
+			if err == nil && st.AddTable(schema, table) {
+				addedCnt++
+			}
+		}
+	}
+	if ok || addedCnt > 0 {
+		tk.tables[task][source] = st // assign the modified SourceTables.
+	}
+	if addedCnt > 0 || removedCnt > 0 {
+		tk.bump()
+	}
+	return addedCnt, removedCnt
+}
+
+// Compact rebuilds internal maps of the keeper to reclaim memory after many tables added/removed,
+// because maps in Go never shrink. empty schemas and sources without any schema are dropped,
+// but empty tasks are kept (even without any source), because only existing tasks can have tables added later,
+// so the keeper still accepts and rejects the same adds after compacted.
+// the generation is increased only if any empty schema or source dropped.
+func (tk *TableKeeper) Compact() {
+	tk.mu.Lock()
+	defer tk.mu.Unlock()
+
+	var dropped bool
+	tables := make(map[string]map[string]SourceTables, len(tk.tables))
+	for task, stm := range tk.tables {
+		tables[task] = make(map[string]SourceTables, len(stm))
+		for source, st := range stm {
+			clone := st
+			clone.Tables = make(map[string]map[string]struct{}, len(st.Tables))
+			for schema, tbls := range st.Tables {
+				if len(tbls) == 0 {
+					dropped = true
+					continue
+				}
+				clone.Tables[schema] = make(map[string]struct{}, len(tbls))
+				for table := range tbls {
+					clone.Tables[schema][table] = struct{}{}
+				}
+			}
+			if len(clone.Tables) == 0 {
+				dropped = true
+				continue
+			}
+			tables[task][source] = clone
+		}
+	}
+	tk.tables = tables
+
+	drained := make(map[string]struct{}, len(tk.drained))
+	for task := range tk.drained {
+		drained[task] = struct{}{}
+	}
+	tk.drained = drained
+
+	if dropped {
+		tk.bump()
+	}
+}
+
 // FindTables finds source tables by task name.
+// the returned source tables are deep copies, so they can be handed to other goroutines safely.
 func (tk *TableKeeper) FindTables(task string) []SourceTables {
 	tk.mu.RLock()
 	defer tk.mu.RUnlock()
@@ -202,7 +1862,210 @@ func (tk *TableKeeper) FindTables(task string) []SourceTables {
 	if !ok {
 		return nil
 	}
-	return SourceTablesMapToSlice(stm)
+	sts := SourceTablesMapToSlice(stm)
+	for i := range sts {
+		sts[i] = sts[i].DeepCopy()
+	}
+	return sts
+}
+
+// TasksForTable returns the sorted names of tasks which have the upstream table of the source.
+func (tk *TableKeeper) TasksForTable(source, schema, table string) []string {
+	tk.mu.RLock()
+	defer tk.mu.RUnlock()
+
+	tasks := make([]string, 0)
+	for task, stm := range tk.tables {
+		if _, ok := stm[source].Tables[schema][table]; ok {
+			tasks = append(tasks, task)
+		}
+	}
+	sort.Strings(tasks)
+	return tasks
+}
+
+// TaskSource represents a pair of the task name and the upstream source ID.
+type TaskSource struct {
+	Task   string // data migration task name
+	Source string // upstream source ID
+}
+
+// AllSources returns all (task, source) pairs in the keeper, sorted by the task name and then the source ID.
+func (tk *TableKeeper) AllSources() []TaskSource {
+	tk.mu.RLock()
+	defer tk.mu.RUnlock()
+
+	pairs := make([]TaskSource, 0)
+	for task, stm := range tk.tables {
+		for source := range stm {
+			pairs = append(pairs, TaskSource{Task: task, Source: source})
+		}
+	}
+	sort.Slice(pairs, func(i, j int) bool {
+		if pairs[i].Task != pairs[j].Task {
+			return pairs[i].Task < pairs[j].Task
+		}
+		return pairs[i].Source < pairs[j].Source
+	})
+	return pairs
+}
+
+// Checkpoint puts a snapshot of all source tables, drained tasks and the revision of the keeper into etcd as a checkpoint.
+// it returns the revision of source tables the snapshot reflects (see `Revision`), not the revision of putting the checkpoint,
+// the caller can resume watching source tables with `revision+1` after loading the checkpoint by `LoadTableKeeperCheckpoint`.
+func (tk *TableKeeper) Checkpoint(cli etcdutil.KVClient) (int64, error) {
+	tk.mu.RLock()
+	state := tk.state()
+	value, err := json.Marshal(state)
+	tk.mu.RUnlock()
+	if err != nil {
+		return 0, err
+	}
+
+	key := common.ShardDDLOptimismTableKeeperCheckpointKeyAdapter.Encode()
+	_, _, err = etcdutil.DoOpsInOneTxnWithRetry(cli, clientv3.OpPut(key, string(value)))
+	return state.Revision, err
+}
+
+// DebugHandler returns a HTTP handler rendering all source tables and drained tasks in the keeper as JSON.
+// it's often registered as a debug endpoint (like pprof) to inspect the live state.
+func (tk *TableKeeper) DebugHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		data, err := tk.marshalState()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		writeDebugData(w, data)
+	})
+}
+
+// writeDebugJSON writes `v` as JSON to the response of a debug HTTP handler.
+func writeDebugJSON(w http.ResponseWriter, v interface{}) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	writeDebugData(w, data)
+}
+
+// writeDebugData writes the JSON data to the response of a debug HTTP handler.
+func writeDebugData(w http.ResponseWriter, data []byte) {
+	w.Header().Set("Content-Type", "application/json")
+	if _, err := w.Write(data); err != nil {
+		log.L().Error("write debug response", log.ShortError(err))
+	}
+}
+
+// tableKeeperState represents the full state of TableKeeper in JSON,
+// it's stable because keys of maps are sorted by `encoding/json` and drained tasks are sorted.
+type tableKeeperState struct {
+	Tables   map[string]map[string]SourceTables `json:"tables"`
+	Drained  []string                           `json:"drained"`
+	Revision int64                              `json:"revision"`
+}
+
+// marshalState returns the JSON represent of the full state of the keeper.
+func (tk *TableKeeper) marshalState() ([]byte, error) {
+	tk.mu.RLock()
+	defer tk.mu.RUnlock()
+	// marshal while holding the read lock to get a consistent snapshot.
+	return json.Marshal(tk.state())
+}
+
+// state returns the full state of the keeper, it should be called when holding the keeper's lock.
+// NOTE: source tables are shared with the keeper, so the state should be marshaled before releasing the lock.
+func (tk *TableKeeper) state() tableKeeperState {
+	return tableKeeperState{
+		Tables:   tk.tables,
+		Drained:  sortedKeys(tk.drained),
+		Revision: tk.revision,
+	}
+}
+
+// WriteTo writes the full state of the keeper (source tables, drained tasks and the revision) into `w` in JSON,
+// it implements `io.WriterTo`, and the state can be read back by `ReadTableKeeper`.
+// this is often used to snapshot the keeper to a file for offline analysis or backup.
+func (tk *TableKeeper) WriteTo(w io.Writer) (int64, error) {
+	data, err := tk.marshalState()
+	if err != nil {
+		return 0, err
+	}
+	n, err := w.Write(data)
+	return int64(n), err
+}
+
+// ReadTableKeeper reads the full state of a keeper written by `TableKeeper.WriteTo` from `r`,
+// and returns a new keeper with the state, which is `Equal` to the written one.
+func ReadTableKeeper(r io.Reader) (*TableKeeper, error) {
+	var state tableKeeperState
+	if err := json.NewDecoder(r).Decode(&state); err != nil {
+		return nil, err
+	}
+	return newTableKeeperFromState(state), nil
+}
+
+// newTableKeeperFromState creates a new keeper with the full state.
+func newTableKeeperFromState(state tableKeeperState) *TableKeeper {
+	tk := NewTableKeeper()
+	tk.Init(state.Tables)
+	for _, task := range state.Drained {
+		tk.drained[task] = struct{}{}
+	}
+	tk.revision = state.Revision
+	return tk
+}
+
+// Equal returns whether two keepers have the same source tables and drained tasks, generations and revisions are not compared.
+func (tk *TableKeeper) Equal(other *TableKeeper) bool {
+	if tk == other {
+		return true
+	}
+	// compare snapshots to avoid holding locks of both keepers at the same time.
+	tk, other = tk.Clone(), other.Clone()
+
+	return reflect.DeepEqual(tk.drained, other.drained) && equalSourceTablesMap(tk.tables, other.tables)
+}
+
+// equalSourceTablesMap returns whether two task-name -> source-ID -> tables maps have the same tasks, sources and tables.
+func equalSourceTablesMap(a, b map[string]map[string]SourceTables) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for task, sts := range a {
+		sts2, ok := b[task]
+		if !ok || len(sts) != len(sts2) {
+			return false
+		}
+		for source, st := range sts {
+			if st2, ok := sts2[source]; !ok || !st.Equal(st2) {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// LoadTableKeeperCheckpoint loads the checkpoint of the table keeper from etcd.
+// it returns the restored keeper, the revision of source tables the checkpoint reflects and whether the checkpoint exists.
+// if the checkpoint not exists, the caller should fallback to `GetAllSourceTables`.
+func LoadTableKeeperCheckpoint(cli etcdutil.KVClient) (*TableKeeper, int64, bool, error) {
+	key := common.ShardDDLOptimismTableKeeperCheckpointKeyAdapter.Encode()
+	respTxn, _, err := etcdutil.DoOpsInOneTxnWithRetry(cli, clientv3.OpGet(key))
+	if err != nil {
+		return nil, 0, false, err
+	}
+	resp := respTxn.Responses[0].GetResponseRange()
+	if resp.Count == 0 {
+		return nil, resp.Header.Revision, false, nil
+	}
+
+	var state tableKeeperState
+	if err = json.Unmarshal(resp.Kvs[0].Value, &state); err != nil {
+		return nil, 0, false, err
+	}
+	return newTableKeeperFromState(state), state.Revision, true, nil
 }
 
 // SourceTablesMapToSlice converts a map[string]SourceTables to []SourceTables.
@@ -14,9 +14,29 @@
 package optimism
 
 import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
 	. "github.com/pingcap/check"
+	"github.com/pingcap/errors"
 	"github.com/pingcap/parser"
+	"github.com/pingcap/parser/ast"
+	"github.com/pingcap/parser/model"
+	"github.com/pingcap/tidb-tools/pkg/schemacmp"
 	"github.com/pingcap/tidb/util/mock"
+	"go.etcd.io/etcd/clientv3"
+	"go.etcd.io/etcd/mvcc/mvccpb"
+
+	"github.com/pingcap/dm/pkg/etcdutil"
+	"github.com/pingcap/dm/pkg/terror"
+	"github.com/pingcap/dm/pkg/utils"
 )
 
 type testKeeper struct{}
@@ -100,112 +120,3416 @@ func (t *testKeeper) TestLockKeeper(c *C) {
 	c.Assert(locks, HasLen, 2)
 	c.Assert(locks[lockID1], Equals, lock1) // compare pointer
 	c.Assert(locks[lockID2], Equals, lock2)
+	c.Assert(lk.LockIDs(), DeepEquals, []string{lockID1, lockID2})
 
 	// remove lock.
 	c.Assert(lk.RemoveLock(lockID1), IsTrue)
 	c.Assert(lk.RemoveLock(lockIDNotExists), IsFalse)
 	c.Assert(lk.Locks(), HasLen, 1)
+	c.Assert(lk.LockIDs(), DeepEquals, []string{lockID2})
 
 	// clear locks.
 	lk.Clear()
 
 	// no locks exist.
 	c.Assert(lk.Locks(), HasLen, 0)
+	c.Assert(lk.LockIDs(), HasLen, 0)
 }
 
-func (t *testKeeper) TestTableKeeper(c *C) {
+func (t *testKeeper) TestLockKeeperTrySyncResult(c *C) {
 	var (
-		tk      = NewTableKeeper()
-		task1   = "task-1"
-		task2   = "task-2"
-		source1 = "mysql-replica-1"
-		source2 = "mysql-replica-2"
-		st11    = NewSourceTables(task1, source1, map[string]map[string]struct{}{
-			"db": {"tbl-1": struct{}{}, "tbl-2": struct{}{}},
-		})
-		st12 = NewSourceTables(task1, source2, map[string]map[string]struct{}{
-			"db": {"tbl-1": struct{}{}, "tbl-2": struct{}{}},
-		})
-		st21 = NewSourceTables(task2, source2, map[string]map[string]struct{}{
-			"db": {"tbl-3": struct{}{}},
-		})
-		st22 = NewSourceTables(task2, source2, map[string]map[string]struct{}{
-			"db": {"tbl-3": struct{}{}, "tbl-4": struct{}{}},
-		})
-		stm = map[string]map[string]SourceTables{
-			task1: {source2: st12, source1: st11},
+		lk         = NewLockKeeper()
+		upSchema   = "foo_1"
+		upTable    = "bar_1"
+		downSchema = "foo"
+		downTable  = "bar"
+		DDLs1      = []string{"ALTER TABLE bar ADD COLUMN c1 INT"}
+		DDLs2      = []string{"ALTER TABLE bar ADD COLUMN c1 TEXT"}
+		task       = "task"
+		source1    = "mysql-replica-1"
+		source2    = "mysql-replica-2"
+
+		p              = parser.New()
+		se             = mock.NewContext()
+		tblID    int64 = 111
+		tiBefore       = createTableInfo(c, p, se, tblID, `CREATE TABLE bar (id INT PRIMARY KEY)`)
+		tiAfter1       = createTableInfo(c, p, se, tblID, `CREATE TABLE bar (id INT PRIMARY KEY, c1 INT)`)
+		tiAfter2       = createTableInfo(c, p, se, tblID, `CREATE TABLE bar (id INT PRIMARY KEY, c1 TEXT)`)
+
+		i1 = NewInfo(task, source1, upSchema, upTable, downSchema, downTable, DDLs1, tiBefore, tiAfter1)
+		i2 = NewInfo(task, source2, upSchema, upTable, downSchema, downTable, DDLs2, tiBefore, tiAfter2)
+
+		sts = []SourceTables{
+			NewSourceTables(task, source1, map[string]map[string]struct{}{upSchema: {upTable: struct{}{}}}),
+			NewSourceTables(task, source2, map[string]map[string]struct{}{upSchema: {upTable: struct{}{}}}),
 		}
 	)
 
-	// no tables exist before Init/Update.
-	c.Assert(tk.FindTables(task1), IsNil)
+	// source2 is pending after source1 synced.
+	res, err := lk.TrySyncResult(i1, sts)
+	c.Assert(err, IsNil)
+	c.Assert(res.LockID, Equals, "task-`foo`.`bar`")
+	c.Assert(res.DDLs, DeepEquals, DDLs1)
+	c.Assert(res.Resolved, IsFalse)
+	c.Assert(res.PendingSources, DeepEquals, []string{source2})
+	c.Assert(res.Conflict, IsNil)
 
-	// Init with `nil` is fine.
-	tk.Init(nil)
-	c.Assert(tk.FindTables(task1), IsNil)
+	// conflict detected for source2.
+	res, err = lk.TrySyncResult(i2, sts)
+	c.Assert(terror.ErrShardDDLOptimismTrySyncFail.Equal(err), IsTrue)
+	c.Assert(res.LockID, Equals, "task-`foo`.`bar`")
+	c.Assert(res.DDLs, HasLen, 0)
+	c.Assert(res.Resolved, IsFalse)
+	c.Assert(res.PendingSources, DeepEquals, []string{source2})
+	c.Assert(res.Conflict, NotNil)
+	c.Assert(res.Conflict.Source, Equals, source2)
+	c.Assert(res.Conflict.UpSchema, Equals, upSchema)
+	c.Assert(res.Conflict.UpTable, Equals, upTable)
+	c.Assert(res.Conflict.DDLs, DeepEquals, DDLs2)
+	c.Assert(res.Conflict.Type, Equals, ConflictTypeColumnType)
+	c.Assert(res.Conflict.Msg, Equals, err.Error())
+}
 
-	// tables for task1 exit after Init.
-	tk.Init(stm)
-	sts := tk.FindTables(task1)
-	c.Assert(sts, HasLen, 2)
-	c.Assert(sts[0], DeepEquals, st11)
-	c.Assert(sts[1], DeepEquals, st12)
+func (t *testKeeper) TestLockKeeperTrySyncOutOfOrder(c *C) {
+	var (
+		lk         = NewLockKeeper()
+		upSchema   = "foo_1"
+		upTable    = "bar_1"
+		downSchema = "foo"
+		downTable  = "bar"
+		DDLs1      = []string{"ALTER TABLE bar ADD COLUMN c1 INT"}
+		DDLs2      = []string{"ALTER TABLE bar ADD COLUMN c2 INT"}
+		task       = "task"
+		source1    = "mysql-replica-1"
+		source2    = "mysql-replica-2"
 
-	// adds new tables.
-	c.Assert(tk.Update(st21), IsTrue)
-	sts = tk.FindTables(task2)
-	c.Assert(sts, HasLen, 1)
-	c.Assert(sts[0], DeepEquals, st21)
+		p           = parser.New()
+		se          = mock.NewContext()
+		tblID int64 = 111
+		ti0         = createTableInfo(c, p, se, tblID, `CREATE TABLE bar (id INT PRIMARY KEY)`)
+		ti1         = createTableInfo(c, p, se, tblID, `CREATE TABLE bar (id INT PRIMARY KEY, c1 INT)`)
+		ti2         = createTableInfo(c, p, se, tblID, `CREATE TABLE bar (id INT PRIMARY KEY, c1 INT, c2 INT)`)
 
-	// updates/appends new tables.
-	c.Assert(tk.Update(st22), IsTrue)
-	sts = tk.FindTables(task2)
-	c.Assert(sts, HasLen, 1)
-	c.Assert(sts[0], DeepEquals, st22)
+		i11 = NewInfo(task, source1, upSchema, upTable, downSchema, downTable, DDLs1, ti0, ti1)
+		i12 = NewInfo(task, source1, upSchema, upTable, downSchema, downTable, DDLs2, ti1, ti2)
+		i21 = NewInfo(task, source2, upSchema, upTable, downSchema, downTable, DDLs1, ti0, ti1)
 
-	// deletes tables.
-	st22.IsDeleted = true
-	c.Assert(tk.Update(st22), IsTrue)
-	c.Assert(tk.FindTables(task2), IsNil)
+		sts = []SourceTables{
+			NewSourceTables(task, source1, map[string]map[string]struct{}{upSchema: {upTable: struct{}{}}}),
+			NewSourceTables(task, source2, map[string]map[string]struct{}{upSchema: {upTable: struct{}{}}}),
+		}
+	)
+	i11.Seq = 1
+	i12.Seq = 2
+	i21.Seq = 1
 
-	// try to delete, but not exist.
-	c.Assert(tk.Update(st22), IsFalse)
-	st22.Task = "not-exist"
-	c.Assert(tk.Update(st22), IsFalse)
+	// the second DDL of source1 arrives first.
+	res, err := lk.TrySyncResult(i12, sts)
+	c.Assert(err, IsNil)
+	c.Assert(res.DDLs, DeepEquals, DDLs2)
 
-	// tables for task1 not affected.
-	sts = tk.FindTables(task1)
-	c.Assert(sts, HasLen, 2)
-	c.Assert(sts[0], DeepEquals, st11)
-	c.Assert(sts[1], DeepEquals, st12)
+	// the first DDL of source1 with a decreasing sequence number is rejected.
+	res, err = lk.TrySyncResult(i11, sts)
+	c.Assert(terror.ErrShardDDLOptimismOutOfOrderDDL.Equal(err), IsTrue)
+	c.Assert(res.DDLs, HasLen, 0)
+	c.Assert(res.Conflict, IsNil)
+	catchUpDDLs, err := lk.FindLock(res.LockID).CatchUpDDLs(source1, upSchema, upTable)
+	c.Assert(err, IsNil)
+	c.Assert(catchUpDDLs, HasLen, 0) // the table info of source1 is not reverted.
 
-	// add a table for st11.
-	c.Assert(tk.AddTable(task1, st11.Source, "db-2", "tbl-3"), IsTrue)
-	c.Assert(tk.AddTable(task1, st11.Source, "db-2", "tbl-3"), IsFalse)
-	sts = tk.FindTables(task1)
-	st11n := sts[0]
-	c.Assert(st11n.Tables, HasKey, "db-2")
-	c.Assert(st11n.Tables["db-2"], HasKey, "tbl-3")
+	// re-sync the same sequence number is fine.
+	_, err = lk.TrySyncResult(i12, sts)
+	c.Assert(err, IsNil)
 
-	// removed the added table in st11.
-	c.Assert(tk.RemoveTable(task1, st11.Source, "db-2", "tbl-3"), IsTrue)
-	c.Assert(tk.RemoveTable(task1, st11.Source, "db-2", "tbl-3"), IsFalse)
-	sts = tk.FindTables(task1)
-	st11n = sts[0]
-	c.Assert(st11n.Tables["db-2"], IsNil)
+	// sequence numbers are kept per table, source2 is not affected.
+	_, err = lk.TrySyncResult(i21, sts)
+	c.Assert(err, IsNil)
 
-	// adds for not existing task takes no effect.
-	c.Assert(tk.AddTable("not-exist", st11.Source, "db-2", "tbl-3"), IsFalse)
-	// adds for not existing source takes effect.
-	c.Assert(tk.AddTable(task1, "new-source", "db-2", "tbl-3"), IsTrue)
-	sts = tk.FindTables(task1)
-	c.Assert(sts, HasLen, 3)
-	c.Assert(sts[2].Source, Equals, "new-source")
-	c.Assert(sts[2].Tables["db-2"], HasKey, "tbl-3")
+	// info without a sequence number is not checked.
+	i11.Seq = 0
+	_, err = lk.TrySyncResult(i11, sts)
+	c.Assert(err, IsNil)
+}
 
-	// removes for not existing task/source takes no effect.
-	c.Assert(tk.RemoveTable("not-exit", st12.Source, "db", "tbl-1"), IsFalse)
-	c.Assert(tk.RemoveTable(task1, "not-exit", "db", "tbl-1"), IsFalse)
-	sts = tk.FindTables(task1)
-	c.Assert(sts[1], DeepEquals, st12)
+func (t *testKeeper) TestLockKeeperTrySyncBatch(c *C) {
+	var (
+		lk         = NewLockKeeper()
+		upSchema   = "foo_1"
+		upTable    = "bar_1"
+		downSchema = "foo"
+		downTable  = "bar"
+		DDLs1      = []string{"ALTER TABLE bar ADD COLUMN c1 INT"}
+		DDLs2      = []string{"ALTER TABLE bar ADD COLUMN c1 TEXT"}
+		task       = "task"
+		source1    = "mysql-replica-1"
+		source2    = "mysql-replica-2"
+		source3    = "mysql-replica-3"
+
+		p           = parser.New()
+		se          = mock.NewContext()
+		tblID int64 = 111
+		ti0         = createTableInfo(c, p, se, tblID, `CREATE TABLE bar (id INT PRIMARY KEY)`)
+		ti1         = createTableInfo(c, p, se, tblID, `CREATE TABLE bar (id INT PRIMARY KEY, c1 INT)`)
+		ti2         = createTableInfo(c, p, se, tblID, `CREATE TABLE bar (id INT PRIMARY KEY, c1 TEXT)`)
+
+		i1 = NewInfo(task, source1, upSchema, upTable, downSchema, downTable, DDLs1, ti0, ti1)
+		i2 = NewInfo(task, source2, upSchema, upTable, downSchema, downTable, DDLs2, ti0, ti2)
+		i3 = NewInfo(task, source3, upSchema, upTable, downSchema, downTable, DDLs1, ti0, ti1)
+
+		tables = map[string]map[string]struct{}{upSchema: {upTable: struct{}{}}}
+		sts    = []SourceTables{
+			NewSourceTables(task, source1, tables),
+			NewSourceTables(task, source2, tables),
+			NewSourceTables(task, source3, tables),
+		}
+	)
+
+	// empty batch.
+	results, err := lk.TrySyncBatch(nil)
+	c.Assert(err, IsNil)
+	c.Assert(results, HasLen, 0)
+
+	// a conflict for the second item does not abort the rest.
+	results, err = lk.TrySyncBatch([]SyncItem{{i1, sts}, {i2, sts}, {i3, sts}})
+	c.Assert(err, IsNil)
+	c.Assert(results, HasLen, 3)
+	c.Assert(results[0].DDLs, DeepEquals, DDLs1)
+	c.Assert(results[0].Conflict, IsNil)
+	c.Assert(results[1].DDLs, HasLen, 0)
+	c.Assert(results[1].Conflict, NotNil)
+	c.Assert(results[1].Conflict.Source, Equals, source2)
+	c.Assert(results[2].DDLs, DeepEquals, DDLs1)
+	c.Assert(results[2].Conflict, IsNil)
+	c.Assert(results[2].PendingSources, DeepEquals, []string{source2})
+
+	// an out-of-order item aborts the rest.
+	i1.Seq, i3.Seq = 2, 1
+	results, err = lk.TrySyncBatch([]SyncItem{{i1, sts}, {i3, sts}})
+	c.Assert(err, IsNil)
+	c.Assert(results, HasLen, 2)
+	i1.Seq = 1
+	results, err = lk.TrySyncBatch([]SyncItem{{i1, sts}, {i3, sts}})
+	c.Assert(terror.ErrShardDDLOptimismOutOfOrderDDL.Equal(err), IsTrue)
+	c.Assert(results, HasLen, 1)
+}
+
+func (t *testKeeper) TestLockKeeperTrySyncAutoIncrement(c *C) {
+	var (
+		lk         = NewLockKeeper()
+		upSchema   = "foo_1"
+		upTable    = "bar_1"
+		downSchema = "foo"
+		downTable  = "bar"
+		DDLs       = []string{"ALTER TABLE bar AUTO_INCREMENT = 1000"}
+		task       = "test-lock-keeper-auto-increment"
+		source1    = "mysql-replica-1"
+		source2    = "mysql-replica-2"
+
+		p           = parser.New()
+		se          = mock.NewContext()
+		tblID int64 = 111
+		ti0         = createTableInfo(c, p, se, tblID, `CREATE TABLE bar (id INT AUTO_INCREMENT PRIMARY KEY)`)
+		ti1         = createTableInfo(c, p, se, tblID, `CREATE TABLE bar (id INT AUTO_INCREMENT PRIMARY KEY) AUTO_INCREMENT = 1000`)
+
+		tables = map[string]map[string]struct{}{upSchema: {upTable: struct{}{}}}
+		sts    = []SourceTables{
+			NewSourceTables(task, source1, tables),
+			NewSourceTables(task, source2, tables),
+		}
+		i1 = NewInfo(task, source1, upSchema, upTable, downSchema, downTable, DDLs, ti0, ti1)
+	)
+
+	// resetting the auto-increment value in one source does not block other sources, no lock created for it.
+	lockID, newDDLs, err := lk.TrySync(i1, sts)
+	c.Assert(err, IsNil)
+	c.Assert(newDDLs, DeepEquals, []string{})
+	c.Assert(lk.FindLock(lockID), IsNil)
+	_, pending, conflicted := lk.LocksByState()
+	c.Assert(pending, HasLen, 0)
+	c.Assert(conflicted, HasLen, 0)
+	c.Assert(lk.AllPendingDDLs(), HasLen, 0)
+}
+
+func (t *testKeeper) TestLockKeeperTrySyncWarnings(c *C) {
+	var (
+		lk         = NewLockKeeper()
+		upSchema   = "foo_1"
+		upTable    = "bar_1"
+		downSchema = "foo"
+		downTable  = "bar"
+		DDLs1      = []string{"ALTER TABLE bar ADD COLUMN c1 INT"}
+		DDLs2      = []string{"ALTER TABLE bar COMMENT = 'new comment'"}
+		task       = "test-lock-keeper-warnings"
+		source1    = "mysql-replica-1"
+		source2    = "mysql-replica-2"
+
+		p           = parser.New()
+		se          = mock.NewContext()
+		tblID int64 = 111
+		ti0         = createTableInfo(c, p, se, tblID, `CREATE TABLE bar (id INT PRIMARY KEY)`)
+		ti1         = createTableInfo(c, p, se, tblID, `CREATE TABLE bar (id INT PRIMARY KEY, c1 INT)`)
+		ti2         = createTableInfo(c, p, se, tblID, `CREATE TABLE bar (id INT PRIMARY KEY, c1 INT) COMMENT = 'new comment'`)
+
+		tables = map[string]map[string]struct{}{upSchema: {upTable: struct{}{}}}
+		st1    = NewSourceTables(task, source1, tables)
+		st2    = NewSourceTables(task, source2, tables)
+		i11    = NewInfo(task, source1, upSchema, upTable, downSchema, downTable, DDLs1, ti0, ti1)
+		i12    = NewInfo(task, source1, upSchema, upTable, downSchema, downTable, DDLs2, ti1, ti2)
+		i21    = NewInfo(task, source2, upSchema, upTable, downSchema, downTable, DDLs1, ti0, ti1)
+	)
+
+	// no warnings for a normal DDL.
+	res, err := lk.TrySyncResult(i11, []SourceTables{st1})
+	c.Assert(err, IsNil)
+	c.Assert(res.DDLs, DeepEquals, DDLs1)
+	c.Assert(res.Warnings, HasLen, 0)
+
+	// a late-joining source caught up with the joined schema.
+	res, err = lk.TrySyncResult(i21, []SourceTables{st1, st2})
+	c.Assert(err, IsNil)
+	c.Assert(res.DDLs, DeepEquals, DDLs1) // warnings don't change the result.
+	c.Assert(res.PendingSources, HasLen, 0)
+	c.Assert(res.Warnings, HasLen, 1)
+	c.Assert(res.Warnings[0], Matches, ".*source mysql-replica-2 joined the lock late and caught up.*")
+
+	// the table is not late-joining any more.
+	res, err = lk.TrySyncResult(i21, []SourceTables{st1, st2})
+	c.Assert(err, IsNil)
+	c.Assert(res.Warnings, HasLen, 0)
+
+	// no-op DDLs skipped.
+	res, err = lk.TrySyncResult(i12, []SourceTables{st1, st2})
+	c.Assert(err, IsNil)
+	c.Assert(res.DDLs, DeepEquals, []string{})
+	c.Assert(res.Warnings, HasLen, 1)
+	c.Assert(res.Warnings[0], Matches, ".*are no-ops for the downstream and skipped")
+	c.Assert(lk.FindLock(res.LockID).Warnings(), DeepEquals, res.Warnings)
+	// no-op DDLs are not tracked as pending DDLs.
+	for _, ddls := range lk.AllPendingDDLs() {
+		for _, ddl := range ddls {
+			c.Assert(ddl, Not(Matches), ".*COMMENT.*")
+		}
+	}
+}
+
+func (t *testKeeper) TestLockKeeperSourceLiveness(c *C) {
+	var (
+		lk         = NewLockKeeper()
+		upSchema   = "foo_1"
+		upTable    = "bar_1"
+		downSchema = "foo"
+		downTable  = "bar"
+		DDLs       = []string{"ALTER TABLE bar ADD COLUMN c1 INT"}
+		task       = "test-lock-keeper-source-liveness"
+		source1    = "mysql-replica-1"
+		source2    = "mysql-replica-2"
+
+		p           = parser.New()
+		se          = mock.NewContext()
+		tblID int64 = 111
+		ti0         = createTableInfo(c, p, se, tblID, `CREATE TABLE bar (id INT PRIMARY KEY)`)
+		ti1         = createTableInfo(c, p, se, tblID, `CREATE TABLE bar (id INT PRIMARY KEY, c1 INT)`)
+
+		tables = map[string]map[string]struct{}{upSchema: {upTable: struct{}{}}}
+		sts    = []SourceTables{
+			NewSourceTables(task, source1, tables),
+			NewSourceTables(task, source2, tables),
+		}
+		i1 = NewInfo(task, source1, upSchema, upTable, downSchema, downTable, DDLs, ti0, ti1)
+		i2 = NewInfo(task, source2, upSchema, upTable, downSchema, downTable, DDLs, ti0, ti1)
+
+		events []LockEvent
+	)
+	lk.SetEventSink(func(ev LockEvent) {
+		events = append(events, ev)
+	})
+
+	// the dead source blocks the lock.
+	res, err := lk.TrySyncResult(i1, sts)
+	c.Assert(err, IsNil)
+	c.Assert(res.PendingSources, DeepEquals, []string{source2})
+	l := lk.FindLock(res.LockID)
+	c.Assert(l.TryMarkDone(source1, upSchema, upTable), IsTrue)
+	c.Assert(l.IsResolved(), IsFalse)
+
+	// the dead source no longer blocks the lock.
+	c.Assert(lk.IsSourceAlive(source2), IsTrue)
+	events = nil
+	lk.SetSourceLiveness(source2, false)
+	c.Assert(lk.IsSourceAlive(source2), IsFalse)
+	synced, remain := l.IsSynced()
+	c.Assert(synced, IsTrue)
+	c.Assert(remain, Equals, 0)
+	c.Assert(l.PendingSources(), HasLen, 0)
+	c.Assert(l.IsResolved(), IsTrue)
+	c.Assert(events, HasLen, 2)
+	c.Assert(events[0].Type, Equals, LockEventSynced)
+	c.Assert(events[1].Type, Equals, LockEventResolved)
+
+	// marking dead again changes nothing.
+	events = nil
+	lk.SetSourceLiveness(source2, false)
+	c.Assert(events, HasLen, 0)
+
+	// new locks also skip the dead source.
+	i1b := NewInfo(task, source1, upSchema, upTable, downSchema, "bar-2", DDLs, ti0, ti1)
+	res, err = lk.TrySyncResult(i1b, sts)
+	c.Assert(err, IsNil)
+	c.Assert(res.PendingSources, HasLen, 0)
+
+	// the source marked alive blocks the lock again.
+	lk.SetSourceLiveness(source2, true)
+	c.Assert(lk.IsSourceAlive(source2), IsTrue)
+	c.Assert(l.PendingSources(), DeepEquals, []string{source2})
+	c.Assert(l.IsResolved(), IsFalse)
+
+	// the dead source is marked alive after it reports again.
+	lk.SetSourceLiveness(source2, false)
+	res, err = lk.TrySyncResult(i2, sts)
+	c.Assert(err, IsNil)
+	c.Assert(lk.IsSourceAlive(source2), IsTrue)
+	c.Assert(res.PendingSources, HasLen, 0)
+	c.Assert(lk.FindLock(i1b.Task+"-`foo`.`bar-2`").PendingSources(), DeepEquals, []string{source2})
+	c.Assert(l.IsResolved(), IsFalse)
+	c.Assert(l.TryMarkDone(source2, upSchema, upTable), IsTrue)
+	c.Assert(l.IsResolved(), IsTrue)
+}
+
+func (t *testKeeper) TestLockKeeperLocksByState(c *C) {
+	var (
+		lk         = NewLockKeeper()
+		upSchema   = "foo_1"
+		upTable    = "bar_1"
+		downSchema = "foo"
+		downTable  = "bar"
+		DDLs1      = []string{"ALTER TABLE bar ADD COLUMN c1 INT"}
+		DDLs2      = []string{"ALTER TABLE bar ADD COLUMN c1 TEXT"}
+		task1      = "task1"
+		task2      = "task2"
+		task3      = "task3"
+		source1    = "mysql-replica-1"
+		source2    = "mysql-replica-2"
+
+		p           = parser.New()
+		se          = mock.NewContext()
+		tblID int64 = 111
+		ti0         = createTableInfo(c, p, se, tblID, `CREATE TABLE bar (id INT PRIMARY KEY)`)
+		ti1         = createTableInfo(c, p, se, tblID, `CREATE TABLE bar (id INT PRIMARY KEY, c1 INT)`)
+		ti2         = createTableInfo(c, p, se, tblID, `CREATE TABLE bar (id INT PRIMARY KEY, c1 TEXT)`)
+
+		tables = map[string]map[string]struct{}{upSchema: {upTable: struct{}{}}}
+		sts    = func(task string) []SourceTables {
+			return []SourceTables{
+				NewSourceTables(task, source1, tables),
+				NewSourceTables(task, source2, tables),
+			}
+		}
+	)
+
+	// no locks.
+	synced, pending, conflicted := lk.LocksByState()
+	c.Assert(synced, HasLen, 0)
+	c.Assert(pending, HasLen, 0)
+	c.Assert(conflicted, HasLen, 0)
+
+	// task1: synced.
+	_, _, err := lk.TrySync(NewInfo(task1, source1, upSchema, upTable, downSchema, downTable, DDLs1, ti0, ti1), sts(task1))
+	c.Assert(err, IsNil)
+	_, _, err = lk.TrySync(NewInfo(task1, source2, upSchema, upTable, downSchema, downTable, DDLs1, ti0, ti1), sts(task1))
+	c.Assert(err, IsNil)
+	// task2: pending.
+	_, _, err = lk.TrySync(NewInfo(task2, source1, upSchema, upTable, downSchema, downTable, DDLs1, ti0, ti1), sts(task2))
+	c.Assert(err, IsNil)
+	// task3: conflicted.
+	_, _, err = lk.TrySync(NewInfo(task3, source1, upSchema, upTable, downSchema, downTable, DDLs1, ti0, ti1), sts(task3))
+	c.Assert(err, IsNil)
+	_, _, err = lk.TrySync(NewInfo(task3, source2, upSchema, upTable, downSchema, downTable, DDLs2, ti0, ti2), sts(task3))
+	c.Assert(terror.ErrShardDDLOptimismTrySyncFail.Equal(err), IsTrue)
+
+	synced, pending, conflicted = lk.LocksByState()
+	c.Assert(synced, HasLen, 1)
+	c.Assert(synced[0].ID, Equals, "task1-`foo`.`bar`")
+	c.Assert(synced[0].Conflict(), Equals, ConflictTypeNone)
+	c.Assert(pending, HasLen, 1)
+	c.Assert(pending[0].ID, Equals, "task2-`foo`.`bar`")
+	c.Assert(conflicted, HasLen, 1)
+	c.Assert(conflicted[0].ID, Equals, "task3-`foo`.`bar`")
+	c.Assert(conflicted[0].Conflict(), Equals, ConflictTypeColumnType)
+
+	// the conflict for task3 resolved, but still pending.
+	_, _, err = lk.TrySync(NewInfo(task3, source2, upSchema, upTable, downSchema, downTable, []string{}, ti2, ti0), sts(task3))
+	c.Assert(err, IsNil)
+	synced, pending, conflicted = lk.LocksByState()
+	c.Assert(synced, HasLen, 1)
+	c.Assert(pending, HasLen, 2)
+	c.Assert(pending[1].ID, Equals, "task3-`foo`.`bar`")
+	c.Assert(pending[1].Conflict(), Equals, ConflictTypeNone)
+	c.Assert(conflicted, HasLen, 0)
+}
+
+func (t *testKeeper) TestLockKeeperRemoveSourceFromLocks(c *C) {
+	var (
+		lk         = NewLockKeeper()
+		upSchema   = "foo_1"
+		upTable    = "bar_1"
+		downSchema = "foo"
+		downTable  = "bar"
+		DDLs       = []string{"ALTER TABLE bar ADD COLUMN c1 INT"}
+		task1      = "task1"
+		task2      = "task2"
+		source1    = "mysql-replica-1"
+		source2    = "mysql-replica-2"
+
+		p           = parser.New()
+		se          = mock.NewContext()
+		tblID int64 = 111
+		ti0         = createTableInfo(c, p, se, tblID, `CREATE TABLE bar (id INT PRIMARY KEY)`)
+		ti1         = createTableInfo(c, p, se, tblID, `CREATE TABLE bar (id INT PRIMARY KEY, c1 INT)`)
+
+		tables = map[string]map[string]struct{}{upSchema: {upTable: struct{}{}}}
+		sts    = func(task string) []SourceTables {
+			return []SourceTables{
+				NewSourceTables(task, source1, tables),
+				NewSourceTables(task, source2, tables),
+			}
+		}
+	)
+
+	// source1 synced and done for both tasks, source2 is pending.
+	for _, task := range []string{task1, task2} {
+		lockID, _, err := lk.TrySync(NewInfo(task, source1, upSchema, upTable, downSchema, downTable, DDLs, ti0, ti1), sts(task))
+		c.Assert(err, IsNil)
+		c.Assert(lk.FindLock(lockID).TryMarkDone(source1, upSchema, upTable), IsTrue)
+		c.Assert(lk.FindLock(lockID).IsResolved(), IsFalse)
+	}
+
+	// remove the last pending source for task1, the lock becomes synced and resolved.
+	var (
+		events []LockEvent
+		pre    []*Lock
+	)
+	lk.SetEventSink(func(ev LockEvent) {
+		events = append(events, ev)
+	})
+	lk.SetPreResolve(func(l *Lock) {
+		pre = append(pre, l)
+	})
+	c.Assert(lk.RemoveSourceFromLocks(task1, source2), DeepEquals, []string{"task1-`foo`.`bar`"})
+	c.Assert(lk.FindLock("task1-`foo`.`bar`").IsResolved(), IsTrue)
+	c.Assert(lk.FindLock("task2-`foo`.`bar`").IsResolved(), IsFalse)
+	c.Assert(events, HasLen, 2)
+	c.Assert(events[0].Type, Equals, LockEventSynced)
+	c.Assert(events[1].Type, Equals, LockEventResolved)
+	c.Assert(events[1].LockID, Equals, "task1-`foo`.`bar`")
+	c.Assert(events[1].Source, Equals, source2)
+	c.Assert(pre, DeepEquals, []*Lock{lk.FindLock("task1-`foo`.`bar`")})
+
+	// no locks for the source now.
+	c.Assert(lk.RemoveSourceFromLocks(task1, source2), HasLen, 0)
+	c.Assert(lk.RemoveSourceFromLocks("not-exist", source2), HasLen, 0)
+}
+
+func (t *testKeeper) TestLockKeeperTruncateTable(c *C) {
+	var (
+		lk         = NewLockKeeper()
+		upSchema   = "foo_1"
+		upTable    = "bar_1"
+		downSchema = "foo"
+		downTable  = "bar"
+		task       = "task"
+		source1    = "mysql-replica-1"
+		source2    = "mysql-replica-2"
+		DDLs       = []string{"TRUNCATE TABLE bar"}
+
+		p           = parser.New()
+		se          = mock.NewContext()
+		tblID int64 = 111
+		ti0         = createTableInfo(c, p, se, tblID, `CREATE TABLE bar (id INT PRIMARY KEY)`)
+
+		tables = map[string]map[string]struct{}{upSchema: {upTable: struct{}{}}}
+		sts    = []SourceTables{
+			NewSourceTables(task, source1, tables),
+			NewSourceTables(task, source2, tables),
+		}
+	)
+
+	// truncate a table in source1, no DDLs to the downstream and no lock created.
+	res, err := lk.TrySyncResult(NewInfo(task, source1, upSchema, upTable, downSchema, downTable, DDLs, ti0, ti0), sts)
+	c.Assert(err, IsNil)
+	c.Assert(res.DDLs, HasLen, 0)
+	c.Assert(res.PendingSources, HasLen, 0)
+	c.Assert(res.Conflict, IsNil)
+	c.Assert(res.Warnings, HasLen, 1)
+	c.Assert(lk.FindLock(res.LockID), IsNil)
+	_, pending, _ := lk.LocksByState()
+	c.Assert(pending, HasLen, 0)
+	c.Assert(lk.AllPendingDDLs(), HasLen, 0)
+
+	// truncate a table for an existing lock, the table is not pending and the DDL is not tracked.
+	ti1 := createTableInfo(c, p, se, tblID, `CREATE TABLE bar (id INT PRIMARY KEY, c1 INT)`)
+	DDLs1 := []string{"ALTER TABLE bar ADD COLUMN c1 INT"}
+	_, _, err = lk.TrySync(NewInfo(task, source1, upSchema, upTable, downSchema, downTable, DDLs1, ti0, ti1), sts)
+	c.Assert(err, IsNil)
+	l := lk.FindLock(res.LockID)
+	c.Assert(l, NotNil)
+	pendingDDLs := l.PendingDDLs()
+	res, err = lk.TrySyncResult(NewInfo(task, source2, upSchema, upTable, downSchema, downTable, DDLs, ti0, ti0), sts)
+	c.Assert(err, IsNil)
+	c.Assert(res.DDLs, HasLen, 0)
+	c.Assert(l.PendingDDLs(), DeepEquals, pendingDDLs)
+	c.Assert(lk.AllPendingDDLs(), DeepEquals, map[string][]string{res.LockID: pendingDDLs})
+	for _, ddl := range l.PendingDDLs() {
+		c.Assert(ddl, Not(Matches), "(?i)TRUNCATE.*")
+	}
+}
+
+func (t *testKeeper) TestLockKeeperDownTargetsForTask(c *C) {
+	var (
+		lk       = NewLockKeeper()
+		upSchema = "foo_1"
+		upTable  = "bar_1"
+		task1    = "task-1"
+		task2    = "task-2"
+		source   = "mysql-replica-1"
+		DDLs     = []string{"ALTER TABLE bar ADD COLUMN c1 INT"}
+
+		p           = parser.New()
+		se          = mock.NewContext()
+		tblID int64 = 111
+		ti0         = createTableInfo(c, p, se, tblID, `CREATE TABLE bar (id INT PRIMARY KEY)`)
+		ti1         = createTableInfo(c, p, se, tblID, `CREATE TABLE bar (id INT PRIMARY KEY, c1 INT)`)
+
+		tables = map[string]map[string]struct{}{upSchema: {upTable: struct{}{}}}
+	)
+
+	c.Assert(lk.DownTargetsForTask(task1), HasLen, 0)
+
+	for _, target := range []struct {
+		task, schema, table string
+	}{
+		{task1, "foo", "bar2"},
+		{task1, "foo", "bar1"},
+		{task1, "baz", "bar1"},
+		{task2, "foo", "bar3"},
+	} {
+		info := NewInfo(target.task, source, upSchema, upTable, target.schema, target.table, DDLs, ti0, ti1)
+		_, _, err := lk.TrySync(info, []SourceTables{NewSourceTables(target.task, source, tables)})
+		c.Assert(err, IsNil)
+	}
+
+	c.Assert(lk.DownTargetsForTask(task1), DeepEquals, []DownTarget{
+		{Schema: "baz", Table: "bar1"},
+		{Schema: "foo", Table: "bar1"},
+		{Schema: "foo", Table: "bar2"},
+	})
+	c.Assert(lk.DownTargetsForTask(task2), DeepEquals, []DownTarget{{Schema: "foo", Table: "bar3"}})
+	c.Assert(lk.DownTargetsForTask("not-exist"), HasLen, 0)
+}
+
+func (t *testKeeper) TestLockKeeperEscalateStale(c *C) {
+	var (
+		lk         = NewLockKeeper()
+		upSchema   = "foo_1"
+		upTable    = "bar_1"
+		downSchema = "foo"
+		downTable  = "bar"
+		task       = "task"
+		source1    = "mysql-replica-1"
+		source2    = "mysql-replica-2"
+		DDLs1      = []string{"ALTER TABLE bar ADD COLUMN c1 INT"}
+		DDLs2      = []string{"ALTER TABLE bar ADD COLUMN c2 INT"}
+		timeout    = 50 * time.Millisecond
+
+		p           = parser.New()
+		se          = mock.NewContext()
+		tblID int64 = 111
+		ti0         = createTableInfo(c, p, se, tblID, `CREATE TABLE bar (id INT PRIMARY KEY)`)
+		ti1         = createTableInfo(c, p, se, tblID, `CREATE TABLE bar (id INT PRIMARY KEY, c1 INT)`)
+		ti2         = createTableInfo(c, p, se, tblID, `CREATE TABLE bar (id INT PRIMARY KEY, c1 INT, c2 INT)`)
+
+		tables = map[string]map[string]struct{}{upSchema: {upTable: struct{}{}}}
+		sts    = []SourceTables{
+			NewSourceTables(task, source1, tables),
+			NewSourceTables(task, source2, tables),
+		}
+		i11 = NewInfo(task, source1, upSchema, upTable, downSchema, downTable, DDLs1, ti0, ti1)
+		i21 = NewInfo(task, source2, upSchema, upTable, downSchema, downTable, DDLs1, ti0, ti1)
+		i12 = NewInfo(task, source1, upSchema, upTable, downSchema, downTable, DDLs2, ti1, ti2)
+
+		events []LockEvent
+	)
+	lk.SetEventSink(func(ev LockEvent) {
+		if ev.Type == LockEventEscalated {
+			events = append(events, ev)
+		}
+	})
+
+	// no locks.
+	c.Assert(lk.EscalateStale(timeout), HasLen, 0)
+
+	// not escalated before the timeout.
+	lockID, _, err := lk.TrySync(i11, sts)
+	c.Assert(err, IsNil)
+	l := lk.FindLock(lockID)
+	c.Assert(lk.EscalateStale(time.Hour), HasLen, 0)
+	c.Assert(lk.EscalateStale(0), HasLen, 0) // disabled.
+	c.Assert(l.IsEscalated(), IsFalse)
+
+	// escalated after the timeout, only once.
+	time.Sleep(2 * timeout)
+	c.Assert(lk.EscalateStale(timeout), DeepEquals, []*Lock{l})
+	c.Assert(l.IsEscalated(), IsTrue)
+	c.Assert(lk.EscalateStale(timeout), HasLen, 0)
+	c.Assert(l.IsEscalated(), IsTrue)
+	c.Assert(events, HasLen, 1)
+	c.Assert(events[0].LockID, Equals, lockID)
+
+	// the escalation is cleared after resolved.
+	_, _, err = lk.TrySync(i21, sts)
+	c.Assert(err, IsNil)
+	c.Assert(l.TryMarkDone(source1, upSchema, upTable), IsTrue)
+	c.Assert(l.TryMarkDone(source2, upSchema, upTable), IsTrue)
+	c.Assert(l.IsResolved(), IsTrue)
+	c.Assert(l.IsEscalated(), IsFalse)
+	time.Sleep(2 * timeout)
+	c.Assert(lk.EscalateStale(timeout), HasLen, 0) // resolved locks are never escalated.
+
+	// unresolved since the new DDLs, even resolved long ago.
+	_, _, err = lk.TrySync(i12, sts)
+	c.Assert(err, IsNil)
+	c.Assert(l.IsResolved(), IsFalse)
+	c.Assert(lk.EscalateStale(timeout), HasLen, 0)
+	time.Sleep(2 * timeout)
+	c.Assert(lk.EscalateStale(timeout), DeepEquals, []*Lock{l})
+
+	// the escalation is cleared after reset.
+	c.Assert(lk.ResetLock(lockID), IsNil)
+	c.Assert(l.IsEscalated(), IsFalse)
+	c.Assert(lk.EscalateStale(time.Hour), HasLen, 0)
+	c.Assert(events, HasLen, 2)
+}
+
+func (t *testKeeper) TestLockKeeperTaskConfig(c *C) {
+	var (
+		lk         = NewLockKeeper()
+		upSchema   = "foo_1"
+		upTable    = "bar_1"
+		downSchema = "foo"
+		task1      = "task1"
+		task2      = "task2"
+		source     = "mysql-replica-1"
+		DDLs1      = []string{"ALTER TABLE bar ADD COLUMN c1 INT"}
+		DDLs2      = []string{"ALTER TABLE bar ADD COLUMN c1 INT", "ALTER TABLE bar COMMENT = 'skipped'"}
+
+		p           = parser.New()
+		se          = mock.NewContext()
+		tblID int64 = 111
+		ti0         = createTableInfo(c, p, se, tblID, `CREATE TABLE bar (id INT PRIMARY KEY)`)
+		ti1         = createTableInfo(c, p, se, tblID, `CREATE TABLE bar (id INT PRIMARY KEY, c1 INT)`)
+
+		tables = map[string]map[string]struct{}{upSchema: {upTable: struct{}{}}}
+		sts1   = []SourceTables{NewSourceTables(task1, source, tables)}
+		sts2   = []SourceTables{NewSourceTables(task2, source, tables)}
+		i11    = NewInfo(task1, source, upSchema, upTable, downSchema, "bar1", DDLs1, ti0, ti1)
+		i12    = NewInfo(task1, source, upSchema, upTable, downSchema, "bar2", DDLs2, ti0, ti1)
+		i2     = NewInfo(task2, source, upSchema, upTable, downSchema, "bar1", DDLs1, ti0, ti1)
+	)
+
+	// the zero value by default.
+	c.Assert(lk.TaskConfig(task1).Paused, IsFalse)
+	c.Assert(lk.TaskConfig(task1).MaxLocks, Equals, 0)
+
+	// paused.
+	lk.SetTaskConfig(task1, TaskConfig{Paused: true})
+	c.Assert(lk.TaskConfig(task1).Paused, IsTrue)
+	_, _, err := lk.TrySync(i11, sts1)
+	c.Assert(terror.ErrShardDDLOptimismTaskPaused.Equal(err), IsTrue)
+	c.Assert(lk.Locks(), HasLen, 0)
+	_, _, err = lk.TrySync(i2, sts2) // other tasks are not affected.
+	c.Assert(err, IsNil)
+
+	// the whole config is replaced, so it's resumed.
+	lk.SetTaskConfig(task1, TaskConfig{
+		MaxLocks: 1,
+		SkipDDL:  func(ddl string) bool { return strings.Contains(ddl, "COMMENT") },
+	})
+	lockID, DDLs, err := lk.TrySync(i11, sts1)
+	c.Assert(err, IsNil)
+	c.Assert(DDLs, DeepEquals, DDLs1)
+
+	// too many locks for the task.
+	_, _, err = lk.TrySync(i12, sts1)
+	c.Assert(terror.ErrShardDDLOptimismTooManyLocks.Equal(err), IsTrue)
+	c.Assert(lk.Locks(), HasLen, 2)
+
+	// DDLs are skipped.
+	lk.SetTaskConfig(task1, TaskConfig{
+		MaxLocks: 2,
+		SkipDDL:  func(ddl string) bool { return strings.Contains(ddl, "COMMENT") },
+	})
+	lockID2, DDLs, err := lk.TrySync(i12, sts1)
+	c.Assert(err, IsNil)
+	c.Assert(DDLs, DeepEquals, DDLs1)
+	c.Assert(lk.FindLock(lockID2).PendingDDLs(), DeepEquals, DDLs2) // the original info is tracked.
+
+	// escalated with the timeout for the task.
+	lk.SetTaskConfig(task1, TaskConfig{StaleTimeout: time.Millisecond})
+	time.Sleep(10 * time.Millisecond)
+	locks := lk.EscalateStale(0) // the lock of task2 is not escalated.
+	c.Assert(locks, HasLen, 2)
+	c.Assert(locks[0].Task, Equals, task1)
+	c.Assert(locks[1].Task, Equals, task1)
+	c.Assert(lk.FindLock(lockID).IsEscalated(), IsTrue)
+
+	// the max number of columns.
+	lk.SetTaskConfig(task1, TaskConfig{MaxColumns: 1})
+	i13 := NewInfo(task1, source, upSchema, upTable, downSchema, "bar3", DDLs1, ti0, ti1)
+	res, err := lk.TrySyncResult(i13, sts1)
+	c.Assert(terror.ErrShardDDLOptimismTrySyncFail.Equal(err), IsTrue)
+	c.Assert(res.Conflict, NotNil)
+	c.Assert(res.Conflict.Type, Equals, ConflictTypeTooManyColumns)
+	lk.SetTaskConfig(task1, TaskConfig{})
+	_, err = lk.TrySyncResult(i13, sts1)
+	c.Assert(err, IsNil)
+}
+
+// fakeClock is a Clock whose time only changes when advanced manually.
+type fakeClock struct {
+	mu  sync.Mutex
+	now time.Time
+}
+
+func (fc *fakeClock) Now() time.Time {
+	fc.mu.Lock()
+	defer fc.mu.Unlock()
+	return fc.now
+}
+
+func (fc *fakeClock) Advance(d time.Duration) {
+	fc.mu.Lock()
+	defer fc.mu.Unlock()
+	fc.now = fc.now.Add(d)
+}
+
+func (t *testKeeper) TestLockKeeperClock(c *C) {
+	var (
+		lk         = NewLockKeeper()
+		clock      = &fakeClock{now: time.Date(2020, 5, 1, 0, 0, 0, 0, time.UTC)}
+		start      = clock.Now()
+		upSchema   = "foo_1"
+		upTable    = "bar_1"
+		downSchema = "foo"
+		task       = "test-lock-keeper-clock"
+		source1    = "mysql-replica-1"
+		source2    = "mysql-replica-2"
+		DDLs       = []string{"ALTER TABLE bar ADD COLUMN c1 INT"}
+
+		p           = parser.New()
+		se          = mock.NewContext()
+		tblID int64 = 111
+		ti0         = createTableInfo(c, p, se, tblID, `CREATE TABLE bar (id INT PRIMARY KEY)`)
+		ti1         = createTableInfo(c, p, se, tblID, `CREATE TABLE bar (id INT PRIMARY KEY, c1 INT)`)
+
+		tables = map[string]map[string]struct{}{upSchema: {upTable: struct{}{}}}
+		sts    = []SourceTables{
+			NewSourceTables(task, source1, tables),
+			NewSourceTables(task, source2, tables),
+		}
+		i1 = NewInfo(task, source1, upSchema, upTable, downSchema, "bar-1", DDLs, ti0, ti1)
+		i2 = NewInfo(task, source1, upSchema, upTable, downSchema, "bar-2", DDLs, ti0, ti1)
+
+		events []LockEvent
+	)
+	lk.SetClock(clock)
+	lk.SetEventSink(func(ev LockEvent) {
+		events = append(events, ev)
+	})
+	lk.SetTaskConfig(task, TaskConfig{LockCreationRate: 1.0 / 60, LockCreationBurst: 1})
+
+	// events are recorded with the time of the clock.
+	lockID1, _, err := lk.TrySync(i1, sts)
+	c.Assert(err, IsNil)
+	c.Assert(events, HasLen, 1)
+	c.Assert(events[0].Time, Equals, start)
+
+	// the rate limit follows the clock.
+	_, _, err = lk.TrySync(i2, sts)
+	c.Assert(terror.ErrShardDDLOptimismRateLimited.Equal(err), IsTrue)
+	clock.Advance(time.Minute)
+	lockID2, _, err := lk.TrySync(i2, sts)
+	c.Assert(err, IsNil)
+
+	// stale locks are detected with the clock, without waiting for the real time.
+	c.Assert(lk.EscalateStale(30*time.Second), DeepEquals, []*Lock{lk.FindLock(lockID1)})
+	clock.Advance(time.Minute)
+	c.Assert(lk.EscalateStale(30*time.Second), DeepEquals, []*Lock{lk.FindLock(lockID2)})
+	c.Assert(events[len(events)-1].Type, Equals, LockEventEscalated)
+	c.Assert(events[len(events)-1].Time, Equals, start.Add(2*time.Minute))
+
+	// the system time is used again after the clock reset, for both the keeper and locks.
+	lk.SetClock(nil)
+	c.Assert(lk.ResetLock(lockID1), IsNil)
+	c.Assert(lk.EscalateStale(time.Hour), HasLen, 0)
+	time.Sleep(time.Millisecond)
+	c.Assert(lk.EscalateStale(time.Nanosecond), DeepEquals, []*Lock{lk.FindLock(lockID1)})
+	c.Assert(events[len(events)-1].Time.After(start.Add(2*time.Minute)), IsTrue)
+}
+
+func (t *testKeeper) TestLockKeeperLockCreationRate(c *C) {
+	var (
+		lk         = NewLockKeeper()
+		upSchema   = "foo_1"
+		upTable    = "bar_1"
+		downSchema = "foo"
+		task1      = "task1"
+		task2      = "task2"
+		source     = "mysql-replica-1"
+		DDLs       = []string{"ALTER TABLE bar ADD COLUMN c1 INT"}
+
+		p           = parser.New()
+		se          = mock.NewContext()
+		tblID int64 = 111
+		ti0         = createTableInfo(c, p, se, tblID, `CREATE TABLE bar (id INT PRIMARY KEY)`)
+		ti1         = createTableInfo(c, p, se, tblID, `CREATE TABLE bar (id INT PRIMARY KEY, c1 INT)`)
+
+		tables = map[string]map[string]struct{}{upSchema: {upTable: struct{}{}}}
+		sts1   = []SourceTables{NewSourceTables(task1, source, tables)}
+		sts2   = []SourceTables{NewSourceTables(task2, source, tables)}
+		i11    = NewInfo(task1, source, upSchema, upTable, downSchema, "bar1", DDLs, ti0, ti1)
+		i12    = NewInfo(task1, source, upSchema, upTable, downSchema, "bar2", DDLs, ti0, ti1)
+		i13    = NewInfo(task1, source, upSchema, upTable, downSchema, "bar3", DDLs, ti0, ti1)
+		i2     = NewInfo(task2, source, upSchema, upTable, downSchema, "bar1", DDLs, ti0, ti1)
+	)
+	lk.SetDedupWindow(time.Minute)
+
+	// at most 2 locks can be created at once, then 1 lock every 1000s.
+	lk.SetTaskConfig(task1, TaskConfig{LockCreationRate: 0.001, LockCreationBurst: 2})
+	_, _, err := lk.TrySync(i11, sts1)
+	c.Assert(err, IsNil)
+	_, _, err = lk.TrySync(i12, sts1)
+	c.Assert(err, IsNil)
+	_, _, err = lk.TrySync(i13, sts1)
+	c.Assert(terror.ErrShardDDLOptimismRateLimited.Equal(err), IsTrue)
+	c.Assert(lk.Locks(), HasLen, 2)
+
+	// syncing existing locks and creating locks of other tasks are not limited.
+	_, _, err = lk.TrySync(i11, sts1)
+	c.Assert(err, IsNil)
+	_, _, err = lk.TrySync(i2, sts2)
+	c.Assert(err, IsNil)
+
+	// the limiter is kept if the rate not changed.
+	lk.SetTaskConfig(task1, TaskConfig{LockCreationRate: 0.001, LockCreationBurst: 2, MaxLocks: 10})
+	_, _, err = lk.TrySync(i13, sts1)
+	c.Assert(terror.ErrShardDDLOptimismRateLimited.Equal(err), IsTrue)
+
+	// unlimited, the rate limited info is not deduplicated.
+	lk.SetTaskConfig(task1, TaskConfig{})
+	_, _, err = lk.TrySync(i13, sts1)
+	c.Assert(err, IsNil)
+	c.Assert(lk.Locks(), HasLen, 4)
+}
+
+func (t *testKeeper) TestLockKeeperConflictPolicy(c *C) {
+	var (
+		upSchema   = "foo_1"
+		upTable    = "bar_1"
+		downSchema = "foo"
+		downTable  = "bar"
+		task       = "task"
+		source1    = "mysql-replica-1"
+		source2    = "mysql-replica-2"
+		DDLs1      = []string{"ALTER TABLE bar ADD COLUMN c1 INT"}
+		DDLs2      = []string{"ALTER TABLE bar ADD COLUMN c1 VARCHAR(10)"}
+		DDLs3      = []string{"ALTER TABLE bar ADD INDEX idx1(c1)"}
+		DDLs4      = []string{"ALTER TABLE bar ADD INDEX idx1(id)"}
+
+		p           = parser.New()
+		se          = mock.NewContext()
+		tblID int64 = 111
+		ti0         = createTableInfo(c, p, se, tblID, `CREATE TABLE bar (id INT PRIMARY KEY)`)
+		ti1         = createTableInfo(c, p, se, tblID, `CREATE TABLE bar (id INT PRIMARY KEY, c1 INT)`)
+		ti2         = createTableInfo(c, p, se, tblID, `CREATE TABLE bar (id INT PRIMARY KEY, c1 VARCHAR(10))`)
+		ti3         = createTableInfo(c, p, se, tblID, `CREATE TABLE bar (id INT PRIMARY KEY, c1 INT, INDEX idx1(c1))`)
+		ti4         = createTableInfo(c, p, se, tblID, `CREATE TABLE bar (id INT PRIMARY KEY, c1 INT, INDEX idx1(id))`)
+
+		tables = map[string]map[string]struct{}{upSchema: {upTable: struct{}{}}}
+		sts    = []SourceTables{
+			NewSourceTables(task, source1, tables),
+			NewSourceTables(task, source2, tables),
+		}
+		i11 = NewInfo(task, source1, upSchema, upTable, downSchema, downTable, DDLs1, ti0, ti1)
+		i21 = NewInfo(task, source2, upSchema, upTable, downSchema, downTable, DDLs1, ti0, ti1)
+		i22 = NewInfo(task, source2, upSchema, upTable, downSchema, downTable, DDLs2, ti0, ti2)
+		i13 = NewInfo(task, source1, upSchema, upTable, downSchema, downTable, DDLs3, ti1, ti3)
+		i24 = NewInfo(task, source2, upSchema, upTable, downSchema, downTable, DDLs4, ti1, ti4)
+	)
+
+	c.Assert(ConflictActionEscalate.String(), Equals, "escalate")
+	c.Assert(ConflictActionSkip.String(), Equals, "skip")
+	c.Assert(ConflictActionForce.String(), Equals, "force")
+	c.Assert(ConflictAction(100).String(), Equals, "unknown conflict action 100")
+
+	// escalated by default.
+	lk := NewLockKeeper()
+	res, err := lk.TrySyncResult(i11, sts)
+	c.Assert(err, IsNil)
+	res, err = lk.TrySyncResult(i22, sts)
+	c.Assert(terror.ErrShardDDLOptimismTrySyncFail.Equal(err), IsTrue)
+	c.Assert(res.Conflict, NotNil)
+	c.Assert(res.Conflict.Type, Equals, ConflictTypeColumnType)
+	c.Assert(res.Conflict.Action, Equals, ConflictActionEscalate)
+	c.Assert(lk.FindLock(res.LockID).Conflict(), Equals, ConflictTypeColumnType)
+
+	// skipped, the table is restored.
+	lk = NewLockKeeper()
+	lk.SetConflictPolicy(ConflictPolicy{ConflictTypeColumnType: ConflictActionSkip})
+	_, err = lk.TrySyncResult(i11, sts)
+	c.Assert(err, IsNil)
+	res, err = lk.TrySyncResult(i22, sts)
+	c.Assert(err, IsNil)
+	c.Assert(res.DDLs, DeepEquals, []string{})
+	c.Assert(res.Conflict, NotNil)
+	c.Assert(res.Conflict.Type, Equals, ConflictTypeColumnType)
+	c.Assert(res.Conflict.Action, Equals, ConflictActionSkip)
+	c.Assert(res.PendingSources, DeepEquals, []string{source2})
+	l := lk.FindLock(res.LockID)
+	c.Assert(l.Conflict(), Equals, ConflictTypeNone)
+	c.Assert(l.SchemaVersions()[source2], Equals, 0)
+	c.Assert(l.tableInfos[source2][upSchema][upTable], Equals, ti0)
+	// the table can be synced later.
+	res, err = lk.TrySyncResult(i21, sts)
+	c.Assert(err, IsNil)
+	c.Assert(res.DDLs, DeepEquals, DDLs1)
+	c.Assert(res.Conflict, IsNil)
+	synced, _ := l.IsSynced()
+	c.Assert(synced, IsTrue)
+
+	// other types of conflicts are still escalated.
+	_, err = lk.TrySyncResult(i13, sts)
+	c.Assert(err, IsNil)
+	res, err = lk.TrySyncResult(i24, sts)
+	c.Assert(terror.ErrShardDDLOptimismTrySyncFail.Equal(err), IsTrue)
+	c.Assert(res.Conflict.Type, Equals, ConflictTypeIncompatibleIndex)
+	c.Assert(res.Conflict.Action, Equals, ConflictActionEscalate)
+
+	// forced, the DDLs are executed to the downstream.
+	lk = NewLockKeeper()
+	lk.SetConflictPolicy(ConflictPolicy{ConflictTypeColumnType: ConflictActionForce})
+	_, err = lk.TrySyncResult(i11, sts)
+	c.Assert(err, IsNil)
+	res, err = lk.TrySyncResult(i22, sts)
+	c.Assert(err, IsNil)
+	c.Assert(res.DDLs, DeepEquals, DDLs2)
+	c.Assert(res.Conflict, NotNil)
+	c.Assert(res.Conflict.Action, Equals, ConflictActionForce)
+	l = lk.FindLock(res.LockID)
+	c.Assert(l.Conflict(), Equals, ConflictTypeNone)
+	c.Assert(l.tableInfos[source2][upSchema][upTable], Equals, ti2)
+
+	// reset to the default policy.
+	lk.SetConflictPolicy(nil)
+	_, _, err = lk.TrySync(i22, sts)
+	c.Assert(terror.ErrShardDDLOptimismTrySyncFail.Equal(err), IsTrue)
+}
+
+func (t *testKeeper) TestLockKeeperMergeFrom(c *C) {
+	var (
+		lk1        = NewLockKeeper()
+		lk2        = NewLockKeeper()
+		upSchema   = "foo_1"
+		upTable    = "bar_1"
+		downSchema = "foo"
+		downTables = []string{"bar1", "bar2", "bar3"}
+		task       = "task"
+		source     = "mysql-replica-1"
+		DDLs       = []string{"ALTER TABLE bar ADD COLUMN c1 INT"}
+
+		p           = parser.New()
+		se          = mock.NewContext()
+		tblID int64 = 111
+		ti0         = createTableInfo(c, p, se, tblID, `CREATE TABLE bar (id INT PRIMARY KEY)`)
+		ti1         = createTableInfo(c, p, se, tblID, `CREATE TABLE bar (id INT PRIMARY KEY, c1 INT)`)
+
+		tables = map[string]map[string]struct{}{upSchema: {upTable: struct{}{}}}
+		sts    = []SourceTables{NewSourceTables(task, source, tables)}
+		events []LockEvent
+	)
+
+	// merge from an empty keeper.
+	c.Assert(lk1.MergeFrom(lk2), HasLen, 0)
+	c.Assert(lk1.Locks(), HasLen, 0)
+
+	// lk1 has lock-1 and lock-2, lk2 has lock-2 and lock-3.
+	lockIDs := make([]string, 0, len(downTables))
+	for i, downTable := range downTables {
+		info := NewInfo(task, source, upSchema, upTable, downSchema, downTable, DDLs, ti0, ti1)
+		if i < 2 {
+			lockID, _, err := lk1.TrySync(info, sts)
+			c.Assert(err, IsNil)
+			lockIDs = append(lockIDs, lockID)
+		}
+		if i > 0 {
+			lockID, _, err := lk2.TrySync(info, sts)
+			c.Assert(err, IsNil)
+			if i == 2 {
+				lockIDs = append(lockIDs, lockID)
+			}
+		}
+	}
+	lock2In1 := lk1.FindLock(lockIDs[1])
+
+	lk1.SetEventSink(func(ev LockEvent) {
+		events = append(events, ev)
+	})
+	c.Assert(lk1.MergeFrom(lk2), DeepEquals, []string{lockIDs[1]})
+	c.Assert(lk1.LockIDs(), DeepEquals, lockIDs)
+	c.Assert(lk1.FindLock(lockIDs[1]), Equals, lock2In1) // untouched.
+	c.Assert(lk1.FindLock(lockIDs[2]), Equals, lk2.FindLock(lockIDs[2]))
+	c.Assert(events, HasLen, 1)
+	c.Assert(events[0].Type, Equals, LockEventCreated)
+	c.Assert(events[0].LockID, Equals, lockIDs[2])
+
+	// merge again, all locks in lk2 conflict now.
+	c.Assert(lk1.MergeFrom(lk2), DeepEquals, []string{lockIDs[1], lockIDs[2]})
+	c.Assert(lk1.MergeFrom(lk1), DeepEquals, lockIDs)
+}
+
+func (t *testKeeper) TestLockKeeperEventSink(c *C) {
+	var (
+		lk         = NewLockKeeper()
+		upSchema   = "foo_1"
+		upTable    = "bar_1"
+		downSchema = "foo"
+		downTable  = "bar"
+		task       = "task"
+		source1    = "mysql-replica-1"
+		source2    = "mysql-replica-2"
+		DDLs1      = []string{"ALTER TABLE bar ADD COLUMN c1 INT"}
+		DDLs2      = []string{"ALTER TABLE bar ADD COLUMN c1 TEXT"}
+
+		p           = parser.New()
+		se          = mock.NewContext()
+		tblID int64 = 111
+		ti0         = createTableInfo(c, p, se, tblID, `CREATE TABLE bar (id INT PRIMARY KEY)`)
+		ti1         = createTableInfo(c, p, se, tblID, `CREATE TABLE bar (id INT PRIMARY KEY, c1 INT)`)
+		ti2         = createTableInfo(c, p, se, tblID, `CREATE TABLE bar (id INT PRIMARY KEY, c1 TEXT)`)
+
+		tables = map[string]map[string]struct{}{upSchema: {upTable: struct{}{}}}
+		sts    = []SourceTables{
+			NewSourceTables(task, source1, tables),
+			NewSourceTables(task, source2, tables),
+		}
+		i11 = NewInfo(task, source1, upSchema, upTable, downSchema, downTable, DDLs1, ti0, ti1)
+		i21 = NewInfo(task, source2, upSchema, upTable, downSchema, downTable, DDLs1, ti0, ti1)
+		i22 = NewInfo(task, source2, upSchema, upTable, downSchema, downTable, DDLs2, ti0, ti2)
+
+		events []LockEvent
+		check  = func(expected ...LockEvent) {
+			c.Assert(events, HasLen, len(expected))
+			for i, ev := range events {
+				c.Assert(ev.Time.IsZero(), IsFalse)
+				ev.Time = time.Time{}
+				c.Assert(ev, DeepEquals, expected[i])
+			}
+			events = nil
+		}
+	)
+
+	// no events recorded without the sink.
+	lockID, _, err := lk.TrySync(i11, sts)
+	c.Assert(err, IsNil)
+	lk.Clear()
+	c.Assert(lk.events, HasLen, 0)
+
+	lk.SetEventSink(func(ev LockEvent) {
+		events = append(events, ev)
+	})
+
+	// created but not synced.
+	_, _, err = lk.TrySync(i11, sts)
+	c.Assert(err, IsNil)
+	check(LockEvent{Type: LockEventCreated, LockID: lockID, Source: source1, DDLs: DDLs1})
+
+	// conflict.
+	_, _, err = lk.TrySync(i22, sts)
+	c.Assert(terror.ErrShardDDLOptimismTrySyncFail.Equal(err), IsTrue)
+	check(LockEvent{Type: LockEventConflict, LockID: lockID, Source: source2, DDLs: DDLs2})
+
+	// synced.
+	_, _, err = lk.TrySync(i21, sts)
+	c.Assert(err, IsNil)
+	check(LockEvent{Type: LockEventSynced, LockID: lockID, Source: source2, DDLs: DDLs1})
+
+	// resolved.
+	l := lk.FindLock(lockID)
+	c.Assert(l.TryMarkDone(source1, upSchema, upTable), IsTrue)
+	c.Assert(l.TryMarkDone(source2, upSchema, upTable), IsTrue)
+	_, _, err = lk.TrySync(i21, sts)
+	c.Assert(err, IsNil)
+	check(LockEvent{Type: LockEventSynced, LockID: lockID, Source: source2, DDLs: DDLs1},
+		LockEvent{Type: LockEventResolved, LockID: lockID, Source: source2, DDLs: DDLs1})
+
+	// removed.
+	c.Assert(lk.RemoveLock(lockID), IsTrue)
+	c.Assert(lk.RemoveLock(lockID), IsFalse)
+	check(LockEvent{Type: LockEventRemoved, LockID: lockID})
+	_, _, err = lk.TrySync(i11, sts)
+	c.Assert(err, IsNil)
+	lk.Clear()
+	check(LockEvent{Type: LockEventCreated, LockID: lockID, Source: source1, DDLs: DDLs1},
+		LockEvent{Type: LockEventRemoved, LockID: lockID})
+
+	// clear silently.
+	_, _, err = lk.TrySync(i11, sts)
+	c.Assert(err, IsNil)
+	lk.ClearSilently()
+	c.Assert(lk.Locks(), HasLen, 0)
+	check(LockEvent{Type: LockEventCreated, LockID: lockID, Source: source1, DDLs: DDLs1})
+
+	// no events after the sink removed.
+	lk.SetEventSink(nil)
+	_, _, err = lk.TrySync(i11, sts)
+	c.Assert(err, IsNil)
+	c.Assert(events, HasLen, 0)
+}
+
+func (t *testKeeper) TestLockKeeperResetLock(c *C) {
+	var (
+		lk         = NewLockKeeper()
+		upSchema   = "foo_1"
+		upTable    = "bar_1"
+		downSchema = "foo"
+		downTable  = "bar"
+		DDLs       = []string{"ALTER TABLE bar ADD COLUMN c1 INT"}
+		task       = "task"
+		source1    = "mysql-replica-1"
+		source2    = "mysql-replica-2"
+
+		p           = parser.New()
+		se          = mock.NewContext()
+		tblID int64 = 111
+		ti0         = createTableInfo(c, p, se, tblID, `CREATE TABLE bar (id INT PRIMARY KEY)`)
+		ti1         = createTableInfo(c, p, se, tblID, `CREATE TABLE bar (id INT PRIMARY KEY, c1 INT)`)
+
+		tables = map[string]map[string]struct{}{upSchema: {upTable: struct{}{}}}
+		sts    = []SourceTables{
+			NewSourceTables(task, source1, tables),
+			NewSourceTables(task, source2, tables),
+		}
+		i1 = NewInfo(task, source1, upSchema, upTable, downSchema, downTable, DDLs, ti0, ti1)
+		i2 = NewInfo(task, source2, upSchema, upTable, downSchema, downTable, DDLs, ti0, ti1)
+	)
+
+	// lock not found.
+	c.Assert(terror.ErrShardDDLOptimismLockNotFound.Equal(lk.ResetLock("not-exist")), IsTrue)
+
+	// source1 added the column, source2 is pending.
+	lockID, _, err := lk.TrySync(i1, sts)
+	c.Assert(err, IsNil)
+	l := lk.FindLock(lockID)
+	synced, remain := l.IsSynced()
+	c.Assert(synced, IsFalse)
+	c.Assert(remain, Equals, 1)
+	cmp, err := l.Joined().Compare(schemacmp.Encode(ti1))
+	c.Assert(err, IsNil)
+	c.Assert(cmp, Equals, 0)
+
+	// reset the lock, all tables are back to the initial table info.
+	c.Assert(lk.ResetLock(lockID), IsNil)
+	c.Assert(lk.FindLock(lockID), Equals, l)
+	synced, remain = l.IsSynced()
+	c.Assert(synced, IsTrue)
+	c.Assert(remain, Equals, 0)
+	cmp, err = l.Joined().Compare(schemacmp.Encode(ti0))
+	c.Assert(err, IsNil)
+	c.Assert(cmp, Equals, 0)
+	c.Assert(l.Ready(), DeepEquals, map[string]map[string]map[string]bool{
+		source1: {upSchema: {upTable: true}},
+		source2: {upSchema: {upTable: true}},
+	})
+	c.Assert(l.IsDone(source1, upSchema, upTable), IsFalse)
+
+	// sources re-send their DDLs to sync the lock again.
+	_, newDDLs, err := lk.TrySync(i1, sts)
+	c.Assert(err, IsNil)
+	c.Assert(newDDLs, DeepEquals, DDLs)
+	_, newDDLs, err = lk.TrySync(i2, sts)
+	c.Assert(err, IsNil)
+	c.Assert(newDDLs, DeepEquals, DDLs)
+	synced, _ = l.IsSynced()
+	c.Assert(synced, IsTrue)
+}
+
+func (t *testKeeper) TestLockKeeperReopen(c *C) {
+	var (
+		lk         = NewLockKeeper()
+		upSchema   = "foo_1"
+		upTable    = "bar_1"
+		downSchema = "foo"
+		downTable  = "bar"
+		task       = "task"
+		source1    = "mysql-replica-1"
+		source2    = "mysql-replica-2"
+		DDLs       = []string{"ALTER TABLE bar ADD COLUMN c1 INT"}
+
+		p           = parser.New()
+		se          = mock.NewContext()
+		tblID int64 = 111
+		ti0         = createTableInfo(c, p, se, tblID, `CREATE TABLE bar (id INT PRIMARY KEY)`)
+		ti1         = createTableInfo(c, p, se, tblID, `CREATE TABLE bar (id INT PRIMARY KEY, c1 INT)`)
+
+		tables = map[string]map[string]struct{}{upSchema: {upTable: struct{}{}}}
+		sts    = []SourceTables{
+			NewSourceTables(task, source1, tables),
+			NewSourceTables(task, source2, tables),
+		}
+		i1 = NewInfo(task, source1, upSchema, upTable, downSchema, downTable, DDLs, ti0, ti1)
+		i2 = NewInfo(task, source2, upSchema, upTable, downSchema, downTable, DDLs, ti0, ti1)
+
+		events []LockEvent
+	)
+	lk.SetEventSink(func(ev LockEvent) {
+		if ev.Type == LockEventReopened {
+			events = append(events, ev)
+		}
+	})
+
+	// the lock not exists.
+	lockID := genDDLLockID(i1)
+	c.Assert(terror.ErrShardDDLOptimismLockNotFound.Equal(lk.Reopen(lockID)), IsTrue)
+
+	// the lock is still syncing.
+	_, _, err := lk.TrySync(i1, sts)
+	c.Assert(err, IsNil)
+	_, _, err = lk.TrySync(i2, sts)
+	c.Assert(err, IsNil)
+	l := lk.FindLock(lockID)
+	c.Assert(l.TryMarkDone(source1, upSchema, upTable), IsTrue)
+	c.Assert(terror.ErrShardDDLOptimismLockNotResolved.Equal(lk.Reopen(lockID)), IsTrue)
+	c.Assert(l.IsDone(source1, upSchema, upTable), IsTrue)
+
+	// reopen the resolved lock.
+	c.Assert(l.TryMarkDone(source2, upSchema, upTable), IsTrue)
+	c.Assert(l.IsResolved(), IsTrue)
+	c.Assert(lk.Reopen(lockID), IsNil)
+	c.Assert(l.IsResolved(), IsFalse)
+	c.Assert(l.IsDone(source1, upSchema, upTable), IsFalse)
+	c.Assert(l.IsDone(source2, upSchema, upTable), IsFalse)
+	synced, _ := l.IsSynced()
+	c.Assert(synced, IsTrue) // the joined schema is kept.
+	c.Assert(events, HasLen, 1)
+	c.Assert(events[0].LockID, Equals, lockID)
+
+	// resolved again after re-applied.
+	c.Assert(l.TryMarkDone(source1, upSchema, upTable), IsTrue)
+	c.Assert(l.TryMarkDone(source2, upSchema, upTable), IsTrue)
+	c.Assert(l.IsResolved(), IsTrue)
+}
+
+func (t *testKeeper) TestLockKeeperTrySyncRemovedLock(c *C) {
+	var (
+		lk         = NewLockKeeper()
+		upSchema   = "foo_1"
+		upTable    = "bar_1"
+		downSchema = "foo"
+		downTable  = "bar"
+		task       = "task"
+		source1    = "mysql-replica-1"
+		source2    = "mysql-replica-2"
+		DDLs       = []string{"ALTER TABLE bar ADD COLUMN c1 INT"}
+
+		p           = parser.New()
+		se          = mock.NewContext()
+		tblID int64 = 111
+		ti0         = createTableInfo(c, p, se, tblID, `CREATE TABLE bar (id INT PRIMARY KEY)`)
+		ti1         = createTableInfo(c, p, se, tblID, `CREATE TABLE bar (id INT PRIMARY KEY, c1 INT)`)
+
+		tables = map[string]map[string]struct{}{upSchema: {upTable: struct{}{}}}
+		sts    = []SourceTables{
+			NewSourceTables(task, source1, tables),
+			NewSourceTables(task, source2, tables),
+		}
+		i1 = NewInfo(task, source1, upSchema, upTable, downSchema, downTable, DDLs, ti0, ti1)
+	)
+
+	lockID, _, err := lk.TrySync(i1, sts)
+	c.Assert(err, IsNil)
+	l := lk.FindLock(lockID)
+	c.Assert(l.IsRemoved(), IsFalse)
+
+	// remove the lock concurrently with syncing it by the pointer got before.
+	var (
+		started  = make(chan struct{})
+		removed  = make(chan bool, 1)
+		maxSyncs = 10000
+	)
+	go func() {
+		<-started
+		removed <- lk.RemoveLock(lockID)
+	}()
+	close(started)
+	for i := 0; i < maxSyncs && err == nil; i++ {
+		_, err = l.TrySync(source2, upSchema, upTable, DDLs, ti1, sts)
+	}
+	select {
+	case ok := <-removed:
+		c.Assert(ok, IsTrue)
+	case <-time.After(5 * time.Second):
+		c.Fatal("lock not removed")
+	}
+	// the removal is always observed after `RemoveLock` returned.
+	if err == nil {
+		_, err = l.TrySync(source2, upSchema, upTable, DDLs, ti1, sts)
+	}
+	c.Assert(terror.ErrShardDDLOptimismLockRemoved.Equal(err), IsTrue)
+	c.Assert(l.IsRemoved(), IsTrue)
+	c.Assert(lk.FindLock(lockID), IsNil)
+
+	// a new lock is created for the same info.
+	lockID2, _, err := lk.TrySync(i1, sts)
+	c.Assert(err, IsNil)
+	c.Assert(lockID2, Equals, lockID)
+	c.Assert(lk.FindLock(lockID).IsRemoved(), IsFalse)
+
+	// locks are also marked after cleared.
+	l = lk.FindLock(lockID)
+	lk.Clear()
+	_, err = l.TrySync(source2, upSchema, upTable, DDLs, ti1, sts)
+	c.Assert(terror.ErrShardDDLOptimismLockRemoved.Equal(err), IsTrue)
+}
+
+func (t *testKeeper) TestLockKeeperContributingInfos(c *C) {
+	var (
+		lk         = NewLockKeeper()
+		upSchema   = "foo_1"
+		upTable1   = "bar_1"
+		upTable2   = "bar_2"
+		downSchema = "foo"
+		downTable  = "bar"
+		task       = "task"
+		source1    = "mysql-replica-1"
+		source2    = "mysql-replica-2"
+		DDLs1      = []string{"ALTER TABLE bar ADD COLUMN c1 INT"}
+		DDLs2      = []string{"ALTER TABLE bar ADD COLUMN c2 INT"}
+
+		p           = parser.New()
+		se          = mock.NewContext()
+		tblID int64 = 111
+		ti0         = createTableInfo(c, p, se, tblID, `CREATE TABLE bar (id INT PRIMARY KEY)`)
+		ti1         = createTableInfo(c, p, se, tblID, `CREATE TABLE bar (id INT PRIMARY KEY, c1 INT)`)
+		ti2         = createTableInfo(c, p, se, tblID, `CREATE TABLE bar (id INT PRIMARY KEY, c1 INT, c2 INT)`)
+
+		tables = map[string]map[string]struct{}{upSchema: {upTable1: struct{}{}, upTable2: struct{}{}}}
+		sts    = []SourceTables{
+			NewSourceTables(task, source1, tables),
+			NewSourceTables(task, source2, tables),
+		}
+		i11  = NewInfo(task, source1, upSchema, upTable1, downSchema, downTable, DDLs1, ti0, ti1)
+		i12  = NewInfo(task, source1, upSchema, upTable2, downSchema, downTable, DDLs1, ti0, ti1)
+		i21  = NewInfo(task, source2, upSchema, upTable1, downSchema, downTable, DDLs1, ti0, ti1)
+		i11b = NewInfo(task, source1, upSchema, upTable1, downSchema, downTable, DDLs2, ti1, ti2)
+	)
+
+	_, _, err := lk.TrySync(i11, sts)
+	c.Assert(err, IsNil)
+	_, _, err = lk.TrySync(i21, sts)
+	c.Assert(err, IsNil)
+	l := lk.FindLock(genDDLLockID(i11))
+	c.Assert(l.ContributingInfos(), DeepEquals, []Info{i11, i21})
+
+	// the info is replaced by the latest one of the table.
+	_, _, err = lk.TrySync(i11b, sts)
+	c.Assert(err, IsNil)
+	_, _, err = lk.TrySync(i12, sts)
+	c.Assert(err, IsNil)
+	c.Assert(l.ContributingInfos(), DeepEquals, []Info{i11b, i12, i21})
+
+	// the rejected out of order info is not tracked.
+	i11b.Seq = 2
+	_, _, err = lk.TrySync(i11b, sts)
+	c.Assert(err, IsNil)
+	i11c := i11
+	i11c.Seq = 1
+	_, _, err = lk.TrySync(i11c, sts)
+	c.Assert(terror.ErrShardDDLOptimismOutOfOrderDDL.Equal(err), IsTrue)
+	c.Assert(l.ContributingInfos(), DeepEquals, []Info{i11b, i12, i21})
+
+	// infos of removed tables and sources are not included.
+	c.Assert(l.TryRemoveTable(source1, upSchema, upTable2), IsTrue)
+	c.Assert(l.ContributingInfos(), DeepEquals, []Info{i11b, i21})
+	c.Assert(l.RemoveSource(source2), IsNil)
+	c.Assert(l.ContributingInfos(), DeepEquals, []Info{i11b})
+
+	// infos are kept after reset.
+	l.Reset()
+	c.Assert(l.ContributingInfos(), DeepEquals, []Info{i11b})
+}
+
+func (t *testKeeper) TestLockKeeperSkipDDL(c *C) {
+	var (
+		lk         = NewLockKeeper()
+		upSchema   = "foo_1"
+		upTable    = "bar_1"
+		downSchema = "foo"
+		downTable  = "bar"
+		task       = "task"
+		source1    = "mysql-replica-1"
+		source2    = "mysql-replica-2"
+		DDLs1      = []string{"ALTER TABLE bar DROP COLUMN c1"}
+		DDLs2      = []string{"ALTER TABLE bar ADD COLUMN c2 INT"}
+
+		p           = parser.New()
+		se          = mock.NewContext()
+		tblID int64 = 111
+		ti0         = createTableInfo(c, p, se, tblID, `CREATE TABLE bar (id INT PRIMARY KEY, c1 INT)`)
+		ti1         = createTableInfo(c, p, se, tblID, `CREATE TABLE bar (id INT PRIMARY KEY)`)
+		ti2         = createTableInfo(c, p, se, tblID, `CREATE TABLE bar (id INT PRIMARY KEY, c1 INT, c2 INT)`)
+
+		tables = map[string]map[string]struct{}{upSchema: {upTable: struct{}{}}}
+		sts    = []SourceTables{
+			NewSourceTables(task, source1, tables),
+			NewSourceTables(task, source2, tables),
+		}
+		i1  = NewInfo(task, source1, upSchema, upTable, downSchema, downTable, DDLs1, ti0, ti1)
+		i2  = NewInfo(task, source2, upSchema, upTable, downSchema, downTable, DDLs2, ti0, ti2)
+		i12 = NewInfo(task, source1, upSchema, upTable, downSchema, downTable, DDLs2, ti0, ti2)
+
+		events []LockEvent
+	)
+	lk.SetEventSink(func(ev LockEvent) {
+		if ev.Type == LockEventSkipped {
+			events = append(events, ev)
+		}
+	})
+
+	// the lock not exists.
+	lockID := genDDLLockID(i1)
+	_, _, err := lk.SkipDDL(lockID, DDLs1[0])
+	c.Assert(terror.ErrShardDDLOptimismLockNotFound.Equal(err), IsTrue)
+
+	// two DDLs are pending in the lock.
+	_, DDLs, err := lk.TrySync(i1, sts)
+	c.Assert(err, IsNil)
+	c.Assert(DDLs, DeepEquals, []string{})
+	_, DDLs, err = lk.TrySync(i2, sts)
+	c.Assert(err, IsNil)
+	c.Assert(DDLs, DeepEquals, DDLs2)
+	l := lk.FindLock(lockID)
+	synced, remain := l.IsSynced()
+	c.Assert(synced, IsFalse)
+	c.Assert(remain, Equals, 1)
+
+	// the DDL not exists in the lock.
+	_, _, err = lk.SkipDDL(lockID, "ALTER TABLE bar ADD COLUMN c3 INT")
+	c.Assert(terror.ErrShardDDLOptimismDDLNotFound.Equal(err), IsTrue)
+	_, _, err = lk.SkipDDL(lockID, "invalid DDL")
+	c.Assert(terror.ErrShardDDLOptimismParseDDL.Equal(err), IsTrue)
+
+	// skip `DROP COLUMN` with a differently-written DDL, the table is restored to the table info before the DDL.
+	infos, ops, err := lk.SkipDDL(lockID, "alter table `bar` drop c1")
+	c.Assert(err, IsNil)
+	c.Assert(infos, DeepEquals, []Info{i1})
+	c.Assert(ops, DeepEquals, []Operation{NewOperation(lockID, task, source1, upSchema, upTable, nil, ConflictNone, false)})
+	c.Assert(l.ContributingInfos(), DeepEquals, []Info{i2})
+	c.Assert(l.joinedTI.Columns, HasLen, 3) // the joined table info is not changed.
+	c.Assert(l.Ready()[source1][upSchema][upTable], IsFalse)
+	c.Assert(l.Ready()[source2][upSchema][upTable], IsTrue)
+	c.Assert(l.IsDone(source1, upSchema, upTable), IsFalse)
+	c.Assert(events, HasLen, 1)
+	c.Assert(events[0].LockID, Equals, lockID)
+
+	// the DDL has been skipped.
+	_, _, err = lk.SkipDDL(lockID, DDLs1[0])
+	c.Assert(terror.ErrShardDDLOptimismDDLNotFound.Equal(err), IsTrue)
+
+	// the other DDL can still be synced.
+	_, DDLs, err = lk.TrySync(i12, sts)
+	c.Assert(err, IsNil)
+	c.Assert(DDLs, DeepEquals, DDLs2)
+	synced, remain = l.IsSynced()
+	c.Assert(synced, IsTrue)
+	c.Assert(remain, Equals, 0)
+}
+
+func (t *testKeeper) TestLockKeeperWithLock(c *C) {
+	var (
+		lk         = NewLockKeeper()
+		upSchema   = "foo_1"
+		upTable    = "bar_1"
+		downSchema = "foo"
+		downTable  = "bar"
+		task       = "task"
+		source1    = "mysql-replica-1"
+		source2    = "mysql-replica-2"
+		DDLs       = []string{"ALTER TABLE bar ADD COLUMN c1 INT"}
+
+		p           = parser.New()
+		se          = mock.NewContext()
+		tblID int64 = 111
+		ti0         = createTableInfo(c, p, se, tblID, `CREATE TABLE bar (id INT PRIMARY KEY)`)
+		ti1         = createTableInfo(c, p, se, tblID, `CREATE TABLE bar (id INT PRIMARY KEY, c1 INT)`)
+
+		tables = map[string]map[string]struct{}{upSchema: {upTable: struct{}{}}}
+		sts    = []SourceTables{
+			NewSourceTables(task, source1, tables),
+			NewSourceTables(task, source2, tables),
+		}
+		i1 = NewInfo(task, source1, upSchema, upTable, downSchema, downTable, DDLs, ti0, ti1)
+		i2 = NewInfo(task, source2, upSchema, upTable, downSchema, downTable, DDLs, ti0, ti1)
+	)
+
+	// the lock not exists.
+	lockID := genDDLLockID(i1)
+	err := lk.WithLock(lockID, func(l *Lock) error { return nil })
+	c.Assert(terror.ErrShardDDLOptimismLockNotFound.Equal(err), IsTrue)
+
+	_, _, err = lk.TrySync(i1, sts)
+	c.Assert(err, IsNil)
+
+	// the error of `fn` is returned.
+	fnErr := errors.New("fn error")
+	err = lk.WithLock(lockID, func(l *Lock) error { return fnErr })
+	c.Assert(err, Equals, fnErr)
+
+	// `TrySync` is blocked until `fn` returned.
+	var (
+		synced = make(chan struct{})
+		remain int
+	)
+	err = lk.WithLock(lockID, func(l *Lock) error {
+		go func() {
+			_, _, err2 := lk.TrySync(i2, sts)
+			c.Assert(err2, IsNil)
+			close(synced)
+		}()
+		select {
+		case <-synced:
+			c.Fatal("TrySync should be blocked")
+		case <-time.After(100 * time.Millisecond):
+		}
+		_, remain = l.IsSynced()
+		return nil
+	})
+	c.Assert(err, IsNil)
+	c.Assert(remain, Equals, 1)
+	<-synced
+	isSynced, _ := lk.FindLock(lockID).IsSynced()
+	c.Assert(isSynced, IsTrue)
+
+	// changes in `fn` are recorded as lock events.
+	var types []LockEventType
+	lk.SetEventSink(func(ev LockEvent) {
+		types = append(types, ev.Type)
+	})
+	err = lk.WithLock(lockID, func(l *Lock) error {
+		l.TryMarkDone(source1, upSchema, upTable)
+		l.TryMarkDone(source2, upSchema, upTable)
+		return nil
+	})
+	c.Assert(err, IsNil)
+	c.Assert(types, DeepEquals, []LockEventType{LockEventModified, LockEventResolved})
+
+	// so do resetting and tagging the lock.
+	c.Assert(lk.ResetLock(lockID), IsNil)
+	c.Assert(lk.SetLockTags(lockID, map[string]string{"ticket": "INC-123"}), IsNil)
+	c.Assert(types, DeepEquals, []LockEventType{LockEventModified, LockEventResolved, LockEventReset, LockEventTagged})
+}
+
+func (t *testKeeper) TestLockKeeperFindLocks(c *C) {
+	var (
+		lk         = NewLockKeeper()
+		upSchema   = "foo_1"
+		upTable    = "bar_1"
+		downSchema = "foo"
+		task1      = "task1"
+		task2      = "task2"
+		source     = "mysql-replica-1"
+		DDLs       = []string{"ALTER TABLE bar ADD COLUMN c1 INT"}
+
+		p           = parser.New()
+		se          = mock.NewContext()
+		tblID int64 = 111
+		ti0         = createTableInfo(c, p, se, tblID, `CREATE TABLE bar (id INT PRIMARY KEY)`)
+		ti1         = createTableInfo(c, p, se, tblID, `CREATE TABLE bar (id INT PRIMARY KEY, c1 INT)`)
+
+		tables = map[string]map[string]struct{}{upSchema: {upTable: struct{}{}}}
+		i1     = NewInfo(task1, source, upSchema, upTable, downSchema, "bar", DDLs, ti0, ti1)
+		i2     = NewInfo(task2, source, upSchema, upTable, downSchema, "bar", DDLs, ti0, ti1)
+	)
+
+	// no locks exist.
+	c.Assert(lk.FindLocks(nil), HasLen, 0)
+	c.Assert(lk.FindLocks([]string{genDDLLockID(i1)}), HasLen, 0)
+
+	_, _, err := lk.TrySync(i1, []SourceTables{NewSourceTables(task1, source, tables)})
+	c.Assert(err, IsNil)
+	_, _, err = lk.TrySync(i2, []SourceTables{NewSourceTables(task2, source, tables)})
+	c.Assert(err, IsNil)
+
+	// non-existing IDs are omitted.
+	lockID1, lockID2 := genDDLLockID(i1), genDDLLockID(i2)
+	locks := lk.FindLocks([]string{lockID1, "not-exist", lockID2})
+	c.Assert(locks, HasLen, 2)
+	c.Assert(locks[lockID1], Equals, lk.FindLock(lockID1))
+	c.Assert(locks[lockID2], Equals, lk.FindLock(lockID2))
+	_, ok := locks["not-exist"]
+	c.Assert(ok, IsFalse)
+
+	locks = lk.FindLocks([]string{lockID2})
+	c.Assert(locks, HasLen, 1)
+	c.Assert(locks[lockID2].Task, Equals, task2)
+}
+
+func (t *testKeeper) TestLockKeeperSnapshotLocks(c *C) {
+	var (
+		lk         = NewLockKeeper()
+		upSchema   = "foo_1"
+		upTable    = "bar_1"
+		downSchema = "foo"
+		task1      = "task1"
+		task2      = "task2"
+		source1    = "mysql-replica-1"
+		source2    = "mysql-replica-2"
+		DDLs       = []string{"ALTER TABLE bar ADD COLUMN c1 INT"}
+
+		p           = parser.New()
+		se          = mock.NewContext()
+		tblID int64 = 111
+		ti0         = createTableInfo(c, p, se, tblID, `CREATE TABLE bar (id INT PRIMARY KEY)`)
+		ti1         = createTableInfo(c, p, se, tblID, `CREATE TABLE bar (id INT PRIMARY KEY, c1 INT)`)
+
+		tables = map[string]map[string]struct{}{upSchema: {upTable: struct{}{}}}
+		sts1   = []SourceTables{
+			NewSourceTables(task1, source1, tables),
+			NewSourceTables(task1, source2, tables),
+		}
+		sts2 = []SourceTables{NewSourceTables(task2, source1, tables)}
+		i11  = NewInfo(task1, source1, upSchema, upTable, downSchema, "bar", DDLs, ti0, ti1)
+		i12  = NewInfo(task1, source2, upSchema, upTable, downSchema, "bar", DDLs, ti0, ti1)
+		i21  = NewInfo(task2, source1, upSchema, upTable, downSchema, "bar", DDLs, ti0, ti1)
+	)
+
+	c.Assert(lk.SnapshotLocks(), HasLen, 0)
+
+	lockID1, _, err := lk.TrySync(i11, sts1)
+	c.Assert(err, IsNil)
+	lockID2, _, err := lk.TrySync(i21, sts2)
+	c.Assert(err, IsNil)
+
+	// snapshots are sorted by lock ID.
+	views := lk.SnapshotLocks()
+	c.Assert(views, HasLen, 2)
+	c.Assert(views[0].ID, Equals, lockID1)
+	c.Assert(views[1].ID, Equals, lockID2)
+	v1 := views[0]
+	c.Assert(v1.Task, Equals, task1)
+	c.Assert(v1.Joined, Equals, lk.FindLock(lockID1).Joined().String())
+	c.Assert(v1.Synced, IsFalse)
+	c.Assert(v1.Remain, Equals, 1)
+	c.Assert(v1.PendingSources, DeepEquals, []string{source2})
+	c.Assert(v1.Ready, DeepEquals, lk.FindLock(lockID1).Ready())
+	c.Assert(v1.Resolved, IsFalse)
+	c.Assert(v1.Conflict, Equals, ConflictTypeNone.String())
+	c.Assert(v1.Escalated, IsFalse)
+	c.Assert(v1.Versions[source1][upSchema][upTable], Equals, 1)
+	c.Assert(v1.Versions[source2][upSchema][upTable], Equals, 0)
+	c.Assert(views[1].Synced, IsTrue)
+
+	// JSON serializable.
+	data, err := json.Marshal(v1)
+	c.Assert(err, IsNil)
+	var v1Decoded LockView
+	c.Assert(json.Unmarshal(data, &v1Decoded), IsNil)
+	c.Assert(&v1Decoded, DeepEquals, v1)
+
+	// snapshots are not changed after the lock changed.
+	_, _, err = lk.TrySync(i12, sts1)
+	c.Assert(err, IsNil)
+	c.Assert(lk.FindLock(lockID1).TryMarkDone(source1, upSchema, upTable), IsTrue)
+	c.Assert(v1.Synced, IsFalse)
+	c.Assert(v1.Done[source1][upSchema][upTable], IsFalse)
+	c.Assert(v1.Versions[source2][upSchema][upTable], Equals, 0)
+
+	// the lock is not changed after the snapshot changed.
+	v1 = lk.SnapshotLocks()[0]
+	c.Assert(v1.Synced, IsTrue)
+	c.Assert(v1.Done[source1][upSchema][upTable], IsTrue)
+	v1.Done[source2][upSchema][upTable] = true
+	c.Assert(lk.FindLock(lockID1).IsDone(source2, upSchema, upTable), IsFalse)
+}
+
+func (t *testKeeper) TestLockKeeperSetLockTags(c *C) {
+	var (
+		lk         = NewLockKeeper()
+		upSchema   = "foo_1"
+		upTable    = "bar_1"
+		downSchema = "foo"
+		task       = "test-lock-keeper-set-lock-tags"
+		source     = "mysql-replica-1"
+		DDLs       = []string{"ALTER TABLE bar ADD COLUMN c1 INT"}
+
+		p           = parser.New()
+		se          = mock.NewContext()
+		tblID int64 = 111
+		ti0         = createTableInfo(c, p, se, tblID, `CREATE TABLE bar (id INT PRIMARY KEY)`)
+		ti1         = createTableInfo(c, p, se, tblID, `CREATE TABLE bar (id INT PRIMARY KEY, c1 INT)`)
+
+		sts  = []SourceTables{NewSourceTables(task, source, map[string]map[string]struct{}{upSchema: {upTable: struct{}{}}})}
+		info = NewInfo(task, source, upSchema, upTable, downSchema, "bar", DDLs, ti0, ti1)
+		tags = map[string]string{"ticket": "INC-123", "owner": "dba"}
+	)
+
+	// the lock not found.
+	c.Assert(terror.ErrShardDDLOptimismLockNotFound.Equal(lk.SetLockTags("not-exist", tags)), IsTrue)
+
+	lockID, _, err := lk.TrySync(info, sts)
+	c.Assert(err, IsNil)
+	l := lk.FindLock(lockID)
+	c.Assert(l.Tags(), IsNil)
+	c.Assert(l.View().Tags, IsNil)
+
+	// tags are copied, and included in views.
+	c.Assert(lk.SetLockTags(lockID, tags), IsNil)
+	tags["owner"] = "someone"
+	c.Assert(l.Tags(), DeepEquals, map[string]string{"ticket": "INC-123", "owner": "dba"})
+	view := lk.SnapshotLocks()[0]
+	c.Assert(view.Tags, DeepEquals, l.Tags())
+	view.Tags["ticket"] = "INC-456"
+	c.Assert(l.Tags()["ticket"], Equals, "INC-123")
+	data, err := json.Marshal(view)
+	c.Assert(err, IsNil)
+	c.Assert(string(data), Matches, `.*"tags":\{"owner":"dba","ticket":"INC-456"\}.*`)
+
+	// tags don't affect the coordination.
+	c.Assert(lk.ResetLock(lockID), IsNil)
+	c.Assert(l.Tags(), HasLen, 2)
+	_, newDDLs, err := lk.TrySync(info, sts)
+	c.Assert(err, IsNil)
+	c.Assert(newDDLs, DeepEquals, DDLs)
+
+	// replace and clear tags.
+	c.Assert(lk.SetLockTags(lockID, map[string]string{"ticket": "INC-789"}), IsNil)
+	c.Assert(l.Tags(), DeepEquals, map[string]string{"ticket": "INC-789"})
+	c.Assert(lk.SetLockTags(lockID, nil), IsNil)
+	c.Assert(l.Tags(), IsNil)
+
+	// tags are discarded when the lock is removed.
+	c.Assert(lk.SetLockTags(lockID, tags), IsNil)
+	c.Assert(lk.RemoveLock(lockID), IsTrue)
+	_, _, err = lk.TrySync(info, sts)
+	c.Assert(err, IsNil)
+	c.Assert(lk.FindLock(lockID).Tags(), IsNil)
+}
+
+// upperDDLParser is a DDLParser which normalizes DDLs to upper case.
+type upperDDLParser struct {
+	parsed []string
+}
+
+func (up *upperDDLParser) Parse(ddl string) (ast.StmtNode, error) {
+	up.parsed = append(up.parsed, ddl)
+	return parser.New().ParseOneStmt(ddl, "", "")
+}
+
+func (up *upperDDLParser) Normalize(ddl string) (string, error) {
+	return strings.ToUpper(ddl), nil
+}
+
+func (t *testKeeper) TestLockKeeperDebugHandler(c *C) {
+	var (
+		lk         = NewLockKeeper()
+		upSchema   = "foo_1"
+		upTable    = "bar_1"
+		downSchema = "foo"
+		task       = "task"
+		source     = "mysql-replica-1"
+		DDLs       = []string{"ALTER TABLE bar ADD COLUMN c1 INT"}
+
+		p           = parser.New()
+		se          = mock.NewContext()
+		tblID int64 = 111
+		ti0         = createTableInfo(c, p, se, tblID, `CREATE TABLE bar (id INT PRIMARY KEY)`)
+		ti1         = createTableInfo(c, p, se, tblID, `CREATE TABLE bar (id INT PRIMARY KEY, c1 INT)`)
+
+		tables = map[string]map[string]struct{}{upSchema: {upTable: struct{}{}}}
+		sts    = []SourceTables{NewSourceTables(task, source, tables)}
+		i1     = NewInfo(task, source, upSchema, upTable, downSchema, "bar1", DDLs, ti0, ti1)
+		i2     = NewInfo(task, source, upSchema, upTable, downSchema, "bar2", DDLs, ti0, ti1)
+		h      = lk.DebugHandler()
+	)
+
+	// no locks.
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/", nil))
+	c.Assert(rec.Code, Equals, http.StatusOK)
+	c.Assert(rec.Header().Get("Content-Type"), Equals, "application/json")
+	c.Assert(rec.Body.String(), Equals, "[]")
+
+	_, _, err := lk.TrySync(i1, sts)
+	c.Assert(err, IsNil)
+	_, _, err = lk.TrySync(i2, sts)
+	c.Assert(err, IsNil)
+
+	// the same as the snapshots.
+	rec = httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/", nil))
+	c.Assert(rec.Code, Equals, http.StatusOK)
+	var views []*LockView
+	c.Assert(json.Unmarshal(rec.Body.Bytes(), &views), IsNil)
+	c.Assert(views, DeepEquals, lk.SnapshotLocks())
+}
+
+func (t *testKeeper) TestLockKeeperDDLParser(c *C) {
+	var (
+		lk         = NewLockKeeper()
+		upSchema   = "foo_1"
+		upTable    = "bar_1"
+		downSchema = "foo"
+		downTable  = "bar"
+		task       = "task"
+		source     = "mysql-replica-1"
+		DDLs       = []string{"alter table bar add column c1 int"}
+
+		p           = parser.New()
+		se          = mock.NewContext()
+		tblID int64 = 111
+		ti0         = createTableInfo(c, p, se, tblID, `CREATE TABLE bar (id INT PRIMARY KEY)`)
+		ti1         = createTableInfo(c, p, se, tblID, `CREATE TABLE bar (id INT PRIMARY KEY, c1 INT)`)
+
+		tables = map[string]map[string]struct{}{upSchema: {upTable: struct{}{}}}
+		sts    = []SourceTables{NewSourceTables(task, source, tables)}
+	)
+
+	// invalid DDLs with the default parser.
+	info := NewInfo(task, source, upSchema, upTable, downSchema, downTable, []string{"invalid ddl"}, ti0, ti1)
+	lockID, newDDLs, err := lk.TrySync(info, sts)
+	c.Assert(terror.ErrShardDDLOptimismParseDDL.Equal(err), IsTrue)
+	c.Assert(lockID, Equals, "task-`foo`.`bar`")
+	c.Assert(newDDLs, HasLen, 0)
+	c.Assert(lk.FindLock(lockID), IsNil) // no lock created.
+
+	// valid DDLs are not rewritten by the default parser.
+	info = NewInfo(task, source, upSchema, upTable, downSchema, downTable, DDLs, ti0, ti1)
+	_, newDDLs, err = lk.TrySync(info, sts)
+	c.Assert(err, IsNil)
+	c.Assert(newDDLs, DeepEquals, DDLs)
+
+	// use a custom parser.
+	up := &upperDDLParser{}
+	lk.Clear()
+	lk.SetDDLParser(up)
+	_, newDDLs, err = lk.TrySync(info, sts)
+	c.Assert(err, IsNil)
+	c.Assert(newDDLs, DeepEquals, []string{"ALTER TABLE BAR ADD COLUMN C1 INT"})
+	c.Assert(up.parsed, DeepEquals, DDLs)
+
+	// reset to the default parser.
+	lk.Clear()
+	lk.SetDDLParser(nil)
+	_, newDDLs, err = lk.TrySync(info, sts)
+	c.Assert(err, IsNil)
+	c.Assert(newDDLs, DeepEquals, DDLs)
+}
+
+func (t *testKeeper) TestLockKeeperDDLRewriter(c *C) {
+	var (
+		lk         = NewLockKeeper()
+		upSchema   = "foo_1"
+		upTable    = "bar_1"
+		downSchema = "foo"
+		downTable  = "bar"
+		task       = "task"
+		source1    = "mysql-replica-1"
+		source2    = "mysql-replica-2"
+		DDLs1      = []string{"ALTER TABLE bar ADD COLUMN c1 INT AUTO_INCREMENT UNIQUE"}
+		DDLs2      = []string{"ALTER TABLE bar ADD COLUMN c1 INT UNIQUE"}
+
+		p           = parser.New()
+		se          = mock.NewContext()
+		tblID int64 = 111
+		ti0         = createTableInfo(c, p, se, tblID, `CREATE TABLE bar (id INT PRIMARY KEY)`)
+		ti1         = createTableInfo(c, p, se, tblID, `CREATE TABLE bar (id INT PRIMARY KEY, c1 INT UNIQUE)`)
+
+		tables = map[string]map[string]struct{}{upSchema: {upTable: struct{}{}}}
+		sts    = []SourceTables{
+			NewSourceTables(task, source1, tables),
+			NewSourceTables(task, source2, tables),
+		}
+		i1 = NewInfo(task, source1, upSchema, upTable, downSchema, downTable, DDLs1, ti0, ti1)
+		i2 = NewInfo(task, source2, upSchema, upTable, downSchema, downTable, DDLs2, ti0, ti1)
+
+		rewritten []string
+		rewriter  = func(ddl string) (string, error) {
+			rewritten = append(rewritten, ddl)
+			if strings.HasPrefix(ddl, "invalid") {
+				return "", errors.New("invalid ddl")
+			}
+			return strings.Replace(ddl, " AUTO_INCREMENT", "", -1), nil
+		}
+	)
+
+	// DDLs are not rewritten by default.
+	lockID, newDDLs, err := lk.TrySync(i1, sts)
+	c.Assert(err, IsNil)
+	c.Assert(newDDLs, DeepEquals, DDLs1)
+
+	// the rewritten DDLs are used to sync the lock and executed to the downstream.
+	lk.Clear()
+	lk.SetDDLRewriter(rewriter)
+	_, newDDLs, err = lk.TrySync(i1, sts)
+	c.Assert(err, IsNil)
+	c.Assert(newDDLs, DeepEquals, DDLs2)
+	c.Assert(rewritten, DeepEquals, DDLs1)
+	_, newDDLs, err = lk.TrySync(i2, sts)
+	c.Assert(err, IsNil)
+	c.Assert(newDDLs, DeepEquals, DDLs2)
+	synced, remain := lk.FindLock(lockID).IsSynced()
+	c.Assert(synced, IsTrue)
+	c.Assert(remain, Equals, 0)
+
+	// fail to rewrite DDLs.
+	lk.Clear()
+	info := NewInfo(task, source1, upSchema, upTable, downSchema, downTable, []string{"invalid ddl"}, ti0, ti1)
+	_, newDDLs, err = lk.TrySync(info, sts)
+	c.Assert(terror.ErrShardDDLOptimismRewriteDDL.Equal(err), IsTrue)
+	c.Assert(newDDLs, HasLen, 0)
+	c.Assert(lk.FindLock(lockID), IsNil) // no lock created.
+
+	// reset to not rewrite DDLs.
+	lk.SetDDLRewriter(nil)
+	_, newDDLs, err = lk.TrySync(i1, sts)
+	c.Assert(err, IsNil)
+	c.Assert(newDDLs, DeepEquals, DDLs1)
+}
+
+// countDDLParser is a DDLParser which counts the DDLs normalized.
+type countDDLParser struct {
+	DDLParser
+	count int32
+}
+
+func (cp *countDDLParser) Normalize(ddl string) (string, error) {
+	atomic.AddInt32(&cp.count, 1)
+	return cp.DDLParser.Normalize(ddl)
+}
+
+func (t *testKeeper) TestLockKeeperDedup(c *C) {
+	var (
+		lk         = NewLockKeeper()
+		cp         = &countDDLParser{DDLParser: newTiDBDDLParser()}
+		upSchema   = "foo_1"
+		upTable    = "bar_1"
+		downSchema = "foo"
+		downTable  = "bar"
+		task       = "task"
+		source1    = "mysql-replica-1"
+		source2    = "mysql-replica-2"
+		DDLs1      = []string{"ALTER TABLE bar ADD COLUMN c1 INT"}
+		DDLs2      = []string{"ALTER TABLE bar ADD COLUMN c2 INT"}
+
+		p           = parser.New()
+		se          = mock.NewContext()
+		tblID int64 = 111
+		ti0         = createTableInfo(c, p, se, tblID, `CREATE TABLE bar (id INT PRIMARY KEY)`)
+		ti1         = createTableInfo(c, p, se, tblID, `CREATE TABLE bar (id INT PRIMARY KEY, c1 INT)`)
+		ti2         = createTableInfo(c, p, se, tblID, `CREATE TABLE bar (id INT PRIMARY KEY, c1 INT, c2 INT)`)
+
+		tables = map[string]map[string]struct{}{upSchema: {upTable: struct{}{}}}
+		sts    = []SourceTables{
+			NewSourceTables(task, source1, tables),
+			NewSourceTables(task, source2, tables),
+		}
+		i11 = NewInfo(task, source1, upSchema, upTable, downSchema, downTable, DDLs1, ti0, ti1)
+		i12 = NewInfo(task, source1, upSchema, upTable, downSchema, downTable, DDLs2, ti1, ti2)
+		i21 = NewInfo(task, source2, upSchema, upTable, downSchema, downTable, DDLs1, ti0, ti1)
+	)
+	lk.SetDDLParser(cp)
+
+	// dedup is disabled by default.
+	res1, err := lk.TrySyncResult(i11, sts)
+	c.Assert(err, IsNil)
+	_, err = lk.TrySyncResult(i11, sts)
+	c.Assert(err, IsNil)
+	c.Assert(atomic.LoadInt32(&cp.count), Equals, int32(2))
+
+	// submit the same info twice concurrently.
+	lk.Clear()
+	atomic.StoreInt32(&cp.count, 0)
+	lk.SetDedupWindow(time.Hour)
+	var (
+		wg      sync.WaitGroup
+		results = make([]SyncResult, 2)
+		errs    = make([]error, 2)
+	)
+	for i := range results {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			results[i], errs[i] = lk.TrySyncResult(i11, sts)
+		}(i)
+	}
+	wg.Wait()
+	c.Assert(errs[0], IsNil)
+	c.Assert(errs[1], IsNil)
+	c.Assert(results[0], DeepEquals, results[1])
+	c.Assert(results[0], DeepEquals, res1)
+	c.Assert(atomic.LoadInt32(&cp.count), Equals, int32(1)) // only processed once.
+
+	// the returned result can be changed without affecting later ones.
+	results[0].DDLs[0] = "changed"
+	res, err := lk.TrySyncResult(i11, sts)
+	c.Assert(err, IsNil)
+	c.Assert(res.DDLs, DeepEquals, DDLs1)
+	c.Assert(atomic.LoadInt32(&cp.count), Equals, int32(1))
+
+	// different infos are not deduplicated.
+	_, err = lk.TrySyncResult(i21, sts)
+	c.Assert(err, IsNil)
+	c.Assert(atomic.LoadInt32(&cp.count), Equals, int32(2))
+	_, err = lk.TrySyncResult(i12, sts)
+	c.Assert(err, IsNil)
+	c.Assert(atomic.LoadInt32(&cp.count), Equals, int32(3))
+	// i11 is different from the latest info (i12) for the table now.
+	_, err = lk.TrySyncResult(i11, sts)
+	c.Assert(err, IsNil)
+	c.Assert(atomic.LoadInt32(&cp.count), Equals, int32(4))
+
+	// results are discarded after the lock removed.
+	c.Assert(lk.RemoveLock(res1.LockID), IsTrue)
+	_, err = lk.TrySyncResult(i11, sts)
+	c.Assert(err, IsNil)
+	c.Assert(atomic.LoadInt32(&cp.count), Equals, int32(5))
+	c.Assert(lk.FindLock(res1.LockID), NotNil)
+
+	// not deduplicated after the window passed.
+	lk.SetDedupWindow(time.Millisecond)
+	_, err = lk.TrySyncResult(i11, sts)
+	c.Assert(err, IsNil)
+	time.Sleep(10 * time.Millisecond)
+	_, err = lk.TrySyncResult(i11, sts)
+	c.Assert(err, IsNil)
+	c.Assert(atomic.LoadInt32(&cp.count), Equals, int32(7))
+}
+
+func (t *testKeeper) TestGroupInfosByLock(c *C) {
+	var (
+		task1   = "task-1"
+		task2   = "task-2"
+		source1 = "mysql-replica-1"
+		source2 = "mysql-replica-2"
+		DDLs    = []string{"ALTER TABLE bar ADD COLUMN c1 INT"}
+		i11     = NewInfo(task1, source1, "foo_1", "bar_1", "foo", "bar", DDLs, nil, nil)
+		i12     = NewInfo(task1, source1, "foo_1", "bar_2", "foo", "bar", DDLs, nil, nil)
+		i13     = NewInfo(task1, source1, "foo_1", "rab_1", "foo", "rab", DDLs, nil, nil)
+		i14     = NewInfo(task1, source2, "foo_1", "bar_1", "foo", "bar", DDLs, nil, nil)
+		i15     = NewInfo(task1, source2, "foo_0", "bar_1", "foo", "bar", DDLs, nil, nil)
+		i21     = NewInfo(task2, source1, "foo_1", "bar_1", "foo", "bar", DDLs, nil, nil)
+		ifm     = map[string]map[string]map[string]map[string]Info{
+			task1: {
+				source1: {"foo_1": {"bar_1": i11, "bar_2": i12, "rab_1": i13}},
+				source2: {"foo_1": {"bar_1": i14}, "foo_0": {"bar_1": i15}},
+			},
+			task2: {
+				source1: {"foo_1": {"bar_1": i21}},
+			},
+		}
+	)
+
+	c.Assert(GroupInfosByLock(nil), HasLen, 0)
+	c.Assert(GroupInfosByLock(ifm), DeepEquals, map[string][]Info{
+		"task-1-`foo`.`bar`": {i11, i12, i15, i14},
+		"task-1-`foo`.`rab`": {i13},
+		"task-2-`foo`.`bar`": {i21},
+	})
+}
+
+func (t *testKeeper) TestGroupInfosBySource(c *C) {
+	var (
+		task1   = "task-1"
+		task2   = "task-2"
+		source1 = "mysql-replica-1"
+		source2 = "mysql-replica-2"
+		DDLs    = []string{"ALTER TABLE bar ADD COLUMN c1 INT"}
+		i11     = NewInfo(task1, source1, "foo_1", "bar_1", "foo", "bar", DDLs, nil, nil)
+		i12     = NewInfo(task1, source1, "foo_1", "bar_2", "foo", "bar", DDLs, nil, nil)
+		i13     = NewInfo(task1, source1, "foo_0", "rab_1", "foo", "rab", DDLs, nil, nil)
+		i14     = NewInfo(task1, source2, "foo_1", "bar_1", "foo", "bar", DDLs, nil, nil)
+		i21     = NewInfo(task2, source1, "foo_1", "bar_1", "foo", "bar", DDLs, nil, nil)
+		ifm     = map[string]map[string]map[string]map[string]Info{
+			task1: {
+				source1: {"foo_1": {"bar_2": i12, "bar_1": i11}, "foo_0": {"rab_1": i13}},
+				source2: {"foo_1": {"bar_1": i14}},
+			},
+			task2: {
+				source1: {"foo_1": {"bar_1": i21}},
+			},
+		}
+	)
+
+	c.Assert(GroupInfosBySource(nil, task1), HasLen, 0)
+	c.Assert(GroupInfosBySource(ifm, "not-exist"), HasLen, 0)
+	c.Assert(GroupInfosBySource(ifm, task1), DeepEquals, map[string][]Info{
+		source1: {i13, i11, i12},
+		source2: {i14},
+	})
+	c.Assert(GroupInfosBySource(ifm, task2), DeepEquals, map[string][]Info{
+		source1: {i21},
+	})
+}
+
+func (t *testKeeper) TestLockKeeperSelfCheck(c *C) {
+	var (
+		lk         = NewLockKeeper()
+		upSchema   = "foo_1"
+		upTable    = "bar_1"
+		downSchema = "foo"
+		downTable  = "bar"
+		DDLs       = []string{"ALTER TABLE bar ADD COLUMN c1 INT"}
+		task1      = "task1"
+		task2      = "task2"
+		source1    = "mysql-replica-1"
+		source2    = "mysql-replica-2"
+
+		p              = parser.New()
+		se             = mock.NewContext()
+		tblID    int64 = 111
+		tiBefore       = createTableInfo(c, p, se, tblID, `CREATE TABLE bar (id INT PRIMARY KEY)`)
+		tiAfter        = createTableInfo(c, p, se, tblID, `CREATE TABLE bar (id INT PRIMARY KEY, c1 INT)`)
+
+		i11 = NewInfo(task1, source1, upSchema, upTable, downSchema, downTable, DDLs, tiBefore, tiAfter)
+		i12 = NewInfo(task1, source2, upSchema, upTable, downSchema, downTable, DDLs, tiBefore, tiAfter)
+		i21 = NewInfo(task2, source1, upSchema, upTable, downSchema, downTable, DDLs, tiBefore, tiAfter)
+
+		tables = map[string]map[string]struct{}{upSchema: {upTable: struct{}{}}}
+		stm    = map[string]map[string]SourceTables{
+			task1: {
+				source1: NewSourceTables(task1, source1, tables),
+				source2: NewSourceTables(task1, source2, tables),
+			},
+			task2: {
+				source1: NewSourceTables(task2, source1, tables),
+			},
+		}
+		ifm = map[string]map[string]map[string]map[string]Info{
+			task1: {
+				source1: {upSchema: {upTable: i11}},
+				source2: {upSchema: {upTable: i12}},
+			},
+		}
+	)
+
+	// no info and no lock.
+	c.Assert(lk.SelfCheck(nil, nil, nil), HasLen, 0)
+
+	// a lock is missing.
+	findings := lk.SelfCheck(ifm, nil, stm)
+	c.Assert(findings, DeepEquals, []string{"lock task1-`foo`.`bar` is missing"})
+
+	// the lock is not synced as expected.
+	lockID, _, err := lk.TrySync(i11, SourceTablesMapToSlice(stm[task1]))
+	c.Assert(err, IsNil)
+	findings = lk.SelfCheck(ifm, nil, stm)
+	c.Assert(findings, HasLen, 1)
+	c.Assert(findings[0], Matches, "synced status of lock task1-`foo`.`bar` mismatch.*")
+
+	// consistent.
+	_, _, err = lk.TrySync(i12, SourceTablesMapToSlice(stm[task1]))
+	c.Assert(err, IsNil)
+	c.Assert(lk.SelfCheck(ifm, nil, stm), HasLen, 0)
+
+	// only the done status is different.
+	c.Assert(lk.FindLock(lockID).TryMarkDone(source1, upSchema, upTable), IsTrue)
+	findings = lk.SelfCheck(ifm, nil, stm)
+	c.Assert(findings, HasLen, 1)
+	c.Assert(findings[0], Matches, "done status of lock task1-`foo`.`bar` mismatch.*")
+
+	// consistent with the done operation.
+	opm := map[string]map[string]map[string]map[string]Operation{
+		task1: {
+			source1: {upSchema: {upTable: NewOperation(lockID, task1, source1, upSchema, upTable, DDLs, ConflictNone, true)}},
+			source2: {upSchema: {upTable: NewOperation(lockID, task1, source2, upSchema, upTable, DDLs, ConflictNone, false)}},
+		},
+	}
+	c.Assert(lk.SelfCheck(ifm, opm, stm), HasLen, 0)
+
+	// pending DDLs are different after the lock resolved.
+	c.Assert(lk.FindLock(lockID).TryMarkDone(source2, upSchema, upTable), IsTrue)
+	findings = lk.SelfCheck(ifm, opm, stm)
+	c.Assert(findings, HasLen, 2)
+	c.Assert(findings[0], Matches, "done status of lock task1-`foo`.`bar` mismatch.*")
+	c.Assert(findings[1], Equals, "pending DDLs of lock task1-`foo`.`bar` mismatch, expected [ALTER TABLE bar ADD COLUMN c1 INT], got []")
+	opm[task1][source2][upSchema][upTable] = NewOperation(lockID, task1, source2, upSchema, upTable, DDLs, ConflictNone, true)
+	c.Assert(lk.SelfCheck(ifm, opm, stm), HasLen, 0)
+
+	// an extra lock.
+	_, _, err = lk.TrySync(i21, SourceTablesMapToSlice(stm[task2]))
+	c.Assert(err, IsNil)
+	c.Assert(lk.SelfCheck(ifm, opm, stm), DeepEquals, []string{"lock task2-`foo`.`bar` is unexpected"})
+}
+
+func (t *testKeeper) TestLockKeeperSelfCheckRewriter(c *C) {
+	var (
+		lk         = NewLockKeeper()
+		upSchema   = "foo_1"
+		upTable    = "bar_1"
+		downSchema = "foo"
+		downTable  = "bar"
+		DDLs       = []string{"ALTER TABLE bar ADD COLUMN c1 INT GARBAGE"} // can't be parsed without rewriting.
+		task       = "task"
+		source     = "mysql-replica-1"
+
+		p           = parser.New()
+		se          = mock.NewContext()
+		tblID int64 = 111
+		ti0         = createTableInfo(c, p, se, tblID, `CREATE TABLE bar (id INT PRIMARY KEY)`)
+		ti1         = createTableInfo(c, p, se, tblID, `CREATE TABLE bar (id INT PRIMARY KEY, c1 INT)`)
+
+		info   = NewInfo(task, source, upSchema, upTable, downSchema, downTable, DDLs, ti0, ti1)
+		tables = map[string]map[string]struct{}{upSchema: {upTable: struct{}{}}}
+		stm    = map[string]map[string]SourceTables{task: {source: NewSourceTables(task, source, tables)}}
+		ifm    = map[string]map[string]map[string]map[string]Info{task: {source: {upSchema: {upTable: info}}}}
+	)
+
+	lk.SetDDLRewriter(func(ddl string) (string, error) {
+		return strings.Replace(ddl, " GARBAGE", "", -1), nil
+	})
+	_, newDDLs, err := lk.TrySync(info, SourceTablesMapToSlice(stm[task]))
+	c.Assert(err, IsNil)
+	c.Assert(newDDLs, DeepEquals, []string{"ALTER TABLE bar ADD COLUMN c1 INT"})
+
+	// locks are re-constructed with the same rewriter.
+	c.Assert(lk.SelfCheck(ifm, nil, stm), HasLen, 0)
+
+	// the configuration of the keeper is not changed by the self check.
+	lk.SetDDLRewriter(nil)
+	findings := lk.SelfCheck(ifm, nil, stm)
+	c.Assert(findings, HasLen, 2)
+	c.Assert(findings[0], Matches, "fail to try sync shard DDL info .*")
+	c.Assert(findings[1], Equals, "lock task-`foo`.`bar` is unexpected")
+}
+
+func (t *testKeeper) TestTableKeeper(c *C) {
+	var (
+		tk      = NewTableKeeper()
+		task1   = "task-1"
+		task2   = "task-2"
+		source1 = "mysql-replica-1"
+		source2 = "mysql-replica-2"
+		st11    = NewSourceTables(task1, source1, map[string]map[string]struct{}{
+			"db": {"tbl-1": struct{}{}, "tbl-2": struct{}{}},
+		})
+		st12 = NewSourceTables(task1, source2, map[string]map[string]struct{}{
+			"db": {"tbl-1": struct{}{}, "tbl-2": struct{}{}},
+		})
+		st21 = NewSourceTables(task2, source2, map[string]map[string]struct{}{
+			"db": {"tbl-3": struct{}{}},
+		})
+		st22 = NewSourceTables(task2, source2, map[string]map[string]struct{}{
+			"db": {"tbl-3": struct{}{}, "tbl-4": struct{}{}},
+		})
+		stm = map[string]map[string]SourceTables{
+			task1: {source2: st12, source1: st11},
+		}
+	)
+
+	// no tables exist before Init/Update.
+	c.Assert(tk.FindTables(task1), IsNil)
+
+	// Init with `nil` is fine.
+	tk.Init(nil)
+	c.Assert(tk.FindTables(task1), IsNil)
+
+	// tables for task1 exit after Init.
+	tk.Init(stm)
+	sts := tk.FindTables(task1)
+	c.Assert(sts, HasLen, 2)
+	c.Assert(sts[0], DeepEquals, st11)
+	c.Assert(sts[1], DeepEquals, st12)
+
+	// adds new tables.
+	c.Assert(tk.Update(st21), IsTrue)
+	sts = tk.FindTables(task2)
+	c.Assert(sts, HasLen, 1)
+	c.Assert(sts[0], DeepEquals, st21)
+
+	// updates/appends new tables.
+	c.Assert(tk.Update(st22), IsTrue)
+	sts = tk.FindTables(task2)
+	c.Assert(sts, HasLen, 1)
+	c.Assert(sts[0], DeepEquals, st22)
+
+	// deletes tables.
+	st22.IsDeleted = true
+	c.Assert(tk.Update(st22), IsTrue)
+	c.Assert(tk.FindTables(task2), IsNil)
+
+	// try to delete, but not exist.
+	c.Assert(tk.Update(st22), IsFalse)
+	st22.Task = "not-exist"
+	c.Assert(tk.Update(st22), IsFalse)
+
+	// tables for task1 not affected.
+	sts = tk.FindTables(task1)
+	c.Assert(sts, HasLen, 2)
+	c.Assert(sts[0], DeepEquals, st11)
+	c.Assert(sts[1], DeepEquals, st12)
+
+	// add a table for st11.
+	c.Assert(tk.AddTable(task1, st11.Source, "db-2", "tbl-3"), IsTrue)
+	c.Assert(tk.AddTable(task1, st11.Source, "db-2", "tbl-3"), IsFalse)
+	sts = tk.FindTables(task1)
+	st11n := sts[0]
+	c.Assert(st11n.Tables, HasKey, "db-2")
+	c.Assert(st11n.Tables["db-2"], HasKey, "tbl-3")
+
+	// removed the added table in st11.
+	c.Assert(tk.RemoveTable(task1, st11.Source, "db-2", "tbl-3"), IsTrue)
+	c.Assert(tk.RemoveTable(task1, st11.Source, "db-2", "tbl-3"), IsFalse)
+	sts = tk.FindTables(task1)
+	st11n = sts[0]
+	c.Assert(st11n.Tables["db-2"], IsNil)
+
+	// adds for not existing task takes no effect.
+	c.Assert(tk.AddTable("not-exist", st11.Source, "db-2", "tbl-3"), IsFalse)
+	// adds for not existing source takes effect.
+	c.Assert(tk.AddTable(task1, "new-source", "db-2", "tbl-3"), IsTrue)
+	sts = tk.FindTables(task1)
+	c.Assert(sts, HasLen, 3)
+	c.Assert(sts[2].Source, Equals, "new-source")
+	c.Assert(sts[2].Tables["db-2"], HasKey, "tbl-3")
+
+	// removes for not existing task/source takes no effect.
+	c.Assert(tk.RemoveTable("not-exit", st12.Source, "db", "tbl-1"), IsFalse)
+	c.Assert(tk.RemoveTable(task1, "not-exit", "db", "tbl-1"), IsFalse)
+	sts = tk.FindTables(task1)
+	c.Assert(sts[1], DeepEquals, st12)
+
+	// adds multiple tables at once.
+	c.Assert(tk.AddTables(task1, st12.Source, map[string][]string{
+		"db":   {"tbl-1", "tbl-3"},
+		"db-3": {"tbl-4", "tbl-5"},
+	}), Equals, 3)
+	c.Assert(tk.AddTables(task1, st12.Source, map[string][]string{"db-3": {"tbl-4"}}), Equals, 0)
+	sts = tk.FindTables(task1)
+	c.Assert(sts[1].Tables["db"], HasLen, 3)
+	c.Assert(sts[1].Tables["db-3"], HasLen, 2)
+
+	// adds multiple tables for not existing task takes no effect.
+	c.Assert(tk.AddTables("not-exist", st12.Source, map[string][]string{"db": {"tbl-1"}}), Equals, 0)
+	c.Assert(tk.FindTables("not-exist"), IsNil)
+
+	// adds no table for a new source neither creates the source nor changes the generation.
+	gen := tk.Generation()
+	c.Assert(tk.AddTables(task1, "empty-source", map[string][]string{"db": {}}), Equals, 0)
+	c.Assert(tk.FindTables(task1), HasLen, len(sts))
+	c.Assert(tk.Generation(), Equals, gen)
+
+	// drain task1, adds are rejected but reads succeed.
+	c.Assert(tk.IsDrained(task1), IsFalse)
+	tk.DrainTask(task1)
+	c.Assert(tk.IsDrained(task1), IsTrue)
+	c.Assert(tk.IsDrained(task2), IsFalse)
+	c.Assert(tk.AddTable(task1, st11.Source, "db-4", "tbl-1"), IsFalse)
+	c.Assert(tk.AddTables(task1, st11.Source, map[string][]string{"db-4": {"tbl-1"}}), Equals, 0)
+	c.Assert(tk.Update(st11), IsFalse)
+	sts = tk.FindTables(task1)
+	c.Assert(sts, HasLen, 3)
+	c.Assert(sts[0].Tables, Not(HasKey), "db-4")
+	// removes are still allowed.
+	c.Assert(tk.RemoveTable(task1, "new-source", "db-2", "tbl-3"), IsTrue)
+
+	// undrain task1, adds are accepted again.
+	tk.UndrainTask(task1)
+	c.Assert(tk.IsDrained(task1), IsFalse)
+	c.Assert(tk.AddTable(task1, st11.Source, "db-4", "tbl-1"), IsTrue)
+	st11 = NewSourceTablesBuilder(task1, st11.Source).AddSchema("db-5", "tbl-1").Build()
+	c.Assert(tk.Update(st11), IsTrue)
+
+	// update with the same tables is skipped.
+	c.Assert(tk.Update(NewSourceTablesBuilder(task1, st11.Source).AddSchema("db-5", "tbl-1").Build()), IsFalse)
+	c.Assert(tk.FindTables(task1)[0], DeepEquals, st11)
+}
+
+func (t *testKeeper) TestTableKeeperCompact(c *C) {
+	var (
+		tk      = NewTableKeeper()
+		task1   = "task-1"
+		task2   = "task-2"
+		task3   = "task-3"
+		source1 = "mysql-replica-1"
+		source2 = "mysql-replica-2"
+	)
+
+	tk.Init(map[string]map[string]SourceTables{
+		task1: {
+			source1: NewSourceTablesBuilder(task1, source1).AddSchema("db-1", "tbl-1", "tbl-2").AddSchema("db-2", "tbl-1").Build(),
+			source2: NewSourceTablesBuilder(task1, source2).AddSchema("db-1", "tbl-1").Build(),
+		},
+		task2: {
+			source1: NewSourceTablesBuilder(task2, source1).AddSchema("db-1", "tbl-1").Build(),
+		},
+		task3: {
+			source1: NewSourceTablesBuilder(task3, source1).AddSchema("db-1", "tbl-1").Build(),
+		},
+	})
+	tk.DrainTask(task2)
+
+	// make some empty containers.
+	c.Assert(tk.RemoveTable(task1, source1, "db-2", "tbl-1"), IsTrue)
+	c.Assert(tk.RemoveTable(task1, source2, "db-1", "tbl-1"), IsTrue) // source2 has no tables.
+	c.Assert(tk.RemoveTable(task2, source1, "db-1", "tbl-1"), IsTrue) // task2 has no tables.
+	st31 := NewSourceTables(task3, source1, nil)
+	st31.IsDeleted = true
+	c.Assert(tk.Update(st31), IsTrue) // task3 has no sources.
+
+	before := tk.Clone()
+	tables1 := tk.FindTables(task1)
+	gen := tk.Generation()
+	tk.Compact()
+	c.Assert(tk.Generation(), Greater, gen)
+	c.Assert(tk.Equal(before), IsFalse)
+	// empty schemas and sources are dropped.
+	sts := tk.FindTables(task1)
+	c.Assert(sts, HasLen, 1)
+	c.Assert(sts[0].Source, Equals, source1)
+	c.Assert(sts[0].Tables, HasLen, 1)
+	c.Assert(sts[0].Tables["db-1"], DeepEquals, tables1[0].Tables["db-1"])
+	c.Assert(tk.FindTables(task2), HasLen, 0)
+	c.Assert(tk.IsDrained(task2), IsTrue)
+
+	// compact again without empty containers takes no effect.
+	after := tk.Clone()
+	gen = tk.Generation()
+	tk.Compact()
+	c.Assert(tk.Generation(), Equals, gen)
+	c.Assert(tk.Equal(after), IsTrue)
+
+	// the compacted keeper still accepts and rejects the same adds, empty tasks are kept.
+	c.Assert(tk.AddTable(task1, source2, "db-1", "tbl-1"), IsTrue)
+	c.Assert(tk.FindTables(task1), HasLen, 2)
+	c.Assert(tk.AddTable(task2, source1, "db-1", "tbl-1"), IsFalse) // task2 is drained.
+	c.Assert(tk.AddTable(task3, source1, "db-1", "tbl-1"), IsTrue)  // task3 still exists.
+	c.Assert(before.AddTable(task3, source1, "db-1", "tbl-1"), IsTrue)
+}
+
+func (t *testKeeper) TestTableKeeperTasksForTable(c *C) {
+	var (
+		tk      = NewTableKeeper()
+		task1   = "task-1"
+		task2   = "task-2"
+		task3   = "task-3"
+		source1 = "mysql-replica-1"
+		source2 = "mysql-replica-2"
+	)
+
+	c.Assert(tk.TasksForTable(source1, "db", "tbl-1"), HasLen, 0)
+
+	tk.Init(map[string]map[string]SourceTables{
+		task1: {
+			source1: NewSourceTablesBuilder(task1, source1).AddSchema("db", "tbl-1", "tbl-2").Build(),
+			source2: NewSourceTablesBuilder(task1, source2).AddSchema("db", "tbl-3").Build(),
+		},
+		task2: {
+			source1: NewSourceTablesBuilder(task2, source1).AddSchema("db", "tbl-1").Build(),
+		},
+		task3: {
+			source2: NewSourceTablesBuilder(task3, source2).AddSchema("db", "tbl-1").Build(),
+		},
+	})
+
+	// the table appears in multiple tasks.
+	c.Assert(tk.TasksForTable(source1, "db", "tbl-1"), DeepEquals, []string{task1, task2})
+	c.Assert(tk.TasksForTable(source1, "db", "tbl-2"), DeepEquals, []string{task1})
+	c.Assert(tk.TasksForTable(source2, "db", "tbl-1"), DeepEquals, []string{task3})
+	c.Assert(tk.TasksForTable(source2, "db", "tbl-2"), HasLen, 0)
+	c.Assert(tk.TasksForTable(source1, "not-exist", "tbl-1"), HasLen, 0)
+	c.Assert(tk.TasksForTable("not-exist", "db", "tbl-1"), HasLen, 0)
+
+	// not found after removed.
+	c.Assert(tk.RemoveTable(task2, source1, "db", "tbl-1"), IsTrue)
+	c.Assert(tk.TasksForTable(source1, "db", "tbl-1"), DeepEquals, []string{task1})
+}
+
+func (t *testKeeper) TestTableKeeperAllSources(c *C) {
+	var (
+		tk      = NewTableKeeper()
+		task1   = "task-1"
+		task2   = "task-2"
+		source1 = "mysql-replica-1"
+		source2 = "mysql-replica-2"
+	)
+
+	c.Assert(tk.AllSources(), HasLen, 0)
+
+	tk.Init(map[string]map[string]SourceTables{
+		task2: {
+			source2: NewSourceTablesBuilder(task2, source2).AddSchema("db", "tbl-1").Build(),
+			source1: NewSourceTablesBuilder(task2, source1).AddSchema("db", "tbl-1").Build(),
+		},
+		task1: {
+			source2: NewSourceTablesBuilder(task1, source2).AddSchema("db", "tbl-1").Build(),
+		},
+	})
+
+	// sorted by task and then source.
+	c.Assert(tk.AllSources(), DeepEquals, []TaskSource{
+		{Task: task1, Source: source2},
+		{Task: task2, Source: source1},
+		{Task: task2, Source: source2},
+	})
+
+	// a new source added.
+	c.Assert(tk.AddTable(task1, source1, "db", "tbl-1"), IsTrue)
+	c.Assert(tk.AllSources(), DeepEquals, []TaskSource{
+		{Task: task1, Source: source1},
+		{Task: task1, Source: source2},
+		{Task: task2, Source: source1},
+		{Task: task2, Source: source2},
+	})
+}
+
+func (t *testKeeper) TestTableKeeperClone(c *C) {
+	var (
+		tk      = NewTableKeeper()
+		task1   = "task-1"
+		task2   = "task-2"
+		source1 = "mysql-replica-1"
+		st11    = NewSourceTablesBuilder(task1, source1).AddSchema("db", "tbl-1").Build()
+		st21    = NewSourceTablesBuilder(task2, source1).AddSchema("db", "tbl-1").Build()
+	)
+
+	tk.Init(map[string]map[string]SourceTables{
+		task1: {source1: st11},
+		task2: {source1: st21},
+	})
+	tk.DrainTask(task2)
+
+	// mutating source tables passed in doesn't affect the keeper.
+	st11.AddTable("db", "tbl-2")
+	c.Assert(tk.FindTables(task1)[0].Tables["db"], HasLen, 1)
+	c.Assert(tk.Update(st11), IsTrue)
+	st11.AddTable("db", "tbl-3")
+	c.Assert(tk.FindTables(task1)[0].Tables["db"], HasLen, 2)
+
+	// mutating source tables found doesn't affect the keeper.
+	sts := tk.FindTables(task1)
+	sts[0].AddTable("db", "tbl-4")
+	c.Assert(tk.FindTables(task1)[0].Tables["db"], HasLen, 2)
+
+	// the clone is independent.
+	clone := tk.Clone()
+	c.Assert(clone.FindTables(task1), DeepEquals, tk.FindTables(task1))
+	c.Assert(clone.FindTables(task2), DeepEquals, tk.FindTables(task2))
+	c.Assert(clone.IsDrained(task2), IsTrue)
+	c.Assert(clone.Generation(), Equals, tk.Generation())
+	c.Assert(clone.AddTable(task1, source1, "db", "tbl-5"), IsTrue)
+	c.Assert(tk.FindTables(task1)[0].Tables["db"], HasLen, 2)
+	c.Assert(tk.RemoveTable(task1, source1, "db", "tbl-1"), IsTrue)
+	c.Assert(clone.FindTables(task1)[0].Tables["db"], HasLen, 3)
+	clone.UndrainTask(task2)
+	c.Assert(tk.IsDrained(task2), IsTrue)
+}
+
+func (t *testKeeper) TestTableKeeperDebugHandler(c *C) {
+	var (
+		tk      = NewTableKeeper()
+		task1   = "task-1"
+		task2   = "task-2"
+		source1 = "mysql-replica-1"
+		h       = tk.DebugHandler()
+	)
+
+	// no tables.
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/", nil))
+	c.Assert(rec.Code, Equals, http.StatusOK)
+	c.Assert(rec.Header().Get("Content-Type"), Equals, "application/json")
+	c.Assert(rec.Body.String(), Equals, `{"tables":{},"drained":[],"revision":0}`)
+
+	st := NewSourceTablesBuilder(task1, source1).AddSchema("db", "tbl-1", "tbl-2").Build()
+	tk.Init(map[string]map[string]SourceTables{task1: {source1: st}})
+	tk.DrainTask(task2)
+
+	rec = httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/", nil))
+	c.Assert(rec.Code, Equals, http.StatusOK)
+	var state struct {
+		Tables  map[string]map[string]SourceTables `json:"tables"`
+		Drained []string                           `json:"drained"`
+	}
+	c.Assert(json.Unmarshal(rec.Body.Bytes(), &state), IsNil)
+	c.Assert(state.Tables, DeepEquals, map[string]map[string]SourceTables{task1: {source1: st}})
+	c.Assert(state.Drained, DeepEquals, []string{task2})
+}
+
+func (t *testKeeper) TestTableKeeperWriteRead(c *C) {
+	var (
+		tk      = NewTableKeeper()
+		task1   = "task-1"
+		task2   = "task-2"
+		source1 = "mysql-replica-1"
+		source2 = "mysql-replica-2"
+		buf     bytes.Buffer
+	)
+
+	// an empty keeper.
+	n, err := tk.WriteTo(&buf)
+	c.Assert(err, IsNil)
+	c.Assert(n, Equals, int64(buf.Len()))
+	c.Assert(buf.String(), Equals, `{"tables":{},"drained":[],"revision":0}`)
+	tk2, err := ReadTableKeeper(&buf)
+	c.Assert(err, IsNil)
+	c.Assert(tk2.Equal(tk), IsTrue)
+
+	tk.Init(map[string]map[string]SourceTables{
+		task1: {
+			source2: NewSourceTablesBuilder(task1, source2).AddSchema("db-2", "tbl-2", "tbl-1").Build(),
+			source1: NewSourceTablesBuilder(task1, source1).AddSchema("db-1", "tbl-1").Build(),
+		},
+	})
+	tk.DrainTask(task2)
+	c.Assert(tk.Equal(tk2), IsFalse)
+
+	// the round trip reproduces an equal keeper.
+	buf.Reset()
+	_, err = tk.WriteTo(&buf)
+	c.Assert(err, IsNil)
+	data := buf.String()
+	tk2, err = ReadTableKeeper(&buf)
+	c.Assert(err, IsNil)
+	c.Assert(tk2.Equal(tk), IsTrue)
+	c.Assert(tk.Equal(tk2), IsTrue)
+	c.Assert(tk2.IsDrained(task2), IsTrue)
+	c.Assert(tk2.FindTables(task1), DeepEquals, tk.FindTables(task1))
+
+	// the encoding is stable.
+	buf.Reset()
+	_, err = tk2.WriteTo(&buf)
+	c.Assert(err, IsNil)
+	c.Assert(buf.String(), Equals, data)
+	c.Assert(strings.Index(data, source1), Less, strings.Index(data, source2))
+
+	// changes are detected.
+	c.Assert(tk2.AddTable(task1, source1, "db-1", "tbl-2"), IsTrue)
+	c.Assert(tk2.Equal(tk), IsFalse)
+	c.Assert(tk2.RemoveTable(task1, source1, "db-1", "tbl-2"), IsTrue)
+	c.Assert(tk2.Equal(tk), IsTrue)
+	tk2.UndrainTask(task2)
+	c.Assert(tk2.Equal(tk), IsFalse)
+
+	// invalid data.
+	_, err = ReadTableKeeper(strings.NewReader("invalid"))
+	c.Assert(err, NotNil)
+}
+
+func (t *testKeeper) TestTableKeeperGeneration(c *C) {
+	var (
+		tk      = NewTableKeeper()
+		task    = "task"
+		source1 = "mysql-replica-1"
+		source2 = "mysql-replica-2"
+		st1     = NewSourceTablesBuilder(task, source1).AddSchema("db", "tbl-1").Build()
+		gen     = tk.Generation()
+		changed = func(expected bool) {
+			c.Assert(tk.Generation() != gen, Equals, expected)
+			gen = tk.Generation()
+		}
+	)
+	c.Assert(gen, Equals, uint64(0))
+
+	tk.Init(map[string]map[string]SourceTables{task: {source1: st1}})
+	changed(true)
+	tk.Init(map[string]map[string]SourceTables{task: {source1: st1.DeepCopy()}}) // the same tables.
+	changed(false)
+
+	c.Assert(tk.Update(st1), IsFalse) // the same tables.
+	changed(false)
+	c.Assert(tk.Update(NewSourceTablesBuilder(task, source1).AddSchema("db", "tbl-1", "tbl-2").Build()), IsTrue)
+	changed(true)
+
+	c.Assert(tk.AddTable(task, source1, "db", "tbl-3"), IsTrue)
+	changed(true)
+	c.Assert(tk.AddTable(task, source1, "db", "tbl-3"), IsFalse)
+	changed(false)
+	c.Assert(tk.AddTables(task, source2, map[string][]string{"db": {"tbl-1"}}), Equals, 1)
+	changed(true)
+	c.Assert(tk.AddTables(task, source2, map[string][]string{"db": {"tbl-1"}}), Equals, 0)
+	changed(false)
+
+	c.Assert(tk.RemoveTable(task, source1, "db", "tbl-3"), IsTrue)
+	changed(true)
+	c.Assert(tk.RemoveTable(task, source1, "db", "tbl-3"), IsFalse)
+	changed(false)
+
+	c.Assert(tk.MoveTable(task, source1, source2, "db", "tbl-2"), IsTrue)
+	changed(true)
+	c.Assert(tk.MoveTable(task, source1, source2, "db", "tbl-2"), IsFalse)
+	changed(false)
+
+	added, removed := tk.ApplyDiff(task, source1, []string{"`db`.`tbl-4`"}, nil)
+	c.Assert(added+removed, Equals, 1)
+	changed(true)
+	added, removed = tk.ApplyDiff(task, source1, []string{"`db`.`tbl-4`"}, nil)
+	c.Assert(added+removed, Equals, 0)
+	changed(false)
+
+	tk.DrainTask(task)
+	changed(true)
+	tk.DrainTask(task)
+	changed(false)
+	tk.UndrainTask(task)
+	changed(true)
+	tk.UndrainTask(task)
+	changed(false)
+
+	tk.Compact()
+	changed(false)
+
+	st2 := NewSourceTables(task, source2, nil)
+	st2.IsDeleted = true
+	c.Assert(tk.Update(st2), IsTrue)
+	changed(true)
+
+	// readers do not change the generation.
+	tk.FindTables(task)
+	tk.AllSources()
+	tk.IsDrained(task)
+	changed(false)
+}
+
+func (t *testKeeper) TestTableKeeperMoveTable(c *C) {
+	var (
+		tk      = NewTableKeeper()
+		task    = "task"
+		source1 = "mysql-replica-1"
+		source2 = "mysql-replica-2"
+		source3 = "mysql-replica-3"
+		schema  = "db"
+		table1  = "tbl-1"
+		table2  = "tbl-2"
+	)
+
+	// the task not exists.
+	c.Assert(tk.MoveTable(task, source1, source2, schema, table1), IsFalse)
+
+	tk.Init(map[string]map[string]SourceTables{
+		task: {
+			source1: NewSourceTablesBuilder(task, source1).AddSchema(schema, table1, table2).Build(),
+			source2: NewSourceTablesBuilder(task, source2).AddSchema(schema, table2).Build(),
+		},
+	})
+
+	// the table not exists in the source.
+	c.Assert(tk.MoveTable(task, source1, source2, schema, "not-exist"), IsFalse)
+	c.Assert(tk.MoveTable(task, source3, source2, schema, table1), IsFalse)
+	// the same source.
+	c.Assert(tk.MoveTable(task, source1, source1, schema, table1), IsFalse)
+	c.Assert(tk.FindTables(task), DeepEquals, []SourceTables{
+		NewSourceTablesBuilder(task, source1).AddSchema(schema, table1, table2).Build(),
+		NewSourceTablesBuilder(task, source2).AddSchema(schema, table2).Build(),
+	})
+
+	// moved to an existing source.
+	c.Assert(tk.MoveTable(task, source1, source2, schema, table1), IsTrue)
+	c.Assert(tk.FindTables(task), DeepEquals, []SourceTables{
+		NewSourceTablesBuilder(task, source1).AddSchema(schema, table2).Build(),
+		NewSourceTablesBuilder(task, source2).AddSchema(schema, table1, table2).Build(),
+	})
+
+	// moved to a new source.
+	c.Assert(tk.MoveTable(task, source2, source3, schema, table1), IsTrue)
+	c.Assert(tk.FindTables(task), DeepEquals, []SourceTables{
+		NewSourceTablesBuilder(task, source1).AddSchema(schema, table2).Build(),
+		NewSourceTablesBuilder(task, source2).AddSchema(schema, table2).Build(),
+		NewSourceTablesBuilder(task, source3).AddSchema(schema, table1).Build(),
+	})
+
+	// not moved for the drained task.
+	tk.DrainTask(task)
+	c.Assert(tk.MoveTable(task, source3, source1, schema, table1), IsFalse)
+	c.Assert(tk.FindTables(task)[2].Tables[schema], HasKey, table1)
+}
+
+func (t *testKeeper) TestTableKeeperApplyDiff(c *C) {
+	var (
+		tk      = NewTableKeeper()
+		task1   = "task-1"
+		task2   = "task-2"
+		source1 = "mysql-replica-1"
+		source2 = "mysql-replica-2"
+		st1     = NewSourceTablesBuilder(task1, source1).AddSchema("db", "tbl-1", "tbl-2").Build()
+		st2     = NewSourceTablesBuilder(task1, source1).AddSchema("db", "tbl-2", "tbl-3").AddSchema("db-2", "tbl-1").Build()
+	)
+
+	// task not exists.
+	added, removed := tk.ApplyDiff(task1, source1, []string{"`db`.`tbl-1`"}, nil)
+	c.Assert(added, Equals, 0)
+	c.Assert(removed, Equals, 0)
+	c.Assert(tk.FindTables(task1), HasLen, 0)
+
+	tk.Init(map[string]map[string]SourceTables{task1: {source1: st1}})
+
+	// apply the diff computed by `SourceTables.Diff`.
+	diffAdded, diffRemoved := st1.Diff(st2)
+	added, removed = tk.ApplyDiff(task1, source1, diffAdded, diffRemoved)
+	c.Assert(added, Equals, 2)
+	c.Assert(removed, Equals, 1)
+	sts := tk.FindTables(task1)
+	c.Assert(sts, HasLen, 1)
+	c.Assert(sts[0].Equal(st2), IsTrue)
+
+	// apply again, nothing changed, and invalid names are skipped.
+	added, removed = tk.ApplyDiff(task1, source1, append(diffAdded, "invalid"), append(diffRemoved, "invalid"))
+	c.Assert(added, Equals, 0)
+	c.Assert(removed, Equals, 0)
+
+	// a new source.
+	added, removed = tk.ApplyDiff(task1, source2, []string{"`db`.`tbl-1`"}, []string{"`db`.`tbl-2`"})
+	c.Assert(added, Equals, 1)
+	c.Assert(removed, Equals, 0)
+	c.Assert(tk.FindTables(task1), HasLen, 2)
+
+	// nothing added for a new source of another task.
+	tk.Init(map[string]map[string]SourceTables{task1: {source1: st2}, task2: {}})
+	added, removed = tk.ApplyDiff(task2, source1, nil, []string{"`db`.`tbl-2`"})
+	c.Assert(added, Equals, 0)
+	c.Assert(removed, Equals, 0)
+	c.Assert(tk.AllSources(), DeepEquals, []TaskSource{{Task: task1, Source: source1}})
+
+	// only removing is allowed for the drained task.
+	tk.DrainTask(task1)
+	added, removed = tk.ApplyDiff(task1, source1, []string{"`db`.`tbl-1`"}, []string{"`db`.`tbl-2`"})
+	c.Assert(added, Equals, 0)
+	c.Assert(removed, Equals, 1)
+	sts = tk.FindTables(task1)
+	c.Assert(sts, HasLen, 1)
+	c.Assert(sts[0].Equal(NewSourceTablesBuilder(task1, source1).AddSchema("db", "tbl-3").AddSchema("db-2", "tbl-1").Build()), IsTrue)
+}
+
+func (t *testForEtcd) TestLockKeeperHeartbeat(c *C) {
+	var (
+		lk     = NewLockKeeper()
+		clock  = &fakeClock{now: time.Date(2020, 5, 1, 0, 0, 0, 0, time.UTC)}
+		key    = "/test-lock-keeper-heartbeat"
+		ttl    = int64(1)
+		getKey = func() *mvccpb.KeyValue {
+			resp, err := etcdTestCli.Get(context.Background(), key)
+			c.Assert(err, IsNil)
+			if len(resp.Kvs) == 0 {
+				return nil
+			}
+			return resp.Kvs[0]
+		}
+	)
+
+	lk.SetClock(clock)
+
+	// fail to start with a canceled context.
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	c.Assert(lk.StartHeartbeat(ctx, etcdTestCli, key, ttl), NotNil)
+	c.Assert(getKey(), IsNil)
+
+	// the key is kept alive longer than the TTL.
+	ctx, cancel = context.WithCancel(context.Background())
+	defer cancel()
+	c.Assert(lk.StartHeartbeat(ctx, etcdTestCli, key, ttl), IsNil)
+	kv := getKey()
+	c.Assert(kv, NotNil)
+	c.Assert(kv.Lease, Not(Equals), int64(0))
+	c.Assert(string(kv.Value), Equals, clock.Now().Format(time.RFC3339Nano)) // the time of the keeper's clock.
+	time.Sleep(time.Duration(ttl)*time.Second + 500*time.Millisecond)
+	c.Assert(getKey(), NotNil)
+
+	// the key is deleted after the context canceled.
+	cancel()
+	c.Assert(utils.WaitSomething(30, 100*time.Millisecond, func() bool {
+		return getKey() == nil
+	}), IsTrue)
+}
+
+func (t *testForEtcd) TestLockKeeperRemoveLockIfDeleted(c *C) {
+	var (
+		lk         = NewLockKeeper()
+		cli        = etcdutil.NewMemClient()
+		upSchema   = "foo_1"
+		upTable    = "bar_1"
+		downSchema = "foo"
+		downTable  = "bar"
+		task       = "task"
+		source     = "mysql-replica-1"
+		DDLs       = []string{"ALTER TABLE bar ADD COLUMN c1 INT"}
+
+		p           = parser.New()
+		se          = mock.NewContext()
+		tblID int64 = 111
+		ti0         = createTableInfo(c, p, se, tblID, `CREATE TABLE bar (id INT PRIMARY KEY)`)
+		ti1         = createTableInfo(c, p, se, tblID, `CREATE TABLE bar (id INT PRIMARY KEY, c1 INT)`)
+
+		tables = map[string]map[string]struct{}{upSchema: {upTable: struct{}{}}}
+		sts    = []SourceTables{NewSourceTables(task, source, tables)}
+		info   = NewInfo(task, source, upSchema, upTable, downSchema, downTable, DDLs, ti0, ti1)
+	)
+	defer cli.Close()
+
+	// not exist lock.
+	removed, err := lk.RemoveLockIfDeleted(cli, "not-exist")
+	c.Assert(err, IsNil)
+	c.Assert(removed, IsFalse)
+
+	// put the info and operation.
+	lockID, newDDLs, err := lk.TrySync(info, sts)
+	c.Assert(err, IsNil)
+	_, err = PutInfo(cli, info)
+	c.Assert(err, IsNil)
+	op := NewOperation(lockID, task, source, upSchema, upTable, newDDLs, ConflictNone, false)
+	_, putted, _, err := PutOperation(cli, false, op)
+	c.Assert(err, IsNil)
+	c.Assert(putted, IsTrue)
+
+	// fail to delete in etcd, the lock is kept.
+	closedCli := etcdutil.NewMemClient()
+	closedCli.Close()
+	removed, err = lk.RemoveLockIfDeleted(closedCli, lockID)
+	c.Assert(err, NotNil)
+	c.Assert(removed, IsFalse)
+	c.Assert(lk.FindLock(lockID), NotNil)
+
+	// the info changed in etcd during removing, the lock is kept.
+	hooked := &txnHookClient{KVClient: cli, hooks: map[int]func(){2: func() {
+		_, err2 := PutInfo(cli, info)
+		c.Assert(err2, IsNil)
+	}}}
+	removed, err = lk.RemoveLockIfDeleted(hooked, lockID)
+	c.Assert(err, IsNil)
+	c.Assert(removed, IsFalse)
+	c.Assert(lk.FindLock(lockID), NotNil)
+	ifm, _, err := GetAllInfo(cli)
+	c.Assert(err, IsNil)
+	c.Assert(ifm, HasLen, 1)
+
+	// the lock changed during removing, the lock is kept and other locks can still be synced meanwhile.
+	hooked = &txnHookClient{KVClient: cli, hooks: map[int]func(){2: func() {
+		_, _, err2 := lk.TrySync(info, sts)
+		c.Assert(err2, IsNil)
+	}}}
+	removed, err = lk.RemoveLockIfDeleted(hooked, lockID)
+	c.Assert(err, IsNil)
+	c.Assert(removed, IsFalse)
+	c.Assert(lk.FindLock(lockID), NotNil)
+
+	// delete in etcd and then remove the lock.
+	_, err = PutInfo(cli, info)
+	c.Assert(err, IsNil)
+	removed, err = lk.RemoveLockIfDeleted(cli, lockID)
+	c.Assert(err, IsNil)
+	c.Assert(removed, IsTrue)
+	c.Assert(lk.FindLock(lockID), IsNil)
+	ifm, _, err = GetAllInfo(cli)
+	c.Assert(err, IsNil)
+	c.Assert(ifm, HasLen, 0)
+	opm, _, err := GetAllOperations(cli)
+	c.Assert(err, IsNil)
+	c.Assert(opm, HasLen, 0)
+}
+
+// txnHookClient is an etcd client which calls hooks before creating the n-th (1-based) transactions.
+type txnHookClient struct {
+	etcdutil.KVClient
+	hooks map[int]func()
+	count int
+}
+
+func (h *txnHookClient) Txn(ctx context.Context) clientv3.Txn {
+	h.count++
+	if hook, ok := h.hooks[h.count]; ok {
+		hook()
+	}
+	return h.KVClient.Txn(ctx)
+}
+
+func (t *testForEtcd) TestTableKeeperCheckpoint(c *C) {
+	defer clearTestInfoOperation(c)
+
+	var (
+		tk      = NewTableKeeper()
+		task1   = "task-1"
+		task2   = "task-2"
+		source1 = "mysql-replica-1"
+		source2 = "mysql-replica-2"
+		stm     = map[string]map[string]SourceTables{
+			task1: {
+				source1: NewSourceTables(task1, source1, map[string]map[string]struct{}{"db": {"tbl-1": struct{}{}}}),
+				source2: NewSourceTables(task1, source2, map[string]map[string]struct{}{"db": {"tbl-2": struct{}{}}}),
+			},
+			task2: {
+				source1: NewSourceTables(task2, source1, map[string]map[string]struct{}{"db": {"tbl-1": struct{}{}}}),
+			},
+		}
+	)
+
+	// no checkpoint exists.
+	tk2, _, exist, err := LoadTableKeeperCheckpoint(etcdTestCli)
+	c.Assert(err, IsNil)
+	c.Assert(exist, IsFalse)
+	c.Assert(tk2, IsNil)
+
+	// put a checkpoint, with the revision of source tables got.
+	tk.Init(stm)
+	tk.SetRevision(100)
+	rev1, err := tk.Checkpoint(etcdTestCli)
+	c.Assert(err, IsNil)
+	c.Assert(rev1, Equals, int64(100))
+
+	// load the checkpoint.
+	tk2, rev2, exist, err := LoadTableKeeperCheckpoint(etcdTestCli)
+	c.Assert(err, IsNil)
+	c.Assert(exist, IsTrue)
+	c.Assert(rev2, Equals, rev1)
+	c.Assert(tk2.Revision(), Equals, rev1)
+	c.Assert(tk2.Equal(tk), IsTrue)
+
+	// update the keeper with watched source tables, drain a task and put the checkpoint again.
+	st := stm[task1][source1].DeepCopy()
+	st.AddTable("db", "tbl-3")
+	st.Revision = 120
+	c.Assert(tk.Update(st), IsTrue)
+	tk.DrainTask(task2)
+	rev3, err := tk.Checkpoint(etcdTestCli)
+	c.Assert(err, IsNil)
+	c.Assert(rev3, Equals, int64(120))
+	tk2, rev4, exist, err := LoadTableKeeperCheckpoint(etcdTestCli)
+	c.Assert(err, IsNil)
+	c.Assert(exist, IsTrue)
+	c.Assert(rev4, Equals, rev3)
+	c.Assert(tk2.Equal(tk), IsTrue)
+	c.Assert(tk2.IsDrained(task2), IsTrue)
+	c.Assert(tk2.FindTables(task1), DeepEquals, tk.FindTables(task1))
+	c.Assert(tk2.FindTables(task1)[0].Revision, Equals, int64(0)) // only the keeper's revision is kept.
+}
+
+func (t *testKeeper) TestLockKeeperDownstreamCollation(c *C) {
+	var (
+		upSchema   = "foo_1"
+		upTable    = "bar_1"
+		downSchema = "foo"
+		downTable  = "bar"
+		task       = "task"
+		source1    = "mysql-replica-1"
+		source2    = "mysql-replica-2"
+		DDLs       = []string{"ALTER TABLE bar ADD COLUMN c1 VARCHAR(10)"}
+
+		p           = parser.New()
+		se          = mock.NewContext()
+		tblID int64 = 111
+		ti0         = createTableInfo(c, p, se, tblID, `CREATE TABLE bar (id INT PRIMARY KEY)`)
+		// the charset and collation of the added column follow the different default collations of upstream tables.
+		ti1 = createTableInfo(c, p, se, tblID, `CREATE TABLE bar (id INT PRIMARY KEY, c1 VARCHAR(10) CHARACTER SET utf8mb4 COLLATE utf8mb4_bin)`)
+		ti2 = createTableInfo(c, p, se, tblID, `CREATE TABLE bar (id INT PRIMARY KEY, c1 VARCHAR(10) CHARACTER SET utf8mb4 COLLATE utf8mb4_general_ci)`)
+
+		tables = map[string]map[string]struct{}{upSchema: {upTable: struct{}{}}}
+		sts    = []SourceTables{
+			NewSourceTables(task, source1, tables),
+			NewSourceTables(task, source2, tables),
+		}
+		i1 = NewInfo(task, source1, upSchema, upTable, downSchema, downTable, DDLs, ti0, ti1)
+		i2 = NewInfo(task, source2, upSchema, upTable, downSchema, downTable, DDLs, ti0, ti2)
+	)
+
+	// the same column with different upstream default collations conflicts.
+	lk := NewLockKeeper()
+	_, DDLs2, err := lk.TrySync(i1, sts)
+	c.Assert(err, IsNil)
+	c.Assert(DDLs2, DeepEquals, DDLs)
+	_, DDLs2, err = lk.TrySync(i2, sts)
+	c.Assert(terror.ErrShardDDLOptimismTrySyncFail.Equal(err), IsTrue)
+	c.Assert(DDLs2, DeepEquals, []string{})
+	c.Assert(lk.FindLock(genDDLLockID(i1)).Conflict(), Equals, ConflictTypeColumnCharset)
+
+	// unknown collation.
+	c.Assert(terror.ErrShardDDLOptimismUnknownCollation.Equal(lk.SetDownstreamCollation("invalid")), IsTrue)
+
+	// normalized to the downstream collation, the lock converges.
+	lk = NewLockKeeper()
+	c.Assert(lk.SetDownstreamCollation("UTF8MB4_GENERAL_CI"), IsNil)
+	_, DDLs2, err = lk.TrySync(i1, sts)
+	c.Assert(err, IsNil)
+	c.Assert(DDLs2, DeepEquals, DDLs)
+	_, DDLs2, err = lk.TrySync(i2, sts)
+	c.Assert(err, IsNil)
+	c.Assert(DDLs2, DeepEquals, DDLs)
+	l := lk.FindLock(genDDLLockID(i1))
+	synced, remain := l.IsSynced()
+	c.Assert(synced, IsTrue)
+	c.Assert(remain, Equals, 0)
+	col := model.FindColumnInfo(l.joinedTI.Columns, "c1")
+	c.Assert(col.Charset, Equals, "utf8mb4")
+	c.Assert(col.Collate, Equals, "utf8mb4_general_ci")
+	c.Assert(l.ContributingInfos(), DeepEquals, []Info{i1, i2}) // the original infos are kept.
+	c.Assert(model.FindColumnInfo(ti1.Columns, "c1").Collate, Equals, "utf8mb4_bin")
+
+	// disable the normalization.
+	c.Assert(lk.SetDownstreamCollation(""), IsNil)
+	c.Assert(lk.downCharset, Equals, "")
+	c.Assert(lk.downCollation, Equals, "")
+}
+
+func (t *testKeeper) TestLockKeeperPauseAll(c *C) {
+	var (
+		lk         = NewLockKeeper()
+		upSchema   = "foo_1"
+		upTable    = "bar_1"
+		downSchema = "foo"
+		downTable  = "bar"
+		task1      = "task1"
+		task2      = "task2"
+		source1    = "mysql-replica-1"
+		source2    = "mysql-replica-2"
+		DDLs       = []string{"ALTER TABLE bar ADD COLUMN c1 INT"}
+
+		p           = parser.New()
+		se          = mock.NewContext()
+		tblID int64 = 111
+		ti0         = createTableInfo(c, p, se, tblID, `CREATE TABLE bar (id INT PRIMARY KEY)`)
+		ti1         = createTableInfo(c, p, se, tblID, `CREATE TABLE bar (id INT PRIMARY KEY, c1 INT)`)
+
+		tables = map[string]map[string]struct{}{upSchema: {upTable: struct{}{}}}
+		sts1   = []SourceTables{NewSourceTables(task1, source1, tables), NewSourceTables(task1, source2, tables)}
+		sts2   = []SourceTables{NewSourceTables(task2, source1, tables)}
+		i11    = NewInfo(task1, source1, upSchema, upTable, downSchema, downTable, DDLs, ti0, ti1)
+		i12    = NewInfo(task1, source2, upSchema, upTable, downSchema, downTable, DDLs, ti0, ti1)
+		i2     = NewInfo(task2, source1, upSchema, upTable, downSchema, downTable, DDLs, ti0, ti1)
+	)
+	lk.SetDedupWindow(time.Minute)
+
+	lockID, _, err := lk.TrySync(i11, sts1)
+	c.Assert(err, IsNil)
+	l := lk.FindLock(lockID)
+	view := l.View()
+	c.Assert(lk.IsPaused(), IsFalse)
+
+	// syncs of all tasks are rejected while paused, without changing any lock.
+	lk.PauseAll()
+	c.Assert(lk.IsPaused(), IsTrue)
+	_, _, err = lk.TrySync(i12, sts1)
+	c.Assert(terror.ErrShardDDLOptimismPaused.Equal(err), IsTrue)
+	_, _, err = lk.TrySync(i11, sts1) // not deduplicated.
+	c.Assert(terror.ErrShardDDLOptimismPaused.Equal(err), IsTrue)
+	_, _, err = lk.TrySync(i2, sts2)
+	c.Assert(terror.ErrShardDDLOptimismPaused.Equal(err), IsTrue)
+	results, err := lk.TrySyncBatch([]SyncItem{{Info: i12, STs: sts1}})
+	c.Assert(terror.ErrShardDDLOptimismPaused.Equal(err), IsTrue)
+	c.Assert(results, HasLen, 1)
+	c.Assert(lk.Locks(), HasLen, 1)
+	c.Assert(l.View(), DeepEquals, view)
+
+	// queries still work.
+	c.Assert(lk.FindLock(lockID), Equals, l)
+	c.Assert(lk.FindLockByInfo(i12), Equals, l)
+	synced, remain := l.IsSynced()
+	c.Assert(synced, IsFalse)
+	c.Assert(remain, Equals, 1)
+
+	// pausing a single task is independent.
+	lk.SetTaskConfig(task2, TaskConfig{Paused: true})
+	lk.ResumeAll()
+	c.Assert(lk.IsPaused(), IsFalse)
+	_, _, err = lk.TrySync(i2, sts2)
+	c.Assert(terror.ErrShardDDLOptimismTaskPaused.Equal(err), IsTrue)
+	_, DDLs2, err := lk.TrySync(i12, sts1)
+	c.Assert(err, IsNil)
+	c.Assert(DDLs2, DeepEquals, DDLs)
+	synced, remain = l.IsSynced()
+	c.Assert(synced, IsTrue)
+	c.Assert(remain, Equals, 0)
+}
+
+func (t *testKeeper) TestLockKeeperLockIDCollision(c *C) {
+	var (
+		lk         = NewLockKeeper()
+		upSchema   = "foo_1"
+		upTable    = "bar_1"
+		downSchema = "foo"
+		downTable  = "bar"
+		task       = "task"
+		source     = "mysql-replica-1"
+		DDLs       = []string{"ALTER TABLE bar ADD COLUMN c1 INT"}
+
+		p           = parser.New()
+		se          = mock.NewContext()
+		tblID int64 = 111
+		ti0         = createTableInfo(c, p, se, tblID, `CREATE TABLE bar (id INT PRIMARY KEY)`)
+		ti1         = createTableInfo(c, p, se, tblID, `CREATE TABLE bar (id INT PRIMARY KEY, c1 INT)`)
+
+		tables = map[string]map[string]struct{}{upSchema: {upTable: struct{}{}}}
+		sts    = []SourceTables{NewSourceTables(task, source, tables)}
+		i1     = NewInfo(task, source, upSchema, upTable, downSchema, downTable, DDLs, ti0, ti1)
+		lockID = genDDLLockID(i1)
+	)
+
+	// IDs are different for different tasks or downstream tables, even with backquotes in names.
+	c.Assert(genDDLLockID(NewInfo("task-`foo`", source, upSchema, upTable, "bar", downTable, DDLs, ti0, ti1)), Not(Equals),
+		genDDLLockID(NewInfo("task", source, upSchema, upTable, "foo`-`bar", downTable, DDLs, ti0, ti1)))
+
+	// an imported lock with the same ID but for another task.
+	other := NewLockKeeper()
+	other.locks[lockID] = NewLock(lockID, "task-`foo`", ti0, sts)
+	c.Assert(lk.MergeFrom(other), HasLen, 0)
+	l := lk.FindLock(lockID)
+
+	// the collision is surfaced, and the lock is not changed.
+	_, _, err := lk.TrySync(i1, sts)
+	c.Assert(terror.ErrShardDDLOptimismLockIDCollision.Equal(err), IsTrue)
+	c.Assert(err, ErrorMatches, ".*lock task-`foo`.`bar` of task task-`foo` .* collides with .* of task task for downstream table `foo`.`bar`.*")
+	c.Assert(l.ContributingInfos(), HasLen, 0)
+	c.Assert(lk.FindLock(lockID), Equals, l)
+
+	// no collision after the imported lock removed.
+	c.Assert(lk.RemoveLock(lockID), IsTrue)
+	_, DDLs2, err := lk.TrySync(i1, sts)
+	c.Assert(err, IsNil)
+	c.Assert(DDLs2, DeepEquals, DDLs)
+}
+
+func (t *testKeeper) TestLockKeeperAllPendingDDLs(c *C) {
+	var (
+		lk         = NewLockKeeper()
+		upSchema   = "foo_1"
+		upTable    = "bar_1"
+		downSchema = "foo"
+		task       = "task"
+		source1    = "mysql-replica-1"
+		source2    = "mysql-replica-2"
+		DDLs1      = []string{"ALTER TABLE bar ADD COLUMN c1 INT"}
+		DDLs2      = []string{"alter table bar add c1 int", "ALTER TABLE bar ADD COLUMN c2 INT"}
+		DDLs3      = []string{"ALTER TABLE bar ADD COLUMN c2 INT"}
+
+		p           = parser.New()
+		se          = mock.NewContext()
+		tblID int64 = 111
+		ti0         = createTableInfo(c, p, se, tblID, `CREATE TABLE bar (id INT PRIMARY KEY)`)
+		ti1         = createTableInfo(c, p, se, tblID, `CREATE TABLE bar (id INT PRIMARY KEY, c1 INT)`)
+		ti2         = createTableInfo(c, p, se, tblID, `CREATE TABLE bar (id INT PRIMARY KEY, c1 INT, c2 INT)`)
+
+		tables = map[string]map[string]struct{}{upSchema: {upTable: struct{}{}}}
+		sts    = []SourceTables{NewSourceTables(task, source1, tables), NewSourceTables(task, source2, tables)}
+		i11    = NewInfo(task, source1, upSchema, upTable, downSchema, "bar1", DDLs1, ti0, ti1)
+		i12    = NewInfo(task, source2, upSchema, upTable, downSchema, "bar1", DDLs2, ti0, ti2)
+		i13    = NewInfo(task, source1, upSchema, upTable, downSchema, "bar1", DDLs3, ti1, ti2)
+		i2     = NewInfo(task, source1, upSchema, upTable, downSchema, "bar2", DDLs1, ti0, ti1)
+	)
+
+	c.Assert(lk.AllPendingDDLs(), HasLen, 0)
+
+	lockID1, _, err := lk.TrySync(i11, sts)
+	c.Assert(err, IsNil)
+	lockID2, _, err := lk.TrySync(i2, sts)
+	c.Assert(err, IsNil)
+	_, _, err = lk.TrySync(i12, sts)
+	c.Assert(err, IsNil)
+
+	// equivalent DDLs are returned only once.
+	c.Assert(lk.AllPendingDDLs(), DeepEquals, map[string][]string{
+		lockID1: {DDLs1[0], DDLs2[1]},
+		lockID2: DDLs1,
+	})
+
+	// DDLs of tables done are not pending.
+	l1 := lk.FindLock(lockID1)
+	c.Assert(l1.TryMarkDone(source2, upSchema, upTable), IsTrue)
+	c.Assert(l1.PendingDDLs(), DeepEquals, DDLs1)
+	_, _, err = lk.TrySync(i13, sts)
+	c.Assert(err, IsNil)
+	c.Assert(l1.PendingDDLs(), DeepEquals, DDLs3)
+	c.Assert(l1.TryMarkDone(source1, upSchema, upTable), IsTrue)
+	c.Assert(l1.PendingDDLs(), HasLen, 0)
+
+	// locks without pending DDLs are omitted.
+	c.Assert(lk.AllPendingDDLs(), DeepEquals, map[string][]string{lockID2: DDLs1})
+}
+
+func (t *testKeeper) TestLockKeeperResolveHooks(c *C) {
+	var (
+		lk         = NewLockKeeper()
+		upSchema   = "foo_1"
+		upTable    = "bar_1"
+		downSchema = "foo"
+		downTable  = "bar"
+		task       = "task"
+		source1    = "mysql-replica-1"
+		source2    = "mysql-replica-2"
+		DDLs1      = []string{"ALTER TABLE bar ADD COLUMN c1 INT"}
+		DDLs2      = []string{"ALTER TABLE bar ADD COLUMN c2 INT"}
+
+		p           = parser.New()
+		se          = mock.NewContext()
+		tblID int64 = 111
+		ti0         = createTableInfo(c, p, se, tblID, `CREATE TABLE bar (id INT PRIMARY KEY)`)
+		ti1         = createTableInfo(c, p, se, tblID, `CREATE TABLE bar (id INT PRIMARY KEY, c1 INT)`)
+		ti2         = createTableInfo(c, p, se, tblID, `CREATE TABLE bar (id INT PRIMARY KEY, c1 INT, c2 INT)`)
+
+		tables = map[string]map[string]struct{}{upSchema: {upTable: struct{}{}}}
+		sts    = []SourceTables{NewSourceTables(task, source1, tables), NewSourceTables(task, source2, tables)}
+		i11    = NewInfo(task, source1, upSchema, upTable, downSchema, downTable, DDLs1, ti0, ti1)
+		i21    = NewInfo(task, source2, upSchema, upTable, downSchema, downTable, DDLs1, ti0, ti1)
+		i12    = NewInfo(task, source1, upSchema, upTable, downSchema, downTable, DDLs2, ti1, ti2)
+		i22    = NewInfo(task, source2, upSchema, upTable, downSchema, downTable, DDLs2, ti1, ti2)
+		i3     = NewInfo(task, source1, upSchema, upTable, downSchema, "baz", DDLs1, ti0, ti1)
+
+		pre  []*Lock
+		post []string
+	)
+	lk.SetPreResolve(func(l *Lock) {
+		// hooks are called outside the keeper's lock.
+		c.Assert(lk.FindLock(l.ID), Equals, l)
+		pre = append(pre, l)
+	})
+	lk.SetPostResolve(func(lockID string) {
+		c.Assert(lk.FindLock(lockID), IsNil)
+		post = append(post, lockID)
+	})
+
+	// not resolvable until all tables synced.
+	lockID, _, err := lk.TrySync(i11, sts)
+	c.Assert(err, IsNil)
+	c.Assert(pre, HasLen, 0)
+	_, _, err = lk.TrySync(i21, sts)
+	c.Assert(err, IsNil)
+	l := lk.FindLock(lockID)
+	c.Assert(pre, DeepEquals, []*Lock{l})
+
+	// called once for each transition.
+	_, _, err = lk.TrySync(i21, sts)
+	c.Assert(err, IsNil)
+	c.Assert(pre, HasLen, 1)
+	_, _, err = lk.TrySync(i12, sts)
+	c.Assert(err, IsNil)
+	c.Assert(pre, HasLen, 1)
+	_, _, err = lk.TrySync(i22, sts)
+	c.Assert(err, IsNil)
+	c.Assert(pre, DeepEquals, []*Lock{l, l})
+
+	// removing the lock not resolved yet doesn't call the post-resolve hook.
+	lockID3, _, err := lk.TrySync(i3, []SourceTables{NewSourceTables(task, source1, tables)})
+	c.Assert(err, IsNil)
+	c.Assert(pre, HasLen, 3)
+	c.Assert(lk.RemoveLock(lockID3), IsTrue)
+	c.Assert(post, HasLen, 0)
+
+	// removing the resolved lock calls the post-resolve hook.
+	c.Assert(l.TryMarkDone(source1, upSchema, upTable), IsTrue)
+	c.Assert(l.TryMarkDone(source2, upSchema, upTable), IsTrue)
+	c.Assert(l.IsResolved(), IsTrue)
+	c.Assert(lk.RemoveLock(lockID), IsTrue)
+	c.Assert(post, DeepEquals, []string{lockID})
+
+	// no hooks after unset.
+	lk.SetPreResolve(nil)
+	lk.SetPostResolve(nil)
+	_, _, err = lk.TrySync(i3, []SourceTables{NewSourceTables(task, source1, tables)})
+	c.Assert(err, IsNil)
+	c.Assert(pre, HasLen, 3)
+	lk.Clear()
+	c.Assert(post, HasLen, 1)
 }
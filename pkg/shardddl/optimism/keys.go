@@ -0,0 +1,70 @@
+// Copyright 2020 PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package optimism
+
+import (
+	"fmt"
+	"hash/fnv"
+	"path"
+	"strings"
+
+	"github.com/pingcap/dm/dm/common"
+)
+
+// keyShards is the number of shards for keys of shard DDL info and operations in etcd, see `SetKeyShards`.
+var keyShards uint32
+
+// SetKeyShards sets the number of shards for keys of shard DDL info and operations in etcd,
+// it's an advanced performance knob for large clusters, and should be called at package init.
+// if `n` > 0, a shard prefix hashed from the task name is inserted after the path of keys,
+// e.g. `/dm-master/shardddl-optimism/info/<shard>/<task>/<source>/<schema>/<table>`,
+// so keys of different tasks spread across etcd ranges, while keys of a task are still under the same prefix.
+// 0 (the default) means keys without the shard prefix.
+// NOTE: all values are still under the same path with any layout, so reading all of them (like `GetAllInfo`) works,
+// but reading, putting or deleting a single key only works for keys written with the same layout.
+// to change the layout of an existing cluster:
+//   1. stop all tasks in the optimistic mode, and wait for all locks resolved.
+//   2. stop DM-master and DM-workers, and remove all shard DDL info and operations in etcd.
+//   3. restart DM-master and DM-workers with the same new layout, and start tasks again.
+func SetKeyShards(n uint32) {
+	keyShards = n
+}
+
+// keyShard returns the shard prefix of keys for the task.
+func keyShard(task string) string {
+	h := fnv.New32a()
+	_, _ = h.Write([]byte(task))
+	return fmt.Sprintf("%x", h.Sum32()%keyShards)
+}
+
+// shardedKey encodes keys with the adapter, the shard prefix is inserted if enabled and the task (the first key) is given.
+func shardedKey(adapter common.KeyAdapter, keys ...string) string {
+	key := adapter.Encode(keys...)
+	if keyShards == 0 || len(keys) == 0 || keys[0] == "" {
+		return key
+	}
+	return path.Join(adapter.Path(), keyShard(keys[0]), strings.TrimPrefix(key, adapter.Path()))
+}
+
+// infoKey returns the key of the shard DDL info in etcd, see `SetKeyShards`.
+// if only some of the leading keys are given, it can be used as the prefix of these keys.
+func infoKey(task, source, upSchema, upTable string) string {
+	return shardedKey(common.ShardDDLOptimismInfoKeyAdapter, task, source, upSchema, upTable)
+}
+
+// operationKey returns the key of the shard DDL operation in etcd, see `SetKeyShards`.
+// if only some of the leading keys are given, it can be used as the prefix of these keys.
+func operationKey(task, source, upSchema, upTable string) string {
+	return shardedKey(common.ShardDDLOptimismOperationKeyAdapter, task, source, upSchema, upTable)
+}
@@ -0,0 +1,150 @@
+// Copyright 2020 PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package optimism
+
+import (
+	"context"
+	"strings"
+	"time"
+
+	. "github.com/pingcap/check"
+	"go.etcd.io/etcd/clientv3"
+
+	"github.com/pingcap/dm/dm/common"
+	"github.com/pingcap/dm/pkg/etcdutil"
+)
+
+func (t *testForEtcd) TestKeyShards(c *C) {
+	defer SetKeyShards(0)
+
+	var (
+		task   = "test-key-shards"
+		source = "mysql-replica-1"
+		path   = common.ShardDDLOptimismInfoKeyAdapter.Path()
+	)
+
+	// the default layout.
+	c.Assert(infoKey(task, source, "db", "tbl"), Equals, common.ShardDDLOptimismInfoKeyAdapter.Encode(task, source, "db", "tbl"))
+	c.Assert(operationKey(task, source, "db", "tbl"), Equals, common.ShardDDLOptimismOperationKeyAdapter.Encode(task, source, "db", "tbl"))
+
+	// the sharded layout.
+	SetKeyShards(16)
+	key := infoKey(task, source, "db", "tbl")
+	c.Assert(key, Equals, path+keyShard(task)+"/"+strings.TrimPrefix(common.ShardDDLOptimismInfoKeyAdapter.Encode(task, source, "db", "tbl"), path))
+	c.Assert(strings.HasPrefix(key, infoKey(task, "", "", "")), IsTrue)
+	c.Assert(strings.HasPrefix(key, infoKey(task, source, "", "")), IsTrue)
+	c.Assert(infoKey("", "", "", ""), Equals, common.ShardDDLOptimismInfoKeyAdapter.Encode())
+	c.Assert(keyShard(task), Equals, keyShard(task))
+
+	// keys of different tasks spread across shards.
+	shards := make(map[string]struct{})
+	for i := 0; i < 100; i++ {
+		shards[keyShard(task+string(rune('a'+i%26))+string(rune('a'+i/26)))] = struct{}{}
+	}
+	c.Assert(len(shards), Greater, 1)
+	for shard := range shards {
+		c.Assert(len(shard), LessEqual, 1) // < 16.
+	}
+}
+
+func (t *testForEtcd) TestKeyShardsEtcd(c *C) {
+	SetKeyShards(8)
+	defer SetKeyShards(0)
+
+	var (
+		cli     = etcdutil.NewMemClient()
+		task1   = "test-key-shards-etcd-1"
+		task2   = "test-key-shards-etcd-2"
+		source  = "mysql-replica-1"
+		DDLs    = []string{"ALTER TABLE bar ADD COLUMN c1 INT"}
+		i11     = NewInfo(task1, source, "db", "tbl-1", "db", "tbl", DDLs, nil, nil)
+		i12     = NewInfo(task1, source, "db", "tbl-2", "db", "tbl", DDLs, nil, nil)
+		i21     = NewInfo(task2, source, "db", "tbl-1", "db", "tbl", DDLs, nil, nil)
+		op11    = NewOperation("ID", task1, source, "db", "tbl-1", DDLs, ConflictNone, false)
+		op21    = NewOperation("ID", task2, source, "db", "tbl-1", DDLs, ConflictNone, false)
+		infoKVs = func(prefix string) []string {
+			resp, err := cli.Get(context.Background(), prefix, clientv3.WithPrefix(), clientv3.WithKeysOnly())
+			c.Assert(err, IsNil)
+			keys := make([]string, 0, len(resp.Kvs))
+			for _, kv := range resp.Kvs {
+				keys = append(keys, string(kv.Key))
+			}
+			return keys
+		}
+	)
+	defer cli.Close()
+
+	for _, info := range []Info{i11, i12, i21} {
+		_, err := PutInfo(cli, info)
+		c.Assert(err, IsNil)
+	}
+	for _, op := range []Operation{op11, op21} {
+		_, putted, _, err := PutOperation(cli, false, op)
+		c.Assert(err, IsNil)
+		c.Assert(putted, IsTrue)
+	}
+
+	// keys are put with the shard prefix.
+	c.Assert(infoKVs(infoKey(task1, source, "db", "tbl-1")), DeepEquals, []string{infoKey(task1, source, "db", "tbl-1")})
+	c.Assert(infoKVs(common.ShardDDLOptimismInfoKeyAdapter.Encode(task1, source, "db", "tbl-1")), HasLen, 0)
+
+	// task-scoped range reads.
+	c.Assert(infoKVs(infoKey(task1, "", "", "")), DeepEquals, []string{
+		infoKey(task1, source, "db", "tbl-1"), infoKey(task1, source, "db", "tbl-2"),
+	})
+	c.Assert(infoKVs(infoKey(task2, "", "", "")), DeepEquals, []string{infoKey(task2, source, "db", "tbl-1")})
+
+	// reading all works.
+	ifm, _, err := GetAllInfo(cli)
+	c.Assert(err, IsNil)
+	c.Assert(ifm, HasLen, 2)
+	c.Assert(ifm[task1][source]["db"], HasLen, 2)
+	c.Assert(ifm[task2][source]["db"]["tbl-1"], DeepEquals, i21)
+	opm, _, err := GetAllOperations(cli)
+	c.Assert(err, IsNil)
+	c.Assert(opm[task1][source]["db"]["tbl-1"], DeepEquals, op11)
+	c.Assert(opm[task2][source]["db"]["tbl-1"], DeepEquals, op21)
+
+	// single key operations.
+	exist, _, err := InfoExists(cli, task1, source, "db", "tbl-2")
+	c.Assert(err, IsNil)
+	c.Assert(exist, IsTrue)
+	exist, _, err = OperationExists(cli, task2, source, "db", "tbl-1")
+	c.Assert(err, IsNil)
+	c.Assert(exist, IsTrue)
+	_, exist, err = GetOperationRev(cli, op11)
+	c.Assert(err, IsNil)
+	c.Assert(exist, IsTrue)
+
+	// watch operations of a task.
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	wch := make(chan Operation, 10)
+	ech := make(chan error, 10)
+	rev, err := DeleteInfosOperations(cli, []Info{i12}, nil)
+	c.Assert(err, IsNil)
+	go WatchOperationPut(ctx, cli, task2, "", "", "", rev, wch, ech)
+	op21.Done = true
+	_, _, _, err = PutOperation(cli, false, op21)
+	c.Assert(err, IsNil)
+	select {
+	case op := <-wch:
+		c.Assert(op, DeepEquals, op21)
+	case <-ctx.Done():
+		c.Fatal("timeout to watch the operation")
+	}
+
+	// deleted with the sharded key.
+	c.Assert(infoKVs(infoKey(task1, "", "", "")), DeepEquals, []string{infoKey(task1, source, "db", "tbl-1")})
+}
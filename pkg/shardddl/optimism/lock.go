@@ -15,9 +15,16 @@ package optimism
 
 import (
 	"fmt"
+	"sort"
+	"strings"
 	"sync"
+	"time"
 
+	"github.com/pingcap/parser/ast"
+	"github.com/pingcap/parser/format"
 	"github.com/pingcap/parser/model"
+	"github.com/pingcap/parser/mysql"
+	"github.com/pingcap/tidb-tools/pkg/dbutil"
 	"github.com/pingcap/tidb-tools/pkg/schemacmp"
 	"go.uber.org/zap"
 
@@ -35,10 +42,56 @@ type Lock struct {
 
 	// current joined info.
 	joined schemacmp.Table
+	// current joined table info, it has the same schema as `joined`.
+	// this is used to generate DDLs from the schema difference.
+	joinedTI *model.TableInfo
+	// the table info when the lock was created, used to reset the lock.
+	initTI *model.TableInfo
 	// per-table's table info,
 	// upstream source ID -> schema name -> table name -> table info.
 	// if all of them are the same, then we call the lock `synced`.
 	tables map[string]map[string]map[string]schemacmp.Table
+	// per-table's original table info, the same structure as `tables`.
+	tableInfos map[string]map[string]map[string]*model.TableInfo
+	// per-table's latest sequence number of the shard DDL info, the same structure as `tables`.
+	seqs map[string]map[string]map[string]uint64
+	// per-table's schema version, the same structure as `tables`.
+	// it's increased by the count of DDLs each time the table's schema changed after trying to sync,
+	// so re-sent shard DDL info which does not change the schema is not counted.
+	versions map[string]map[string]map[string]int
+	// per-table's latest shard DDL info tried to sync, the same structure as `tables`.
+	// these infos compose the lock, and should be deleted from etcd after the lock resolved.
+	infos map[string]map[string]map[string]Info
+	// canonical forms of DDLs in `infos`, the same structure as `infos`, see `canonicalDDL`.
+	// they are computed once when the info is tracked, so DDLs can be compared without parsing them again.
+	canonicals map[string]map[string]map[string][]string
+	// FULLTEXT/SPATIAL indexes added by tables, lower case index name -> the index.
+	// these indexes are ignored in the table info, so they are tracked by names separately.
+	specialIndexes map[string]*specialIndex
+
+	// the type of the conflict detected in the latest sync, `ConflictTypeNone` if no conflict exists.
+	conflict ConflictType
+	// advisory messages for noteworthy decisions made in the latest sync, see `Warnings`.
+	warnings []string
+	// the max number of columns in the joined table info, see `SetMaxColumns`.
+	maxColumns int
+
+	// the time since when the lock is unresolved, it's the time when the lock was created, reset or resolved last time.
+	unresolvedSince time.Time
+	// the clock used to get the current time, see `LockKeeper.SetClock`.
+	clock Clock
+	// whether the lock has been escalated as requiring manual intervention because it's unresolved for too long.
+	escalated bool
+	// whether the lock has been removed from the keeper, trying to sync a removed lock is rejected.
+	removed bool
+	// sources marked dead, their tables are skipped when deciding whether the lock is synced or resolved,
+	// see `LockKeeper.SetSourceLiveness`.
+	deadSources map[string]struct{}
+	// increased each time the sync state of the lock may be changed, used to detect changes since read, see `generation`.
+	gen uint64
+	// labels attached by operators (e.g. a ticket ID), see `LockKeeper.SetLockTags`.
+	// they are in-memory only and never affect the coordination.
+	tags map[string]string
 
 	// whether the operations have done (execute the shard DDL) in synced status.
 	// if all of them have done, then we call the lock `resolved`.
@@ -46,20 +99,139 @@ type Lock struct {
 	done map[string]map[string]map[string]bool
 }
 
+// ConflictInfo represents the information of a conflict detected when trying to sync the lock.
+type ConflictInfo struct {
+	Source   string       `json:"source"`    // upstream source ID
+	UpSchema string       `json:"up-schema"` // upstream/source schema name
+	UpTable  string       `json:"up-table"`  // upstream/source table name
+	DDLs     []string     `json:"ddls"`      // DDL statements caused the conflict
+	Type     ConflictType `json:"type"`      // the type of the conflict
+	Msg      string       `json:"msg"`       // the detail message of the conflict
+
+	Action ConflictAction `json:"action"` // the action taken for the conflict, see `ConflictPolicy`
+}
+
+// LockView represents an immutable snapshot of a Lock, which can be marshaled into JSON.
+// all fields are copied from the lock, so it can be used without holding any lock.
+type LockView struct {
+	ID             string                                `json:"id"`              // lock's ID
+	Task           string                                `json:"task"`            // lock's corresponding task name
+	Joined         string                                `json:"joined"`          // the joined table info
+	Synced         bool                                  `json:"synced"`          // whether all tables are synced
+	Remain         int                                   `json:"remain"`          // the count of tables not synced yet
+	Ready          map[string]map[string]map[string]bool `json:"ready"`           // the sync status of tables, see `Lock.Ready`
+	PendingSources []string                              `json:"pending-sources"` // sources which have tables not synced yet, sorted
+	Done           map[string]map[string]map[string]bool `json:"done"`            // whether the operations of tables have done
+	Resolved       bool                                  `json:"resolved"`        // whether all operations have done
+	Conflict       string                                `json:"conflict"`        // the type of the conflict detected in the latest sync
+	Escalated      bool                                  `json:"escalated"`       // whether the lock has been escalated
+	Versions       map[string]map[string]map[string]int  `json:"versions"`        // the schema versions of tables
+	Tags           map[string]string                     `json:"tags"`            // labels attached by operators
+}
+
+// ConflictType represents the type of a conflict detected when trying to sync the lock.
+type ConflictType int
+
+// types of the conflict.
+const (
+	// ConflictTypeNone indicates no conflict detected.
+	ConflictTypeNone ConflictType = iota
+	// ConflictTypeUnknown indicates a conflict detected but can't be classified.
+	ConflictTypeUnknown
+	// ConflictTypeColumnType indicates columns with the same name have incompatible types.
+	ConflictTypeColumnType
+	// ConflictTypeColumnDefault indicates columns with the same name have different default values.
+	ConflictTypeColumnDefault
+	// ConflictTypeGeneratedColumn indicates generated columns with the same name have different expressions.
+	ConflictTypeGeneratedColumn
+	// ConflictTypeDropReferencedColumn indicates a column dropped in some tables is still referenced by indexes in other tables.
+	ConflictTypeDropReferencedColumn
+	// ConflictTypeIncompatibleIndex indicates indexes with the same name have incompatible definitions.
+	ConflictTypeIncompatibleIndex
+	// ConflictTypeColumnCharset indicates columns with the same name have different charsets or collations.
+	ConflictTypeColumnCharset
+	// ConflictTypeTooManyColumns indicates the joined table info has more columns than the limit.
+	ConflictTypeTooManyColumns
+	// ConflictTypeMissingDefault indicates a NOT NULL column without a valid default value exists in only some tables.
+	ConflictTypeMissingDefault
+)
+
+// DefaultMaxColumns is the default max number of columns in the joined table info of a lock,
+// it's the max number of columns in an InnoDB table of MySQL.
+const DefaultMaxColumns = 1017
+
+// String implements Stringer interface.
+func (t ConflictType) String() string {
+	switch t {
+	case ConflictTypeNone:
+		return "none"
+	case ConflictTypeUnknown:
+		return "unknown"
+	case ConflictTypeColumnType:
+		return "column-type-mismatch"
+	case ConflictTypeColumnDefault:
+		return "column-default-mismatch"
+	case ConflictTypeGeneratedColumn:
+		return "generated-column-mismatch"
+	case ConflictTypeDropReferencedColumn:
+		return "drop-referenced-column"
+	case ConflictTypeIncompatibleIndex:
+		return "incompatible-index"
+	case ConflictTypeColumnCharset:
+		return "column-charset-mismatch"
+	case ConflictTypeTooManyColumns:
+		return "too-many-columns"
+	case ConflictTypeMissingDefault:
+		return "missing-default-value"
+	}
+	return fmt.Sprintf("unknown conflict type %d", int(t))
+}
+
 // NewLock creates a new Lock instance.
 // NOTE: we MUST give the initial table info when creating the lock now.
 func NewLock(ID, task string, ti *model.TableInfo, sts []SourceTables) *Lock {
+	return newLock(ID, task, ti, sts, realClock{})
+}
+
+// newLock creates a new Lock instance using `clock` to get the current time.
+func newLock(ID, task string, ti *model.TableInfo, sts []SourceTables, clock Clock) *Lock {
 	l := &Lock{
-		ID:     ID,
-		Task:   task,
-		joined: schemacmp.Encode(ti),
-		tables: make(map[string]map[string]map[string]schemacmp.Table),
-		done:   make(map[string]map[string]map[string]bool),
+		ID:             ID,
+		Task:           task,
+		joined:         encodeTable(ti),
+		joinedTI:       ti,
+		initTI:         ti,
+		tables:         make(map[string]map[string]map[string]schemacmp.Table),
+		tableInfos:     make(map[string]map[string]map[string]*model.TableInfo),
+		seqs:           make(map[string]map[string]map[string]uint64),
+		versions:       make(map[string]map[string]map[string]int),
+		infos:          make(map[string]map[string]map[string]Info),
+		canonicals:     make(map[string]map[string]map[string][]string),
+		specialIndexes: make(map[string]*specialIndex),
+		done:           make(map[string]map[string]map[string]bool),
+		maxColumns:     DefaultMaxColumns,
+		deadSources:    make(map[string]struct{}),
+
+		unresolvedSince: clock.Now(),
+		clock:           clock,
 	}
 	l.addSources(sts)
 	return l
 }
 
+// SetMaxColumns sets the max number of columns in the joined table info, `DefaultMaxColumns` is used if `n` <= 0.
+// DDLs which make the joined table info have more columns than the limit are treated as a conflict,
+// because they can't be executed to the downstream.
+func (l *Lock) SetMaxColumns(n int) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if n <= 0 {
+		n = DefaultMaxColumns
+	}
+	l.maxColumns = n
+}
+
 // TrySync tries to sync the lock, re-entrant.
 // new upstream sources may join when the DDL lock is in syncing,
 // so we need to merge these new sources.
@@ -73,10 +245,88 @@ func NewLock(ID, task string, ti *model.TableInfo, sts []SourceTables) *Lock {
 // TODO: but both of these modes are difficult to be implemented in DM-worker now, try to do that later.
 // for non-intrusive, a broadcast mechanism needed to notify conflict tables after the conflict has resolved, or even a block mechanism needed.
 // for intrusive, a DML prune or transform mechanism needed for two different schemas (before and after the conflict resolved).
+// NOTE: for a column added or modified by the caller, its attributes are reconciled with other tables as following:
+//   - nullability: if any table allows NULL for the column, the joined column is nullable.
+//   - default value: if only some tables have a default value, the default value is used;
+//     if the column is NOT NULL without default value and missing in some tables,
+//     the standard default value (e.g. 0 for integers) is used, then rows from these tables can still be inserted.
+//   - default value: if tables have different default values, a conflict is detected.
+//     this also applies to `ALTER COLUMN c SET DEFAULT xxx`, and the joined default value is kept
+//     for `ALTER COLUMN c DROP DEFAULT` until all tables have dropped the default value.
+//   - charset and collation: if tables have different charsets or collations, a conflict is detected.
+//   - type: if tables have different but compatible types (e.g. INT and BIGINT), the widest type is used,
+//     so widening a column converges after all tables widened it, while narrowing a column is a conflict.
+//     types of different families (e.g. INT and VARCHAR) are a conflict, see `widenColumnType` for the compatibility matrix.
+//   - generated column: the generation expression and the storage (STORED or VIRTUAL) must be the same,
+//     and a generated column can't be joined with a normal column, otherwise a conflict is detected.
+//   if the reconciled column is different from the one of the caller (or the column already exists in the downstream),
+//   DDLs generated from the joined schema (instead of the original DDLs) are returned.
+// NOTE: for an index added or modified by the caller, if an index with the same name but a different definition
+// exists in other tables, a conflict is detected. the index is added to the downstream after all tables have added it.
+// indexes with the same columns in different orders (e.g. `idx(a, b)` and `idx(b, a)`) are also conflicts.
+// NOTE: if the joined table info has more columns than the limit (see `SetMaxColumns`), a conflict is detected.
+// NOTE: foreign keys are not supported by TiDB and not tracked in the joined schema, so DDLs adding or dropping
+// foreign keys (including `REFERENCES` in column definitions) are rejected with `ErrShardDDLOptimismForeignKeyNotSupported`
+// before changing anything in the lock, instead of being coordinated inconsistently.
+// NOTE: FULLTEXT/SPATIAL indexes are ignored in the table info, so they are handled by their names:
+//   - the DDLs are executed to the downstream when the index is added by the first table or dropped by the last table.
+//   - if an index with the same name but a different type exists in other tables, a conflict is detected.
+// NOTE: guard clauses (`IF NOT EXISTS` or `IF EXISTS`) for columns and indexes are resolved with the table info before the DDLs:
+//   - if the guard makes the change a no-op (e.g. the column to add already exists), the change is removed from the DDLs.
+//   - otherwise, the guard is removed, then the DDLs are the same as the unguarded equivalents.
+// NOTE: positions of columns (`FIRST` or `AFTER xxx`) in ADD/MODIFY/CHANGE COLUMN are ignored for the downstream,
+// i.e. columns are always added as the last ones, because tables may add the same column with different positions
+// and the downstream column order should not depend on which table executes the DDL first.
+// NOTE: conflicts are detected by comparing table infos rather than DDL texts, so equivalent but differently-written DDLs
+// (e.g. `ADD c INT` and `ADD COLUMN c INT`) from different tables never conflict, see also `equivalentDDL`.
 func (l *Lock) TrySync(callerSource, callerSchema, callerTable string,
 	ddls []string, newTI *model.TableInfo, sts []SourceTables) (newDDLs []string, err error) {
+	newDDLs, _, err = l.trySync(callerSource, callerSchema, callerTable, parseDDLs(newTiDBDDLParser(), ddls), newTI, sts, 0)
+	return newDDLs, err
+}
+
+// trySync tries to sync the lock, it also returns the type of the conflict if detected.
+// if `seq` is not 0, DDLs with a sequence number less than the latest one for the table are rejected as out of order.
+// DDLs are passed with their ASTs parsed by the caller, so they are not parsed again, see `parseDDLs`.
+func (l *Lock) trySync(callerSource, callerSchema, callerTable string,
+	parsed []parsedDDL, newTI *model.TableInfo, sts []SourceTables, seq uint64) (newDDLs []string, ct ConflictType, err error) {
 	l.mu.Lock()
 	defer l.mu.Unlock()
+	l.gen++
+
+	l.warnings = nil
+
+	// the lock may be removed after the caller got it, changes to it would be lost.
+	if l.removed {
+		return []string{}, ConflictTypeNone, terror.ErrShardDDLOptimismLockRemoved.Generate(l.ID)
+	}
+
+	// the table joined the lock late (e.g. a source added after the lock created) and has caught up with other tables.
+	if _, ok := l.tables[callerSource][callerSchema][callerTable]; !ok {
+		defer func() {
+			if err != nil || ct != ConflictTypeNone {
+				return
+			}
+			if cmp, err2 := l.joined.Compare(l.tables[callerSource][callerSchema][callerTable]); err2 == nil && cmp == 0 {
+				l.warnings = append(l.warnings, fmt.Sprintf("table %s of source %s joined the lock late and caught up with the joined schema",
+					dbutil.TableName(callerSchema, callerTable), callerSource))
+			}
+		}()
+	}
+
+	if seq != 0 {
+		if lastSeq := l.seqs[callerSource][callerSchema][callerTable]; seq < lastSeq {
+			return []string{}, ConflictTypeNone, terror.ErrShardDDLOptimismOutOfOrderDDL.Generate(
+				seq, dbutil.TableName(callerSchema, callerTable), callerSource, l.ID, lastSeq)
+		}
+	}
+
+	if ddl := foreignKeyDDL(parsed); ddl != "" {
+		return []string{}, ConflictTypeNone, terror.ErrShardDDLOptimismForeignKeyNotSupported.Generate(ddl, l.ID)
+	}
+
+	// column positions are ignored for the downstream, so the downstream column order is deterministic.
+	parsed = ignoreColumnPositions(parsed)
 
 	// handle the case where <callerSource, callerSchema, callerTable>
 	// is not in old source tables and current new source tables.
@@ -87,39 +337,163 @@ func (l *Lock) TrySync(callerSource, callerSchema, callerTable string,
 	l.addSources(sts)
 
 	oldTable := l.tables[callerSource][callerSchema][callerTable]
-	newTable := schemacmp.Encode(newTI)
+	oldTI := l.tableInfos[callerSource][callerSchema][callerTable]
+	// guard clauses (`IF [NOT] EXISTS`) are resolved with the table info before the DDLs,
+	// so DDLs with the same effective change converge no matter whether guarded or not.
+	parsed = resolveGuardClauses(parsed, oldTI)
+	ddls := ddlTexts(parsed)
+	newTable := encodeTable(newTI)
 	oldJoined := l.joined
+	oldJoinedTI := l.joinedTI
 	newJoined := newTable
 	l.tables[callerSource][callerSchema][callerTable] = newTable
+	l.tableInfos[callerSource][callerSchema][callerTable] = newTI
+	if seq != 0 {
+		l.seqs[callerSource][callerSchema][callerTable] = seq
+	}
+	if cmp, err2 := oldTable.Compare(newTable); err2 != nil || cmp != 0 {
+		l.versions[callerSource][callerSchema][callerTable] += len(ddls)
+	}
 	log.L().Info("update table info", zap.String("lock", l.ID), zap.String("source", callerSource), zap.String("schema", callerSchema), zap.String("table", callerTable),
 		zap.Stringer("from", oldTable), zap.Stringer("to", newTable), zap.Strings("ddls", ddls))
 
+	// special case: partition management DDLs (ADD/DROP/REORGANIZE PARTITION) do not change the column schema,
+	// so they can be applied immediately without waiting for other tables.
+	if isPartitionDDLs(parsed) {
+		log.L().Info("partition DDLs applied immediately", zap.String("lock", l.ID), zap.String("source", callerSource),
+			zap.String("schema", callerSchema), zap.String("table", callerTable), zap.Strings("ddls", ddls))
+		return ddls, ConflictTypeNone, nil
+	}
+
+	// special case: DDLs which converge trivially (e.g. change the comment of the table or a column)
+	// are marked as synced without executing them to the downstream.
+	if isNoOpDownstreamDDLs(parsed) || isCommentOnlyDDLs(parsed, oldTI, newTI) {
+		log.L().Info("no-op DDLs for the downstream skipped", zap.String("lock", l.ID), zap.String("source", callerSource),
+			zap.String("schema", callerSchema), zap.String("table", callerTable), zap.Strings("ddls", ddls))
+		l.warnings = append(l.warnings, fmt.Sprintf("DDLs %v of table %s of source %s are no-ops for the downstream and skipped",
+			ddls, dbutil.TableName(callerSchema, callerTable), callerSource))
+		return []string{}, ConflictTypeNone, nil
+	}
+
+	// special case: FULLTEXT/SPATIAL indexes are ignored in the table info,
+	// so they are tracked by their names in the lock.
+	if added, ok := addedSpecialIndexes(parsed); ok {
+		return l.trySyncAddSpecialIndexes(callerSource, callerSchema, callerTable, ddls, added)
+	}
+	if dropped, ok := droppedIndexes(parsed); ok && l.hasSpecialIndexes(callerSource, callerSchema, callerTable, dropped) {
+		return l.trySyncDropSpecialIndexes(callerSource, callerSchema, callerTable, ddls, dropped)
+	}
+	if index, si := l.conflictSpecialIndex(oldTI, newTI); index != nil {
+		// NOTE: conflict detected for a normal index with the same name as a FULLTEXT/SPATIAL index.
+		return l.specialIndexConflict(callerSource, callerSchema, callerTable, ddls, fmt.Sprintf(
+			"index %s conflicts with the %s index in other tables", indexDefinition(index), si.keyType))
+	}
+
+	// special case: default values of columns are set or dropped, check them with other tables explicitly,
+	// then the conflict can be reported with the column and the different default values.
+	if cols, ok := alteredColumnDefaults(parsed); ok {
+		if msg := l.conflictColumnDefault(callerSource, callerSchema, callerTable, newTI, cols); msg != "" {
+			// NOTE: conflict detected for columns with different default values.
+			ct = ConflictTypeColumnDefault
+			l.conflict = ct
+			log.L().Warn("conflict detected", zap.String("lock", l.ID), zap.Stringer("type", ct),
+				zap.String("source", callerSource), zap.String("schema", callerSchema), zap.String("table", callerTable), zap.Strings("ddls", ddls))
+			return []string{}, ct, terror.ErrShardDDLOptimismTrySyncFail.Generate(l.ID, msg)
+		}
+	}
+
+	// special case: types of columns are narrowed (e.g. BIGINT -> INT), this can't be coordinated
+	// because rows from other tables may be out of the range of the narrowed type.
+	if col, oldCol := narrowedColumn(oldTI, newTI); col != nil {
+		// NOTE: conflict detected for the narrowed column type.
+		ct = ConflictTypeColumnType
+		l.conflict = ct
+		log.L().Warn("conflict detected", zap.String("lock", l.ID), zap.Stringer("type", ct),
+			zap.String("source", callerSource), zap.String("schema", callerSchema), zap.String("table", callerTable), zap.Strings("ddls", ddls))
+		return []string{}, ct, terror.ErrShardDDLOptimismTrySyncFail.Generate(l.ID, fmt.Sprintf(
+			"type of column %s is narrowed from %s to %s", col.Name.O, oldCol.FieldType.CompactStr(), col.FieldType.CompactStr()))
+	}
+
 	// special case: if the DDL does not affect the schema at all, assume it is
 	// idempotent and just execute the DDL directly.
 	// if any real conflicts after joined exist, they will be detected by the following steps.
 	var cmp int
 	if cmp, err = newTable.Compare(oldJoined); err == nil && cmp == 0 {
-		return ddls, nil
+		// the table may converge to the joined schema to resolve the conflict detected before.
+		l.tryResolveConflict()
+		return ddls, ConflictTypeNone, nil
 	}
 
-	// try to join tables.
+	// try to join tables, columns with compatible types are joined with the widest types.
 	var emptyDDLs = []string{}
+	widest := l.widestColumnTypes()
+	if len(widest) > 0 {
+		newJoined = encodeTable(widenTableInfo(newTI, widest))
+	}
 	for source, schemaTables := range l.tables {
 		for schema, tables := range schemaTables {
 			for table, ti := range tables {
 				if source != callerSource || schema != callerSchema || table != callerTable {
+					if len(widest) > 0 {
+						ti = encodeTable(widenTableInfo(l.tableInfos[source][schema][table], widest))
+					}
 					newJoined2, err2 := newJoined.Join(ti)
 					if err2 != nil {
 						// NOTE: conflict detected.
-						return emptyDDLs, terror.ErrShardDDLOptimismTrySyncFail.Delegate(
+						ct = classifyConflict(newTI, l.tableInfos[source][schema][table])
+						l.conflict = ct
+						log.L().Warn("conflict detected", zap.String("lock", l.ID), zap.Stringer("type", ct),
+							zap.String("source", callerSource), zap.String("schema", callerSchema), zap.String("table", callerTable), zap.Strings("ddls", ddls))
+						if ct == ConflictTypeColumnCharset {
+							// report the column and the different charset or collation.
+							return emptyDDLs, ct, terror.ErrShardDDLOptimismTrySyncFail.Delegate(err2, l.ID, fmt.Sprintf("%s in table %s of source %s",
+								charsetConflict(newTI, l.tableInfos[source][schema][table]), dbutil.TableName(schema, table), source))
+						}
+						return emptyDDLs, ct, terror.ErrShardDDLOptimismTrySyncFail.Delegate(
 							err2, l.ID, fmt.Sprintf("fail to join table info %s with %s", newJoined, ti))
 					}
+					if index := conflictIndex(oldTI, newTI, l.tableInfos[source][schema][table]); index != nil {
+						// NOTE: conflict detected for indexes with the same name but different definitions.
+						ct = ConflictTypeIncompatibleIndex
+						l.conflict = ct
+						log.L().Warn("conflict detected", zap.String("lock", l.ID), zap.Stringer("type", ct),
+							zap.String("source", callerSource), zap.String("schema", callerSchema), zap.String("table", callerTable), zap.Strings("ddls", ddls))
+						msg := fmt.Sprintf("index %s conflicts with the one in table %s of source %s", indexDefinition(index), dbutil.TableName(schema, table), source)
+						if index2 := l.tableInfos[source][schema][table].FindIndexByName(index.Name.L); indexColumnsReordered(index, index2) {
+							// report the different column orders of the same columns.
+							msg += fmt.Sprintf(", columns are in different orders %s and %s", indexColumnOrder(index), indexColumnOrder(index2))
+						}
+						return emptyDDLs, ct, terror.ErrShardDDLOptimismTrySyncFail.Generate(l.ID, msg)
+					}
 					newJoined = newJoined2
 				}
 			}
 		}
 	}
+	newJoinedTI := l.joinTableInfos()
+	if col, source, schema, table := l.missingDefaultColumn(newJoinedTI); col != nil {
+		// NOTE: conflict detected for a NOT NULL column without a valid default value missing in some tables,
+		// rows from these tables can't be inserted into the downstream.
+		ct = ConflictTypeMissingDefault
+		l.conflict = ct
+		log.L().Warn("conflict detected", zap.String("lock", l.ID), zap.Stringer("type", ct),
+			zap.String("source", callerSource), zap.String("schema", callerSchema), zap.String("table", callerTable), zap.Strings("ddls", ddls))
+		return emptyDDLs, ct, terror.ErrShardDDLOptimismTrySyncFail.Generate(l.ID, fmt.Sprintf(
+			"NOT NULL column %s of type %s has no default value but not exists in table %s of source %s, add it with a default value or as nullable",
+			col.Name.O, col.FieldType.CompactStr(), dbutil.TableName(schema, table), source))
+	}
+	if newJoinedTI != nil && len(newJoinedTI.Columns) > l.maxColumns {
+		// NOTE: conflict detected for too many columns, the joined table can't be created in the downstream.
+		ct = ConflictTypeTooManyColumns
+		l.conflict = ct
+		log.L().Warn("conflict detected", zap.String("lock", l.ID), zap.Stringer("type", ct),
+			zap.String("source", callerSource), zap.String("schema", callerSchema), zap.String("table", callerTable), zap.Strings("ddls", ddls))
+		return emptyDDLs, ct, terror.ErrShardDDLOptimismTrySyncFail.Generate(
+			l.ID, fmt.Sprintf("the joined table info has %d columns, exceeds the limit %d", len(newJoinedTI.Columns), l.maxColumns))
+	}
 	l.joined = newJoined // update the current table info.
+	l.conflict = ConflictTypeNone
+	l.joinedTI = newJoinedTI
 	log.L().Info("update joined table info", zap.String("lock", l.ID), zap.Stringer("from", oldJoined), zap.Stringer("to", newJoined),
 		zap.String("source", callerSource), zap.String("schema", callerSchema), zap.String("table", callerTable), zap.Strings("ddls", ddls))
 
@@ -135,7 +509,7 @@ func (l *Lock) TrySync(callerSource, callerSchema, callerTable string,
 		// resolving conflict in non-intrusive mode.
 		log.L().Warn("resolving conflict", zap.String("lock", l.ID), zap.String("source", callerSource), zap.String("schema", callerSchema), zap.String("table", callerTable),
 			zap.Stringer("joined-from", oldJoined), zap.Stringer("joined-to", newJoined), zap.Strings("ddls", ddls))
-		return ddls, nil
+		return ddls, ConflictTypeNone, nil
 	}
 	if cmp != 0 {
 		// < 0: the joined schema become larger after applied these DDLs.
@@ -145,7 +519,7 @@ func (l *Lock) TrySync(callerSource, callerSchema, callerTable string,
 		// for these two cases, we should execute the DDLs to the downstream to update the schema.
 		log.L().Info("joined table info changed", zap.String("lock", l.ID), zap.Int("cmp", cmp), zap.Stringer("from", oldJoined), zap.Stringer("to", newJoined),
 			zap.String("source", callerSource), zap.String("schema", callerSchema), zap.String("table", callerTable), zap.Strings("ddls", ddls))
-		return ddls, nil
+		return l.reconcileDDLs(oldJoinedTI, oldTI, newTI, ddls), ConflictTypeNone, nil
 	}
 
 	// NOTE: now, different DM-workers do not wait for each other when executing DDL/DML,
@@ -167,31 +541,31 @@ func (l *Lock) TrySync(callerSource, callerSchema, callerTable string,
 
 	cmp, err = oldTable.Compare(newTable)
 	if err != nil {
-		return emptyDDLs, terror.ErrShardDDLOptimismTrySyncFail.Delegate(
+		return emptyDDLs, ConflictTypeNone, terror.ErrShardDDLOptimismTrySyncFail.Delegate(
 			err, l.ID, fmt.Sprintf("can't compare table info (old table info) %s with (new table info) %s", oldTable, newTable)) // NOTE: this should not happen.
 	}
 	if cmp < 0 {
 		// let every table to replicate the DDL.
-		return ddls, nil
+		return ddls, ConflictTypeNone, nil
 	} else if cmp > 0 {
 		// do nothing except the last table.
-		return emptyDDLs, nil
+		return emptyDDLs, ConflictTypeNone, nil
 	}
 
 	// compare the current table's info with joined info.
 	cmp, err = newTable.Compare(newJoined)
 	if err != nil {
-		return emptyDDLs, terror.ErrShardDDLOptimismTrySyncFail.Delegate(
+		return emptyDDLs, ConflictTypeNone, terror.ErrShardDDLOptimismTrySyncFail.Delegate(
 			err, l.ID, "can't compare table info (new table info) %s with (new joined table info) %s", newTable, newJoined) // NOTE: this should not happen.
 	}
 	if cmp < 0 {
 		// no need to replicate DDLs, because has a larger joined schema (in the downstream).
 		// FIXME: if the previous tables reached the joined schema has not replicated to the downstream,
 		// now, they should re-try until replicated successfully, try to implement better strategy later.
-		return emptyDDLs, nil
+		return emptyDDLs, ConflictTypeNone, nil
 	}
 	log.L().Warn("new table info >= new joined table info", zap.Stringer("table info", newTable), zap.Stringer("joined table info", newJoined))
-	return ddls, nil // NOTE: this should not happen.
+	return ddls, ConflictTypeNone, nil // NOTE: this should not happen.
 }
 
 // TryRemoveTable tries to remove a table in the lock.
@@ -203,6 +577,7 @@ func (l *Lock) TrySync(callerSource, callerSchema, callerTable string,
 func (l *Lock) TryRemoveTable(source, schema, table string) bool {
 	l.mu.Lock()
 	defer l.mu.Unlock()
+	l.gen++
 
 	if _, ok := l.tables[source]; !ok {
 		return false
@@ -215,15 +590,134 @@ func (l *Lock) TryRemoveTable(source, schema, table string) bool {
 	}
 
 	delete(l.tables[source][schema], table)
+	delete(l.tableInfos[source][schema], table)
+	delete(l.seqs[source][schema], table)
+	delete(l.versions[source][schema], table)
+	delete(l.infos[source][schema], table)
+	delete(l.canonicals[source][schema], table)
 	delete(l.done[source][schema], table)
+	for name, si := range l.specialIndexes {
+		delete(si.tables[source][schema], table)
+		if si.count() == 0 {
+			delete(l.specialIndexes, name)
+		}
+	}
 	return true
 }
 
+// RemoveSource removes all tables of a source from the lock,
+// this is often used when the source is removed permanently while the lock is still pending on it.
+// after removed, the lock may become synced or resolved if only tables of this source were not synced or done.
+// NOTE: like `TryRemoveTable`, it does NOT try to rebuild the joined schema after the source removed now.
+func (l *Lock) RemoveSource(source string) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.gen++
+
+	if _, ok := l.tables[source]; !ok {
+		return terror.ErrShardDDLOptimismSourceNotFound.Generate(source, l.ID)
+	}
+
+	delete(l.tables, source)
+	delete(l.tableInfos, source)
+	delete(l.seqs, source)
+	delete(l.versions, source)
+	delete(l.infos, source)
+	delete(l.canonicals, source)
+	delete(l.done, source)
+	for name, si := range l.specialIndexes {
+		delete(si.tables, source)
+		if si.count() == 0 {
+			delete(l.specialIndexes, name)
+		}
+	}
+	return nil
+}
+
+// Reset resets the sync state of the lock back to the table info when it was created,
+// but keeps its ID and all tables in it.
+// after reset, all tables are synced with the initial table info and none of them have done the operation,
+// so sources MUST re-send their shard DDL info to sync the lock again.
+func (l *Lock) Reset() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.gen++
+
+	l.joined = encodeTable(l.initTI)
+	l.joinedTI = l.initTI
+	l.conflict = ConflictTypeNone
+	l.warnings = nil
+	l.unresolvedSince = l.clock.Now()
+	l.escalated = false
+	l.specialIndexes = make(map[string]*specialIndex)
+	for source, schemaTables := range l.tables {
+		for schema, tables := range schemaTables {
+			for table := range tables {
+				l.tables[source][schema][table] = l.joined
+				l.tableInfos[source][schema][table] = l.joinedTI
+				l.done[source][schema][table] = false
+				delete(l.seqs[source][schema], table)
+				delete(l.versions[source][schema], table)
+			}
+		}
+	}
+}
+
+// ContributingInfos returns the latest shard DDL infos of tables tried to sync the lock,
+// sorted by source, schema and table. tables removed from the lock are not included.
+// after the lock resolved, these infos can be deleted by `DeleteInfosOperations` directly.
+// NOTE: infos are kept after `Reset` until they are replaced by the re-sent ones.
+func (l *Lock) ContributingInfos() []Info {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+
+	infos := make([]Info, 0)
+	for _, source := range sortedKeys(l.infos) {
+		for _, schema := range sortedKeys(l.infos[source]) {
+			for _, table := range sortedKeys(l.infos[source][schema]) {
+				infos = append(infos, l.infos[source][schema][table])
+			}
+		}
+	}
+	return infos
+}
+
+// PendingDDLs returns DDLs in the latest shard DDL infos of tables whose operations have not done yet,
+// sorted by source, schema and table (the same as `ContributingInfos`) and then the order in infos.
+// equivalent DDLs from different tables (see `equivalentDDL`) are returned only once, the first one is kept.
+func (l *Lock) PendingDDLs() []string {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+
+	var (
+		ddls = make([]string, 0)
+		seen = make(map[string]struct{}) // canonical forms of DDLs returned.
+	)
+	for _, source := range sortedKeys(l.infos) {
+		for _, schema := range sortedKeys(l.infos[source]) {
+			for _, table := range sortedKeys(l.infos[source][schema]) {
+				if l.done[source][schema][table] {
+					continue
+				}
+				canonicals := l.canonicals[source][schema][table]
+				for i, ddl := range l.infos[source][schema][table].DDLs {
+					if _, ok := seen[canonicals[i]]; !ok {
+						seen[canonicals[i]] = struct{}{}
+						ddls = append(ddls, ddl)
+					}
+				}
+			}
+		}
+	}
+	return ddls
+}
+
 // IsSynced returns whether the lock has synced.
 // In the optimistic mode, we call it `synced` if table info of all tables are the same,
 // and we define `remain` as the table count which have different table info with the joined one,
 // e.g. for `ADD COLUMN`, it's the table count which have not added the column,
 // for `DROP COLUMN`, it's the table count which have dropped the column.
+// NOTE: tables of sources marked dead are skipped, see `LockKeeper.SetSourceLiveness`.
 func (l *Lock) IsSynced() (bool, int) {
 	l.mu.RLock()
 	defer l.mu.RUnlock()
@@ -242,6 +736,89 @@ func (l *Lock) Ready() map[string]map[string]map[string]bool {
 	return ready
 }
 
+// Progress returns the fraction (0.0 - 1.0) of tables which are ready (see `Ready`) in all tables of the lock,
+// it's 1.0 if no tables in the lock.
+func (l *Lock) Progress() float64 {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+
+	ready, remain := l.syncStatus()
+	total := 0
+	for _, schemaTables := range ready {
+		for _, tables := range schemaTables {
+			total += len(tables)
+		}
+	}
+	if total == 0 {
+		return 1.0
+	}
+	return float64(total-remain) / float64(total)
+}
+
+// PendingSources returns the sorted sources which have tables not synced yet.
+func (l *Lock) PendingSources() []string {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+
+	ready, _ := l.syncStatus()
+	return pendingSources(ready)
+}
+
+// pendingSources returns the sorted sources which have tables not synced yet in the sync status.
+func pendingSources(ready map[string]map[string]map[string]bool) []string {
+	sources := make([]string, 0)
+	for source, schemaTables := range ready {
+	outer:
+		for _, tables := range schemaTables {
+			for _, synced := range tables {
+				if !synced {
+					sources = append(sources, source)
+					break outer
+				}
+			}
+		}
+	}
+	sort.Strings(sources)
+	return sources
+}
+
+// Conflict returns the type of the conflict detected in the latest sync,
+// `ConflictTypeNone` if no conflict exists.
+func (l *Lock) Conflict() ConflictType {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	return l.conflict
+}
+
+// Warnings returns advisory messages for noteworthy but valid decisions made in the latest sync,
+// e.g. a late-joining table caught up with the joined schema, or no-op DDLs skipped.
+func (l *Lock) Warnings() []string {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	return append([]string{}, l.warnings...)
+}
+
+// DownstreamCreateTable returns the `CREATE TABLE` statement of the joined schema for the downstream table,
+// it's often used to diff the coordinated schema against the actual one in the downstream.
+// the joined schema is only converged after all tables synced, so an error is returned if the lock is not synced.
+// NOTE: FULLTEXT/SPATIAL indexes are not included, because they are ignored in the table info.
+func (l *Lock) DownstreamCreateTable() (string, error) {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+
+	if _, remain := l.syncStatus(); remain > 0 {
+		return "", terror.ErrShardDDLOptimismLockNotSynced.Generate(l.ID, remain)
+	}
+	return createTableDefinition(l.downTable(), l.joinedTI), nil
+}
+
+// Tags returns labels attached to the lock by operators, nil if no labels attached.
+func (l *Lock) Tags() map[string]string {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	return l.copyTags()
+}
+
 // Joined returns the joined table info.
 func (l *Lock) Joined() schemacmp.Table {
 	l.mu.RLock()
@@ -249,6 +826,72 @@ func (l *Lock) Joined() schemacmp.Table {
 	return l.joined
 }
 
+// AddedColumns returns names of columns which exist in the joined table info but not in the initial one,
+// in the order of columns in the joined table info.
+func (l *Lock) AddedColumns() []string {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	return missingColumns(l.joinedTI, l.initTI)
+}
+
+// DroppedColumns returns names of columns which exist in the initial table info but not in the joined one,
+// in the order of columns in the initial table info.
+func (l *Lock) DroppedColumns() []string {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	return missingColumns(l.initTI, l.joinedTI)
+}
+
+// SchemaVersions returns the schema version of each source in the lock, source ID -> version.
+// the version of a table is increased by the count of DDLs each time its schema changed after trying to sync,
+// and the version of a source is the smallest one of its tables (i.e. the most lagging table).
+// if versions of sources diverge widely, it often means some sources are lagging badly.
+func (l *Lock) SchemaVersions() map[string]int {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+
+	versions := make(map[string]int, len(l.tables))
+	for source, schemaTables := range l.tables {
+		first := true
+		for schema, tables := range schemaTables {
+			for table := range tables {
+				v := l.versions[source][schema][table]
+				if first || v < versions[source] {
+					versions[source] = v
+					first = false
+				}
+			}
+		}
+		if first {
+			versions[source] = 0
+		}
+	}
+	return versions
+}
+
+// CatchUpDDLs returns DDLs needed to bring the source table from its current schema to the joined schema.
+// this is often used for a table which joined the lock after some DDLs have been applied by other tables,
+// e.g. a newly added table with the initial schema after other tables have added some columns.
+func (l *Lock) CatchUpDDLs(source, schema, table string) ([]string, error) {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+
+	ti, ok := l.tableInfos[source][schema][table]
+	if !ok {
+		return nil, terror.ErrShardDDLOptimismTrySyncFail.Generate(l.ID,
+			fmt.Sprintf("table %s of source %s not found", dbutil.TableName(schema, table), source))
+	}
+
+	// the joined table info is derived from table infos of all tables,
+	// double check it with the joined schema to ensure the DDLs are correct.
+	// NOTE: some flags (like key flags) are not visible in DDLs, so we only compare the restored schema.
+	if encodeTable(l.joinedTI).String() != l.joined.String() {
+		return nil, terror.ErrShardDDLOptimismTrySyncFail.Generate(l.ID,
+			fmt.Sprintf("can't derive the joined table info for %s", l.joined))
+	}
+	return diffTableInfo(dbutil.TableName(schema, table), ti, l.joinedTI), nil
+}
+
 // TryMarkDone tries to mark the operation of the source table as done.
 // it returns whether marked done.
 // NOTE: we can only mark the operation of the table as done if it's already synced.
@@ -256,6 +899,7 @@ func (l *Lock) Joined() schemacmp.Table {
 func (l *Lock) TryMarkDone(source, schema, table string) bool {
 	l.mu.Lock()
 	defer l.mu.Unlock()
+	l.gen++
 
 	if _, ok := l.done[source]; !ok {
 		return false
@@ -271,6 +915,10 @@ func (l *Lock) TryMarkDone(source, schema, table string) bool {
 		return false
 	}
 	l.done[source][schema][table] = true
+	if l.isResolved() {
+		l.unresolvedSince = l.clock.Now()
+		l.escalated = false
+	}
 	return true
 }
 
@@ -292,79 +940,1216 @@ func (l *Lock) IsDone(source, schema, table string) bool {
 }
 
 // IsResolved returns whether the lock has resolved (all operations have done).
+// NOTE: tables of sources marked dead are skipped, see `LockKeeper.SetSourceLiveness`.
 func (l *Lock) IsResolved() bool {
 	l.mu.RLock()
 	defer l.mu.RUnlock()
+	return l.isResolved()
+}
 
-	for _, schemaTables := range l.done {
-		for _, tables := range schemaTables {
-			for _, done := range tables {
-				if !done {
-					return false
-				}
+// Reopen reverts the done status of all tables to transition the resolved lock back to pending,
+// so the DDLs can be re-coordinated and re-applied (like after the downstream execution failed).
+// it returns false without changing anything if the lock is not resolved (some tables are still syncing).
+func (l *Lock) Reopen() bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.gen++
+
+	if !l.isResolved() {
+		return false
+	}
+	for source, schemaTables := range l.done {
+		for schema, tables := range schemaTables {
+			for table := range tables {
+				l.done[source][schema][table] = false
 			}
 		}
 	}
+	l.unresolvedSince = l.clock.Now()
+	l.escalated = false
 	return true
 }
 
-// syncedStatus returns the current tables' sync status (<Ready, remain>).
-func (l *Lock) syncStatus() (map[string]map[string]map[string]bool, int) {
-	ready := make(map[string]map[string]map[string]bool)
-	remain := 0
-	for source, schemaTables := range l.tables {
-		if _, ok := ready[source]; !ok {
-			ready[source] = make(map[string]map[string]bool)
-		}
+// IsRemoved returns whether the lock has been removed from the keeper.
+func (l *Lock) IsRemoved() bool {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+
+	return l.removed
+}
+
+// IsEscalated returns whether the lock has been escalated as requiring manual intervention, see `LockKeeper.EscalateStale`.
+// the escalation is cleared after the lock resolved or reset.
+func (l *Lock) IsEscalated() bool {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	return l.escalated
+}
+
+// View returns an immutable snapshot of the lock.
+func (l *Lock) View() LockView {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+
+	ready, remain := l.syncStatus()
+	done := make(map[string]map[string]map[string]bool, len(l.done))
+	for source, schemaTables := range l.done {
+		done[source] = make(map[string]map[string]bool, len(schemaTables))
 		for schema, tables := range schemaTables {
-			if _, ok := ready[source][schema]; !ok {
-				ready[source][schema] = make(map[string]bool)
-			}
-			for table, ti := range tables {
-				if cmp, err := l.joined.Compare(ti); err == nil && cmp == 0 {
-					ready[source][schema][table] = true
-				} else {
-					ready[source][schema][table] = false
-					remain++
-				}
+			done[source][schema] = make(map[string]bool, len(tables))
+			for table, isDone := range tables {
+				done[source][schema][table] = isDone
 			}
 		}
 	}
-	return ready, remain
-}
-
-// tryRevertDone tries to revert the done status when the joined schema changed.
-func (l *Lock) tryRevertDone() {
-	for source, schemaTables := range l.tables {
+	versions := make(map[string]map[string]map[string]int, len(l.versions))
+	for source, schemaTables := range l.versions {
+		versions[source] = make(map[string]map[string]int, len(schemaTables))
 		for schema, tables := range schemaTables {
-			for table, ti := range tables {
-				if cmp, err := l.joined.Compare(ti); err != nil || cmp != 0 {
-					l.done[source][schema][table] = false
-				}
+			versions[source][schema] = make(map[string]int, len(tables))
+			for table, version := range tables {
+				versions[source][schema][table] = version
 			}
 		}
 	}
+
+	return LockView{
+		ID:             l.ID,
+		Task:           l.Task,
+		Joined:         l.joined.String(),
+		Synced:         remain == 0,
+		Remain:         remain,
+		Ready:          ready,
+		PendingSources: pendingSources(ready),
+		Done:           done,
+		Resolved:       l.isResolved(),
+		Conflict:       l.conflict.String(),
+		Escalated:      l.escalated,
+		Versions:       versions,
+		Tags:           l.copyTags(),
+	}
 }
 
-// addSources adds any not-existing tables into the lock.
-func (l *Lock) addSources(sts []SourceTables) {
-	for _, st := range sts {
-		if _, ok := l.tables[st.Source]; !ok {
-			l.tables[st.Source] = make(map[string]map[string]schemacmp.Table)
-			l.done[st.Source] = make(map[string]map[string]bool)
+// setTags replaces labels attached to the lock with a copy of `tags`, nil or empty `tags` clears all labels.
+func (l *Lock) setTags(tags map[string]string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.tags = nil
+	if len(tags) > 0 {
+		l.tags = make(map[string]string, len(tags))
+		for k, v := range tags {
+			l.tags[k] = v
 		}
-		for schema, tables := range st.Tables {
-			if _, ok := l.tables[st.Source][schema]; !ok {
-				l.tables[st.Source][schema] = make(map[string]schemacmp.Table)
-				l.done[st.Source][schema] = make(map[string]bool)
-			}
-			for table := range tables {
-				if _, ok := l.tables[st.Source][schema][table]; !ok {
-					// NOTE: the newly added table uses the current table info.
-					l.tables[st.Source][schema][table] = l.joined
-					l.done[st.Source][schema][table] = false
+	}
+}
+
+// copyTags returns a copy of labels attached to the lock, it should be called when holding the lock.
+func (l *Lock) copyTags() map[string]string {
+	if len(l.tags) == 0 {
+		return nil
+	}
+	tags := make(map[string]string, len(l.tags))
+	for k, v := range l.tags {
+		tags[k] = v
+	}
+	return tags
+}
+
+// setSourceAlive marks the source as alive or dead, and returns whether the liveness changed.
+func (l *Lock) setSourceAlive(source string, alive bool) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.gen++
+
+	_, dead := l.deadSources[source]
+	if alive == !dead {
+		return false
+	}
+	if alive {
+		delete(l.deadSources, source)
+	} else {
+		l.deadSources[source] = struct{}{}
+	}
+	return true
+}
+
+// setClock sets the clock used to get the current time.
+func (l *Lock) setClock(clock Clock) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.clock = clock
+}
+
+// generation returns the generation of the lock, it's changed if the sync state of the lock may be changed.
+func (l *Lock) generation() uint64 {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	return l.gen
+}
+
+// markRemoved marks the lock as removed from the keeper.
+func (l *Lock) markRemoved() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.removed = true
+}
+
+// trackInfo tracks the shard DDL info tried to sync the lock, it's ignored if the table is not in the lock.
+// `canonicals` are canonical forms of DDLs in the info, see `canonicalDDLs`.
+func (l *Lock) trackInfo(info Info, canonicals []string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.gen++
+
+	if _, ok := l.tables[info.Source][info.UpSchema][info.UpTable]; !ok {
+		return
+	}
+	l.infos[info.Source][info.UpSchema][info.UpTable] = info
+	l.canonicals[info.Source][info.UpSchema][info.UpTable] = canonicals
+}
+
+// tryEscalate tries to escalate the lock if it's unresolved for longer than `timeout` until `now`.
+// it returns whether escalated in this call, a lock already escalated is not escalated again.
+func (l *Lock) tryEscalate(timeout time.Duration, now time.Time) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.isResolved() {
+		// the lock may become resolved without `TryMarkDone` (like a source removed).
+		l.unresolvedSince = now
+		l.escalated = false
+		return false
+	}
+	if l.escalated || now.Sub(l.unresolvedSince) <= timeout {
+		return false
+	}
+	l.escalated = true
+	return true
+}
+
+// isResolved returns whether the lock has resolved without holding the lock's lock.
+func (l *Lock) isResolved() bool {
+	for source, schemaTables := range l.done {
+		if _, ok := l.deadSources[source]; ok {
+			continue
+		}
+		for _, tables := range schemaTables {
+			for _, done := range tables {
+				if !done {
+					return false
+				}
+			}
+		}
+	}
+	return true
+}
+
+// syncedStatus returns the current tables' sync status (<Ready, remain>).
+func (l *Lock) syncStatus() (map[string]map[string]map[string]bool, int) {
+	ready := make(map[string]map[string]map[string]bool)
+	remain := 0
+	for source, schemaTables := range l.tables {
+		if _, ok := l.deadSources[source]; ok {
+			continue // tables of dead sources are not waited for.
+		}
+		if _, ok := ready[source]; !ok {
+			ready[source] = make(map[string]map[string]bool)
+		}
+		for schema, tables := range schemaTables {
+			if _, ok := ready[source][schema]; !ok {
+				ready[source][schema] = make(map[string]bool)
+			}
+			for table, ti := range tables {
+				if cmp, err := l.joined.Compare(ti); err == nil && cmp == 0 {
+					ready[source][schema][table] = true
+				} else {
+					ready[source][schema][table] = false
+					remain++
+				}
+			}
+		}
+	}
+	return ready, remain
+}
+
+// tableState represents the state of a table in the lock, used to restore the table after skipping DDLs.
+type tableState struct {
+	source   string
+	schema   string
+	table    string
+	exists   bool // whether the table exists in the lock
+	tbl      schemacmp.Table
+	ti       *model.TableInfo
+	seq      uint64
+	version  int
+	conflict ConflictType // the conflict of the lock
+}
+
+// saveTableState saves the state of the table, it can be restored by `restoreTableState` later.
+func (l *Lock) saveTableState(source, schema, table string) tableState {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+
+	st := tableState{source: source, schema: schema, table: table, conflict: l.conflict}
+	st.tbl, st.exists = l.tables[source][schema][table]
+	if st.exists {
+		st.ti = l.tableInfos[source][schema][table]
+		st.seq = l.seqs[source][schema][table]
+		st.version = l.versions[source][schema][table]
+	}
+	return st
+}
+
+// restoreTableState restores the state of the table saved by `saveTableState`.
+// the table not existed when saving is restored to the current joined table info, like a newly added table.
+func (l *Lock) restoreTableState(st tableState) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.gen++
+
+	if _, ok := l.tables[st.source][st.schema][st.table]; !ok {
+		return // the table has been removed.
+	}
+	l.conflict = st.conflict
+	if !st.exists {
+		l.tables[st.source][st.schema][st.table] = l.joined
+		l.tableInfos[st.source][st.schema][st.table] = l.joinedTI
+		delete(l.seqs[st.source][st.schema], st.table)
+		delete(l.versions[st.source][st.schema], st.table)
+		return
+	}
+	l.tables[st.source][st.schema][st.table] = st.tbl
+	l.tableInfos[st.source][st.schema][st.table] = st.ti
+	if st.seq != 0 {
+		l.seqs[st.source][st.schema][st.table] = st.seq
+	} else {
+		delete(l.seqs[st.source][st.schema], st.table)
+	}
+	l.versions[st.source][st.schema][st.table] = st.version
+}
+
+// skipInfos skips DDLs in the shard DDL infos, tables of the infos are restored to the table info before the DDLs,
+// then the joined table info is re-computed from all tables, and these tables are marked as done if synced.
+// nothing is changed if tables can't be joined after skipped.
+func (l *Lock) skipInfos(infos []Info) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.gen++
+
+	var (
+		oldTables = make([]schemacmp.Table, len(infos))
+		oldTIs    = make([]*model.TableInfo, len(infos))
+	)
+	for i, info := range infos {
+		oldTables[i] = l.tables[info.Source][info.UpSchema][info.UpTable]
+		oldTIs[i] = l.tableInfos[info.Source][info.UpSchema][info.UpTable]
+		ti := info.TableInfoBefore
+		if ti == nil {
+			ti = l.joinedTI
+		}
+		l.tables[info.Source][info.UpSchema][info.UpTable] = encodeTable(ti)
+		l.tableInfos[info.Source][info.UpSchema][info.UpTable] = ti
+	}
+
+	newJoined, err := l.joinTables()
+	if err != nil {
+		for i, info := range infos { // rollback.
+			l.tables[info.Source][info.UpSchema][info.UpTable] = oldTables[i]
+			l.tableInfos[info.Source][info.UpSchema][info.UpTable] = oldTIs[i]
+		}
+		return terror.ErrShardDDLOptimismTrySyncFail.Delegate(err, l.ID, "fail to join tables after skipped DDLs")
+	}
+
+	oldJoined := l.joined
+	l.joined = newJoined
+	l.joinedTI = l.joinTableInfos()
+	l.conflict = ConflictTypeNone
+	if cmp, err2 := oldJoined.Compare(newJoined); err2 != nil || cmp != 0 {
+		l.tryRevertDone()
+	}
+	for _, info := range infos {
+		if cmp, err2 := l.joined.Compare(l.tables[info.Source][info.UpSchema][info.UpTable]); err2 == nil && cmp == 0 {
+			l.done[info.Source][info.UpSchema][info.UpTable] = true
+		}
+		delete(l.infos[info.Source][info.UpSchema], info.UpTable)
+		delete(l.canonicals[info.Source][info.UpSchema], info.UpTable)
+	}
+	return nil
+}
+
+// joinTables joins all tables in the lock, columns with compatible types are joined with the widest types.
+// the current joined table info is returned if no table exists.
+func (l *Lock) joinTables() (schemacmp.Table, error) {
+	var (
+		widest = l.widestColumnTypes()
+		joined = l.joined
+		first  = true
+	)
+	for _, source := range sortedKeys(l.tables) {
+		for _, schema := range sortedKeys(l.tables[source]) {
+			for _, table := range sortedKeys(l.tables[source][schema]) {
+				tbl := l.tables[source][schema][table]
+				if len(widest) > 0 {
+					tbl = encodeTable(widenTableInfo(l.tableInfos[source][schema][table], widest))
+				}
+				if first {
+					joined, first = tbl, false
+					continue
+				}
+				var err error
+				if joined, err = joined.Join(tbl); err != nil {
+					return joined, err
+				}
+			}
+		}
+	}
+	return joined, nil
+}
+
+// forceConflict clears the conflict detected in the latest sync, because DDLs causing it are forced to execute.
+func (l *Lock) forceConflict() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.gen++
+	l.conflict = ConflictTypeNone
+}
+
+// tryRevertDone tries to revert the done status when the joined schema changed.
+// if the lock was resolved before reverted, it's unresolved since now.
+func (l *Lock) tryRevertDone() {
+	resolved := l.isResolved()
+	for source, schemaTables := range l.tables {
+		for schema, tables := range schemaTables {
+			for table, ti := range tables {
+				if cmp, err := l.joined.Compare(ti); err != nil || cmp != 0 {
+					l.done[source][schema][table] = false
+				}
+			}
+		}
+	}
+	if resolved && !l.isResolved() {
+		l.unresolvedSince = l.clock.Now()
+	}
+}
+
+// tryResolveConflict resets the conflict detected before if all tables can be joined now.
+func (l *Lock) tryResolveConflict() {
+	if l.conflict == ConflictTypeNone {
+		return
+	}
+	var joined schemacmp.Table
+	first := true
+	for _, schemaTables := range l.tables {
+		for _, tables := range schemaTables {
+			for _, ti := range tables {
+				if first {
+					joined, first = ti, false
+					continue
+				}
+				var err error
+				if joined, err = joined.Join(ti); err != nil {
+					return
+				}
+			}
+		}
+	}
+	l.conflict = ConflictTypeNone
+}
+
+// reconcileDDLs returns DDLs generated from the difference between `oldJoinedTI` and the current joined table info
+// if any column changed by the caller has been reconciled with other tables, otherwise the original DDLs are returned.
+// a column is reconciled if:
+//   - the column of the caller is different from the joined one, or
+//   - the column is added by the caller but it already exists in the old joined table info (the downstream).
+func (l *Lock) reconcileDDLs(oldJoinedTI, oldTI, newTI *model.TableInfo, ddls []string) []string {
+	if oldJoinedTI == nil || oldTI == nil || newTI == nil || l.joinedTI == nil ||
+		encodeTable(l.joinedTI).String() != l.joined.String() {
+		return ddls // can't derive the joined table info.
+	}
+
+	for _, col := range l.joinedTI.Columns {
+		newCol := model.FindColumnInfo(newTI.Columns, col.Name.L)
+		if newCol == nil {
+			continue // not the column of the caller.
+		}
+		oldJoinedCol := model.FindColumnInfo(oldJoinedTI.Columns, col.Name.L)
+		if oldJoinedCol != nil && columnDefinition(oldJoinedCol) == columnDefinition(col) {
+			continue // not changed.
+		}
+		cmp, err := compareColumnInfo(newCol, col)
+		if err != nil || cmp != 0 || (oldJoinedCol != nil && model.FindColumnInfo(oldTI.Columns, col.Name.L) == nil) {
+			newDDLs := diffTableInfo(l.downTable(), oldJoinedTI, l.joinedTI)
+			log.L().Info("reconcile DDLs with the joined table info", zap.String("lock", l.ID), zap.String("column", col.Name.O),
+				zap.Strings("from", ddls), zap.Strings("to", newDDLs))
+			return newDDLs
+		}
+	}
+	return ddls
+}
+
+// downTable returns the quoted downstream table name of the lock.
+func (l *Lock) downTable() string {
+	return strings.TrimPrefix(l.ID, l.Task+"-")
+}
+
+// joinTableInfos joins table info of all tables.
+// tables are visited in order to make the order of columns in the joined table info stable.
+func (l *Lock) joinTableInfos() *model.TableInfo {
+	tis := make([]*model.TableInfo, 0, len(l.tableInfos))
+	widest := l.widestColumnTypes()
+	for _, source := range sortedKeys(l.tableInfos) {
+		schemaTables := l.tableInfos[source]
+		for _, schema := range sortedKeys(schemaTables) {
+			tables := schemaTables[schema]
+			for _, table := range sortedKeys(tables) {
+				tis = append(tis, widenTableInfo(tables[table], widest))
+			}
+		}
+	}
+	if len(tis) == 0 {
+		return l.joinedTI
+	}
+	return joinTableInfo(tis)
+}
+
+// missingDefaultColumn returns a NOT NULL column without a valid default value in the joined table info,
+// and the first table (in order) missing the column, see `hasStandardDefaultValue`.
+// it returns nil if no such column.
+func (l *Lock) missingDefaultColumn(joinedTI *model.TableInfo) (col *model.ColumnInfo, source, schema, table string) {
+	if joinedTI == nil {
+		return nil, "", "", ""
+	}
+	for _, col = range joinedTI.Columns {
+		if !mysql.HasNotNullFlag(col.Flag) || col.GetDefaultValue() != nil || col.IsGenerated() || hasStandardDefaultValue(col) {
+			continue
+		}
+		for _, source = range sortedKeys(l.tableInfos) {
+			schemaTables := l.tableInfos[source]
+			for _, schema = range sortedKeys(schemaTables) {
+				tables := schemaTables[schema]
+				for _, table = range sortedKeys(tables) {
+					if model.FindColumnInfo(tables[table].Columns, col.Name.L) == nil {
+						return col, source, schema, table
+					}
+				}
+			}
+		}
+	}
+	return nil, "", "", ""
+}
+
+// widestColumnTypes returns columns with the widest types among all tables, column name -> the widest column,
+// only columns with different but compatible types are included, see `widenColumnType`.
+// columns with incompatible types are not included, they are detected as conflicts when joining tables.
+func (l *Lock) widestColumnTypes() map[string]*model.ColumnInfo {
+	var (
+		widest       = make(map[string]*model.ColumnInfo)
+		different    = make(map[string]bool)
+		incompatible = make(map[string]bool)
+	)
+	for _, schemaTables := range l.tableInfos {
+		for _, tables := range schemaTables {
+			for _, ti := range tables {
+				if ti == nil {
+					continue
+				}
+				for _, col := range ti.Columns {
+					name := col.Name.L
+					w, ok := widest[name]
+					if !ok {
+						widest[name] = col
+						continue
+					}
+					if incompatible[name] || sameColumnType(w, col) {
+						continue
+					}
+					different[name] = true
+					if w2, ok2 := widenColumnType(w, col); ok2 {
+						widest[name] = w2
+					} else {
+						incompatible[name] = true
+					}
+				}
+			}
+		}
+	}
+	for name := range widest {
+		if !different[name] || incompatible[name] {
+			delete(widest, name)
+		}
+	}
+	return widest
+}
+
+// addSources adds any not-existing tables into the lock.
+func (l *Lock) addSources(sts []SourceTables) {
+	for _, st := range sts {
+		if _, ok := l.tables[st.Source]; !ok {
+			l.tables[st.Source] = make(map[string]map[string]schemacmp.Table)
+			l.tableInfos[st.Source] = make(map[string]map[string]*model.TableInfo)
+			l.seqs[st.Source] = make(map[string]map[string]uint64)
+			l.versions[st.Source] = make(map[string]map[string]int)
+			l.infos[st.Source] = make(map[string]map[string]Info)
+			l.canonicals[st.Source] = make(map[string]map[string][]string)
+			l.done[st.Source] = make(map[string]map[string]bool)
+		}
+		for schema, tables := range st.Tables {
+			if _, ok := l.tables[st.Source][schema]; !ok {
+				l.tables[st.Source][schema] = make(map[string]schemacmp.Table)
+				l.tableInfos[st.Source][schema] = make(map[string]*model.TableInfo)
+				l.seqs[st.Source][schema] = make(map[string]uint64)
+				l.versions[st.Source][schema] = make(map[string]int)
+				l.infos[st.Source][schema] = make(map[string]Info)
+				l.canonicals[st.Source][schema] = make(map[string][]string)
+				l.done[st.Source][schema] = make(map[string]bool)
+			}
+			for table := range tables {
+				if _, ok := l.tables[st.Source][schema][table]; !ok {
+					// NOTE: the newly added table uses the current table info.
+					l.tables[st.Source][schema][table] = l.joined
+					l.tableInfos[st.Source][schema][table] = l.joinedTI
+					l.done[st.Source][schema][table] = false
+				}
+			}
+		}
+	}
+}
+
+// parsedDDL represents a DDL with its AST, DDLs are parsed once before trying to sync the lock,
+// and helpers inspecting (or rewriting) them use the AST directly instead of parsing the DDL again.
+type parsedDDL struct {
+	text string
+	stmt ast.StmtNode // nil if the DDL can't be parsed.
+}
+
+// parseDDLs parses DDLs with the parser, DDLs which can't be parsed are kept with nil ASTs.
+func parseDDLs(p DDLParser, ddls []string) []parsedDDL {
+	parsed := make([]parsedDDL, 0, len(ddls))
+	for _, ddl := range ddls {
+		stmt, err := p.Parse(ddl)
+		if err != nil {
+			stmt = nil
+		}
+		parsed = append(parsed, parsedDDL{text: ddl, stmt: stmt})
+	}
+	return parsed
+}
+
+// ddlTexts returns texts of the parsed DDLs in order.
+func ddlTexts(ddls []parsedDDL) []string {
+	texts := make([]string, 0, len(ddls))
+	for _, ddl := range ddls {
+		texts = append(texts, ddl.text)
+	}
+	return texts
+}
+
+// isPartitionDDLs returns whether all DDLs are partition management DDLs (ADD/DROP/REORGANIZE PARTITION).
+func isPartitionDDLs(ddls []parsedDDL) bool {
+	if len(ddls) == 0 {
+		return false
+	}
+	for _, ddl := range ddls {
+		alter, ok := ddl.stmt.(*ast.AlterTableStmt)
+		if !ok || len(alter.Specs) == 0 {
+			return false
+		}
+		for _, spec := range alter.Specs {
+			switch spec.Tp {
+			case ast.AlterTableAddPartitions, ast.AlterTableDropPartition, ast.AlterTableReorganizePartition:
+			default:
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// foreignKeyDDL returns the first DDL which adds or drops a foreign key, "" if no such DDL.
+// foreign keys may be added by `ADD [CONSTRAINT] FOREIGN KEY` or `REFERENCES` in column definitions.
+func foreignKeyDDL(ddls []parsedDDL) string {
+	for _, ddl := range ddls {
+		alter, ok := ddl.stmt.(*ast.AlterTableStmt)
+		if !ok {
+			continue
+		}
+		for _, spec := range alter.Specs {
+			switch spec.Tp {
+			case ast.AlterTableDropForeignKey:
+				return ddl.text
+			case ast.AlterTableAddConstraint:
+				if spec.Constraint != nil && spec.Constraint.Tp == ast.ConstraintForeignKey {
+					return ddl.text
+				}
+			}
+			for _, col := range spec.NewColumns {
+				for _, opt := range col.Options {
+					if opt.Tp == ast.ColumnOptionReference {
+						return ddl.text
+					}
+				}
+			}
+		}
+	}
+	return ""
+}
+
+// ignoreColumnPositions removes positions of columns (`FIRST` or `AFTER xxx`) in ADD/MODIFY/CHANGE COLUMN,
+// DDLs without column positions (or can't be parsed) are returned as they are.
+// the ASTs of DDLs are changed in place, and the texts are restored from them.
+func ignoreColumnPositions(ddls []parsedDDL) []parsedDDL {
+	newDDLs := make([]parsedDDL, 0, len(ddls))
+	for _, ddl := range ddls {
+		alter, ok := ddl.stmt.(*ast.AlterTableStmt)
+		if !ok {
+			newDDLs = append(newDDLs, ddl)
+			continue
+		}
+
+		var ignored bool
+		for _, spec := range alter.Specs {
+			switch spec.Tp {
+			case ast.AlterTableAddColumns, ast.AlterTableModifyColumn, ast.AlterTableChangeColumn:
+				if spec.Position != nil && spec.Position.Tp != ast.ColumnPositionNone {
+					spec.Position = &ast.ColumnPosition{Tp: ast.ColumnPositionNone}
+					ignored = true
+				}
+			}
+		}
+		if !ignored {
+			newDDLs = append(newDDLs, ddl)
+			continue
+		}
+
+		var sb strings.Builder
+		if err := alter.Restore(format.NewRestoreCtx(format.DefaultRestoreFlags, &sb)); err != nil {
+			newDDLs = append(newDDLs, ddl)
+			continue
+		}
+		log.L().Info("column positions ignored", zap.String("from", ddl.text), zap.String("to", sb.String()))
+		newDDLs = append(newDDLs, parsedDDL{text: sb.String(), stmt: alter})
+	}
+	return newDDLs
+}
+
+// resolveGuardClauses resolves guard clauses (`IF NOT EXISTS` or `IF EXISTS`) in DDLs with `oldTI` (the table info before DDLs):
+//   - specs which do nothing because of the guard are removed, and DDLs without any spec left are removed.
+//   - guards of specs which really change the schema are removed.
+// guards which can't be resolved with the table info (e.g. FULLTEXT indexes or partitions) are kept as they are.
+// DDLs without guard clauses (or can't be parsed) are returned as they are.
+// the ASTs of DDLs are changed in place, and the texts are restored from them.
+func resolveGuardClauses(ddls []parsedDDL, oldTI *model.TableInfo) []parsedDDL {
+	if oldTI == nil {
+		return ddls
+	}
+	newDDLs := make([]parsedDDL, 0, len(ddls))
+	for _, ddl := range ddls {
+		var resolved, noOp bool
+		switch st := ddl.stmt.(type) {
+		case *ast.AlterTableStmt:
+			specs := make([]*ast.AlterTableSpec, 0, len(st.Specs))
+			for _, spec := range st.Specs {
+				keep, changed := resolveGuardSpec(spec, oldTI)
+				resolved = resolved || changed
+				if keep {
+					specs = append(specs, spec)
+				}
+			}
+			st.Specs = specs
+			noOp = len(specs) == 0
+		case *ast.CreateIndexStmt:
+			if st.IfNotExists && st.KeyType != ast.IndexKeyTypeFullText && st.KeyType != ast.IndexKeyTypeSpatial {
+				noOp = findIndexInfo(oldTI, st.IndexName) != nil
+				st.IfNotExists, resolved = false, true
+			}
+		case *ast.DropIndexStmt:
+			if st.IfExists && findIndexInfo(oldTI, st.IndexName) != nil {
+				st.IfExists, resolved = false, true
+			}
+		}
+		if !resolved {
+			newDDLs = append(newDDLs, ddl)
+			continue
+		}
+		if noOp {
+			log.L().Info("no-op guarded DDL removed", zap.String("ddl", ddl.text))
+			continue
+		}
+
+		var sb strings.Builder
+		if err := ddl.stmt.Restore(format.NewRestoreCtx(format.DefaultRestoreFlags, &sb)); err != nil {
+			newDDLs = append(newDDLs, ddl)
+			continue
+		}
+		log.L().Info("guard clauses resolved", zap.String("from", ddl.text), zap.String("to", sb.String()))
+		newDDLs = append(newDDLs, parsedDDL{text: sb.String(), stmt: ddl.stmt})
+	}
+	return newDDLs
+}
+
+// resolveGuardSpec resolves the guard clause in an ALTER TABLE spec with `oldTI`,
+// it returns whether the spec should be kept and whether the spec has been changed.
+func resolveGuardSpec(spec *ast.AlterTableSpec, oldTI *model.TableInfo) (keep, changed bool) {
+	switch spec.Tp {
+	case ast.AlterTableAddColumns:
+		if !spec.IfNotExists {
+			return true, false
+		}
+		cols := make([]*ast.ColumnDef, 0, len(spec.NewColumns))
+		for _, col := range spec.NewColumns {
+			if model.FindColumnInfo(oldTI.Columns, col.Name.Name.L) == nil {
+				cols = append(cols, col)
+			}
+		}
+		spec.NewColumns, spec.IfNotExists = cols, false
+		return len(cols) > 0, true
+	case ast.AlterTableDropColumn, ast.AlterTableModifyColumn, ast.AlterTableChangeColumn:
+		if !spec.IfExists {
+			return true, false
+		}
+		name := spec.OldColumnName
+		if spec.Tp == ast.AlterTableModifyColumn && len(spec.NewColumns) > 0 {
+			name = spec.NewColumns[0].Name
+		}
+		if name == nil {
+			return true, false
+		}
+		spec.IfExists = false
+		return model.FindColumnInfo(oldTI.Columns, name.Name.L) != nil, true
+	case ast.AlterTableAddConstraint:
+		if spec.Constraint == nil || !spec.Constraint.IfNotExists || spec.Constraint.Name == "" ||
+			spec.Constraint.Tp == ast.ConstraintFulltext {
+			return true, false
+		}
+		spec.Constraint.IfNotExists = false
+		return findIndexInfo(oldTI, spec.Constraint.Name) == nil, true
+	case ast.AlterTableDropIndex:
+		// indexes not found may be FULLTEXT/SPATIAL indexes ignored in the table info, so keep the guard for them.
+		if !spec.IfExists || findIndexInfo(oldTI, spec.Name) == nil {
+			return true, false
+		}
+		spec.IfExists = false
+		return true, true
+	}
+	return true, false
+}
+
+// findIndexInfo finds the index with the name (case insensitive) in the table info.
+func findIndexInfo(ti *model.TableInfo, name string) *model.IndexInfo {
+	for _, idx := range ti.Indices {
+		if idx.Name.L == strings.ToLower(name) {
+			return idx
+		}
+	}
+	return nil
+}
+
+// noOpDownstreamAlterSpecs contains types of ALTER TABLE specs which do not need to be executed to the downstream,
+// the value is an optional checker for the spec, nil means any spec of the type is a no-op.
+// categories treated as no-ops now:
+//   - table options: only changing the comment of the table (`ALTER TABLE t COMMENT = 'xxx'`)
+//     or resetting the auto-increment value (`ALTER TABLE t AUTO_INCREMENT = 1000`),
+//     the auto-increment value of the merged table in the downstream is decided by the rows written into it.
+//   - rename index: `ALTER TABLE t RENAME INDEX a TO b`.
+// add more types here if needed.
+// NOTE: only changing the comment of a column (`ALTER TABLE t MODIFY COLUMN c INT COMMENT 'xxx'`) is also a no-op,
+// but it needs to be checked with the table info before and after the DDL, see `isCommentOnlyDDLs`.
+// NOTE: besides these ALTER TABLE specs, `TRUNCATE TABLE` is also a no-op because it does not change the schema,
+// and truncating one of the sharding tables should not truncate the merged table in the downstream.
+var noOpDownstreamAlterSpecs = map[ast.AlterTableType]func(spec *ast.AlterTableSpec) bool{
+	ast.AlterTableOption: func(spec *ast.AlterTableSpec) bool {
+		for _, opt := range spec.Options {
+			if opt.Tp != ast.TableOptionComment && opt.Tp != ast.TableOptionAutoIncrement {
+				return false
+			}
+		}
+		return len(spec.Options) > 0
+	},
+	ast.AlterTableRenameIndex: nil,
+}
+
+// canonicalDDL returns the canonical form of the DDL which is restored from its AST,
+// e.g. both `alter table t add c int` and `ALTER TABLE t ADD COLUMN c INT` become "ALTER TABLE `t` ADD COLUMN `c` INT".
+// the DDL itself is returned if it can't be parsed or restored.
+func canonicalDDL(ddl parsedDDL) string {
+	if ddl.stmt == nil {
+		return ddl.text
+	}
+	var sb strings.Builder
+	if err := ddl.stmt.Restore(format.NewRestoreCtx(format.DefaultRestoreFlags, &sb)); err != nil {
+		return ddl.text
+	}
+	return sb.String()
+}
+
+// canonicalDDLs returns canonical forms of DDLs in order, see `canonicalDDL`.
+func canonicalDDLs(ddls []parsedDDL) []string {
+	canonicals := make([]string, 0, len(ddls))
+	for _, ddl := range ddls {
+		canonicals = append(canonicals, canonicalDDL(ddl))
+	}
+	return canonicals
+}
+
+// equivalentDDL returns whether two DDLs are equivalent, i.e. the same after canonicalized, see `canonicalDDL`.
+func equivalentDDL(ddl1, ddl2 parsedDDL) bool {
+	return ddl1.text == ddl2.text || canonicalDDL(ddl1) == canonicalDDL(ddl2)
+}
+
+// isNoOpDownstream returns whether the DDL does not need to be executed to the downstream.
+func isNoOpDownstream(stmt ast.StmtNode) bool {
+	if _, ok := stmt.(*ast.TruncateTableStmt); ok {
+		return true
+	}
+	alter, ok := stmt.(*ast.AlterTableStmt)
+	if !ok || len(alter.Specs) == 0 {
+		return false
+	}
+	for _, spec := range alter.Specs {
+		checker, ok := noOpDownstreamAlterSpecs[spec.Tp]
+		if !ok || (checker != nil && !checker(spec)) {
+			return false
+		}
+	}
+	return true
+}
+
+// isCommentOnlyDDLs returns whether all DDLs only change comments of the table or columns,
+// `oldTI` and `newTI` are the table info before and after these DDLs, used to check whether only comments of columns changed.
+func isCommentOnlyDDLs(ddls []parsedDDL, oldTI, newTI *model.TableInfo) bool {
+	if len(ddls) == 0 || oldTI == nil || newTI == nil {
+		return false
+	}
+	for _, ddl := range ddls {
+		alter, ok := ddl.stmt.(*ast.AlterTableStmt)
+		if !ok || len(alter.Specs) == 0 {
+			return false
+		}
+		for _, spec := range alter.Specs {
+			switch spec.Tp {
+			case ast.AlterTableOption:
+				if !noOpDownstreamAlterSpecs[ast.AlterTableOption](spec) {
+					return false
+				}
+			case ast.AlterTableModifyColumn, ast.AlterTableChangeColumn:
+				if len(spec.NewColumns) != 1 || !hasColumnComment(spec.NewColumns[0]) {
+					return false
+				}
+				name := spec.NewColumns[0].Name.Name.L
+				if spec.OldColumnName != nil && spec.OldColumnName.Name.L != name {
+					return false // rename column.
+				}
+				if !isCommentOnlyColumnChange(model.FindColumnInfo(oldTI.Columns, name), model.FindColumnInfo(newTI.Columns, name)) {
+					return false
+				}
+			default:
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// hasColumnComment returns whether the column definition contains a COMMENT option.
+func hasColumnComment(col *ast.ColumnDef) bool {
+	for _, opt := range col.Options {
+		if opt.Tp == ast.ColumnOptionComment {
+			return true
+		}
+	}
+	return false
+}
+
+// isCommentOnlyColumnChange returns whether the column definition is the same except the comment.
+func isCommentOnlyColumnChange(oldCol, newCol *model.ColumnInfo) bool {
+	if oldCol == nil || newCol == nil {
+		return false
+	}
+	oldCol, newCol = oldCol.Clone(), newCol.Clone()
+	oldCol.Comment, newCol.Comment = "", ""
+	return columnDefinition(oldCol) == columnDefinition(newCol)
+}
+
+// isNoOpDownstreamDDLs returns whether all DDLs do not need to be executed to the downstream.
+func isNoOpDownstreamDDLs(ddls []parsedDDL) bool {
+	if len(ddls) == 0 {
+		return false
+	}
+	for _, ddl := range ddls {
+		if !isNoOpDownstream(ddl.stmt) {
+			return false
+		}
+	}
+	return true
+}
+
+// specialIndex represents a FULLTEXT/SPATIAL index added by tables in the lock.
+type specialIndex struct {
+	keyType string // `FULLTEXT` or `SPATIAL`.
+	// tables which have the index, upstream source ID -> schema name -> table name -> struct{}.
+	tables map[string]map[string]map[string]struct{}
+}
+
+// has returns whether the table has the index.
+func (si *specialIndex) has(source, schema, table string) bool {
+	_, ok := si.tables[source][schema][table]
+	return ok
+}
+
+// add adds a table which has the index.
+func (si *specialIndex) add(source, schema, table string) {
+	if _, ok := si.tables[source]; !ok {
+		si.tables[source] = make(map[string]map[string]struct{})
+	}
+	if _, ok := si.tables[source][schema]; !ok {
+		si.tables[source][schema] = make(map[string]struct{})
+	}
+	si.tables[source][schema][table] = struct{}{}
+}
+
+// count returns the count of tables which have the index.
+func (si *specialIndex) count() int {
+	var count int
+	for _, schemaTables := range si.tables {
+		for _, tables := range schemaTables {
+			count += len(tables)
+		}
+	}
+	return count
+}
+
+// trySyncAddSpecialIndexes handles DDLs which only add FULLTEXT/SPATIAL indexes.
+// the DDLs are executed to the downstream if any index is added by the first table.
+func (l *Lock) trySyncAddSpecialIndexes(callerSource, callerSchema, callerTable string,
+	ddls []string, added map[string]string) ([]string, ConflictType, error) {
+	names := make([]string, 0, len(added))
+	for name := range added {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		if si, ok := l.specialIndexes[name]; ok && si.keyType != added[name] {
+			return l.specialIndexConflict(callerSource, callerSchema, callerTable, ddls, fmt.Sprintf(
+				"%s index %s conflicts with the %s index in other tables", added[name], quoteName(name), si.keyType))
+		}
+		for source, schemaTables := range l.tableInfos {
+			for schema, tables := range schemaTables {
+				for table, ti := range tables {
+					if source == callerSource && schema == callerSchema && table == callerTable {
+						continue
+					}
+					if ti == nil {
+						continue
+					}
+					if index := ti.FindIndexByName(name); index != nil {
+						return l.specialIndexConflict(callerSource, callerSchema, callerTable, ddls, fmt.Sprintf(
+							"%s index %s conflicts with the index %s in table %s of source %s",
+							added[name], quoteName(name), indexDefinition(index), dbutil.TableName(schema, table), source))
+					}
+				}
+			}
+		}
+	}
+
+	var first bool
+	for _, name := range names {
+		si, ok := l.specialIndexes[name]
+		if !ok {
+			si = &specialIndex{keyType: added[name], tables: make(map[string]map[string]map[string]struct{})}
+			l.specialIndexes[name] = si
+			first = true
+		}
+		si.add(callerSource, callerSchema, callerTable)
+	}
+	l.conflict = ConflictTypeNone
+	log.L().Info("FULLTEXT/SPATIAL indexes added", zap.String("lock", l.ID), zap.Bool("first", first), zap.String("source", callerSource),
+		zap.String("schema", callerSchema), zap.String("table", callerTable), zap.Strings("ddls", ddls))
+	if first {
+		return ddls, ConflictTypeNone, nil
+	}
+	return []string{}, ConflictTypeNone, nil
+}
+
+// trySyncDropSpecialIndexes handles DDLs which only drop FULLTEXT/SPATIAL indexes.
+// the DDLs are executed to the downstream if any index is dropped by the last table.
+func (l *Lock) trySyncDropSpecialIndexes(callerSource, callerSchema, callerTable string,
+	ddls []string, dropped []string) ([]string, ConflictType, error) {
+	var last bool
+	for _, name := range dropped {
+		si := l.specialIndexes[name]
+		delete(si.tables[callerSource][callerSchema], callerTable)
+		if si.count() == 0 {
+			delete(l.specialIndexes, name)
+			last = true
+		}
+	}
+	log.L().Info("FULLTEXT/SPATIAL indexes dropped", zap.String("lock", l.ID), zap.Bool("last", last), zap.String("source", callerSource),
+		zap.String("schema", callerSchema), zap.String("table", callerTable), zap.Strings("ddls", ddls))
+	if last {
+		return ddls, ConflictTypeNone, nil
+	}
+	return []string{}, ConflictTypeNone, nil
+}
+
+// hasSpecialIndexes returns whether the table has all the FULLTEXT/SPATIAL indexes.
+func (l *Lock) hasSpecialIndexes(source, schema, table string, names []string) bool {
+	for _, name := range names {
+		si, ok := l.specialIndexes[name]
+		if !ok || !si.has(source, schema, table) {
+			return false
+		}
+	}
+	return true
+}
+
+// conflictSpecialIndex returns the first index added in `newTI` with the same name as a FULLTEXT/SPATIAL index.
+func (l *Lock) conflictSpecialIndex(oldTI, newTI *model.TableInfo) (*model.IndexInfo, *specialIndex) {
+	if newTI == nil {
+		return nil, nil
+	}
+	for _, index := range newTI.Indices {
+		if oldTI != nil && oldTI.FindIndexByName(index.Name.L) != nil {
+			continue // not added.
+		}
+		if si, ok := l.specialIndexes[index.Name.L]; ok {
+			return index, si
+		}
+	}
+	return nil, nil
+}
+
+// specialIndexConflict records and returns a conflict detected for FULLTEXT/SPATIAL indexes.
+func (l *Lock) specialIndexConflict(callerSource, callerSchema, callerTable string,
+	ddls []string, msg string) ([]string, ConflictType, error) {
+	ct := ConflictTypeIncompatibleIndex
+	l.conflict = ct
+	log.L().Warn("conflict detected", zap.String("lock", l.ID), zap.Stringer("type", ct),
+		zap.String("source", callerSource), zap.String("schema", callerSchema), zap.String("table", callerTable), zap.Strings("ddls", ddls))
+	return []string{}, ct, terror.ErrShardDDLOptimismTrySyncFail.Generate(l.ID, msg)
+}
+
+// alteredColumnDefaults returns lower case names of columns whose default values are set or dropped in the DDLs,
+// i.e. `ALTER TABLE t ALTER COLUMN c SET DEFAULT xxx` or `ALTER TABLE t ALTER COLUMN c DROP DEFAULT`.
+// it returns false if any DDL does something else, then the DDLs are handled as usual.
+func alteredColumnDefaults(ddls []parsedDDL) ([]string, bool) {
+	if len(ddls) == 0 {
+		return nil, false
+	}
+	cols := make([]string, 0, len(ddls))
+	for _, ddl := range ddls {
+		alter, ok := ddl.stmt.(*ast.AlterTableStmt)
+		if !ok || len(alter.Specs) == 0 {
+			return nil, false
+		}
+		for _, spec := range alter.Specs {
+			if spec.Tp != ast.AlterTableAlterColumn || len(spec.NewColumns) != 1 {
+				return nil, false
+			}
+			cols = append(cols, spec.NewColumns[0].Name.Name.L)
+		}
+	}
+	return cols, true
+}
+
+// conflictColumnDefault returns the message of the conflict if the default value of any column in `cols`
+// is different from the one in other tables, empty if no conflict.
+// NOTE: a column without the default value in some tables does not conflict, the default value in other tables is used.
+func (l *Lock) conflictColumnDefault(callerSource, callerSchema, callerTable string, newTI *model.TableInfo, cols []string) string {
+	if newTI == nil {
+		return ""
+	}
+	for _, name := range cols {
+		col := model.FindColumnInfo(newTI.Columns, name)
+		if col == nil || col.GetDefaultValue() == nil {
+			continue
+		}
+		for _, source := range sortedKeys(l.tableInfos) {
+			for _, schema := range sortedKeys(l.tableInfos[source]) {
+				for _, table := range sortedKeys(l.tableInfos[source][schema]) {
+					if source == callerSource && schema == callerSchema && table == callerTable {
+						continue
+					}
+					ti := l.tableInfos[source][schema][table]
+					if ti == nil {
+						continue
+					}
+					col2 := model.FindColumnInfo(ti.Columns, name)
+					if col2 == nil || col2.GetDefaultValue() == nil {
+						continue
+					}
+					if def, def2 := fmt.Sprintf("%v", col.GetDefaultValue()), fmt.Sprintf("%v", col2.GetDefaultValue()); def != def2 {
+						return fmt.Sprintf("default value %s of column %s conflicts with %s in table %s of source %s",
+							def, col.Name.O, def2, dbutil.TableName(schema, table), source)
+					}
+				}
+			}
+		}
+	}
+	return ""
+}
+
+// addedSpecialIndexes returns FULLTEXT/SPATIAL indexes added in the DDLs, lower case index name -> key type.
+// it returns false if any DDL does something else, then the DDLs are handled as usual.
+func addedSpecialIndexes(ddls []parsedDDL) (map[string]string, bool) {
+	if len(ddls) == 0 {
+		return nil, false
+	}
+	added := make(map[string]string)
+	for _, ddl := range ddls {
+		switch st := ddl.stmt.(type) {
+		case *ast.AlterTableStmt:
+			if len(st.Specs) == 0 {
+				return nil, false
+			}
+			for _, spec := range st.Specs {
+				if spec.Tp != ast.AlterTableAddConstraint || spec.Constraint == nil ||
+					spec.Constraint.Tp != ast.ConstraintFulltext || spec.Constraint.Name == "" {
+					return nil, false
+				}
+				added[strings.ToLower(spec.Constraint.Name)] = "FULLTEXT"
+			}
+		case *ast.CreateIndexStmt:
+			switch st.KeyType {
+			case ast.IndexKeyTypeFullText:
+				added[strings.ToLower(st.IndexName)] = "FULLTEXT"
+			case ast.IndexKeyTypeSpatial:
+				added[strings.ToLower(st.IndexName)] = "SPATIAL"
+			default:
+				return nil, false
+			}
+		default:
+			return nil, false
+		}
+	}
+	return added, true
+}
+
+// droppedIndexes returns lower case names of indexes dropped in the DDLs.
+// it returns false if any DDL does something else.
+func droppedIndexes(ddls []parsedDDL) ([]string, bool) {
+	if len(ddls) == 0 {
+		return nil, false
+	}
+	dropped := make([]string, 0, len(ddls))
+	for _, ddl := range ddls {
+		switch st := ddl.stmt.(type) {
+		case *ast.AlterTableStmt:
+			if len(st.Specs) == 0 {
+				return nil, false
+			}
+			for _, spec := range st.Specs {
+				if spec.Tp != ast.AlterTableDropIndex {
+					return nil, false
 				}
+				dropped = append(dropped, strings.ToLower(spec.Name))
 			}
+		case *ast.DropIndexStmt:
+			dropped = append(dropped, strings.ToLower(st.IndexName))
+		default:
+			return nil, false
 		}
 	}
+	return dropped, true
 }
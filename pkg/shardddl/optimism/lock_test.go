@@ -31,6 +31,16 @@ func (t *testLock) SetUpSuite(c *C) {
 	log.InitLogger(&log.Config{})
 }
 
+// parsedDDLs parses DDLs with the default parser, which is used to call helpers of the lock.
+func parsedDDLs(ddls []string) []parsedDDL {
+	return parseDDLs(newTiDBDDLParser(), ddls)
+}
+
+// parsedDDL1 parses a DDL with the default parser.
+func parsedDDL1(ddl string) parsedDDL {
+	return parsedDDLs([]string{ddl})[0]
+}
+
 func (t *testLock) TestLockTrySyncNormal(c *C) {
 	var (
 		ID               = "test_lock_try_sync_normal-`foo`.`bar`"
@@ -338,560 +348,1886 @@ func (t *testLock) TestLockTrySyncNewTable(c *C) {
 	c.Assert(ready[source2][db2][tbl2], IsTrue)
 }
 
-func (t *testLock) TestLockTrySyncRevert(c *C) {
+func (t *testLock) TestLockCatchUpDDLs(c *C) {
 	var (
-		ID           = "test_lock_try_sync_revert-`foo`.`bar`"
-		task         = "test_lock_try_sync_revert"
-		source       = "mysql-replica-1"
-		db           = "foo"
-		tbls         = []string{"bar1", "bar2"}
-		p            = parser.New()
-		se           = mock.NewContext()
-		tblID  int64 = 111
-
-		DDLs1 = []string{"ALTER TABLE bar ADD COLUMN c1 TEXT"}
-		DDLs2 = []string{"ALTER TABLE bar DROP COLUMN c1"}
-		ti0   = createTableInfo(c, p, se, tblID, `CREATE TABLE bar (id INT PRIMARY KEY)`)
-		ti1   = createTableInfo(c, p, se, tblID, `CREATE TABLE bar (id INT PRIMARY KEY, c1 TEXT)`)
-		ti2   = ti0
-
-		DDLs3 = []string{"ALTER TABLE bar ADD COLUMN c1 TEXT", "ALTER TABLE bar ADD COLUMN c2 INT"}
-		DDLs4 = []string{"ALTER TABLE bar DROP COLUMN c2"}
-		DDLs5 = []string{"ALTER TABLE bar DROP COLUMN c1"}
-		ti3   = createTableInfo(c, p, se, tblID, `CREATE TABLE bar (id INT PRIMARY KEY, c1 TEXT, c2 INT)`)
-		ti4   = createTableInfo(c, p, se, tblID, `CREATE TABLE bar (id INT PRIMARY KEY, c1 TEXT)`)
-		ti5   = ti0
-
-		DDLs6 = DDLs3
-		DDLs7 = DDLs4
-		DDLs8 = []string{"ALTER TABLE bar ADD COLUMN c1 TEXT"}
-		ti6   = ti3
-		ti7   = ti4
-		ti8   = ti4
+		ID            = "test_lock_catch_up_ddls-`foo`.`bar`"
+		task          = "test_lock_catch_up_ddls"
+		source1       = "mysql-replica-1"
+		source2       = "mysql-replica-2"
+		db            = "foo"
+		tbl           = "bar"
+		p             = parser.New()
+		se            = mock.NewContext()
+		tblID   int64 = 111
+		DDLs1         = []string{"ALTER TABLE bar ADD COLUMN c1 INT"}
+		DDLs2         = []string{"ALTER TABLE bar ADD COLUMN c2 VARCHAR(10) NOT NULL DEFAULT 'abc'"}
+		DDLs3         = []string{"ALTER TABLE bar ADD COLUMN c3 BIGINT NOT NULL DEFAULT 0"}
+		ti0           = createTableInfo(c, p, se, tblID, `CREATE TABLE bar (id INT PRIMARY KEY)`)
+		ti1           = createTableInfo(c, p, se, tblID, `CREATE TABLE bar (id INT PRIMARY KEY, c1 INT)`)
+		ti2           = createTableInfo(c, p, se, tblID, `CREATE TABLE bar (id INT PRIMARY KEY, c1 INT, c2 VARCHAR(10) NOT NULL DEFAULT 'abc')`)
+		ti3           = createTableInfo(c, p, se, tblID, `CREATE TABLE bar (id INT PRIMARY KEY, c1 INT, c2 VARCHAR(10) NOT NULL DEFAULT 'abc', c3 BIGINT NOT NULL DEFAULT 0)`)
 
-		tables = map[string]map[string]struct{}{db: {tbls[0]: struct{}{}, tbls[1]: struct{}{}}}
-		sts    = []SourceTables{NewSourceTables(task, source, tables)}
+		tables = map[string]map[string]struct{}{db: {tbl: struct{}{}}}
+		sts    = []SourceTables{NewSourceTables(task, source1, tables)}
 		l      = NewLock(ID, task, ti0, sts)
 	)
 
-	// the initial status is synced.
-	t.checkLockSynced(c, l)
-	t.checkLockNoDone(c, l)
+	// no DDLs needed for the initial status.
+	DDLs, err := l.CatchUpDDLs(source1, db, tbl)
+	c.Assert(err, IsNil)
+	c.Assert(DDLs, HasLen, 0)
 
-	// CASE: revert for single DDL.
-	// TrySync for one table.
-	DDLs, err := l.TrySync(source, db, tbls[0], DDLs1, ti1, sts)
+	// the table in source1 executes several DDLs.
+	DDLs, err = l.TrySync(source1, db, tbl, DDLs1, ti1, sts)
 	c.Assert(err, IsNil)
 	c.Assert(DDLs, DeepEquals, DDLs1)
-	ready := l.Ready()
-	c.Assert(ready[source][db][tbls[0]], IsTrue)
-	c.Assert(ready[source][db][tbls[1]], IsFalse)
-	cmp, err := l.tables[source][db][tbls[0]].Compare(l.Joined())
-	c.Assert(err, IsNil)
-	c.Assert(cmp, Equals, 0)
-	cmp, err = l.tables[source][db][tbls[1]].Compare(l.Joined())
-	c.Assert(err, IsNil)
-	c.Assert(cmp, Equals, -1)
-
-	// revert for the table, become synced again.
-	DDLs, err = l.TrySync(source, db, tbls[0], DDLs2, ti2, sts)
+	DDLs, err = l.TrySync(source1, db, tbl, DDLs2, ti2, sts)
 	c.Assert(err, IsNil)
 	c.Assert(DDLs, DeepEquals, DDLs2)
-	t.checkLockSynced(c, l)
-	t.checkLockNoDone(c, l)
-
-	// CASE: revert for multiple DDLs.
-	// TrySync for one table.
-	DDLs, err = l.TrySync(source, db, tbls[0], DDLs3, ti3, sts)
+	DDLs, err = l.TrySync(source1, db, tbl, DDLs3, ti3, sts)
 	c.Assert(err, IsNil)
 	c.Assert(DDLs, DeepEquals, DDLs3)
-	ready = l.Ready()
-	c.Assert(ready[source][db][tbls[0]], IsTrue)
-	c.Assert(ready[source][db][tbls[1]], IsFalse)
-	cmp, err = l.tables[source][db][tbls[0]].Compare(l.Joined())
-	c.Assert(err, IsNil)
-	c.Assert(cmp, Equals, 0)
-	cmp, err = l.tables[source][db][tbls[1]].Compare(l.Joined())
-	c.Assert(err, IsNil)
-	c.Assert(cmp, Equals, -1)
+	t.checkLockSynced(c, l)
 
-	// revert part of the DDLs.
-	DDLs, err = l.TrySync(source, db, tbls[0], DDLs4, ti4, sts)
-	c.Assert(err, IsNil)
-	c.Assert(DDLs, DeepEquals, DDLs4)
-	ready = l.Ready()
-	c.Assert(ready[source][db][tbls[1]], IsFalse)
-	cmp, err = l.tables[source][db][tbls[0]].Compare(l.Joined())
+	// a table in source2 joins the lock with the initial schema.
+	sts = append(sts, NewSourceTables(task, source2, tables))
+	DDLs, err = l.TrySync(source2, db, tbl, []string{}, ti0, sts)
 	c.Assert(err, IsNil)
-	c.Assert(cmp, Equals, 0)
-	cmp, err = l.tables[source][db][tbls[1]].Compare(l.Joined())
+	c.Assert(DDLs, HasLen, 0)
+	synced, remain := l.IsSynced()
+	c.Assert(synced, IsFalse)
+	c.Assert(remain, Equals, 1)
+
+	// DDLs needed to catch up with the joined schema.
+	DDLs, err = l.CatchUpDDLs(source2, db, tbl)
 	c.Assert(err, IsNil)
-	c.Assert(cmp, Equals, -1)
+	c.Assert(DDLs, DeepEquals, []string{
+		"ALTER TABLE `foo`.`bar` ADD COLUMN `c1` INT(11)",
+		"ALTER TABLE `foo`.`bar` ADD COLUMN `c2` VARCHAR(10) CHARACTER SET UTF8MB4 COLLATE utf8mb4_bin NOT NULL DEFAULT 'abc'",
+		"ALTER TABLE `foo`.`bar` ADD COLUMN `c3` BIGINT(20) NOT NULL DEFAULT '0'",
+	})
 
-	// revert the reset part of the DDLs.
-	DDLs, err = l.TrySync(source, db, tbls[0], DDLs5, ti5, sts)
+	// no DDLs needed for the table in source1.
+	DDLs, err = l.CatchUpDDLs(source1, db, tbl)
 	c.Assert(err, IsNil)
-	c.Assert(DDLs, DeepEquals, DDLs5)
-	t.checkLockSynced(c, l)
-	t.checkLockNoDone(c, l)
+	c.Assert(DDLs, HasLen, 0)
 
-	// CASE: revert part of multiple DDLs.
-	// TrySync for one table.
-	DDLs, err = l.TrySync(source, db, tbls[0], DDLs6, ti6, sts)
+	// the table in source2 catches up.
+	_, err = l.TrySync(source2, db, tbl, DDLs, ti3, sts)
 	c.Assert(err, IsNil)
-	c.Assert(DDLs, DeepEquals, DDLs6)
-	ready = l.Ready()
-	c.Assert(ready[source][db][tbls[1]], IsFalse)
-	cmp, err = l.tables[source][db][tbls[0]].Compare(l.Joined())
+	t.checkLockSynced(c, l)
+	DDLs, err = l.CatchUpDDLs(source2, db, tbl)
 	c.Assert(err, IsNil)
-	c.Assert(cmp, Equals, 0)
-	cmp, err = l.tables[source][db][tbls[1]].Compare(l.Joined())
+	c.Assert(DDLs, HasLen, 0)
+
+	// not existing table.
+	_, err = l.CatchUpDDLs(source2, db, "not-exist")
+	c.Assert(terror.ErrShardDDLOptimismTrySyncFail.Equal(err), IsTrue)
+}
+
+func (t *testLock) TestLockTrySyncReconcileColumn(c *C) {
+	var (
+		ID            = "test_lock_try_sync_reconcile_column-`foo`.`bar`"
+		task          = "test_lock_try_sync_reconcile_column"
+		source1       = "mysql-replica-1"
+		source2       = "mysql-replica-2"
+		db            = "foo"
+		tbl           = "bar"
+		p             = parser.New()
+		se            = mock.NewContext()
+		tblID   int64 = 111
+		DDLs1         = []string{"ALTER TABLE bar ADD COLUMN c1 INT NOT NULL"}
+		DDLs2         = []string{"ALTER TABLE bar ADD COLUMN c1 INT NOT NULL DEFAULT 0"}
+		DDLs3         = []string{"ALTER TABLE bar ADD COLUMN c2 INT NOT NULL DEFAULT 1"}
+		DDLs4         = []string{"ALTER TABLE bar ADD COLUMN c2 INT DEFAULT 1"}
+		DDLs5         = []string{"ALTER TABLE bar ADD COLUMN c3 INT NOT NULL DEFAULT 1"}
+		DDLs6         = []string{"ALTER TABLE bar ADD COLUMN c3 INT NOT NULL DEFAULT 2"}
+		ti0           = createTableInfo(c, p, se, tblID, `CREATE TABLE bar (id INT PRIMARY KEY)`)
+		ti1           = createTableInfo(c, p, se, tblID, `CREATE TABLE bar (id INT PRIMARY KEY, c1 INT NOT NULL)`)
+		ti2           = createTableInfo(c, p, se, tblID, `CREATE TABLE bar (id INT PRIMARY KEY, c1 INT NOT NULL DEFAULT 0)`)
+		ti3           = createTableInfo(c, p, se, tblID, `CREATE TABLE bar (id INT PRIMARY KEY, c1 INT NOT NULL, c2 INT NOT NULL DEFAULT 1)`)
+		ti4           = createTableInfo(c, p, se, tblID, `CREATE TABLE bar (id INT PRIMARY KEY, c1 INT NOT NULL DEFAULT 0, c2 INT DEFAULT 1)`)
+		ti5           = createTableInfo(c, p, se, tblID, `CREATE TABLE bar (id INT PRIMARY KEY, c1 INT NOT NULL, c2 INT NOT NULL DEFAULT 1, c3 INT NOT NULL DEFAULT 1)`)
+		ti6           = createTableInfo(c, p, se, tblID, `CREATE TABLE bar (id INT PRIMARY KEY, c1 INT NOT NULL DEFAULT 0, c2 INT DEFAULT 1, c3 INT NOT NULL DEFAULT 2)`)
+
+		tables = map[string]map[string]struct{}{db: {tbl: struct{}{}}}
+		sts    = []SourceTables{
+			NewSourceTables(task, source1, tables),
+			NewSourceTables(task, source2, tables),
+		}
+		l = NewLock(ID, task, ti0, sts)
+	)
+
+	// CASE: add a NOT NULL column without default value in the first table,
+	// the standard default value is used for other tables which have not added the column.
+	DDLs, err := l.TrySync(source1, db, tbl, DDLs1, ti1, sts)
 	c.Assert(err, IsNil)
-	c.Assert(cmp, Equals, -1)
+	c.Assert(DDLs, DeepEquals, []string{"ALTER TABLE `foo`.`bar` ADD COLUMN `c1` INT(11) NOT NULL DEFAULT '0'"})
 
-	// revert part of the DDLs.
-	DDLs, err = l.TrySync(source, db, tbls[0], DDLs7, ti7, sts)
+	// add the same column with the default value in the second table.
+	DDLs, err = l.TrySync(source2, db, tbl, DDLs2, ti2, sts)
 	c.Assert(err, IsNil)
-	c.Assert(DDLs, DeepEquals, DDLs7)
-	ready = l.Ready()
-	c.Assert(ready[source][db][tbls[1]], IsFalse)
-	cmp, err = l.tables[source][db][tbls[0]].Compare(l.Joined())
+	c.Assert(DDLs, DeepEquals, DDLs2)
+
+	// CASE: add a NOT NULL column in the first table,
+	// then add a nullable column in the second table, the joined column become nullable.
+	DDLs, err = l.TrySync(source1, db, tbl, DDLs3, ti3, sts)
 	c.Assert(err, IsNil)
-	c.Assert(cmp, Equals, 0)
-	cmp, err = l.tables[source][db][tbls[1]].Compare(l.Joined())
+	c.Assert(DDLs, DeepEquals, DDLs3)
+	DDLs, err = l.TrySync(source2, db, tbl, DDLs4, ti4, sts)
 	c.Assert(err, IsNil)
-	c.Assert(cmp, Equals, -1)
+	c.Assert(DDLs, DeepEquals, []string{"ALTER TABLE `foo`.`bar` MODIFY COLUMN `c2` INT(11) DEFAULT '1'"})
 
-	// TrySync for another table.
-	DDLs, err = l.TrySync(source, db, tbls[1], DDLs8, ti8, sts)
+	// CASE: add columns with different default values, conflict detected.
+	DDLs, err = l.TrySync(source1, db, tbl, DDLs5, ti5, sts)
 	c.Assert(err, IsNil)
-	c.Assert(DDLs, DeepEquals, DDLs8)
-	t.checkLockSynced(c, l)
-	t.checkLockNoDone(c, l)
+	c.Assert(DDLs, DeepEquals, DDLs5)
+	DDLs, err = l.TrySync(source2, db, tbl, DDLs6, ti6, sts)
+	c.Assert(terror.ErrShardDDLOptimismTrySyncFail.Equal(err), IsTrue)
+	c.Assert(DDLs, HasLen, 0)
 }
 
-func (t *testLock) TestLockTrySyncConflictNonIntrusive(c *C) {
+func (t *testLock) TestLockTrySyncPartition(c *C) {
 	var (
-		ID           = "test_lock_try_sync_conflict_non_intrusive-`foo`.`bar`"
-		task         = "test_lock_try_sync_conflict_non_intrusive"
-		source       = "mysql-replica-1"
-		db           = "foo"
-		tbls         = []string{"bar1", "bar2"}
-		p            = parser.New()
-		se           = mock.NewContext()
-		tblID  int64 = 111
-		DDLs1        = []string{"ALTER TABLE bar ADD COLUMN c1 TEXT"}
-		DDLs2        = []string{"ALTER TABLE bar ADD COLUMN c1 DATETIME", "ALTER TABLE bar ADD COLUMN c2 INT"}
-		DDLs3        = []string{"ALTER TABLE bar DROP COLUMN c1"}
-		DDLs4        = DDLs2
-		ti0          = createTableInfo(c, p, se, tblID, `CREATE TABLE bar (id INT PRIMARY KEY)`)
-		ti1          = createTableInfo(c, p, se, tblID, `CREATE TABLE bar (id INT PRIMARY KEY, c1 TEXT)`)
-		ti2          = createTableInfo(c, p, se, tblID, `CREATE TABLE bar (id INT PRIMARY KEY, c1 DATETIME, c2 INT)`)
-		ti3          = ti0
-		ti4          = ti2
+		ID            = "test_lock_try_sync_partition-`foo`.`bar`"
+		task          = "test_lock_try_sync_partition"
+		source1       = "mysql-replica-1"
+		source2       = "mysql-replica-2"
+		db            = "foo"
+		tbl           = "bar"
+		p             = parser.New()
+		se            = mock.NewContext()
+		tblID   int64 = 111
+		DDLs1         = []string{"ALTER TABLE bar ADD COLUMN c1 INT"}
+		DDLs2         = []string{"ALTER TABLE bar ADD PARTITION (PARTITION p2 VALUES LESS THAN (300))"}
+		DDLs3         = []string{
+			"ALTER TABLE bar DROP PARTITION p0",
+			"ALTER TABLE bar REORGANIZE PARTITION p1 INTO (PARTITION p1 VALUES LESS THAN (200))",
+		}
+		ti0 = createTableInfo(c, p, se, tblID, `CREATE TABLE bar (id INT PRIMARY KEY)`)
+		ti1 = createTableInfo(c, p, se, tblID, `CREATE TABLE bar (id INT PRIMARY KEY, c1 INT)`)
 
-		tables = map[string]map[string]struct{}{db: {tbls[0]: struct{}{}, tbls[1]: struct{}{}}}
-		sts    = []SourceTables{NewSourceTables(task, source, tables)}
-		l      = NewLock(ID, task, ti0, sts)
+		tables = map[string]map[string]struct{}{db: {tbl: struct{}{}}}
+		sts    = []SourceTables{
+			NewSourceTables(task, source1, tables),
+			NewSourceTables(task, source2, tables),
+		}
+		l = NewLock(ID, task, ti0, sts)
 	)
 
-	// the initial status is synced.
-	t.checkLockSynced(c, l)
-	t.checkLockNoDone(c, l)
+	c.Assert(isPartitionDDLs(nil), IsFalse)
+	c.Assert(isPartitionDDLs(parsedDDLs(DDLs1)), IsFalse)
+	c.Assert(isPartitionDDLs(parsedDDLs(DDLs2)), IsTrue)
+	c.Assert(isPartitionDDLs(parsedDDLs(DDLs3)), IsTrue)
+	c.Assert(isPartitionDDLs(parsedDDLs(append(DDLs1, DDLs2...))), IsFalse)
+	c.Assert(isPartitionDDLs(parsedDDLs([]string{"invalid DDL"})), IsFalse)
 
-	// TrySync for the first table, construct the joined schema.
-	DDLs, err := l.TrySync(source, db, tbls[0], DDLs1, ti1, sts)
+	// source1 adds a column, source2 is pending.
+	DDLs, err := l.TrySync(source1, db, tbl, DDLs1, ti1, sts)
 	c.Assert(err, IsNil)
 	c.Assert(DDLs, DeepEquals, DDLs1)
-	ready := l.Ready()
-	c.Assert(ready[source][db][tbls[0]], IsTrue)
-	c.Assert(ready[source][db][tbls[1]], IsFalse)
-	cmp, err := l.tables[source][db][tbls[0]].Compare(l.Joined())
-	c.Assert(err, IsNil)
-	c.Assert(cmp, Equals, 0)
-	cmp, err = l.tables[source][db][tbls[1]].Compare(l.Joined())
-	c.Assert(err, IsNil)
-	c.Assert(cmp, Equals, -1)
+	synced, remain := l.IsSynced()
+	c.Assert(synced, IsFalse)
+	c.Assert(remain, Equals, 1)
 
-	// TrySync for the second table with another schema (add two columns, one of them will cause conflict).
-	DDLs, err = l.TrySync(source, db, tbls[1], DDLs2, ti2, sts)
-	c.Assert(terror.ErrShardDDLOptimismTrySyncFail.Equal(err), IsTrue)
-	c.Assert(DDLs, DeepEquals, []string{})
-	cmp, err = l.tables[source][db][tbls[1]].Compare(l.Joined())
-	c.Assert(err, ErrorMatches, ".*at tuple index.*")
-	c.Assert(cmp, Equals, 0)
-	ready = l.Ready()
-	c.Assert(ready[source][db][tbls[1]], IsFalse)
+	// partition DDLs from the pending source2 are not blocked.
+	DDLs, err = l.TrySync(source2, db, tbl, DDLs2, ti0, sts)
+	c.Assert(err, IsNil)
+	c.Assert(DDLs, DeepEquals, DDLs2)
 
-	// TrySync for the first table to resolve the conflict.
-	DDLs, err = l.TrySync(source, db, tbls[0], DDLs3, ti3, sts)
+	// partition DDLs from source1 are not blocked too.
+	DDLs, err = l.TrySync(source1, db, tbl, DDLs3, ti1, sts)
 	c.Assert(err, IsNil)
 	c.Assert(DDLs, DeepEquals, DDLs3)
-	ready = l.Ready()
-	c.Assert(ready[source][db][tbls[0]], IsFalse)
-	c.Assert(ready[source][db][tbls[1]], IsTrue) // the second table become synced now.
-	cmp, err = l.tables[source][db][tbls[0]].Compare(l.Joined())
-	c.Assert(err, IsNil)
-	c.Assert(cmp, Equals, -1)
-	cmp, err = l.tables[source][db][tbls[1]].Compare(l.Joined())
-	c.Assert(err, IsNil)
-	c.Assert(cmp, Equals, 0)
 
-	// TrySync for the first table.
-	DDLs, err = l.TrySync(source, db, tbls[0], DDLs4, ti4, sts)
-	c.Assert(err, IsNil)
-	c.Assert(DDLs, DeepEquals, DDLs4)
-	t.checkLockSynced(c, l)
-	t.checkLockNoDone(c, l)
+	// the lock is still pending for source2.
+	synced, remain = l.IsSynced()
+	c.Assert(synced, IsFalse)
+	c.Assert(remain, Equals, 1)
+	c.Assert(l.PendingSources(), DeepEquals, []string{source2})
 }
 
-func (t *testLock) TestLockTrySyncConflictIntrusive(c *C) {
+func (t *testLock) TestLockRemoveSource(c *C) {
 	var (
-		ID           = "test_lock_try_sync_conflict_intrusive-`foo`.`bar`"
-		task         = "test_lock_try_sync_conflict_intrusive"
-		source       = "mysql-replica-1"
-		db           = "foo"
-		tbls         = []string{"bar1", "bar2"}
-		p            = parser.New()
-		se           = mock.NewContext()
-		tblID  int64 = 111
-		DDLs1        = []string{"ALTER TABLE bar ADD COLUMN c1 TEXT"}
-		DDLs2        = []string{"ALTER TABLE bar ADD COLUMN c1 DATETIME", "ALTER TABLE bar ADD COLUMN c2 INT"}
-		DDLs3        = []string{"ALTER TABLE bar DROP COLUMN c2"}
-		DDLs4        = []string{"ALTER TABLE bar DROP COLUMN c1"}
-		ti0          = createTableInfo(c, p, se, tblID, `CREATE TABLE bar (id INT PRIMARY KEY)`)
-		ti1          = createTableInfo(c, p, se, tblID, `CREATE TABLE bar (id INT PRIMARY KEY, c1 TEXT)`)
-		ti2          = createTableInfo(c, p, se, tblID, `CREATE TABLE bar (id INT PRIMARY KEY, c1 DATETIME, c2 INT)`)
-		ti3          = createTableInfo(c, p, se, tblID, `CREATE TABLE bar (id INT PRIMARY KEY, c1 DATETIME)`)
-		ti4          = ti0
-
-		DDLs5   = []string{"ALTER TABLE bar ADD COLUMN c2 TEXT"}
-		DDLs6   = []string{"ALTER TABLE bar ADD COLUMN c2 DATETIME", "ALTER TABLE bar ADD COLUMN c3 INT"}
-		DDLs7   = []string{"ALTER TABLE bar DROP COLUMN c2"}
-		DDLs8_1 = []string{"ALTER TABLE bar ADD COLUMN c3 INT"}
-		DDLs8_2 = []string{"ALTER TABLE bar ADD COLUMN c2 TEXT"}
-		ti5     = createTableInfo(c, p, se, tblID, `CREATE TABLE bar (id INT PRIMARY KEY, c1 TEXT, c2 TEXT)`)
-		ti6     = createTableInfo(c, p, se, tblID, `CREATE TABLE bar (id INT PRIMARY KEY, c1 TEXT, c2 DATETIME, c3 INT)`)
-		ti7     = createTableInfo(c, p, se, tblID, `CREATE TABLE bar (id INT PRIMARY KEY, c1 TEXT, c3 INT)`)
-		ti8     = createTableInfo(c, p, se, tblID, `CREATE TABLE bar (id INT PRIMARY KEY, c1 TEXT, c2 TEXT, c3 INT)`)
+		ID            = "test_lock_remove_source-`foo`.`bar`"
+		task          = "test_lock_remove_source"
+		source1       = "mysql-replica-1"
+		source2       = "mysql-replica-2"
+		db            = "foo"
+		tbls          = []string{"bar1", "bar2"}
+		p             = parser.New()
+		se            = mock.NewContext()
+		tblID   int64 = 111
+		DDLs          = []string{"ALTER TABLE bar ADD COLUMN c1 INT"}
+		ti0           = createTableInfo(c, p, se, tblID, `CREATE TABLE bar (id INT PRIMARY KEY)`)
+		ti1           = createTableInfo(c, p, se, tblID, `CREATE TABLE bar (id INT PRIMARY KEY, c1 INT)`)
 
 		tables = map[string]map[string]struct{}{db: {tbls[0]: struct{}{}, tbls[1]: struct{}{}}}
-		sts    = []SourceTables{NewSourceTables(task, source, tables)}
-		l      = NewLock(ID, task, ti0, sts)
-	)
+		sts    = []SourceTables{
+			NewSourceTables(task, source1, tables),
+			NewSourceTables(task, source2, tables),
+		}
+		l = NewLock(ID, task, ti0, sts)
+	)
+
+	// all tables of source1 have added the column and done.
+	for _, tbl := range tbls {
+		_, err := l.TrySync(source1, db, tbl, DDLs, ti1, sts)
+		c.Assert(err, IsNil)
+		c.Assert(l.TryMarkDone(source1, db, tbl), IsTrue)
+	}
+	synced, remain := l.IsSynced()
+	c.Assert(synced, IsFalse)
+	c.Assert(remain, Equals, 2)
+	c.Assert(l.IsResolved(), IsFalse)
+
+	// remove a not-existing source.
+	err := l.RemoveSource("not-exist")
+	c.Assert(terror.ErrShardDDLOptimismSourceNotFound.Equal(err), IsTrue)
+
+	// remove the pending source2, the lock become synced and resolved.
+	c.Assert(l.RemoveSource(source2), IsNil)
+	synced, remain = l.IsSynced()
+	c.Assert(synced, IsTrue)
+	c.Assert(remain, Equals, 0)
+	c.Assert(l.IsResolved(), IsTrue)
+	c.Assert(l.Ready(), HasLen, 1)
+	c.Assert(l.PendingSources(), HasLen, 0)
+
+	// remove again.
+	err = l.RemoveSource(source2)
+	c.Assert(terror.ErrShardDDLOptimismSourceNotFound.Equal(err), IsTrue)
+}
+
+func (t *testLock) TestLockProgress(c *C) {
+	var (
+		ID            = "test_lock_progress-`foo`.`bar`"
+		task          = "test_lock_progress"
+		source1       = "mysql-replica-1"
+		source2       = "mysql-replica-2"
+		db            = "foo"
+		tbls          = []string{"bar1", "bar2"}
+		p             = parser.New()
+		se            = mock.NewContext()
+		tblID   int64 = 111
+		DDLs          = []string{"ALTER TABLE bar ADD COLUMN c1 INT"}
+		ti0           = createTableInfo(c, p, se, tblID, `CREATE TABLE bar (id INT PRIMARY KEY)`)
+		ti1           = createTableInfo(c, p, se, tblID, `CREATE TABLE bar (id INT PRIMARY KEY, c1 INT)`)
+
+		tables = map[string]map[string]struct{}{db: {tbls[0]: struct{}{}, tbls[1]: struct{}{}}}
+		sts    = []SourceTables{
+			NewSourceTables(task, source1, tables),
+			NewSourceTables(task, source2, tables),
+		}
+		l = NewLock(ID, task, ti0, sts)
+	)
+
+	// no tables.
+	c.Assert(NewLock(ID, task, ti0, nil).Progress(), Equals, 1.0)
+
+	// all tables are ready initially.
+	c.Assert(l.Progress(), Equals, 1.0)
+
+	// partial readiness.
+	_, err := l.TrySync(source1, db, tbls[0], DDLs, ti1, sts)
+	c.Assert(err, IsNil)
+	c.Assert(l.Progress(), Equals, 0.25)
+	_, err = l.TrySync(source1, db, tbls[1], DDLs, ti1, sts)
+	c.Assert(err, IsNil)
+	c.Assert(l.Progress(), Equals, 0.5)
+	_, err = l.TrySync(source2, db, tbls[0], DDLs, ti1, sts)
+	c.Assert(err, IsNil)
+	c.Assert(l.Progress(), Equals, 0.75)
+
+	// full readiness.
+	_, err = l.TrySync(source2, db, tbls[1], DDLs, ti1, sts)
+	c.Assert(err, IsNil)
+	c.Assert(l.Progress(), Equals, 1.0)
+}
+
+func (t *testLock) TestLockDownstreamCreateTable(c *C) {
+	var (
+		ID            = "test_lock_downstream_create_table-`foo`.`bar`"
+		task          = "test_lock_downstream_create_table"
+		source1       = "mysql-replica-1"
+		source2       = "mysql-replica-2"
+		db            = "foo"
+		tbl           = "bar"
+		p             = parser.New()
+		se            = mock.NewContext()
+		tblID   int64 = 111
+		DDLs          = []string{"ALTER TABLE bar ADD COLUMN c2 VARCHAR(20) NOT NULL DEFAULT 'x' COMMENT 'the c2', ADD UNIQUE INDEX uk_c2(c2)"}
+		ti0           = createTableInfo(c, p, se, tblID, `CREATE TABLE bar (id INT AUTO_INCREMENT PRIMARY KEY, c1 INT, INDEX idx_c1(c1)) COMMENT = 'the bar'`)
+		ti1           = createTableInfo(c, p, se, tblID, `CREATE TABLE bar (id INT AUTO_INCREMENT PRIMARY KEY, c1 INT, c2 VARCHAR(20) NOT NULL DEFAULT 'x' COMMENT 'the c2', INDEX idx_c1(c1), UNIQUE INDEX uk_c2(c2)) COMMENT = 'the bar'`)
+
+		tables = map[string]map[string]struct{}{db: {tbl: struct{}{}}}
+		sts    = []SourceTables{
+			NewSourceTables(task, source1, tables),
+			NewSourceTables(task, source2, tables),
+		}
+		l = NewLock(ID, task, ti0, sts)
+	)
+
+	// synced initially.
+	s, err := l.DownstreamCreateTable()
+	c.Assert(err, IsNil)
+	c.Assert(s, Equals, "CREATE TABLE `foo`.`bar` (\n"+
+		"  `id` INT(11) NOT NULL AUTO_INCREMENT,\n"+
+		"  `c1` INT(11),\n"+
+		"  PRIMARY KEY (`id`),\n"+
+		"  INDEX `idx_c1`(`c1`)\n"+
+		") DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_bin COMMENT='the bar'")
+
+	// not synced.
+	_, err = l.TrySync(source1, db, tbl, DDLs, ti1, sts)
+	c.Assert(err, IsNil)
+	_, err = l.DownstreamCreateTable()
+	c.Assert(terror.ErrShardDDLOptimismLockNotSynced.Equal(err), IsTrue)
+
+	// synced again.
+	_, err = l.TrySync(source2, db, tbl, DDLs, ti1, sts)
+	c.Assert(err, IsNil)
+	s, err = l.DownstreamCreateTable()
+	c.Assert(err, IsNil)
+	c.Assert(s, Matches, "(?s).*`c2` VARCHAR\\(20\\).* NOT NULL DEFAULT 'x' COMMENT 'the c2',.*UNIQUE INDEX `uk_c2`\\(`c2`\\).*")
+
+	// the statement has the same schema as the joined one.
+	cmp, err := l.Joined().Compare(encodeTable(createTableInfo(c, p, se, tblID, s)))
+	c.Assert(err, IsNil)
+	c.Assert(cmp, Equals, 0)
+}
+
+func (t *testLock) TestLockTrySyncNoOpDownstream(c *C) {
+	var (
+		ID            = "test_lock_try_sync_no_op_downstream-`foo`.`bar`"
+		task          = "test_lock_try_sync_no_op_downstream"
+		source1       = "mysql-replica-1"
+		source2       = "mysql-replica-2"
+		db            = "foo"
+		tbl           = "bar"
+		p             = parser.New()
+		se            = mock.NewContext()
+		tblID   int64 = 111
+		DDLs1         = []string{"ALTER TABLE bar COMMENT = 'new comment'"}
+		DDLs2         = []string{"ALTER TABLE bar RENAME INDEX idx1 TO idx2"}
+		ti0           = createTableInfo(c, p, se, tblID, `CREATE TABLE bar (id INT PRIMARY KEY, c1 INT, INDEX idx1(c1))`)
+		ti1           = createTableInfo(c, p, se, tblID, `CREATE TABLE bar (id INT PRIMARY KEY, c1 INT, INDEX idx1(c1)) COMMENT = 'new comment'`)
+
+		tables = map[string]map[string]struct{}{db: {tbl: struct{}{}}}
+		sts    = []SourceTables{
+			NewSourceTables(task, source1, tables),
+			NewSourceTables(task, source2, tables),
+		}
+		l = NewLock(ID, task, ti0, sts)
+	)
+
+	c.Assert(isNoOpDownstream(parsedDDL1(DDLs1[0]).stmt), IsTrue)
+	c.Assert(isNoOpDownstream(parsedDDL1(DDLs2[0]).stmt), IsTrue)
+	c.Assert(isNoOpDownstream(parsedDDL1("ALTER TABLE bar COMMENT = 'new comment', ENGINE = InnoDB").stmt), IsFalse)
+	c.Assert(isNoOpDownstream(parsedDDL1("ALTER TABLE bar AUTO_INCREMENT = 1000").stmt), IsTrue)
+	c.Assert(isNoOpDownstream(parsedDDL1("ALTER TABLE bar AUTO_INCREMENT = 1000, COMMENT = 'new comment'").stmt), IsTrue)
+	c.Assert(isNoOpDownstream(parsedDDL1("ALTER TABLE bar AUTO_INCREMENT = 1000, ENGINE = InnoDB").stmt), IsFalse)
+	c.Assert(isNoOpDownstream(parsedDDL1("ALTER TABLE bar AUTO_INCREMENT = 1000, ADD COLUMN c2 INT").stmt), IsFalse)
+	c.Assert(isNoOpDownstream(parsedDDL1("ALTER TABLE bar ADD COLUMN c2 INT").stmt), IsFalse)
+	c.Assert(isNoOpDownstream(parsedDDL1("ALTER TABLE bar RENAME INDEX idx1 TO idx2, ADD COLUMN c2 INT").stmt), IsFalse)
+	c.Assert(isNoOpDownstream(parsedDDL1("TRUNCATE TABLE bar").stmt), IsTrue)
+	c.Assert(isNoOpDownstream(parsedDDL1("CREATE TABLE bar (id INT PRIMARY KEY)").stmt), IsFalse)
+	c.Assert(isNoOpDownstream(parsedDDL1("invalid DDL").stmt), IsFalse)
+	c.Assert(isNoOpDownstreamDDLs(nil), IsFalse)
+	c.Assert(isNoOpDownstreamDDLs(parsedDDLs(append(DDLs1, DDLs2...))), IsTrue)
+
+	// no DDLs need to be executed to the downstream.
+	DDLs, err := l.TrySync(source1, db, tbl, DDLs1, ti1, sts)
+	c.Assert(err, IsNil)
+	c.Assert(DDLs, DeepEquals, []string{})
+	synced, remain := l.IsSynced()
+	c.Assert(synced, IsTrue)
+	c.Assert(remain, Equals, 0)
+
+	// only change comments of columns.
+	var (
+		DDLs3 = []string{"ALTER TABLE bar MODIFY COLUMN c1 INT COMMENT 'new comment'"}
+		DDLs4 = []string{"ALTER TABLE bar CHANGE COLUMN c1 c1 INT COMMENT 'new comment', COMMENT = 'new comment'"}
+		ti2   = createTableInfo(c, p, se, tblID, `CREATE TABLE bar (id INT PRIMARY KEY, c1 INT COMMENT 'new comment', INDEX idx1(c1)) COMMENT = 'new comment'`)
+		ti3   = createTableInfo(c, p, se, tblID, `CREATE TABLE bar (id INT PRIMARY KEY, c1 BIGINT COMMENT 'new comment', INDEX idx1(c1)) COMMENT = 'new comment'`)
+		ti4   = createTableInfo(c, p, se, tblID, `CREATE TABLE bar (id INT PRIMARY KEY, c2 INT COMMENT 'new comment', INDEX idx1(c2)) COMMENT = 'new comment'`)
+	)
+	c.Assert(isCommentOnlyDDLs(parsedDDLs(DDLs3), ti1, ti2), IsTrue)
+	c.Assert(isCommentOnlyDDLs(parsedDDLs(DDLs4), ti0, ti2), IsTrue)
+	c.Assert(isCommentOnlyDDLs(parsedDDLs(DDLs1), ti0, ti1), IsTrue)
+	c.Assert(isCommentOnlyDDLs(nil, ti1, ti2), IsFalse)
+	c.Assert(isCommentOnlyDDLs(parsedDDLs(DDLs3), nil, ti2), IsFalse)
+	c.Assert(isCommentOnlyDDLs(parsedDDLs([]string{"ALTER TABLE bar MODIFY COLUMN c1 BIGINT COMMENT 'new comment'"}), ti1, ti3), IsFalse)
+	c.Assert(isCommentOnlyDDLs(parsedDDLs([]string{"ALTER TABLE bar CHANGE COLUMN c1 c2 INT COMMENT 'new comment'"}), ti1, ti4), IsFalse)
+	c.Assert(isCommentOnlyDDLs(parsedDDLs([]string{"ALTER TABLE bar MODIFY COLUMN c1 INT COMMENT 'new comment', ADD COLUMN c2 INT"}), ti1, ti2), IsFalse)
+	c.Assert(isCommentOnlyDDLs(parsedDDLs(DDLs2), ti1, ti1), IsFalse)
+	c.Assert(isCommentOnlyDDLs(parsedDDLs([]string{"ALTER TABLE bar MODIFY COLUMN c1 INT"}), ti2, ti2), IsFalse)
+
+	DDLs, err = l.TrySync(source1, db, tbl, DDLs3, ti2, sts)
+	c.Assert(err, IsNil)
+	c.Assert(DDLs, DeepEquals, []string{})
+	DDLs, err = l.TrySync(source2, db, tbl, DDLs4, ti2, sts)
+	c.Assert(err, IsNil)
+	c.Assert(DDLs, DeepEquals, []string{})
+	synced, remain = l.IsSynced()
+	c.Assert(synced, IsTrue)
+	c.Assert(remain, Equals, 0)
+}
+
+func (t *testLock) TestLockTrySyncGeneratedColumn(c *C) {
+	var (
+		ID            = "test_lock_try_sync_generated_column-`foo`.`bar`"
+		task          = "test_lock_try_sync_generated_column"
+		source1       = "mysql-replica-1"
+		source2       = "mysql-replica-2"
+		db            = "foo"
+		tbl           = "bar"
+		p             = parser.New()
+		se            = mock.NewContext()
+		tblID   int64 = 111
+		DDLs1         = []string{"ALTER TABLE bar ADD COLUMN c1 INT AS (id + 1) VIRTUAL"}
+		DDLs2         = []string{"ALTER TABLE bar ADD COLUMN c1 INT AS (id + 2) VIRTUAL"}
+		DDLs3         = []string{"ALTER TABLE bar ADD COLUMN c1 INT AS (id + 1) STORED"}
+		DDLs4         = []string{"ALTER TABLE bar ADD COLUMN c1 INT"}
+		ti0           = createTableInfo(c, p, se, tblID, `CREATE TABLE bar (id INT PRIMARY KEY)`)
+		ti1           = createTableInfo(c, p, se, tblID, `CREATE TABLE bar (id INT PRIMARY KEY, c1 INT AS (id + 1) VIRTUAL)`)
+		ti2           = createTableInfo(c, p, se, tblID, `CREATE TABLE bar (id INT PRIMARY KEY, c1 INT AS (id + 2) VIRTUAL)`)
+		ti3           = createTableInfo(c, p, se, tblID, `CREATE TABLE bar (id INT PRIMARY KEY, c1 INT AS (id + 1) STORED)`)
+		ti4           = createTableInfo(c, p, se, tblID, `CREATE TABLE bar (id INT PRIMARY KEY, c1 INT)`)
+
+		tables = map[string]map[string]struct{}{db: {tbl: struct{}{}}}
+		sts    = []SourceTables{
+			NewSourceTables(task, source1, tables),
+			NewSourceTables(task, source2, tables),
+		}
+		l = NewLock(ID, task, ti0, sts)
+	)
+
+	// add a generated column in source1.
+	DDLs, err := l.TrySync(source1, db, tbl, DDLs1, ti1, sts)
+	c.Assert(err, IsNil)
+	c.Assert(DDLs, DeepEquals, DDLs1)
+
+	// mismatching generated column definitions in source2.
+	for _, cs := range []struct {
+		DDLs []string
+		ti   *model.TableInfo
+		tp   ConflictType
+	}{
+		{DDLs2, ti2, ConflictTypeGeneratedColumn}, // different expressions.
+		{DDLs3, ti3, ConflictTypeGeneratedColumn}, // STORED vs VIRTUAL.
+		{DDLs4, ti4, ConflictTypeGeneratedColumn}, // generated vs normal.
+	} {
+		DDLs, ct, err2 := l.trySync(source2, db, tbl, parsedDDLs(cs.DDLs), cs.ti, sts, 0)
+		c.Assert(terror.ErrShardDDLOptimismTrySyncFail.Equal(err2), IsTrue)
+		c.Assert(ct, Equals, cs.tp)
+		c.Assert(DDLs, HasLen, 0)
+	}
+
+	// revert source2 and add the matching generated column, the lock converges.
+	DDLs, err = l.TrySync(source2, db, tbl, []string{}, ti0, sts)
+	c.Assert(err, IsNil)
+	c.Assert(DDLs, HasLen, 0)
+	DDLs, err = l.TrySync(source2, db, tbl, DDLs1, ti1, sts)
+	c.Assert(err, IsNil)
+	c.Assert(DDLs, DeepEquals, DDLs1)
+	synced, remain := l.IsSynced()
+	c.Assert(synced, IsTrue)
+	c.Assert(remain, Equals, 0)
+}
+
+func (t *testLock) TestLockTrySyncIndex(c *C) {
+	var (
+		ID            = "test_lock_try_sync_index-`foo`.`bar`"
+		task          = "test_lock_try_sync_index"
+		source1       = "mysql-replica-1"
+		source2       = "mysql-replica-2"
+		db            = "foo"
+		tbl           = "bar"
+		p             = parser.New()
+		se            = mock.NewContext()
+		tblID   int64 = 111
+		DDLs1         = []string{"ALTER TABLE bar ADD INDEX idx1(c1)"}
+		DDLs2         = []string{"ALTER TABLE bar ADD INDEX idx1(c2)"}
+		DDLs3         = []string{"ALTER TABLE bar ADD UNIQUE INDEX idx1(c1)"}
+		ti0           = createTableInfo(c, p, se, tblID, `CREATE TABLE bar (id INT PRIMARY KEY, c1 INT, c2 INT)`)
+		ti1           = createTableInfo(c, p, se, tblID, `CREATE TABLE bar (id INT PRIMARY KEY, c1 INT, c2 INT, INDEX idx1(c1))`)
+		ti2           = createTableInfo(c, p, se, tblID, `CREATE TABLE bar (id INT PRIMARY KEY, c1 INT, c2 INT, INDEX idx1(c2))`)
+		ti3           = createTableInfo(c, p, se, tblID, `CREATE TABLE bar (id INT PRIMARY KEY, c1 INT, c2 INT, UNIQUE INDEX idx1(c1))`)
+
+		tables = map[string]map[string]struct{}{db: {tbl: struct{}{}}}
+		sts    = []SourceTables{
+			NewSourceTables(task, source1, tables),
+			NewSourceTables(task, source2, tables),
+		}
+		l = NewLock(ID, task, ti0, sts)
+	)
+
+	// add an index in source1, no DDLs to the downstream until all tables added it.
+	DDLs, err := l.TrySync(source1, db, tbl, DDLs1, ti1, sts)
+	c.Assert(err, IsNil)
+	c.Assert(DDLs, HasLen, 0)
+
+	// add an index with the same name but different columns in source2.
+	DDLs, ct, err := l.trySync(source2, db, tbl, parsedDDLs(DDLs2), ti2, sts, 0)
+	c.Assert(terror.ErrShardDDLOptimismTrySyncFail.Equal(err), IsTrue)
+	c.Assert(ct, Equals, ConflictTypeIncompatibleIndex)
+	c.Assert(DDLs, HasLen, 0)
+	c.Assert(l.Conflict(), Equals, ConflictTypeIncompatibleIndex)
+
+	// add an unique index with the same name and columns in source2.
+	DDLs, ct, err = l.trySync(source2, db, tbl, parsedDDLs(DDLs3), ti3, sts, 0)
+	c.Assert(terror.ErrShardDDLOptimismTrySyncFail.Equal(err), IsTrue)
+	c.Assert(ct, Equals, ConflictTypeIncompatibleIndex)
+	c.Assert(DDLs, HasLen, 0)
+
+	// add the same index in source2, the lock converges.
+	DDLs, err = l.TrySync(source2, db, tbl, DDLs1, ti1, sts)
+	c.Assert(err, IsNil)
+	c.Assert(DDLs, DeepEquals, DDLs1)
+	c.Assert(l.Conflict(), Equals, ConflictTypeNone)
+	synced, remain := l.IsSynced()
+	c.Assert(synced, IsTrue)
+	c.Assert(remain, Equals, 0)
+}
+
+func (t *testLock) TestLockTrySyncIndexColumnOrder(c *C) {
+	var (
+		ID            = "test_lock_try_sync_index_column_order-`foo`.`bar`"
+		task          = "test_lock_try_sync_index_column_order"
+		source1       = "mysql-replica-1"
+		source2       = "mysql-replica-2"
+		db            = "foo"
+		tbl           = "bar"
+		p             = parser.New()
+		se            = mock.NewContext()
+		tblID   int64 = 111
+		DDLs1         = []string{"ALTER TABLE bar ADD INDEX idx1(c1, c2)"}
+		DDLs2         = []string{"ALTER TABLE bar ADD INDEX idx1(c2, c1)"}
+		ti0           = createTableInfo(c, p, se, tblID, `CREATE TABLE bar (id INT PRIMARY KEY, c1 INT, c2 INT)`)
+		ti1           = createTableInfo(c, p, se, tblID, `CREATE TABLE bar (id INT PRIMARY KEY, c1 INT, c2 INT, INDEX idx1(c1, c2))`)
+		ti2           = createTableInfo(c, p, se, tblID, `CREATE TABLE bar (id INT PRIMARY KEY, c1 INT, c2 INT, INDEX idx1(c2, c1))`)
+
+		tables = map[string]map[string]struct{}{db: {tbl: struct{}{}}}
+		sts    = []SourceTables{
+			NewSourceTables(task, source1, tables),
+			NewSourceTables(task, source2, tables),
+		}
+		l = NewLock(ID, task, ti0, sts)
+	)
+
+	// add a composite index in source1.
+	DDLs, err := l.TrySync(source1, db, tbl, DDLs1, ti1, sts)
+	c.Assert(err, IsNil)
+	c.Assert(DDLs, HasLen, 0)
+
+	// add the index with the same columns in a different order in source2.
+	DDLs, ct, err := l.trySync(source2, db, tbl, parsedDDLs(DDLs2), ti2, sts, 0)
+	c.Assert(terror.ErrShardDDLOptimismTrySyncFail.Equal(err), IsTrue)
+	c.Assert(err, ErrorMatches, ".*columns are in different orders \\(c2, c1\\) and \\(c1, c2\\).*")
+	c.Assert(ct, Equals, ConflictTypeIncompatibleIndex)
+	c.Assert(DDLs, HasLen, 0)
+	c.Assert(l.Conflict(), Equals, ConflictTypeIncompatibleIndex)
+
+	// add the index with the same column order in source2, the lock converges.
+	DDLs, err = l.TrySync(source2, db, tbl, DDLs1, ti1, sts)
+	c.Assert(err, IsNil)
+	c.Assert(DDLs, DeepEquals, DDLs1)
+	c.Assert(l.Conflict(), Equals, ConflictTypeNone)
+}
+
+func (t *testLock) TestLockTrySyncSpecialIndex(c *C) {
+	var (
+		ID            = "test_lock_try_sync_special_index-`foo`.`bar`"
+		task          = "test_lock_try_sync_special_index"
+		source1       = "mysql-replica-1"
+		source2       = "mysql-replica-2"
+		db            = "foo"
+		tbl           = "bar"
+		p             = parser.New()
+		se            = mock.NewContext()
+		tblID   int64 = 111
+		DDLs1         = []string{"ALTER TABLE bar ADD FULLTEXT INDEX idx1(c1)"}
+		DDLs2         = []string{"ALTER TABLE bar ADD INDEX idx1(c1)"}
+		DDLs3         = []string{"CREATE SPATIAL INDEX idx1 ON bar(c1)"}
+		DDLs4         = []string{"ALTER TABLE bar DROP INDEX idx1"}
+		DDLs5         = []string{"DROP INDEX idx1 ON bar"}
+		ti0           = createTableInfo(c, p, se, tblID, `CREATE TABLE bar (id INT PRIMARY KEY, c1 VARCHAR(20))`)
+		ti1           = createTableInfo(c, p, se, tblID, `CREATE TABLE bar (id INT PRIMARY KEY, c1 VARCHAR(20), INDEX idx1(c1))`)
+
+		tables = map[string]map[string]struct{}{db: {tbl: struct{}{}}}
+		sts    = []SourceTables{
+			NewSourceTables(task, source1, tables),
+			NewSourceTables(task, source2, tables),
+		}
+		l = NewLock(ID, task, ti0, sts)
+	)
+
+	// add a FULLTEXT index in source1, it's ignored in the table info but executed to the downstream.
+	DDLs, err := l.TrySync(source1, db, tbl, DDLs1, ti0, sts)
+	c.Assert(err, IsNil)
+	c.Assert(DDLs, DeepEquals, DDLs1)
+
+	// add a normal index with the same name in source2.
+	DDLs, ct, err := l.trySync(source2, db, tbl, parsedDDLs(DDLs2), ti1, sts, 0)
+	c.Assert(terror.ErrShardDDLOptimismTrySyncFail.Equal(err), IsTrue)
+	c.Assert(ct, Equals, ConflictTypeIncompatibleIndex)
+	c.Assert(DDLs, HasLen, 0)
+	c.Assert(l.Conflict(), Equals, ConflictTypeIncompatibleIndex)
+
+	// add a SPATIAL index with the same name in source2.
+	DDLs, ct, err = l.trySync(source2, db, tbl, parsedDDLs(DDLs3), ti0, sts, 0)
+	c.Assert(terror.ErrShardDDLOptimismTrySyncFail.Equal(err), IsTrue)
+	c.Assert(ct, Equals, ConflictTypeIncompatibleIndex)
+	c.Assert(DDLs, HasLen, 0)
+
+	// add the same FULLTEXT index in source2, no DDLs to the downstream because it has been added.
+	DDLs, err = l.TrySync(source2, db, tbl, DDLs1, ti0, sts)
+	c.Assert(err, IsNil)
+	c.Assert(DDLs, HasLen, 0)
+	c.Assert(l.Conflict(), Equals, ConflictTypeNone)
+	synced, _ := l.IsSynced()
+	c.Assert(synced, IsTrue)
+
+	// drop the FULLTEXT index in source1, no DDLs to the downstream until all tables dropped it.
+	DDLs, err = l.TrySync(source1, db, tbl, DDLs4, ti0, sts)
+	c.Assert(err, IsNil)
+	c.Assert(DDLs, HasLen, 0)
+	DDLs, err = l.TrySync(source2, db, tbl, DDLs5, ti0, sts)
+	c.Assert(err, IsNil)
+	c.Assert(DDLs, DeepEquals, DDLs5)
+	c.Assert(l.specialIndexes, HasLen, 0)
+
+	// add a normal index in source2 first, then add a FULLTEXT index with the same name in source1.
+	DDLs, err = l.TrySync(source2, db, tbl, DDLs2, ti1, sts)
+	c.Assert(err, IsNil)
+	c.Assert(DDLs, HasLen, 0)
+	DDLs, ct, err = l.trySync(source1, db, tbl, parsedDDLs(DDLs1), ti0, sts, 0)
+	c.Assert(terror.ErrShardDDLOptimismTrySyncFail.Equal(err), IsTrue)
+	c.Assert(ct, Equals, ConflictTypeIncompatibleIndex)
+	c.Assert(DDLs, HasLen, 0)
+
+	// FULLTEXT indexes are removed with the table.
+	l = NewLock(ID, task, ti0, sts)
+	DDLs, err = l.TrySync(source1, db, tbl, DDLs1, ti0, sts)
+	c.Assert(err, IsNil)
+	c.Assert(DDLs, DeepEquals, DDLs1)
+	c.Assert(l.TryRemoveTable(source1, db, tbl), IsTrue)
+	c.Assert(l.specialIndexes, HasLen, 0)
+	DDLs, err = l.TrySync(source2, db, tbl, DDLs2, ti1, sts)
+	c.Assert(err, IsNil)
+	c.Assert(DDLs, HasLen, 0)
+}
+
+func (t *testLock) TestLockTrySyncRevert(c *C) {
+	var (
+		ID           = "test_lock_try_sync_revert-`foo`.`bar`"
+		task         = "test_lock_try_sync_revert"
+		source       = "mysql-replica-1"
+		db           = "foo"
+		tbls         = []string{"bar1", "bar2"}
+		p            = parser.New()
+		se           = mock.NewContext()
+		tblID  int64 = 111
+
+		DDLs1 = []string{"ALTER TABLE bar ADD COLUMN c1 TEXT"}
+		DDLs2 = []string{"ALTER TABLE bar DROP COLUMN c1"}
+		ti0   = createTableInfo(c, p, se, tblID, `CREATE TABLE bar (id INT PRIMARY KEY)`)
+		ti1   = createTableInfo(c, p, se, tblID, `CREATE TABLE bar (id INT PRIMARY KEY, c1 TEXT)`)
+		ti2   = ti0
+
+		DDLs3 = []string{"ALTER TABLE bar ADD COLUMN c1 TEXT", "ALTER TABLE bar ADD COLUMN c2 INT"}
+		DDLs4 = []string{"ALTER TABLE bar DROP COLUMN c2"}
+		DDLs5 = []string{"ALTER TABLE bar DROP COLUMN c1"}
+		ti3   = createTableInfo(c, p, se, tblID, `CREATE TABLE bar (id INT PRIMARY KEY, c1 TEXT, c2 INT)`)
+		ti4   = createTableInfo(c, p, se, tblID, `CREATE TABLE bar (id INT PRIMARY KEY, c1 TEXT)`)
+		ti5   = ti0
+
+		DDLs6 = DDLs3
+		DDLs7 = DDLs4
+		DDLs8 = []string{"ALTER TABLE bar ADD COLUMN c1 TEXT"}
+		ti6   = ti3
+		ti7   = ti4
+		ti8   = ti4
+
+		tables = map[string]map[string]struct{}{db: {tbls[0]: struct{}{}, tbls[1]: struct{}{}}}
+		sts    = []SourceTables{NewSourceTables(task, source, tables)}
+		l      = NewLock(ID, task, ti0, sts)
+	)
+
+	// the initial status is synced.
+	t.checkLockSynced(c, l)
+	t.checkLockNoDone(c, l)
+
+	// CASE: revert for single DDL.
+	// TrySync for one table.
+	DDLs, err := l.TrySync(source, db, tbls[0], DDLs1, ti1, sts)
+	c.Assert(err, IsNil)
+	c.Assert(DDLs, DeepEquals, DDLs1)
+	ready := l.Ready()
+	c.Assert(ready[source][db][tbls[0]], IsTrue)
+	c.Assert(ready[source][db][tbls[1]], IsFalse)
+	cmp, err := l.tables[source][db][tbls[0]].Compare(l.Joined())
+	c.Assert(err, IsNil)
+	c.Assert(cmp, Equals, 0)
+	cmp, err = l.tables[source][db][tbls[1]].Compare(l.Joined())
+	c.Assert(err, IsNil)
+	c.Assert(cmp, Equals, -1)
+
+	// revert for the table, become synced again.
+	DDLs, err = l.TrySync(source, db, tbls[0], DDLs2, ti2, sts)
+	c.Assert(err, IsNil)
+	c.Assert(DDLs, DeepEquals, DDLs2)
+	t.checkLockSynced(c, l)
+	t.checkLockNoDone(c, l)
+
+	// CASE: revert for multiple DDLs.
+	// TrySync for one table.
+	DDLs, err = l.TrySync(source, db, tbls[0], DDLs3, ti3, sts)
+	c.Assert(err, IsNil)
+	c.Assert(DDLs, DeepEquals, DDLs3)
+	ready = l.Ready()
+	c.Assert(ready[source][db][tbls[0]], IsTrue)
+	c.Assert(ready[source][db][tbls[1]], IsFalse)
+	cmp, err = l.tables[source][db][tbls[0]].Compare(l.Joined())
+	c.Assert(err, IsNil)
+	c.Assert(cmp, Equals, 0)
+	cmp, err = l.tables[source][db][tbls[1]].Compare(l.Joined())
+	c.Assert(err, IsNil)
+	c.Assert(cmp, Equals, -1)
+
+	// revert part of the DDLs.
+	DDLs, err = l.TrySync(source, db, tbls[0], DDLs4, ti4, sts)
+	c.Assert(err, IsNil)
+	c.Assert(DDLs, DeepEquals, DDLs4)
+	ready = l.Ready()
+	c.Assert(ready[source][db][tbls[1]], IsFalse)
+	cmp, err = l.tables[source][db][tbls[0]].Compare(l.Joined())
+	c.Assert(err, IsNil)
+	c.Assert(cmp, Equals, 0)
+	cmp, err = l.tables[source][db][tbls[1]].Compare(l.Joined())
+	c.Assert(err, IsNil)
+	c.Assert(cmp, Equals, -1)
+
+	// revert the reset part of the DDLs.
+	DDLs, err = l.TrySync(source, db, tbls[0], DDLs5, ti5, sts)
+	c.Assert(err, IsNil)
+	c.Assert(DDLs, DeepEquals, DDLs5)
+	t.checkLockSynced(c, l)
+	t.checkLockNoDone(c, l)
+
+	// CASE: revert part of multiple DDLs.
+	// TrySync for one table.
+	DDLs, err = l.TrySync(source, db, tbls[0], DDLs6, ti6, sts)
+	c.Assert(err, IsNil)
+	c.Assert(DDLs, DeepEquals, DDLs6)
+	ready = l.Ready()
+	c.Assert(ready[source][db][tbls[1]], IsFalse)
+	cmp, err = l.tables[source][db][tbls[0]].Compare(l.Joined())
+	c.Assert(err, IsNil)
+	c.Assert(cmp, Equals, 0)
+	cmp, err = l.tables[source][db][tbls[1]].Compare(l.Joined())
+	c.Assert(err, IsNil)
+	c.Assert(cmp, Equals, -1)
+
+	// revert part of the DDLs.
+	DDLs, err = l.TrySync(source, db, tbls[0], DDLs7, ti7, sts)
+	c.Assert(err, IsNil)
+	c.Assert(DDLs, DeepEquals, DDLs7)
+	ready = l.Ready()
+	c.Assert(ready[source][db][tbls[1]], IsFalse)
+	cmp, err = l.tables[source][db][tbls[0]].Compare(l.Joined())
+	c.Assert(err, IsNil)
+	c.Assert(cmp, Equals, 0)
+	cmp, err = l.tables[source][db][tbls[1]].Compare(l.Joined())
+	c.Assert(err, IsNil)
+	c.Assert(cmp, Equals, -1)
+
+	// TrySync for another table.
+	DDLs, err = l.TrySync(source, db, tbls[1], DDLs8, ti8, sts)
+	c.Assert(err, IsNil)
+	c.Assert(DDLs, DeepEquals, DDLs8)
+	t.checkLockSynced(c, l)
+	t.checkLockNoDone(c, l)
+}
+
+func (t *testLock) TestLockTrySyncConflictNonIntrusive(c *C) {
+	var (
+		ID           = "test_lock_try_sync_conflict_non_intrusive-`foo`.`bar`"
+		task         = "test_lock_try_sync_conflict_non_intrusive"
+		source       = "mysql-replica-1"
+		db           = "foo"
+		tbls         = []string{"bar1", "bar2"}
+		p            = parser.New()
+		se           = mock.NewContext()
+		tblID  int64 = 111
+		DDLs1        = []string{"ALTER TABLE bar ADD COLUMN c1 TEXT"}
+		DDLs2        = []string{"ALTER TABLE bar ADD COLUMN c1 DATETIME", "ALTER TABLE bar ADD COLUMN c2 INT"}
+		DDLs3        = []string{"ALTER TABLE bar DROP COLUMN c1"}
+		DDLs4        = DDLs2
+		ti0          = createTableInfo(c, p, se, tblID, `CREATE TABLE bar (id INT PRIMARY KEY)`)
+		ti1          = createTableInfo(c, p, se, tblID, `CREATE TABLE bar (id INT PRIMARY KEY, c1 TEXT)`)
+		ti2          = createTableInfo(c, p, se, tblID, `CREATE TABLE bar (id INT PRIMARY KEY, c1 DATETIME, c2 INT)`)
+		ti3          = ti0
+		ti4          = ti2
+
+		tables = map[string]map[string]struct{}{db: {tbls[0]: struct{}{}, tbls[1]: struct{}{}}}
+		sts    = []SourceTables{NewSourceTables(task, source, tables)}
+		l      = NewLock(ID, task, ti0, sts)
+	)
+
+	// the initial status is synced.
+	t.checkLockSynced(c, l)
+	t.checkLockNoDone(c, l)
+
+	// TrySync for the first table, construct the joined schema.
+	DDLs, err := l.TrySync(source, db, tbls[0], DDLs1, ti1, sts)
+	c.Assert(err, IsNil)
+	c.Assert(DDLs, DeepEquals, DDLs1)
+	ready := l.Ready()
+	c.Assert(ready[source][db][tbls[0]], IsTrue)
+	c.Assert(ready[source][db][tbls[1]], IsFalse)
+	cmp, err := l.tables[source][db][tbls[0]].Compare(l.Joined())
+	c.Assert(err, IsNil)
+	c.Assert(cmp, Equals, 0)
+	cmp, err = l.tables[source][db][tbls[1]].Compare(l.Joined())
+	c.Assert(err, IsNil)
+	c.Assert(cmp, Equals, -1)
+
+	// TrySync for the second table with another schema (add two columns, one of them will cause conflict).
+	DDLs, err = l.TrySync(source, db, tbls[1], DDLs2, ti2, sts)
+	c.Assert(terror.ErrShardDDLOptimismTrySyncFail.Equal(err), IsTrue)
+	c.Assert(DDLs, DeepEquals, []string{})
+	cmp, err = l.tables[source][db][tbls[1]].Compare(l.Joined())
+	c.Assert(err, ErrorMatches, ".*at tuple index.*")
+	c.Assert(cmp, Equals, 0)
+	ready = l.Ready()
+	c.Assert(ready[source][db][tbls[1]], IsFalse)
+
+	// TrySync for the first table to resolve the conflict.
+	DDLs, err = l.TrySync(source, db, tbls[0], DDLs3, ti3, sts)
+	c.Assert(err, IsNil)
+	c.Assert(DDLs, DeepEquals, DDLs3)
+	ready = l.Ready()
+	c.Assert(ready[source][db][tbls[0]], IsFalse)
+	c.Assert(ready[source][db][tbls[1]], IsTrue) // the second table become synced now.
+	cmp, err = l.tables[source][db][tbls[0]].Compare(l.Joined())
+	c.Assert(err, IsNil)
+	c.Assert(cmp, Equals, -1)
+	cmp, err = l.tables[source][db][tbls[1]].Compare(l.Joined())
+	c.Assert(err, IsNil)
+	c.Assert(cmp, Equals, 0)
+
+	// TrySync for the first table.
+	DDLs, err = l.TrySync(source, db, tbls[0], DDLs4, ti4, sts)
+	c.Assert(err, IsNil)
+	c.Assert(DDLs, DeepEquals, DDLs4)
+	t.checkLockSynced(c, l)
+	t.checkLockNoDone(c, l)
+}
+
+func (t *testLock) TestLockTrySyncConflictIntrusive(c *C) {
+	var (
+		ID           = "test_lock_try_sync_conflict_intrusive-`foo`.`bar`"
+		task         = "test_lock_try_sync_conflict_intrusive"
+		source       = "mysql-replica-1"
+		db           = "foo"
+		tbls         = []string{"bar1", "bar2"}
+		p            = parser.New()
+		se           = mock.NewContext()
+		tblID  int64 = 111
+		DDLs1        = []string{"ALTER TABLE bar ADD COLUMN c1 TEXT"}
+		DDLs2        = []string{"ALTER TABLE bar ADD COLUMN c1 DATETIME", "ALTER TABLE bar ADD COLUMN c2 INT"}
+		DDLs3        = []string{"ALTER TABLE bar DROP COLUMN c2"}
+		DDLs4        = []string{"ALTER TABLE bar DROP COLUMN c1"}
+		ti0          = createTableInfo(c, p, se, tblID, `CREATE TABLE bar (id INT PRIMARY KEY)`)
+		ti1          = createTableInfo(c, p, se, tblID, `CREATE TABLE bar (id INT PRIMARY KEY, c1 TEXT)`)
+		ti2          = createTableInfo(c, p, se, tblID, `CREATE TABLE bar (id INT PRIMARY KEY, c1 DATETIME, c2 INT)`)
+		ti3          = createTableInfo(c, p, se, tblID, `CREATE TABLE bar (id INT PRIMARY KEY, c1 DATETIME)`)
+		ti4          = ti0
+
+		DDLs5   = []string{"ALTER TABLE bar ADD COLUMN c2 TEXT"}
+		DDLs6   = []string{"ALTER TABLE bar ADD COLUMN c2 DATETIME", "ALTER TABLE bar ADD COLUMN c3 INT"}
+		DDLs7   = []string{"ALTER TABLE bar DROP COLUMN c2"}
+		DDLs8_1 = []string{"ALTER TABLE bar ADD COLUMN c3 INT"}
+		DDLs8_2 = []string{"ALTER TABLE bar ADD COLUMN c2 TEXT"}
+		ti5     = createTableInfo(c, p, se, tblID, `CREATE TABLE bar (id INT PRIMARY KEY, c1 TEXT, c2 TEXT)`)
+		ti6     = createTableInfo(c, p, se, tblID, `CREATE TABLE bar (id INT PRIMARY KEY, c1 TEXT, c2 DATETIME, c3 INT)`)
+		ti7     = createTableInfo(c, p, se, tblID, `CREATE TABLE bar (id INT PRIMARY KEY, c1 TEXT, c3 INT)`)
+		ti8     = createTableInfo(c, p, se, tblID, `CREATE TABLE bar (id INT PRIMARY KEY, c1 TEXT, c2 TEXT, c3 INT)`)
+
+		tables = map[string]map[string]struct{}{db: {tbls[0]: struct{}{}, tbls[1]: struct{}{}}}
+		sts    = []SourceTables{NewSourceTables(task, source, tables)}
+		l      = NewLock(ID, task, ti0, sts)
+	)
+
+	// the initial status is synced.
+	t.checkLockSynced(c, l)
+	t.checkLockNoDone(c, l)
+
+	// CASE: conflict happen, revert all changes to resolve the conflict.
+	// TrySync for the first table, construct the joined schema.
+	DDLs, err := l.TrySync(source, db, tbls[0], DDLs1, ti1, sts)
+	c.Assert(err, IsNil)
+	c.Assert(DDLs, DeepEquals, DDLs1)
+	ready := l.Ready()
+	c.Assert(ready[source][db][tbls[0]], IsTrue)
+	c.Assert(ready[source][db][tbls[1]], IsFalse)
+	cmp, err := l.tables[source][db][tbls[0]].Compare(l.Joined())
+	c.Assert(err, IsNil)
+	c.Assert(cmp, Equals, 0)
+	cmp, err = l.tables[source][db][tbls[1]].Compare(l.Joined())
+	c.Assert(err, IsNil)
+	c.Assert(cmp, Equals, -1)
+
+	// TrySync for the second table with another schema (add two columns, one of them will cause conflict).
+	DDLs, err = l.TrySync(source, db, tbls[1], DDLs2, ti2, sts)
+	c.Assert(terror.ErrShardDDLOptimismTrySyncFail.Equal(err), IsTrue)
+	c.Assert(DDLs, DeepEquals, []string{})
+	cmp, err = l.tables[source][db][tbls[1]].Compare(l.Joined())
+	c.Assert(err, ErrorMatches, ".*at tuple index.*")
+	c.Assert(cmp, Equals, 0)
+	ready = l.Ready()
+	c.Assert(ready[source][db][tbls[1]], IsFalse)
+
+	// TrySync again.
+	DDLs, err = l.TrySync(source, db, tbls[1], DDLs2, ti2, sts)
+	c.Assert(terror.ErrShardDDLOptimismTrySyncFail.Equal(err), IsTrue)
+	c.Assert(DDLs, DeepEquals, []string{})
+	cmp, err = l.tables[source][db][tbls[1]].Compare(l.Joined())
+	c.Assert(err, ErrorMatches, ".*at tuple index.*")
+	c.Assert(cmp, Equals, 0)
+
+	// TrySync for the second table to drop the non-conflict column, the conflict should still exist.
+	DDLs, err = l.TrySync(source, db, tbls[1], DDLs3, ti3, sts)
+	c.Assert(terror.ErrShardDDLOptimismTrySyncFail.Equal(err), IsTrue)
+	c.Assert(DDLs, DeepEquals, []string{})
+	cmp, err = l.tables[source][db][tbls[1]].Compare(l.Joined())
+	c.Assert(err, ErrorMatches, ".*at tuple index.*")
+	c.Assert(cmp, Equals, 0)
+	ready = l.Ready()
+	c.Assert(ready[source][db][tbls[1]], IsFalse)
+
+	// TrySync for the second table to drop the conflict column, the conflict should be resolved.
+	DDLs, err = l.TrySync(source, db, tbls[1], DDLs4, ti4, sts)
+	c.Assert(err, IsNil)
+	c.Assert(DDLs, DeepEquals, []string{})
+	cmp, err = l.tables[source][db][tbls[1]].Compare(l.Joined())
+	c.Assert(err, IsNil)
+	c.Assert(cmp, Equals, -1)
+	ready = l.Ready()
+	c.Assert(ready[source][db][tbls[1]], IsFalse)
+
+	// TrySync for the second table as we did for the first table, the lock should be synced.
+	DDLs, err = l.TrySync(source, db, tbls[1], DDLs1, ti1, sts)
+	c.Assert(err, IsNil)
+	c.Assert(DDLs, DeepEquals, DDLs)
+	cmp, err = l.tables[source][db][tbls[1]].Compare(l.Joined())
+	c.Assert(err, IsNil)
+	c.Assert(cmp, Equals, 0)
+	t.checkLockSynced(c, l)
+	t.checkLockNoDone(c, l)
+
+	// CASE: conflict happen, revert part of changes to resolve the conflict.
+	// TrySync for the first table, construct the joined schema.
+	DDLs, err = l.TrySync(source, db, tbls[0], DDLs5, ti5, sts)
+	c.Assert(err, IsNil)
+	c.Assert(DDLs, DeepEquals, DDLs5)
+	ready = l.Ready()
+	c.Assert(ready[source][db][tbls[0]], IsTrue)
+	c.Assert(ready[source][db][tbls[1]], IsFalse)
+	cmp, err = l.tables[source][db][tbls[0]].Compare(l.Joined())
+	c.Assert(err, IsNil)
+	c.Assert(cmp, Equals, 0)
+	cmp, err = l.tables[source][db][tbls[1]].Compare(l.Joined())
+	c.Assert(err, IsNil)
+	c.Assert(cmp, Equals, -1)
+
+	// TrySync for the second table with another schema (add two columns, one of them will cause conflict).
+	DDLs, err = l.TrySync(source, db, tbls[1], DDLs6, ti6, sts)
+	c.Assert(terror.ErrShardDDLOptimismTrySyncFail.Equal(err), IsTrue)
+	c.Assert(DDLs, DeepEquals, []string{})
+	cmp, err = l.tables[source][db][tbls[1]].Compare(l.Joined())
+	c.Assert(err, ErrorMatches, ".*at tuple index.*")
+	c.Assert(cmp, Equals, 0)
+	ready = l.Ready()
+	c.Assert(ready[source][db][tbls[1]], IsFalse)
+
+	// TrySync for the second table to drop the conflict column, the conflict should be resolved.
+	// but both of tables are not synced now.
+	DDLs, err = l.TrySync(source, db, tbls[1], DDLs7, ti7, sts)
+	c.Assert(err, IsNil)
+	c.Assert(DDLs, DeepEquals, DDLs7) // special case: these DDLs should not be replicated to the downstream.
+	ready = l.Ready()
+	c.Assert(ready[source][db][tbls[0]], IsFalse)
+	c.Assert(ready[source][db][tbls[1]], IsFalse)
+	cmp, err = l.tables[source][db][tbls[0]].Compare(l.Joined())
+	c.Assert(err, IsNil)
+	c.Assert(cmp, Equals, -1)
+	cmp, err = l.tables[source][db][tbls[1]].Compare(l.Joined())
+	c.Assert(err, IsNil)
+	c.Assert(cmp, Equals, -1)
+
+	// TrySync for the first table to become synced.
+	DDLs, err = l.TrySync(source, db, tbls[0], DDLs8_1, ti8, sts)
+	c.Assert(err, IsNil)
+	c.Assert(DDLs, DeepEquals, DDLs8_1)
+	ready = l.Ready()
+	c.Assert(ready[source][db][tbls[0]], IsTrue)
+
+	// TrySync for the second table to become synced.
+	DDLs, err = l.TrySync(source, db, tbls[1], DDLs8_2, ti8, sts)
+	c.Assert(err, IsNil)
+	c.Assert(DDLs, DeepEquals, DDLs8_2)
+	ready = l.Ready()
+	c.Assert(ready[source][db][tbls[1]], IsTrue)
+
+	// all tables synced now.
+	t.checkLockSynced(c, l)
+	t.checkLockNoDone(c, l)
+}
+
+func (t *testLock) TestTryRemoveTable(c *C) {
+	var (
+		ID           = "test_lock_try_remove_table-`foo`.`bar`"
+		task         = "test_lock_try_remove_table"
+		source       = "mysql-replica-1"
+		db           = "foo"
+		tbl1         = "bar1"
+		tbl2         = "bar2"
+		p            = parser.New()
+		se           = mock.NewContext()
+		tblID  int64 = 111
+		DDLs1        = []string{"ALTER TABLE bar ADD COLUMN c1 INT"}
+		DDLs2        = []string{"ALTER TABLE bar ADD COLUMN c2 INT"}
+		ti0          = createTableInfo(c, p, se, tblID, `CREATE TABLE bar (id INT PRIMARY KEY)`)
+		ti1          = createTableInfo(c, p, se, tblID, `CREATE TABLE bar (id INT PRIMARY KEY, c1 INT)`)
+		ti2          = createTableInfo(c, p, se, tblID, `CREATE TABLE bar (id INT PRIMARY KEY, c1 INT, c2 INT)`)
+
+		tables = map[string]map[string]struct{}{db: {tbl1: struct{}{}, tbl2: struct{}{}}}
+		sts    = []SourceTables{NewSourceTables(task, source, tables)}
+		l      = NewLock(ID, task, ti0, sts)
+	)
+
+	// only one table exists before TrySync.
+	t.checkLockSynced(c, l)
+	t.checkLockNoDone(c, l)
+
+	// CASE: remove a table as normal.
+	// TrySync for the first table.
+	DDLs, err := l.TrySync(source, db, tbl1, DDLs1, ti1, sts)
+	c.Assert(err, IsNil)
+	c.Assert(DDLs, DeepEquals, DDLs1)
+	ready := l.Ready()
+	c.Assert(ready, HasLen, 1)
+	c.Assert(ready[source], HasLen, 1)
+	c.Assert(ready[source][db], HasLen, 2)
+	c.Assert(ready[source][db][tbl1], IsTrue)
+	c.Assert(ready[source][db][tbl2], IsFalse)
+
+	// TryRemoveTable for the second table.
+	c.Assert(l.TryRemoveTable(source, db, tbl2), IsTrue)
+	ready = l.Ready()
+	c.Assert(ready, HasLen, 1)
+	c.Assert(ready[source], HasLen, 1)
+	c.Assert(ready[source][db], HasLen, 1)
+	c.Assert(ready[source][db][tbl1], IsTrue)
+
+	// CASE: remove a table will not rebuild joined schema now.
+	// TrySync to add the second back.
+	DDLs, err = l.TrySync(source, db, tbl2, DDLs2, ti2, sts)
+	c.Assert(err, IsNil)
+	c.Assert(DDLs, DeepEquals, DDLs2)
+	ready = l.Ready()
+	c.Assert(ready, HasLen, 1)
+	c.Assert(ready[source], HasLen, 1)
+	c.Assert(ready[source][db], HasLen, 2)
+	c.Assert(ready[source][db][tbl1], IsFalse)
+	c.Assert(ready[source][db][tbl2], IsTrue)
+
+	// TryRemoveTable for the second table.
+	c.Assert(l.TryRemoveTable(source, db, tbl2), IsTrue)
+	ready = l.Ready()
+	c.Assert(ready, HasLen, 1)
+	c.Assert(ready[source], HasLen, 1)
+	c.Assert(ready[source][db], HasLen, 1)
+	c.Assert(ready[source][db][tbl1], IsFalse) // the joined schema is not rebuild.
+
+	// CASE: try to remove for not-exists table.
+	c.Assert(l.TryRemoveTable(source, db, "not-exist"), IsFalse)
+	c.Assert(l.TryRemoveTable(source, "not-exist", tbl1), IsFalse)
+	c.Assert(l.TryRemoveTable("not-exist", db, tbl1), IsFalse)
+}
+
+func (t *testLock) TestLockTryMarkDone(c *C) {
+	var (
+		ID           = "test_lock_try_mark_done-`foo`.`bar`"
+		task         = "test_lock_try_mark_done"
+		source       = "mysql-replica-1"
+		db           = "foo"
+		tbls         = []string{"bar1", "bar2"}
+		p            = parser.New()
+		se           = mock.NewContext()
+		tblID  int64 = 111
+		DDLs1        = []string{"ALTER TABLE bar ADD COLUMN c1 INT"}
+		DDLs2        = []string{"ALTER TABLE bar ADD COLUMN c1 INT", "ALTER TABLE bar ADD COLUMN c2 INT"}
+		DDLs3        = []string{"ALTER TABLE bar ADD COLUMN c2 INT"}
+		ti0          = createTableInfo(c, p, se, tblID, `CREATE TABLE bar (id INT PRIMARY KEY)`)
+		ti1          = createTableInfo(c, p, se, tblID, `CREATE TABLE bar (id INT PRIMARY KEY, c1 INT)`)
+		ti2          = createTableInfo(c, p, se, tblID, `CREATE TABLE bar (id INT PRIMARY KEY, c1 INT, c2 INT)`)
+		ti3          = ti2
+
+		tables = map[string]map[string]struct{}{db: {tbls[0]: struct{}{}, tbls[1]: struct{}{}}}
+		sts    = []SourceTables{NewSourceTables(task, source, tables)}
+		l      = NewLock(ID, task, ti0, sts)
+	)
 
 	// the initial status is synced.
 	t.checkLockSynced(c, l)
 	t.checkLockNoDone(c, l)
 
-	// CASE: conflict happen, revert all changes to resolve the conflict.
-	// TrySync for the first table, construct the joined schema.
+	// TrySync for the first table.
 	DDLs, err := l.TrySync(source, db, tbls[0], DDLs1, ti1, sts)
 	c.Assert(err, IsNil)
 	c.Assert(DDLs, DeepEquals, DDLs1)
+
+	// mark done for synced table, fail for non-synced table
+	c.Assert(l.TryMarkDone(source, db, tbls[0]), IsTrue)
+	c.Assert(l.TryMarkDone(source, db, tbls[1]), IsFalse)
+	c.Assert(l.IsDone(source, db, tbls[0]), IsTrue)
+	c.Assert(l.IsDone(source, db, tbls[1]), IsFalse)
+
+	// TrySync for the second table, the joined schema become larger.
+	DDLs, err = l.TrySync(source, db, tbls[1], DDLs2, ti2, sts)
+	c.Assert(err, IsNil)
+	c.Assert(DDLs, DeepEquals, DDLs2)
+
+	// both of tables should become not-done now.
+	c.Assert(l.IsDone(source, db, tbls[0]), IsFalse)
+	c.Assert(l.IsDone(source, db, tbls[1]), IsFalse)
+
+	// mark done for synced table, fail for non-synced table
+	c.Assert(l.TryMarkDone(source, db, tbls[0]), IsFalse)
+	c.Assert(l.TryMarkDone(source, db, tbls[1]), IsTrue)
+	c.Assert(l.IsDone(source, db, tbls[0]), IsFalse)
+	c.Assert(l.IsDone(source, db, tbls[1]), IsTrue)
+
+	// TrySync for the first table, all tables become synced.
+	DDLs, err = l.TrySync(source, db, tbls[0], DDLs3, ti3, sts)
+	c.Assert(err, IsNil)
+	c.Assert(DDLs, DeepEquals, DDLs3)
+
+	// the lock is still not resolved.
+	c.Assert(l.IsResolved(), IsFalse)
+
+	// mark done for the first table.
+	c.Assert(l.TryMarkDone(source, db, tbls[0]), IsTrue)
+	c.Assert(l.IsDone(source, db, tbls[0]), IsTrue)
+
+	// the lock become resolved now.
+	c.Assert(l.IsResolved(), IsTrue)
+
+	// TryMarkDone for not-existing table take no effect.
+	c.Assert(l.TryMarkDone(source, db, "not-exist"), IsFalse)
+	c.Assert(l.TryMarkDone(source, "not-exist", tbls[0]), IsFalse)
+	c.Assert(l.TryMarkDone("not-exist", db, tbls[0]), IsFalse)
+
+	// check IsDone for not-existing table take no effect.
+	c.Assert(l.IsDone(source, db, "not-exist"), IsFalse)
+	c.Assert(l.IsDone(source, "not-exist", tbls[0]), IsFalse)
+	c.Assert(l.IsDone("not-exist", db, tbls[0]), IsFalse)
+}
+
+func (t *testLock) trySyncForAllTablesLarger(c *C, l *Lock,
+	DDLs []string, ti *model.TableInfo, sts []SourceTables) {
+	for source, schemaTables := range l.Ready() {
+		for schema, tables := range schemaTables {
+			for table := range tables {
+				DDLs2, err := l.TrySync(source, schema, table, DDLs, ti, sts)
+				c.Assert(err, IsNil)
+				c.Assert(DDLs2, DeepEquals, DDLs)
+			}
+		}
+	}
+}
+
+func (t *testLock) checkLockSynced(c *C, l *Lock) {
+	synced, remain := l.IsSynced()
+	c.Assert(synced, IsTrue)
+	c.Assert(remain, Equals, 0)
+
 	ready := l.Ready()
-	c.Assert(ready[source][db][tbls[0]], IsTrue)
-	c.Assert(ready[source][db][tbls[1]], IsFalse)
-	cmp, err := l.tables[source][db][tbls[0]].Compare(l.Joined())
+	for _, schemaTables := range ready {
+		for _, tables := range schemaTables {
+			for _, synced := range tables {
+				c.Assert(synced, IsTrue)
+			}
+		}
+	}
+}
+
+func (t *testLock) checkLockNoDone(c *C, l *Lock) {
+	c.Assert(l.IsResolved(), IsFalse)
+	for source, schemaTables := range l.Ready() {
+		for schema, tables := range schemaTables {
+			for table := range tables {
+				c.Assert(l.IsDone(source, schema, table), IsFalse)
+			}
+		}
+	}
+}
+
+func (t *testLock) TestConflictTypeString(c *C) {
+	c.Assert(ConflictTypeNone.String(), Equals, "none")
+	c.Assert(ConflictTypeUnknown.String(), Equals, "unknown")
+	c.Assert(ConflictTypeColumnType.String(), Equals, "column-type-mismatch")
+	c.Assert(ConflictTypeColumnDefault.String(), Equals, "column-default-mismatch")
+	c.Assert(ConflictTypeGeneratedColumn.String(), Equals, "generated-column-mismatch")
+	c.Assert(ConflictTypeDropReferencedColumn.String(), Equals, "drop-referenced-column")
+	c.Assert(ConflictTypeIncompatibleIndex.String(), Equals, "incompatible-index")
+	c.Assert(ConflictTypeColumnCharset.String(), Equals, "column-charset-mismatch")
+	c.Assert(ConflictTypeTooManyColumns.String(), Equals, "too-many-columns")
+	c.Assert(ConflictTypeMissingDefault.String(), Equals, "missing-default-value")
+	c.Assert(ConflictType(100).String(), Equals, "unknown conflict type 100")
+}
+
+func (t *testLock) TestLockAddedDroppedColumns(c *C) {
+	var (
+		ID           = "test_lock_added_dropped_columns-`foo`.`bar`"
+		task         = "test_lock_added_dropped_columns"
+		source       = "mysql-replica-1"
+		db           = "foo"
+		tbls         = []string{"bar1", "bar2"}
+		p            = parser.New()
+		se           = mock.NewContext()
+		tblID  int64 = 111
+		DDLs1        = []string{"ALTER TABLE bar DROP COLUMN c1", "ALTER TABLE bar ADD COLUMN c4 INT", "ALTER TABLE bar ADD COLUMN c3 INT"}
+		ti0          = createTableInfo(c, p, se, tblID, `CREATE TABLE bar (id INT PRIMARY KEY, c1 INT, c2 INT)`)
+		ti1          = createTableInfo(c, p, se, tblID, `CREATE TABLE bar (id INT PRIMARY KEY, c2 INT, c4 INT, c3 INT)`)
+
+		tables = map[string]map[string]struct{}{db: {tbls[0]: struct{}{}, tbls[1]: struct{}{}}}
+		sts    = []SourceTables{NewSourceTables(task, source, tables)}
+		l      = NewLock(ID, task, ti0, sts)
+	)
+
+	// no changes for a new lock.
+	c.Assert(l.AddedColumns(), HasLen, 0)
+	c.Assert(l.DroppedColumns(), HasLen, 0)
+
+	// only the first table changed, the joined schema has added columns but no dropped columns.
+	_, err := l.TrySync(source, db, tbls[0], DDLs1, ti1, sts)
 	c.Assert(err, IsNil)
-	c.Assert(cmp, Equals, 0)
-	cmp, err = l.tables[source][db][tbls[1]].Compare(l.Joined())
+	c.Assert(l.AddedColumns(), DeepEquals, []string{"c4", "c3"})
+	c.Assert(l.DroppedColumns(), HasLen, 0)
+
+	// all tables changed.
+	_, err = l.TrySync(source, db, tbls[1], DDLs1, ti1, sts)
 	c.Assert(err, IsNil)
-	c.Assert(cmp, Equals, -1)
+	c.Assert(l.AddedColumns(), DeepEquals, []string{"c4", "c3"})
+	c.Assert(l.DroppedColumns(), DeepEquals, []string{"c1"})
+}
 
-	// TrySync for the second table with another schema (add two columns, one of them will cause conflict).
-	DDLs, err = l.TrySync(source, db, tbls[1], DDLs2, ti2, sts)
-	c.Assert(terror.ErrShardDDLOptimismTrySyncFail.Equal(err), IsTrue)
-	c.Assert(DDLs, DeepEquals, []string{})
-	cmp, err = l.tables[source][db][tbls[1]].Compare(l.Joined())
-	c.Assert(err, ErrorMatches, ".*at tuple index.*")
-	c.Assert(cmp, Equals, 0)
-	ready = l.Ready()
-	c.Assert(ready[source][db][tbls[1]], IsFalse)
+func (t *testLock) TestLockSchemaVersions(c *C) {
+	var (
+		ID            = "test_lock_schema_versions-`foo`.`bar`"
+		task          = "test_lock_schema_versions"
+		sources       = []string{"mysql-replica-1", "mysql-replica-2"}
+		db            = "foo"
+		tbls          = []string{"bar1", "bar2"}
+		p             = parser.New()
+		se            = mock.NewContext()
+		tblID   int64 = 111
+		DDLs1         = []string{"ALTER TABLE bar ADD COLUMN c1 INT"}
+		DDLs2         = []string{"ALTER TABLE bar ADD COLUMN c2 INT", "ALTER TABLE bar ADD COLUMN c3 INT"}
+		ti0           = createTableInfo(c, p, se, tblID, `CREATE TABLE bar (id INT PRIMARY KEY)`)
+		ti1           = createTableInfo(c, p, se, tblID, `CREATE TABLE bar (id INT PRIMARY KEY, c1 INT)`)
+		ti2           = createTableInfo(c, p, se, tblID, `CREATE TABLE bar (id INT PRIMARY KEY, c1 INT, c2 INT, c3 INT)`)
 
-	// TrySync again.
-	DDLs, err = l.TrySync(source, db, tbls[1], DDLs2, ti2, sts)
-	c.Assert(terror.ErrShardDDLOptimismTrySyncFail.Equal(err), IsTrue)
-	c.Assert(DDLs, DeepEquals, []string{})
-	cmp, err = l.tables[source][db][tbls[1]].Compare(l.Joined())
-	c.Assert(err, ErrorMatches, ".*at tuple index.*")
-	c.Assert(cmp, Equals, 0)
+		sts = []SourceTables{
+			NewSourceTables(task, sources[0], map[string]map[string]struct{}{db: {tbls[0]: struct{}{}, tbls[1]: struct{}{}}}),
+			NewSourceTables(task, sources[1], map[string]map[string]struct{}{db: {tbls[0]: struct{}{}}}),
+		}
+		l = NewLock(ID, task, ti0, sts)
+	)
 
-	// TrySync for the second table to drop the non-conflict column, the conflict should still exist.
-	DDLs, err = l.TrySync(source, db, tbls[1], DDLs3, ti3, sts)
-	c.Assert(terror.ErrShardDDLOptimismTrySyncFail.Equal(err), IsTrue)
-	c.Assert(DDLs, DeepEquals, []string{})
-	cmp, err = l.tables[source][db][tbls[1]].Compare(l.Joined())
-	c.Assert(err, ErrorMatches, ".*at tuple index.*")
-	c.Assert(cmp, Equals, 0)
-	ready = l.Ready()
-	c.Assert(ready[source][db][tbls[1]], IsFalse)
+	// all versions are 0 for a new lock.
+	c.Assert(l.SchemaVersions(), DeepEquals, map[string]int{sources[0]: 0, sources[1]: 0})
 
-	// TrySync for the second table to drop the conflict column, the conflict should be resolved.
-	DDLs, err = l.TrySync(source, db, tbls[1], DDLs4, ti4, sts)
+	// the version of a source is the smallest one of its tables.
+	_, err := l.TrySync(sources[0], db, tbls[0], DDLs1, ti1, sts)
 	c.Assert(err, IsNil)
-	c.Assert(DDLs, DeepEquals, []string{})
-	cmp, err = l.tables[source][db][tbls[1]].Compare(l.Joined())
+	c.Assert(l.SchemaVersions(), DeepEquals, map[string]int{sources[0]: 0, sources[1]: 0})
+	_, err = l.TrySync(sources[0], db, tbls[1], DDLs1, ti1, sts)
 	c.Assert(err, IsNil)
-	c.Assert(cmp, Equals, -1)
-	ready = l.Ready()
-	c.Assert(ready[source][db][tbls[1]], IsFalse)
+	c.Assert(l.SchemaVersions(), DeepEquals, map[string]int{sources[0]: 1, sources[1]: 0})
 
-	// TrySync for the second table as we did for the first table, the lock should be synced.
-	DDLs, err = l.TrySync(source, db, tbls[1], DDLs1, ti1, sts)
+	// re-sent DDLs without schema changes are not counted.
+	_, err = l.TrySync(sources[0], db, tbls[1], DDLs1, ti1, sts)
 	c.Assert(err, IsNil)
-	c.Assert(DDLs, DeepEquals, DDLs)
-	cmp, err = l.tables[source][db][tbls[1]].Compare(l.Joined())
+	c.Assert(l.SchemaVersions(), DeepEquals, map[string]int{sources[0]: 1, sources[1]: 0})
+
+	// increased by the count of DDLs.
+	_, err = l.TrySync(sources[0], db, tbls[0], DDLs2, ti2, sts)
 	c.Assert(err, IsNil)
-	c.Assert(cmp, Equals, 0)
-	t.checkLockSynced(c, l)
-	t.checkLockNoDone(c, l)
+	_, err = l.TrySync(sources[1], db, tbls[0], DDLs1, ti1, sts)
+	c.Assert(err, IsNil)
+	c.Assert(l.SchemaVersions(), DeepEquals, map[string]int{sources[0]: 1, sources[1]: 1})
 
-	// CASE: conflict happen, revert part of changes to resolve the conflict.
-	// TrySync for the first table, construct the joined schema.
-	DDLs, err = l.TrySync(source, db, tbls[0], DDLs5, ti5, sts)
+	// the most lagging table removed.
+	c.Assert(l.TryRemoveTable(sources[0], db, tbls[1]), IsTrue)
+	c.Assert(l.SchemaVersions(), DeepEquals, map[string]int{sources[0]: 3, sources[1]: 1})
+
+	// versions are cleared after reset.
+	l.Reset()
+	c.Assert(l.SchemaVersions(), DeepEquals, map[string]int{sources[0]: 0, sources[1]: 0})
+}
+
+func (t *testLock) TestLockTrySyncColumnPositions(c *C) {
+	var (
+		ID             = "test_lock_try_sync_column_positions-`foo`.`bar`"
+		task           = "test_lock_try_sync_column_positions"
+		sources        = []string{"mysql-replica-1", "mysql-replica-2"}
+		db             = "foo"
+		tbl            = "bar"
+		p              = parser.New()
+		se             = mock.NewContext()
+		tblID    int64 = 111
+		DDLs1          = []string{"ALTER TABLE bar ADD COLUMN c1 INT AFTER a"}
+		DDLs2          = []string{"ALTER TABLE bar ADD COLUMN c1 INT FIRST"}
+		DDLs3          = []string{"ALTER TABLE bar ADD COLUMN c2 INT"}
+		DDLs4          = []string{"ALTER TABLE bar MODIFY COLUMN c2 INT FIRST"}
+		ti0            = createTableInfo(c, p, se, tblID, `CREATE TABLE bar (id INT PRIMARY KEY, a INT)`)
+		ti1            = createTableInfo(c, p, se, tblID, `CREATE TABLE bar (id INT PRIMARY KEY, a INT, c1 INT)`)
+		ti2            = createTableInfo(c, p, se, tblID, `CREATE TABLE bar (c1 INT, id INT PRIMARY KEY, a INT)`)
+		ti3            = createTableInfo(c, p, se, tblID, `CREATE TABLE bar (id INT PRIMARY KEY, a INT, c1 INT, c2 INT)`)
+		ti4            = createTableInfo(c, p, se, tblID, `CREATE TABLE bar (c2 INT, id INT PRIMARY KEY, a INT, c1 INT)`)
+		expected       = []string{"ALTER TABLE `bar` ADD COLUMN `c1` INT"}
+
+		tables = map[string]map[string]struct{}{db: {tbl: struct{}{}}}
+		sts    = []SourceTables{NewSourceTables(task, sources[0], tables), NewSourceTables(task, sources[1], tables)}
+		l      = NewLock(ID, task, ti0, sts)
+	)
+
+	// DDLs without column positions are not changed.
+	c.Assert(ddlTexts(ignoreColumnPositions(parsedDDLs(DDLs3))), DeepEquals, DDLs3)
+	c.Assert(ddlTexts(ignoreColumnPositions(parsedDDLs([]string{"invalid ddl"}))), DeepEquals, []string{"invalid ddl"})
+
+	// the position is ignored for the first table.
+	DDLs, err := l.TrySync(sources[0], db, tbl, DDLs1, ti1, sts)
 	c.Assert(err, IsNil)
-	c.Assert(DDLs, DeepEquals, DDLs5)
-	ready = l.Ready()
-	c.Assert(ready[source][db][tbls[0]], IsTrue)
-	c.Assert(ready[source][db][tbls[1]], IsFalse)
-	cmp, err = l.tables[source][db][tbls[0]].Compare(l.Joined())
+	c.Assert(DDLs, DeepEquals, expected)
+
+	// another table adds the column with a different position, the same DDLs returned without conflict.
+	DDLs, err = l.TrySync(sources[1], db, tbl, DDLs2, ti2, sts)
 	c.Assert(err, IsNil)
-	c.Assert(cmp, Equals, 0)
-	cmp, err = l.tables[source][db][tbls[1]].Compare(l.Joined())
+	c.Assert(DDLs, DeepEquals, expected)
+	synced, remain := l.IsSynced()
+	c.Assert(synced, IsTrue)
+	c.Assert(remain, Equals, 0)
+
+	// re-order with the same position for all tables.
+	l = NewLock(ID, task, ti0, sts)
+	for _, source := range sources {
+		DDLs, err = l.TrySync(source, db, tbl, DDLs1, ti1, sts)
+		c.Assert(err, IsNil)
+		c.Assert(DDLs, DeepEquals, expected)
+	}
+
+	// positions in MODIFY COLUMN are also ignored.
+	for _, source := range sources {
+		_, err = l.TrySync(source, db, tbl, DDLs3, ti3, sts)
+		c.Assert(err, IsNil)
+	}
+	DDLs, err = l.TrySync(sources[0], db, tbl, DDLs4, ti4, sts)
 	c.Assert(err, IsNil)
-	c.Assert(cmp, Equals, -1)
+	c.Assert(DDLs, DeepEquals, []string{"ALTER TABLE `bar` MODIFY COLUMN `c2` INT"})
+}
 
-	// TrySync for the second table with another schema (add two columns, one of them will cause conflict).
-	DDLs, err = l.TrySync(source, db, tbls[1], DDLs6, ti6, sts)
-	c.Assert(terror.ErrShardDDLOptimismTrySyncFail.Equal(err), IsTrue)
-	c.Assert(DDLs, DeepEquals, []string{})
-	cmp, err = l.tables[source][db][tbls[1]].Compare(l.Joined())
-	c.Assert(err, ErrorMatches, ".*at tuple index.*")
-	c.Assert(cmp, Equals, 0)
-	ready = l.Ready()
-	c.Assert(ready[source][db][tbls[1]], IsFalse)
+func (t *testLock) TestLockTrySyncGuardClauses(c *C) {
+	var (
+		ID             = "test_lock_try_sync_guard_clauses-`foo`.`bar`"
+		task           = "test_lock_try_sync_guard_clauses"
+		sources        = []string{"mysql-replica-1", "mysql-replica-2", "mysql-replica-3"}
+		db             = "foo"
+		tbl            = "bar"
+		p              = parser.New()
+		se             = mock.NewContext()
+		tblID    int64 = 111
+		DDLs1          = []string{"ALTER TABLE bar ADD COLUMN IF NOT EXISTS c1 INT"}
+		DDLs2          = []string{"ALTER TABLE bar ADD COLUMN c1 INT"}
+		DDLs3          = []string{"ALTER TABLE bar ADD COLUMN IF NOT EXISTS a INT, ADD COLUMN IF NOT EXISTS c1 INT"}
+		ti0            = createTableInfo(c, p, se, tblID, `CREATE TABLE bar (id INT PRIMARY KEY, a INT, INDEX idx_a(a))`)
+		ti1            = createTableInfo(c, p, se, tblID, `CREATE TABLE bar (id INT PRIMARY KEY, a INT, c1 INT, INDEX idx_a(a))`)
+		expected       = []string{"ALTER TABLE `bar` ADD COLUMN `c1` INT"}
+
+		tables = map[string]map[string]struct{}{db: {tbl: struct{}{}}}
+		sts    = []SourceTables{
+			NewSourceTables(task, sources[0], tables),
+			NewSourceTables(task, sources[1], tables),
+			NewSourceTables(task, sources[2], tables),
+		}
+		l = NewLock(ID, task, ti0, sts)
+	)
 
-	// TrySync for the second table to drop the conflict column, the conflict should be resolved.
-	// but both of tables are not synced now.
-	DDLs, err = l.TrySync(source, db, tbls[1], DDLs7, ti7, sts)
+	// resolve guard clauses with the table info.
+	for _, cs := range []struct {
+		ddls     []string
+		expected []string
+	}{
+		{DDLs1, expected},
+		{DDLs2, DDLs2}, // no guard clauses.
+		{DDLs3, expected},
+		{[]string{"ALTER TABLE bar ADD COLUMN IF NOT EXISTS a INT"}, []string{}},
+		{[]string{"ALTER TABLE bar DROP COLUMN IF EXISTS c2, ADD COLUMN c1 INT"}, expected},
+		{[]string{"ALTER TABLE bar DROP COLUMN IF EXISTS a"}, []string{"ALTER TABLE `bar` DROP COLUMN `a`"}},
+		{[]string{"ALTER TABLE bar MODIFY COLUMN IF EXISTS c2 BIGINT"}, []string{}},
+		{[]string{"ALTER TABLE bar ADD INDEX IF NOT EXISTS idx_a(a)"}, []string{}},
+		{[]string{"ALTER TABLE bar ADD INDEX IF NOT EXISTS idx_c1(c1)"}, []string{"ALTER TABLE `bar` ADD INDEX `idx_c1`(`c1`)"}},
+		{[]string{"CREATE INDEX IF NOT EXISTS idx_a ON bar(a)"}, []string{}},
+		{[]string{"DROP INDEX IF EXISTS idx_a ON bar"}, []string{"DROP INDEX `idx_a` ON `bar`"}},
+		{[]string{"DROP INDEX IF EXISTS idx_ft ON bar"}, []string{"DROP INDEX IF EXISTS idx_ft ON bar"}}, // may be a FULLTEXT index.
+		{[]string{"invalid ddl"}, []string{"invalid ddl"}},
+	} {
+		c.Assert(ddlTexts(resolveGuardClauses(parsedDDLs(cs.ddls), ti0)), DeepEquals, cs.expected, Commentf("%v", cs.ddls))
+	}
+	c.Assert(ddlTexts(resolveGuardClauses(parsedDDLs(DDLs1), nil)), DeepEquals, DDLs1)
+
+	// guarded and unguarded DDLs with the same effective change converge.
+	DDLs, err := l.TrySync(sources[0], db, tbl, DDLs1, ti1, sts)
 	c.Assert(err, IsNil)
-	c.Assert(DDLs, DeepEquals, DDLs7) // special case: these DDLs should not be replicated to the downstream.
-	ready = l.Ready()
-	c.Assert(ready[source][db][tbls[0]], IsFalse)
-	c.Assert(ready[source][db][tbls[1]], IsFalse)
-	cmp, err = l.tables[source][db][tbls[0]].Compare(l.Joined())
+	c.Assert(DDLs, DeepEquals, expected)
+	DDLs, err = l.TrySync(sources[1], db, tbl, DDLs2, ti1, sts)
 	c.Assert(err, IsNil)
-	c.Assert(cmp, Equals, -1)
-	cmp, err = l.tables[source][db][tbls[1]].Compare(l.Joined())
+	c.Assert(DDLs, DeepEquals, DDLs2)
+	DDLs, err = l.TrySync(sources[2], db, tbl, DDLs3, ti1, sts)
 	c.Assert(err, IsNil)
-	c.Assert(cmp, Equals, -1)
+	c.Assert(DDLs, DeepEquals, expected)
+	synced, remain := l.IsSynced()
+	c.Assert(synced, IsTrue)
+	c.Assert(remain, Equals, 0)
+
+	// the guarded DDL does nothing now.
+	DDLs, err = l.TrySync(sources[0], db, tbl, DDLs1, ti1, sts)
+	c.Assert(err, IsNil)
+	c.Assert(DDLs, DeepEquals, []string{})
+	synced, _ = l.IsSynced()
+	c.Assert(synced, IsTrue)
+}
+
+func (t *testLock) TestLockTrySyncColumnDefault(c *C) {
+	var (
+		ID            = "test_lock_try_sync_column_default-`foo`.`bar`"
+		task          = "test_lock_try_sync_column_default"
+		sources       = []string{"mysql-replica-1", "mysql-replica-2"}
+		db            = "foo"
+		tbl           = "bar"
+		p             = parser.New()
+		se            = mock.NewContext()
+		tblID   int64 = 111
+		DDLs1         = []string{"ALTER TABLE bar ALTER COLUMN c1 SET DEFAULT 5"}
+		DDLs2         = []string{"ALTER TABLE bar ALTER COLUMN c1 SET DEFAULT 6"}
+		DDLs3         = []string{"ALTER TABLE bar ALTER COLUMN c1 DROP DEFAULT"}
+		ti0           = createTableInfo(c, p, se, tblID, `CREATE TABLE bar (id INT PRIMARY KEY, c1 INT)`)
+		ti1           = createTableInfo(c, p, se, tblID, `CREATE TABLE bar (id INT PRIMARY KEY, c1 INT DEFAULT 5)`)
+		ti2           = createTableInfo(c, p, se, tblID, `CREATE TABLE bar (id INT PRIMARY KEY, c1 INT DEFAULT 6)`)
+
+		tables = map[string]map[string]struct{}{db: {tbl: struct{}{}}}
+		sts    = []SourceTables{NewSourceTables(task, sources[0], tables), NewSourceTables(task, sources[1], tables)}
+		l      = NewLock(ID, task, ti0, sts)
+	)
+
+	cols, ok := alteredColumnDefaults(parsedDDLs([]string{"ALTER TABLE bar ALTER COLUMN c1 SET DEFAULT 5, ALTER COLUMN C2 DROP DEFAULT"}))
+	c.Assert(ok, IsTrue)
+	c.Assert(cols, DeepEquals, []string{"c1", "c2"})
+	_, ok = alteredColumnDefaults(parsedDDLs([]string{"ALTER TABLE bar ALTER COLUMN c1 SET DEFAULT 5, ADD COLUMN c2 INT"}))
+	c.Assert(ok, IsFalse)
+	_, ok = alteredColumnDefaults(nil)
+	c.Assert(ok, IsFalse)
+
+	// the default value is set by the first table, and used by the downstream directly.
+	DDLs, err := l.TrySync(sources[0], db, tbl, DDLs1, ti1, sts)
+	c.Assert(err, IsNil)
+	c.Assert(DDLs, DeepEquals, DDLs1)
+
+	// a different default value set by another table.
+	DDLs, err = l.TrySync(sources[1], db, tbl, DDLs2, ti2, sts)
+	c.Assert(terror.ErrShardDDLOptimismTrySyncFail.Equal(err), IsTrue)
+	c.Assert(err, ErrorMatches, ".*default value 6 of column c1 conflicts with 5 in table `foo`.`bar` of source mysql-replica-1.*")
+	c.Assert(DDLs, DeepEquals, []string{})
+	c.Assert(l.Conflict(), Equals, ConflictTypeColumnDefault)
+
+	// the same default value set, the conflict resolved.
+	DDLs, err = l.TrySync(sources[1], db, tbl, DDLs1, ti1, sts)
+	c.Assert(err, IsNil)
+	c.Assert(DDLs, DeepEquals, DDLs1)
+	c.Assert(l.Conflict(), Equals, ConflictTypeNone)
+	synced, remain := l.IsSynced()
+	c.Assert(synced, IsTrue)
+	c.Assert(remain, Equals, 0)
 
-	// TrySync for the first table to become synced.
-	DDLs, err = l.TrySync(source, db, tbls[0], DDLs8_1, ti8, sts)
+	// the default value is kept until all tables have dropped it.
+	DDLs, err = l.TrySync(sources[0], db, tbl, DDLs3, ti0, sts)
 	c.Assert(err, IsNil)
-	c.Assert(DDLs, DeepEquals, DDLs8_1)
-	ready = l.Ready()
-	c.Assert(ready[source][db][tbls[0]], IsTrue)
-
-	// TrySync for the second table to become synced.
-	DDLs, err = l.TrySync(source, db, tbls[1], DDLs8_2, ti8, sts)
+	c.Assert(DDLs, DeepEquals, []string{})
+	DDLs, err = l.TrySync(sources[1], db, tbl, DDLs3, ti0, sts)
 	c.Assert(err, IsNil)
-	c.Assert(DDLs, DeepEquals, DDLs8_2)
-	ready = l.Ready()
-	c.Assert(ready[source][db][tbls[1]], IsTrue)
+	c.Assert(DDLs, DeepEquals, DDLs3)
+	synced, _ = l.IsSynced()
+	c.Assert(synced, IsTrue)
 
-	// all tables synced now.
-	t.checkLockSynced(c, l)
-	t.checkLockNoDone(c, l)
+	// no conflict for a table without the default value.
+	DDLs, err = l.TrySync(sources[0], db, tbl, DDLs2, ti2, sts)
+	c.Assert(err, IsNil)
+	c.Assert(DDLs, DeepEquals, DDLs2)
 }
 
-func (t *testLock) TestTryRemoveTable(c *C) {
+func (t *testLock) TestLockTrySyncMaxColumns(c *C) {
 	var (
-		ID           = "test_lock_try_remove_table-`foo`.`bar`"
-		task         = "test_lock_try_remove_table"
-		source       = "mysql-replica-1"
-		db           = "foo"
-		tbl1         = "bar1"
-		tbl2         = "bar2"
-		p            = parser.New()
-		se           = mock.NewContext()
-		tblID  int64 = 111
-		DDLs1        = []string{"ALTER TABLE bar ADD COLUMN c1 INT"}
-		DDLs2        = []string{"ALTER TABLE bar ADD COLUMN c2 INT"}
-		ti0          = createTableInfo(c, p, se, tblID, `CREATE TABLE bar (id INT PRIMARY KEY)`)
-		ti1          = createTableInfo(c, p, se, tblID, `CREATE TABLE bar (id INT PRIMARY KEY, c1 INT)`)
-		ti2          = createTableInfo(c, p, se, tblID, `CREATE TABLE bar (id INT PRIMARY KEY, c1 INT, c2 INT)`)
+		ID            = "test_lock_try_sync_max_columns-`foo`.`bar`"
+		task          = "test_lock_try_sync_max_columns"
+		sources       = []string{"mysql-replica-1", "mysql-replica-2"}
+		db            = "foo"
+		tbl           = "bar"
+		p             = parser.New()
+		se            = mock.NewContext()
+		tblID   int64 = 111
+		DDLs1         = []string{"ALTER TABLE bar ADD COLUMN c1 INT"}
+		DDLs2         = []string{"ALTER TABLE bar ADD COLUMN c2 INT"}
+		ti0           = createTableInfo(c, p, se, tblID, `CREATE TABLE bar (id INT PRIMARY KEY)`)
+		ti1           = createTableInfo(c, p, se, tblID, `CREATE TABLE bar (id INT PRIMARY KEY, c1 INT)`)
+		ti2           = createTableInfo(c, p, se, tblID, `CREATE TABLE bar (id INT PRIMARY KEY, c2 INT)`)
 
-		tables = map[string]map[string]struct{}{db: {tbl1: struct{}{}, tbl2: struct{}{}}}
-		sts    = []SourceTables{NewSourceTables(task, source, tables)}
+		tables = map[string]map[string]struct{}{db: {tbl: struct{}{}}}
+		sts    = []SourceTables{NewSourceTables(task, sources[0], tables), NewSourceTables(task, sources[1], tables)}
 		l      = NewLock(ID, task, ti0, sts)
 	)
 
-	// only one table exists before TrySync.
-	t.checkLockSynced(c, l)
-	t.checkLockNoDone(c, l)
+	c.Assert(l.maxColumns, Equals, DefaultMaxColumns)
+	l.SetMaxColumns(2)
 
-	// CASE: remove a table as normal.
-	// TrySync for the first table.
-	DDLs, err := l.TrySync(source, db, tbl1, DDLs1, ti1, sts)
+	// the joined table info has 2 columns.
+	DDLs, err := l.TrySync(sources[0], db, tbl, DDLs1, ti1, sts)
 	c.Assert(err, IsNil)
 	c.Assert(DDLs, DeepEquals, DDLs1)
-	ready := l.Ready()
-	c.Assert(ready, HasLen, 1)
-	c.Assert(ready[source], HasLen, 1)
-	c.Assert(ready[source][db], HasLen, 2)
-	c.Assert(ready[source][db][tbl1], IsTrue)
-	c.Assert(ready[source][db][tbl2], IsFalse)
 
-	// TryRemoveTable for the second table.
-	c.Assert(l.TryRemoveTable(source, db, tbl2), IsTrue)
-	ready = l.Ready()
-	c.Assert(ready, HasLen, 1)
-	c.Assert(ready[source], HasLen, 1)
-	c.Assert(ready[source][db], HasLen, 1)
-	c.Assert(ready[source][db][tbl1], IsTrue)
+	// the joined table info would have 3 columns.
+	DDLs, ct, err := l.trySync(sources[1], db, tbl, parsedDDLs(DDLs2), ti2, sts, 0)
+	c.Assert(terror.ErrShardDDLOptimismTrySyncFail.Equal(err), IsTrue)
+	c.Assert(err, ErrorMatches, ".*the joined table info has 3 columns, exceeds the limit 2.*")
+	c.Assert(ct, Equals, ConflictTypeTooManyColumns)
+	c.Assert(DDLs, DeepEquals, []string{})
+	c.Assert(l.Conflict(), Equals, ConflictTypeTooManyColumns)
+	c.Assert(l.joinedTI.Columns, HasLen, 2) // the joined table info is not changed.
 
-	// CASE: remove a table will not rebuild joined schema now.
-	// TrySync to add the second back.
-	DDLs, err = l.TrySync(source, db, tbl2, DDLs2, ti2, sts)
+	// raise the limit, then the DDLs can be synced.
+	l.SetMaxColumns(3)
+	DDLs, err = l.TrySync(sources[1], db, tbl, DDLs2, ti2, sts)
 	c.Assert(err, IsNil)
 	c.Assert(DDLs, DeepEquals, DDLs2)
-	ready = l.Ready()
-	c.Assert(ready, HasLen, 1)
-	c.Assert(ready[source], HasLen, 1)
-	c.Assert(ready[source][db], HasLen, 2)
-	c.Assert(ready[source][db][tbl1], IsFalse)
-	c.Assert(ready[source][db][tbl2], IsTrue)
-
-	// TryRemoveTable for the second table.
-	c.Assert(l.TryRemoveTable(source, db, tbl2), IsTrue)
-	ready = l.Ready()
-	c.Assert(ready, HasLen, 1)
-	c.Assert(ready[source], HasLen, 1)
-	c.Assert(ready[source][db], HasLen, 1)
-	c.Assert(ready[source][db][tbl1], IsFalse) // the joined schema is not rebuild.
+	c.Assert(l.Conflict(), Equals, ConflictTypeNone)
 
-	// CASE: try to remove for not-exists table.
-	c.Assert(l.TryRemoveTable(source, db, "not-exist"), IsFalse)
-	c.Assert(l.TryRemoveTable(source, "not-exist", tbl1), IsFalse)
-	c.Assert(l.TryRemoveTable("not-exist", db, tbl1), IsFalse)
+	// reset to the default limit.
+	l.SetMaxColumns(0)
+	c.Assert(l.maxColumns, Equals, DefaultMaxColumns)
 }
 
-func (t *testLock) TestLockTryMarkDone(c *C) {
+func (t *testLock) TestLockTrySyncMissingDefault(c *C) {
 	var (
-		ID           = "test_lock_try_mark_done-`foo`.`bar`"
-		task         = "test_lock_try_mark_done"
-		source       = "mysql-replica-1"
-		db           = "foo"
-		tbls         = []string{"bar1", "bar2"}
-		p            = parser.New()
-		se           = mock.NewContext()
-		tblID  int64 = 111
-		DDLs1        = []string{"ALTER TABLE bar ADD COLUMN c1 INT"}
-		DDLs2        = []string{"ALTER TABLE bar ADD COLUMN c1 INT", "ALTER TABLE bar ADD COLUMN c2 INT"}
-		DDLs3        = []string{"ALTER TABLE bar ADD COLUMN c2 INT"}
-		ti0          = createTableInfo(c, p, se, tblID, `CREATE TABLE bar (id INT PRIMARY KEY)`)
-		ti1          = createTableInfo(c, p, se, tblID, `CREATE TABLE bar (id INT PRIMARY KEY, c1 INT)`)
-		ti2          = createTableInfo(c, p, se, tblID, `CREATE TABLE bar (id INT PRIMARY KEY, c1 INT, c2 INT)`)
-		ti3          = ti2
+		ID            = "test_lock_try_sync_missing_default-`foo`.`bar`"
+		task          = "test_lock_try_sync_missing_default"
+		sources       = []string{"mysql-replica-1", "mysql-replica-2"}
+		db            = "foo"
+		tbl           = "bar"
+		p             = parser.New()
+		se            = mock.NewContext()
+		tblID   int64 = 111
+		ti0           = createTableInfo(c, p, se, tblID, `CREATE TABLE bar (id INT PRIMARY KEY)`)
 
-		tables = map[string]map[string]struct{}{db: {tbls[0]: struct{}{}, tbls[1]: struct{}{}}}
-		sts    = []SourceTables{NewSourceTables(task, source, tables)}
-		l      = NewLock(ID, task, ti0, sts)
+		tables = map[string]map[string]struct{}{db: {tbl: struct{}{}}}
+		sts    = []SourceTables{NewSourceTables(task, sources[0], tables), NewSourceTables(task, sources[1], tables)}
 	)
 
-	// the initial status is synced.
-	t.checkLockSynced(c, l)
-	t.checkLockNoDone(c, l)
+	cases := []struct {
+		col string
+		tp  string
+	}{
+		{"c1 TEXT NOT NULL", "text"},
+		{"c1 BLOB NOT NULL", "blob"},
+		{"c1 JSON NOT NULL", "json"},
+		{"c1 DATETIME NOT NULL", "datetime"},
+		{"c1 DATE NOT NULL", "date"},
+	}
+	for _, cs := range cases {
+		var (
+			l    = NewLock(ID, task, ti0, sts)
+			DDLs = []string{"ALTER TABLE bar ADD COLUMN " + cs.col}
+			ti1  = createTableInfo(c, p, se, tblID, "CREATE TABLE bar (id INT PRIMARY KEY, "+cs.col+")")
+		)
+
+		// add the column to only one source, rows from the other source can't be inserted without a default value.
+		DDLs2, ct, err := l.trySync(sources[0], db, tbl, parsedDDLs(DDLs), ti1, sts, 0)
+		c.Assert(terror.ErrShardDDLOptimismTrySyncFail.Equal(err), IsTrue, Commentf("%s", cs.col))
+		c.Assert(err, ErrorMatches, ".*NOT NULL column c1 of type "+cs.tp+" has no default value but not exists in table `foo`.`bar` of source mysql-replica-2.*")
+		c.Assert(ct, Equals, ConflictTypeMissingDefault)
+		c.Assert(DDLs2, DeepEquals, []string{})
+		c.Assert(l.Conflict(), Equals, ConflictTypeMissingDefault)
+		c.Assert(l.joinedTI.Columns, HasLen, 1) // the joined table info is not changed.
+
+		// the conflict is resolved after the column added to all sources.
+		_, err = l.TrySync(sources[1], db, tbl, DDLs, ti1, sts)
+		c.Assert(err, IsNil)
+		c.Assert(l.Conflict(), Equals, ConflictTypeNone)
+		c.Assert(l.joinedTI.Columns, HasLen, 2)
+	}
 
-	// TrySync for the first table.
-	DDLs, err := l.TrySync(source, db, tbls[0], DDLs1, ti1, sts)
+	// a NOT NULL column with a valid standard default value can still be added to only one source.
+	var (
+		l    = NewLock(ID, task, ti0, sts)
+		DDLs = []string{"ALTER TABLE bar ADD COLUMN c1 INT NOT NULL"}
+		ti1  = createTableInfo(c, p, se, tblID, `CREATE TABLE bar (id INT PRIMARY KEY, c1 INT NOT NULL)`)
+	)
+	DDLs2, err := l.TrySync(sources[0], db, tbl, DDLs, ti1, sts)
 	c.Assert(err, IsNil)
-	c.Assert(DDLs, DeepEquals, DDLs1)
+	c.Assert(DDLs2, DeepEquals, []string{"ALTER TABLE `foo`.`bar` ADD COLUMN `c1` INT(11) NOT NULL DEFAULT '0'"})
+	c.Assert(l.Conflict(), Equals, ConflictTypeNone)
+}
 
-	// mark done for synced table, fail for non-synced table
-	c.Assert(l.TryMarkDone(source, db, tbls[0]), IsTrue)
-	c.Assert(l.TryMarkDone(source, db, tbls[1]), IsFalse)
-	c.Assert(l.IsDone(source, db, tbls[0]), IsTrue)
-	c.Assert(l.IsDone(source, db, tbls[1]), IsFalse)
+func (t *testLock) TestLockTrySyncColumnTypeWidening(c *C) {
+	var (
+		ID            = "test_lock_try_sync_column_type_widening-`foo`.`bar`"
+		task          = "test_lock_try_sync_column_type_widening"
+		sources       = []string{"mysql-replica-1", "mysql-replica-2"}
+		db            = "foo"
+		tbl           = "bar"
+		p             = parser.New()
+		se            = mock.NewContext()
+		tblID   int64 = 111
+		DDLs1         = []string{"ALTER TABLE bar MODIFY COLUMN c1 BIGINT"}
+		DDLs2         = []string{"ALTER TABLE bar ADD COLUMN c2 INT"}
+		DDLs3         = []string{"ALTER TABLE bar MODIFY COLUMN c1 INT"}
+		DDLs4         = []string{"ALTER TABLE bar MODIFY COLUMN c1 VARCHAR(20)"}
+		ti0           = createTableInfo(c, p, se, tblID, `CREATE TABLE bar (id INT PRIMARY KEY, c1 INT)`)
+		ti1           = createTableInfo(c, p, se, tblID, `CREATE TABLE bar (id INT PRIMARY KEY, c1 BIGINT)`)
+		ti2           = createTableInfo(c, p, se, tblID, `CREATE TABLE bar (id INT PRIMARY KEY, c1 INT, c2 INT)`)
+		ti3           = createTableInfo(c, p, se, tblID, `CREATE TABLE bar (id INT PRIMARY KEY, c1 BIGINT, c2 INT)`)
+		ti4           = createTableInfo(c, p, se, tblID, `CREATE TABLE bar (id INT PRIMARY KEY, c1 VARCHAR(20), c2 INT)`)
+
+		tables = map[string]map[string]struct{}{db: {tbl: struct{}{}}}
+		sts    = []SourceTables{NewSourceTables(task, sources[0], tables), NewSourceTables(task, sources[1], tables)}
+		l      = NewLock(ID, task, ti0, sts)
+	)
 
-	// TrySync for the second table, the joined schema become larger.
-	DDLs, err = l.TrySync(source, db, tbls[1], DDLs2, ti2, sts)
+	// widen INT -> BIGINT for the first table, the joined column is widened.
+	DDLs, err := l.TrySync(sources[0], db, tbl, DDLs1, ti1, sts)
+	c.Assert(err, IsNil)
+	c.Assert(DDLs, DeepEquals, DDLs1)
+	c.Assert(l.joinedTI.Columns[1].FieldType.CompactStr(), Equals, "bigint(20)")
+	synced, remain := l.IsSynced()
+	c.Assert(synced, IsFalse)
+	c.Assert(remain, Equals, 1)
+
+	// other DDLs can still be synced for the table not widened yet.
+	DDLs, err = l.TrySync(sources[1], db, tbl, DDLs2, ti2, sts)
+	c.Assert(err, IsNil)
+	c.Assert(DDLs, DeepEquals, DDLs2)
+	c.Assert(l.joinedTI.Columns[1].FieldType.CompactStr(), Equals, "bigint(20)")
+	DDLs, err = l.TrySync(sources[0], db, tbl, DDLs2, ti3, sts)
 	c.Assert(err, IsNil)
 	c.Assert(DDLs, DeepEquals, DDLs2)
+	synced, remain = l.IsSynced()
+	c.Assert(synced, IsFalse)
+	c.Assert(remain, Equals, 1)
 
-	// both of tables should become not-done now.
-	c.Assert(l.IsDone(source, db, tbls[0]), IsFalse)
-	c.Assert(l.IsDone(source, db, tbls[1]), IsFalse)
+	// widen INT -> BIGINT for the second table, converged.
+	DDLs, err = l.TrySync(sources[1], db, tbl, DDLs1, ti3, sts)
+	c.Assert(err, IsNil)
+	c.Assert(DDLs, DeepEquals, DDLs1)
+	synced, remain = l.IsSynced()
+	c.Assert(synced, IsTrue)
+	c.Assert(remain, Equals, 0)
+	c.Assert(l.Conflict(), Equals, ConflictTypeNone)
 
-	// mark done for synced table, fail for non-synced table
-	c.Assert(l.TryMarkDone(source, db, tbls[0]), IsFalse)
-	c.Assert(l.TryMarkDone(source, db, tbls[1]), IsTrue)
-	c.Assert(l.IsDone(source, db, tbls[0]), IsFalse)
-	c.Assert(l.IsDone(source, db, tbls[1]), IsTrue)
+	// narrow BIGINT -> INT, conflict.
+	DDLs, ct, err := l.trySync(sources[0], db, tbl, parsedDDLs(DDLs3), ti2, sts, 0)
+	c.Assert(terror.ErrShardDDLOptimismTrySyncFail.Equal(err), IsTrue)
+	c.Assert(err, ErrorMatches, ".*type of column c1 is narrowed from bigint\\(20\\) to int\\(11\\).*")
+	c.Assert(ct, Equals, ConflictTypeColumnType)
+	c.Assert(DDLs, DeepEquals, []string{})
+	c.Assert(l.Conflict(), Equals, ConflictTypeColumnType)
 
-	// TrySync for the first table, all tables become synced.
-	DDLs, err = l.TrySync(source, db, tbls[0], DDLs3, ti3, sts)
+	// widen back, the conflict is resolved.
+	DDLs, err = l.TrySync(sources[0], db, tbl, DDLs1, ti3, sts)
 	c.Assert(err, IsNil)
-	c.Assert(DDLs, DeepEquals, DDLs3)
+	c.Assert(DDLs, DeepEquals, DDLs1)
+	c.Assert(l.Conflict(), Equals, ConflictTypeNone)
 
-	// the lock is still not resolved.
-	c.Assert(l.IsResolved(), IsFalse)
+	// incompatible types, conflict.
+	_, ct, err = l.trySync(sources[0], db, tbl, parsedDDLs(DDLs4), ti4, sts, 0)
+	c.Assert(terror.ErrShardDDLOptimismTrySyncFail.Equal(err), IsTrue)
+	c.Assert(ct, Equals, ConflictTypeColumnType)
+}
 
-	// mark done for the first table.
-	c.Assert(l.TryMarkDone(source, db, tbls[0]), IsTrue)
-	c.Assert(l.IsDone(source, db, tbls[0]), IsTrue)
+func (t *testLock) TestLockTrySyncForeignKey(c *C) {
+	var (
+		ID            = "test_lock_try_sync_foreign_key-`foo`.`bar`"
+		task          = "test_lock_try_sync_foreign_key"
+		sources       = []string{"mysql-replica-1", "mysql-replica-2"}
+		db            = "foo"
+		tbl           = "bar"
+		p             = parser.New()
+		se            = mock.NewContext()
+		tblID   int64 = 111
+		DDLs1         = []string{"ALTER TABLE bar ADD CONSTRAINT fk_c1 FOREIGN KEY (c1) REFERENCES t (id)"}
+		DDLs2         = []string{"ALTER TABLE bar DROP FOREIGN KEY fk_c1"}
+		DDLs3         = []string{"ALTER TABLE bar ADD COLUMN c2 INT", "ALTER TABLE bar ADD COLUMN c3 INT REFERENCES t (id)"}
+		ti0           = createTableInfo(c, p, se, tblID, `CREATE TABLE bar (id INT PRIMARY KEY, c1 INT)`)
+		ti1           = createTableInfo(c, p, se, tblID, `CREATE TABLE bar (id INT PRIMARY KEY, c1 INT, c2 INT, c3 INT)`)
+
+		tables = map[string]map[string]struct{}{db: {tbl: struct{}{}}}
+		sts    = []SourceTables{NewSourceTables(task, sources[0], tables), NewSourceTables(task, sources[1], tables)}
+		l      = NewLock(ID, task, ti0, sts)
+	)
 
-	// the lock become resolved now.
-	c.Assert(l.IsResolved(), IsTrue)
+	c.Assert(foreignKeyDDL(parsedDDLs(DDLs1)), Equals, DDLs1[0])
+	c.Assert(foreignKeyDDL(parsedDDLs(DDLs2)), Equals, DDLs2[0])
+	c.Assert(foreignKeyDDL(parsedDDLs(DDLs3)), Equals, DDLs3[1])
+	c.Assert(foreignKeyDDL(parsedDDLs([]string{"ALTER TABLE bar ADD INDEX idx_c1 (c1)"})), Equals, "")
 
-	// TryMarkDone for not-existing table take no effect.
-	c.Assert(l.TryMarkDone(source, db, "not-exist"), IsFalse)
-	c.Assert(l.TryMarkDone(source, "not-exist", tbls[0]), IsFalse)
-	c.Assert(l.TryMarkDone("not-exist", db, tbls[0]), IsFalse)
+	// ADD FOREIGN KEY is rejected.
+	DDLs, err := l.TrySync(sources[0], db, tbl, DDLs1, ti0, sts)
+	c.Assert(terror.ErrShardDDLOptimismForeignKeyNotSupported.Equal(err), IsTrue)
+	c.Assert(DDLs, DeepEquals, []string{})
 
-	// check IsDone for not-existing table take no effect.
-	c.Assert(l.IsDone(source, db, "not-exist"), IsFalse)
-	c.Assert(l.IsDone(source, "not-exist", tbls[0]), IsFalse)
-	c.Assert(l.IsDone("not-exist", db, tbls[0]), IsFalse)
-}
+	// DROP FOREIGN KEY is rejected.
+	DDLs, err = l.TrySync(sources[1], db, tbl, DDLs2, ti0, sts)
+	c.Assert(terror.ErrShardDDLOptimismForeignKeyNotSupported.Equal(err), IsTrue)
+	c.Assert(DDLs, DeepEquals, []string{})
 
-func (t *testLock) trySyncForAllTablesLarger(c *C, l *Lock,
-	DDLs []string, ti *model.TableInfo, sts []SourceTables) {
-	for source, schemaTables := range l.Ready() {
-		for schema, tables := range schemaTables {
-			for table := range tables {
-				DDLs2, err := l.TrySync(source, schema, table, DDLs, ti, sts)
-				c.Assert(err, IsNil)
-				c.Assert(DDLs2, DeepEquals, DDLs)
-			}
-		}
-	}
+	// the whole batch is rejected if any DDL references a foreign table.
+	DDLs, err = l.TrySync(sources[0], db, tbl, DDLs3, ti1, sts)
+	c.Assert(terror.ErrShardDDLOptimismForeignKeyNotSupported.Equal(err), IsTrue)
+	c.Assert(DDLs, DeepEquals, []string{})
+
+	// the lock is not changed.
+	c.Assert(l.joinedTI.Columns, HasLen, 2)
+	c.Assert(l.Conflict(), Equals, ConflictTypeNone)
+	c.Assert(l.versions[sources[0]][db][tbl], Equals, 0)
+	c.Assert(l.versions[sources[1]][db][tbl], Equals, 0)
 }
 
-func (t *testLock) checkLockSynced(c *C, l *Lock) {
+func (t *testLock) TestLockTrySyncColumnCharset(c *C) {
+	var (
+		ID            = "test_lock_try_sync_column_charset-`foo`.`bar`"
+		task          = "test_lock_try_sync_column_charset"
+		sources       = []string{"mysql-replica-1", "mysql-replica-2"}
+		db            = "foo"
+		tbl           = "bar"
+		p             = parser.New()
+		se            = mock.NewContext()
+		tblID   int64 = 111
+		DDLs1         = []string{"ALTER TABLE bar MODIFY COLUMN c1 VARCHAR(10) CHARACTER SET utf8mb4"}
+		DDLs2         = []string{"ALTER TABLE bar MODIFY COLUMN c1 VARCHAR(10) CHARACTER SET utf8mb4 COLLATE utf8mb4_general_ci"}
+		DDLs3         = []string{"ALTER TABLE bar MODIFY COLUMN c1 VARCHAR(10) CHARACTER SET utf8"}
+		ti0           = createTableInfo(c, p, se, tblID, `CREATE TABLE bar (id INT PRIMARY KEY, c1 VARCHAR(10) CHARACTER SET latin1)`)
+		ti1           = createTableInfo(c, p, se, tblID, `CREATE TABLE bar (id INT PRIMARY KEY, c1 VARCHAR(10) CHARACTER SET utf8mb4)`)
+		ti2           = createTableInfo(c, p, se, tblID, `CREATE TABLE bar (id INT PRIMARY KEY, c1 VARCHAR(10) CHARACTER SET utf8mb4 COLLATE utf8mb4_general_ci)`)
+		ti3           = createTableInfo(c, p, se, tblID, `CREATE TABLE bar (id INT PRIMARY KEY, c1 VARCHAR(10) CHARACTER SET utf8)`)
+
+		tables = map[string]map[string]struct{}{db: {tbl: struct{}{}}}
+		sts    = []SourceTables{NewSourceTables(task, sources[0], tables), NewSourceTables(task, sources[1], tables)}
+		l      = NewLock(ID, task, ti0, sts)
+	)
+
+	// the charset is changed by the first table, it conflicts with other tables until they changed it too.
+	DDLs, err := l.TrySync(sources[0], db, tbl, DDLs1, ti1, sts)
+	c.Assert(terror.ErrShardDDLOptimismTrySyncFail.Equal(err), IsTrue)
+	c.Assert(err, ErrorMatches, ".*charset utf8mb4 of column c1 conflicts with latin1 in table `foo`.`bar` of source mysql-replica-2.*")
+	c.Assert(DDLs, DeepEquals, []string{})
+	c.Assert(l.Conflict(), Equals, ConflictTypeColumnCharset)
+
+	// the same charset, converged.
+	DDLs, err = l.TrySync(sources[1], db, tbl, DDLs1, ti1, sts)
+	c.Assert(err, IsNil)
+	c.Assert(DDLs, DeepEquals, DDLs1)
+	c.Assert(l.Conflict(), Equals, ConflictTypeNone)
 	synced, remain := l.IsSynced()
 	c.Assert(synced, IsTrue)
 	c.Assert(remain, Equals, 0)
 
-	ready := l.Ready()
-	for _, schemaTables := range ready {
-		for _, tables := range schemaTables {
-			for _, synced := range tables {
-				c.Assert(synced, IsTrue)
-			}
-		}
-	}
+	// a different collation.
+	DDLs, err = l.TrySync(sources[0], db, tbl, DDLs2, ti2, sts)
+	c.Assert(terror.ErrShardDDLOptimismTrySyncFail.Equal(err), IsTrue)
+	c.Assert(err, ErrorMatches, ".*collation utf8mb4_general_ci of column c1 conflicts with utf8mb4_bin in table `foo`.`bar` of source mysql-replica-2.*")
+	c.Assert(DDLs, DeepEquals, []string{})
+	c.Assert(l.Conflict(), Equals, ConflictTypeColumnCharset)
+
+	// another table changes to a different charset, still conflicted.
+	DDLs, err = l.TrySync(sources[1], db, tbl, DDLs3, ti3, sts)
+	c.Assert(terror.ErrShardDDLOptimismTrySyncFail.Equal(err), IsTrue)
+	c.Assert(err, ErrorMatches, ".*charset utf8 of column c1 conflicts with utf8mb4 in table `foo`.`bar` of source mysql-replica-1.*")
+	c.Assert(DDLs, DeepEquals, []string{})
+	c.Assert(l.Conflict(), Equals, ConflictTypeColumnCharset)
 }
 
-func (t *testLock) checkLockNoDone(c *C, l *Lock) {
-	c.Assert(l.IsResolved(), IsFalse)
-	for source, schemaTables := range l.Ready() {
-		for schema, tables := range schemaTables {
-			for table := range tables {
-				c.Assert(l.IsDone(source, schema, table), IsFalse)
-			}
+func (t *testLock) TestLockTrySyncEquivalentDDLs(c *C) {
+	var (
+		ID            = "test_lock_try_sync_equivalent_ddls-`foo`.`bar`"
+		task          = "test_lock_try_sync_equivalent_ddls"
+		sources       = []string{"mysql-replica-1", "mysql-replica-2", "mysql-replica-3"}
+		db            = "foo"
+		tbl           = "bar"
+		p             = parser.New()
+		se            = mock.NewContext()
+		tblID   int64 = 111
+		DDLs1         = []string{"ALTER TABLE bar ADD COLUMN c1 INT"}
+		DDLs2         = []string{"alter table bar add c1 int"}
+		DDLs3         = []string{"ALTER TABLE `bar` ADD COLUMN (`c1` INT)"}
+		ti0           = createTableInfo(c, p, se, tblID, `CREATE TABLE bar (id INT PRIMARY KEY)`)
+		ti1           = createTableInfo(c, p, se, tblID, `CREATE TABLE bar (id INT PRIMARY KEY, c1 INT)`)
+
+		tables = map[string]map[string]struct{}{db: {tbl: struct{}{}}}
+		sts    = []SourceTables{
+			NewSourceTables(task, sources[0], tables),
+			NewSourceTables(task, sources[1], tables),
+			NewSourceTables(task, sources[2], tables),
 		}
+		l = NewLock(ID, task, ti0, sts)
+	)
+
+	// canonical forms.
+	c.Assert(canonicalDDL(parsedDDL1(DDLs1[0])), Equals, "ALTER TABLE `bar` ADD COLUMN `c1` INT")
+	c.Assert(canonicalDDL(parsedDDL1(DDLs2[0])), Equals, canonicalDDL(parsedDDL1(DDLs1[0])))
+	c.Assert(canonicalDDL(parsedDDL1("ALTER TABLE bar DROP c1")), Equals, "ALTER TABLE `bar` DROP COLUMN `c1`")
+	c.Assert(canonicalDDL(parsedDDL1("ALTER TABLE bar ADD KEY idx(c1)")), Equals, canonicalDDL(parsedDDL1("ALTER TABLE bar ADD INDEX idx(c1)")))
+	c.Assert(canonicalDDL(parsedDDL1("invalid DDL")), Equals, "invalid DDL")
+	c.Assert(equivalentDDL(parsedDDL1(DDLs1[0]), parsedDDL1(DDLs2[0])), IsTrue)
+	c.Assert(equivalentDDL(parsedDDL1("invalid DDL"), parsedDDL1("invalid DDL")), IsTrue)
+	c.Assert(equivalentDDL(parsedDDL1(DDLs1[0]), parsedDDL1("ALTER TABLE bar ADD COLUMN c1 BIGINT")), IsFalse)
+	c.Assert(equivalentDDL(parsedDDL1(DDLs1[0]), parsedDDL1("ALTER TABLE bar ADD COLUMN c2 INT")), IsFalse)
+
+	// differently-written DDLs from different sources do not conflict.
+	DDLs, err := l.TrySync(sources[0], db, tbl, DDLs1, ti1, sts)
+	c.Assert(err, IsNil)
+	c.Assert(DDLs, DeepEquals, DDLs1)
+	DDLs, err = l.TrySync(sources[1], db, tbl, DDLs2, ti1, sts)
+	c.Assert(err, IsNil)
+	c.Assert(DDLs, DeepEquals, DDLs2)
+	c.Assert(l.Conflict(), Equals, ConflictTypeNone)
+	DDLs, err = l.TrySync(sources[2], db, tbl, DDLs3, ti1, sts)
+	c.Assert(err, IsNil)
+	c.Assert(DDLs, DeepEquals, DDLs3)
+	c.Assert(l.Conflict(), Equals, ConflictTypeNone)
+	synced, remain := l.IsSynced()
+	c.Assert(synced, IsTrue)
+	c.Assert(remain, Equals, 0)
+
+	// canonical forms are stored when infos tracked, and equivalent pending DDLs are returned only once.
+	for i, ddls := range [][]string{DDLs1, DDLs2} {
+		l.trackInfo(NewInfo(task, sources[i], db, tbl, "foo", "bar", ddls, ti0, ti1), canonicalDDLs(parsedDDLs(ddls)))
+		c.Assert(l.canonicals[sources[i]][db][tbl], DeepEquals, []string{canonicalDDL(parsedDDL1(DDLs1[0]))})
 	}
+	c.Assert(l.PendingDDLs(), DeepEquals, DDLs1)
+	c.Assert(l.RemoveSource(sources[0]), IsNil)
+	c.Assert(l.canonicals, Not(HasKey), sources[0])
+	c.Assert(l.PendingDDLs(), DeepEquals, DDLs2)
 }
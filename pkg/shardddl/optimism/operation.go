@@ -16,6 +16,7 @@ package optimism
 import (
 	"context"
 	"encoding/json"
+	"sort"
 
 	"go.etcd.io/etcd/clientv3"
 	"go.etcd.io/etcd/clientv3/clientv3util"
@@ -41,6 +42,13 @@ const (
 	ConflictResolved ConflictStage = "resolved"
 )
 
+// CurrentOperationVersion is the version of the JSON represent of Operation written now.
+// versions:
+//   - 0: Operation written before the version introduced, without the `version` field.
+//   - 1: add the `version` field.
+// NOTE: increase the version and handle the old versions in `upgrade` when changing the JSON represent of Operation.
+const CurrentOperationVersion = 1
+
 // Operation represents a shard DDL coordinate operation.
 // This information should be persistent in etcd so can be retrieved after the DM-master leader restarted or changed.
 // NOTE: `Task`, `Source`, `UpSchema` and `UpTable` are redundant in the etcd key path for convenient.
@@ -57,6 +65,14 @@ type Operation struct {
 	DDLs          []string      `json:"ddls"`           // DDL statements need to apply to the downstream.
 	ConflictStage ConflictStage `json:"conflict-stage"` // current conflict stage.
 	Done          bool          `json:"done"`           // whether the operation has done
+
+	// the retry information when failed to apply the DDLs to the downstream, updated by `WithRetry`.
+	// they are omitted if empty, so operations without retry have the same JSON represent as before.
+	RetryCount int    `json:"retry-count,omitempty"` // how many times the DDLs have been retried
+	LastError  string `json:"last-error,omitempty"`  // the error of the last failed attempt
+
+	// the version of the JSON represent, see `CurrentOperationVersion`.
+	Version int `json:"version"`
 }
 
 // NewOperation creates a new Operation instance.
@@ -71,7 +87,20 @@ func NewOperation(ID, task, source, upSchema, upTable string,
 		DDLs:          DDLs,
 		ConflictStage: conflictStage,
 		Done:          done,
+		Version:       CurrentOperationVersion,
+	}
+}
+
+// WithRetry returns a copy of the operation with the retry count increased and `err` recorded as the last error.
+// this is often used by DM-worker after failed to apply the DDLs to the downstream and before retrying them.
+// NOTE: use `NewOperation(...).WithRetry(err)` to create an operation with retry information.
+// the retry information is not compared when checking whether the operation has been done in `PutOperation`.
+func (o Operation) WithRetry(err error) Operation {
+	o.RetryCount++
+	if err != nil {
+		o.LastError = err.Error()
 	}
+	return o
 }
 
 // String implements Stringer interface.
@@ -81,7 +110,11 @@ func (o Operation) String() string {
 }
 
 // toJSON returns the string of JSON represent.
+// the current version is used if the version is not set.
 func (o Operation) toJSON() (string, error) {
+	if o.Version == 0 {
+		o.Version = CurrentOperationVersion
+	}
 	data, err := json.Marshal(o)
 	if err != nil {
 		return "", err
@@ -90,69 +123,357 @@ func (o Operation) toJSON() (string, error) {
 }
 
 // operationFromJSON constructs Operation from its JSON represent.
+// Operation written with an older version is upgraded to the current version.
 func operationFromJSON(s string) (o Operation, err error) {
-	err = json.Unmarshal([]byte(s), &o)
+	if err = json.Unmarshal([]byte(s), &o); err == nil {
+		o.upgrade()
+	}
+	return
+}
+
+// encode returns the represent of Operation put into etcd, encoded by the codec set by `SetCodec`.
+// NOTE: values in etcd are decoded before compared by `PutOperation`, so they may be encoded by another codec.
+func (o Operation) encode() (string, error) {
+	if valueCodec != CodecGob {
+		return o.toJSON()
+	}
+	if o.Version == 0 {
+		o.Version = CurrentOperationVersion
+	}
+	return encodeGob(o)
+}
+
+// operationFromValue constructs Operation from its represent in etcd, which may be encoded by any codec.
+func operationFromValue(s string) (o Operation, err error) {
+	if !isGobValue(s) {
+		return operationFromJSON(s)
+	}
+	if err = decodeGob(s, &o); err == nil {
+		o.upgrade()
+		if o.DDLs == nil {
+			o.DDLs = []string{} // gob doesn't keep empty slices.
+		}
+	}
 	return
 }
 
+// upgrade upgrades Operation decoded from an older version to the current version,
+// fields missing in the older version are defaulted. it returns whether upgraded.
+// NOTE: Operation with a newer version (written by a newer DM-master) is kept as is.
+func (o *Operation) upgrade() bool {
+	if o.Version >= CurrentOperationVersion {
+		return false
+	}
+	// 0 -> 1: `retry-count` and `last-error` missing means never retried, which are also the zero values.
+	if o.ConflictStage == "" {
+		o.ConflictStage = ConflictNone
+	}
+	if o.DDLs == nil {
+		o.DDLs = []string{}
+	}
+	o.Version = CurrentOperationVersion
+	return true
+}
+
 // PutOperation puts the shard DDL operation into etcd.
-func PutOperation(cli *clientv3.Client, skipDone bool, op Operation) (rev int64, putted bool, err error) {
-	value, err := op.toJSON()
+// if `skipDone` is true, the operation is not putted if the existing one in etcd is the same but with `done` set to `true`,
+// see `isDoneValue` for how they are compared.
+// it returns the revision of the etcd response, whether the operation has been putted,
+// and the mod revision of the operation key after the write (the existing one if not putted),
+// the mod revision can be used to correlate with the watched events for the operation.
+func PutOperation(cli etcdutil.KVClient, skipDone bool, op Operation) (rev int64, putted bool, modRev int64, err error) {
+	value, err := op.encode()
 	if err != nil {
-		return 0, false, err
+		return 0, false, 0, err
 	}
-	key := common.ShardDDLOptimismOperationKeyAdapter.Encode(op.Task, op.Source, op.UpSchema, op.UpTable)
+	key := operationKey(op.Task, op.Source, op.UpSchema, op.UpTable)
 	opPut := clientv3.OpPut(key, value)
 
-	cmpsNotExist := make([]clientv3.Cmp, 0, 1)
-	cmpsNotDone := make([]clientv3.Cmp, 0, 1)
-	if skipDone {
-		opDone := op
-		opDone.Done = true // set `done` to `true`.
-		valueDone, err2 := opDone.toJSON()
-		if err2 != nil {
-			return 0, false, err2
+	ctx, cancel := context.WithTimeout(cli.Ctx(), etcdutil.DefaultRequestTimeout)
+	defer cancel()
+
+	if !skipDone {
+		resp, err := cli.Txn(ctx).Then(opPut).Commit()
+		if err != nil {
+			return 0, false, 0, err
 		}
-		cmpsNotExist = append(cmpsNotExist, clientv3util.KeyMissing(key))
-		cmpsNotDone = append(cmpsNotDone, clientv3.Compare(clientv3.Value(key), "!=", valueDone))
+		return resp.Header.Revision, true, resp.Header.Revision, nil
+	}
+
+	for {
+		// txn 1: try to PUT if the key "not exist", or GET the existing one.
+		resp, err := cli.Txn(ctx).If(clientv3util.KeyMissing(key)).Then(opPut).Else(clientv3.OpGet(key)).Commit()
+		if err != nil {
+			return 0, false, 0, err
+		} else if resp.Succeeded {
+			return resp.Header.Revision, true, resp.Header.Revision, nil
+		}
+		kvs := resp.Responses[0].GetResponseRange().Kvs
+		if len(kvs) == 0 {
+			continue // deleted after the comparison, try again.
+		}
+		done, err := isDoneValue(kvs[0], op)
+		if err != nil {
+			return 0, false, 0, err
+		} else if done {
+			return resp.Header.Revision, false, kvs[0].ModRevision, nil
+		}
+
+		// txn 2: try to PUT if the key has not been changed since read.
+		resp, err = cli.Txn(ctx).If(clientv3.Compare(clientv3.ModRevision(key), "=", kvs[0].ModRevision)).Then(opPut).Commit()
+		if err != nil {
+			return 0, false, 0, err
+		} else if resp.Succeeded {
+			return resp.Header.Revision, true, resp.Header.Revision, nil
+		}
+		// the operation has been changed since read, try again.
+	}
+}
+
+// isDoneValue returns whether the operation in the etcd kv is the same as `op` but with `done` set to `true`.
+// the value is decoded and only the fields describing the operation are compared,
+// so the version, the retry information and the codec of the value don't matter.
+func isDoneValue(kv *mvccpb.KeyValue, op Operation) (bool, error) {
+	existing, err := operationFromValue(string(kv.Value))
+	if err != nil {
+		return false, err
+	}
+	return existing.Done &&
+		existing.ID == op.ID &&
+		existing.Task == op.Task &&
+		existing.Source == op.Source &&
+		existing.UpSchema == op.UpSchema &&
+		existing.UpTable == op.UpTable &&
+		existing.ConflictStage == op.ConflictStage &&
+		sameDDLs(existing.DDLs, op.DDLs), nil
+}
+
+// sameDDLs returns whether two DDL lists are the same in order, nil and empty lists are the same.
+func sameDDLs(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// maxOpsPerTxn is the max number of operations in one etcd transaction, the same as the default `--max-txn-ops` of etcd.
+const maxOpsPerTxn = 128
+
+// PutOperations puts multiple shard DDL operations into etcd, e.g. when resolving a lock for multiple sources at once.
+// operations are written in chunks of at most `maxOpsPerTxn` operations, and each chunk is written in one transaction,
+// so all operations are written atomically if there are not too many of them.
+// `skipDone` is honored for each operation as in `PutOperation`, i.e. if `skipDone` is true, an operation is not putted
+// if the existing one in etcd is the same but with `done` set to `true`; other operations in the chunk are still putted.
+// it returns the revision of etcd after the last transaction.
+// This function should often be called by DM-master.
+func PutOperations(cli etcdutil.KVClient, skipDone bool, ops []Operation) (int64, error) {
+	if len(ops) == 0 {
+		_, rev, err := etcdutil.DoOpsInOneTxnWithRetry(cli)
+		return rev, err
+	}
+
+	var rev int64
+	for start := 0; start < len(ops); start += maxOpsPerTxn {
+		end := start + maxOpsPerTxn
+		if end > len(ops) {
+			end = len(ops)
+		}
+		var err error
+		if rev, err = putOperationsChunk(cli, skipDone, ops[start:end]); err != nil {
+			return 0, err
+		}
+	}
+	return rev, nil
+}
+
+// putOperationsChunk puts a chunk of shard DDL operations in one transaction, see `PutOperations`.
+// if `skipDone` is true, operations in etcd are read first to decide which ones to skip,
+// then the transaction is committed only if these operations have not been changed since read, or retried otherwise.
+func putOperationsChunk(cli etcdutil.KVClient, skipDone bool, ops []Operation) (int64, error) {
+	keys := make([]string, 0, len(ops))
+	values := make([]string, 0, len(ops))
+	for _, op := range ops {
+		value, err := op.encode()
+		if err != nil {
+			return 0, err
+		}
+		keys = append(keys, operationKey(op.Task, op.Source, op.UpSchema, op.UpTable))
+		values = append(values, value)
+	}
+
+	if !skipDone {
+		opsPut := make([]clientv3.Op, 0, len(ops))
+		for i := range keys {
+			opsPut = append(opsPut, clientv3.OpPut(keys[i], values[i]))
+		}
+		_, rev, err := etcdutil.DoOpsInOneTxnWithRetry(cli, opsPut...)
+		return rev, err
 	}
 
 	ctx, cancel := context.WithTimeout(cli.Ctx(), etcdutil.DefaultRequestTimeout)
 	defer cancel()
 
-	// txn 1: try to PUT if the key "not exist".
-	resp, err := cli.Txn(ctx).If(cmpsNotExist...).Then(opPut).Commit()
-	if err != nil {
-		return 0, false, err
-	} else if resp.Succeeded {
-		return resp.Header.Revision, resp.Succeeded, nil
+	opsGet := make([]clientv3.Op, 0, len(keys))
+	for _, key := range keys {
+		opsGet = append(opsGet, clientv3.OpGet(key))
 	}
+	for {
+		resp, err := cli.Txn(ctx).Then(opsGet...).Commit()
+		if err != nil {
+			return 0, err
+		}
 
-	// txn 2: try to PUT if the key "the `done`" field is not `true`.
-	resp, err = cli.Txn(ctx).If(cmpsNotDone...).Then(opPut).Commit()
+		cmps := make([]clientv3.Cmp, 0, len(keys))
+		opsPut := make([]clientv3.Op, 0, len(keys))
+		for i, key := range keys {
+			kvs := resp.Responses[i].GetResponseRange().Kvs
+			if len(kvs) == 0 {
+				cmps = append(cmps, clientv3util.KeyMissing(key))
+			} else {
+				cmps = append(cmps, clientv3.Compare(clientv3.ModRevision(key), "=", kvs[0].ModRevision))
+				done, err := isDoneValue(kvs[0], ops[i])
+				if err != nil {
+					return 0, err
+				} else if done {
+					continue // the operation has been done.
+				}
+			}
+			opsPut = append(opsPut, clientv3.OpPut(key, values[i]))
+		}
+
+		resp, err = cli.Txn(ctx).If(cmps...).Then(opsPut...).Commit()
+		if err != nil {
+			return 0, err
+		} else if resp.Succeeded {
+			return resp.Header.Revision, nil
+		}
+		// some operations have been changed since read, try again.
+	}
+}
+
+// GetOperationRev gets the mod revision of the shard DDL operation in etcd.
+// it returns the mod revision and whether the operation exists.
+// This function should often be called by DM-master to wait for the operation appearing in its watch stream.
+func GetOperationRev(cli etcdutil.KVClient, op Operation) (int64, bool, error) {
+	key := operationKey(op.Task, op.Source, op.UpSchema, op.UpTable)
+	respTxn, _, err := etcdutil.DoOpsInOneTxnWithRetry(cli, clientv3.OpGet(key))
 	if err != nil {
 		return 0, false, err
 	}
-	return resp.Header.Revision, resp.Succeeded, nil
+	resp := respTxn.Responses[0].GetResponseRange()
+	if resp.Count == 0 {
+		return 0, false, nil
+	}
+	return resp.Kvs[0].ModRevision, true, nil
+}
+
+// OperationExists checks whether the shard DDL operation of the upstream table exists in etcd,
+// only the count of the key is requested, so the value is not transferred and decoded.
+// it returns whether the operation exists and the revision of etcd.
+func OperationExists(cli etcdutil.KVClient, task, source, upSchema, upTable string) (bool, int64, error) {
+	return keyExists(cli, operationKey(task, source, upSchema, upTable))
 }
 
 // GetAllOperations gets all shard DDL operation in etcd currently.
 // This function should often be called by DM-master.
 // k/k/k/k/v: task-name -> source-ID -> upstream-schema-name -> upstream-table-name -> shard DDL operation.
-func GetAllOperations(cli *clientv3.Client) (map[string]map[string]map[string]map[string]Operation, int64, error) {
-	respTxn, _, err := etcdutil.DoOpsInOneTxnWithRetry(cli, clientv3.OpGet(common.ShardDDLOptimismOperationKeyAdapter.Path(), clientv3.WithPrefix()))
+func GetAllOperations(cli etcdutil.KVClient) (map[string]map[string]map[string]map[string]Operation, int64, error) {
+	return GetAllOperationsCtx(cli.Ctx(), cli)
+}
+
+// GetAllOperationsCtx is the same as `GetAllOperations` but honors the deadline/cancellation of `ctx`.
+func GetAllOperationsCtx(ctx context.Context, cli etcdutil.KVClient) (map[string]map[string]map[string]map[string]Operation, int64, error) {
+	respTxn, _, err := etcdutil.DoOpsInOneTxnWithRetryCtx(ctx, cli, clientv3.OpGet(common.ShardDDLOptimismOperationKeyAdapter.Path(), clientv3.WithPrefix()))
 	if err != nil {
 		return nil, 0, err
 	}
 	resp := respTxn.Responses[0].GetResponseRange()
 
-	opm := make(map[string]map[string]map[string]map[string]Operation)
+	opm, err := operationsFromKVs(resp.Kvs)
+	if err != nil {
+		return nil, 0, err
+	}
+	return opm, resp.Header.Revision, nil
+}
+
+// GetOperationsForLock gets shard DDL operations belonging to the lock in etcd currently, sorted by their keys.
+// only operations of the task derived from the lock ID are read, then filtered by the lock ID in each operation,
+// so it's cheaper than `GetAllOperations` when cleaning up a single lock.
+// `ErrShardDDLOptimismInvalidLockID` is returned if the lock ID is not generated for the optimistic shard DDL lock.
+func GetOperationsForLock(cli etcdutil.KVClient, lockID string) ([]Operation, int64, error) {
+	task, err := taskFromLockID(lockID)
+	if err != nil {
+		return nil, 0, err
+	}
+	// end the prefix with `/`, otherwise operations of tasks whose (hex encoded) name has the same prefix are also read.
+	respTxn, _, err := etcdutil.DoOpsInOneTxnWithRetry(cli, clientv3.OpGet(operationKey(task, "", "", "")+"/", clientv3.WithPrefix()))
+	if err != nil {
+		return nil, 0, err
+	}
+	resp := respTxn.Responses[0].GetResponseRange()
+
+	ops := make([]Operation, 0, len(resp.Kvs))
+	for _, kv := range resp.Kvs {
+		op, err := operationFromValue(string(kv.Value))
+		if err != nil {
+			return nil, 0, err
+		}
+		if op.ID == lockID {
+			ops = append(ops, op)
+		}
+	}
+	return ops, resp.Header.Revision, nil
+}
+
+// DiscardedOperation represents a shard DDL operation in etcd discarded by `GetAllOperationsDedup`.
+type DiscardedOperation struct {
+	Key         string    // the key in etcd
+	ModRevision int64     // the mod revision of the key
+	Op          Operation // the discarded operation
+}
+
+// GetAllOperationsDedup is the same as `GetAllOperations`, but if multiple operations are for the same upstream table
+// (e.g. put with different keys because of a past key-encoding bug), only the one with the highest mod revision is kept.
+// other ones are returned as `DiscardedOperation`s sorted by keys, so that they can be cleaned up from etcd later.
+// This function should often be called by DM-master.
+func GetAllOperationsDedup(cli etcdutil.KVClient) (map[string]map[string]map[string]map[string]Operation, []DiscardedOperation, int64, error) {
+	respTxn, _, err := etcdutil.DoOpsInOneTxnWithRetry(cli, clientv3.OpGet(common.ShardDDLOptimismOperationKeyAdapter.Path(), clientv3.WithPrefix()))
+	if err != nil {
+		return nil, nil, 0, err
+	}
+	resp := respTxn.Responses[0].GetResponseRange()
+
+	var (
+		kept      = make(map[string]DiscardedOperation) // the key for the upstream table -> the kept operation.
+		discarded []DiscardedOperation
+	)
 	for _, kv := range resp.Kvs {
-		op, err2 := operationFromJSON(string(kv.Value))
+		op, err2 := operationFromValue(string(kv.Value))
 		if err2 != nil {
-			return nil, 0, err2
+			return nil, nil, 0, err2
 		}
+		cur := DiscardedOperation{Key: string(kv.Key), ModRevision: kv.ModRevision, Op: op}
+		tableKey := common.ShardDDLOptimismOperationKeyAdapter.Encode(op.Task, op.Source, op.UpSchema, op.UpTable)
+		if prev, ok := kept[tableKey]; ok {
+			if prev.ModRevision > cur.ModRevision {
+				prev, cur = cur, prev
+			}
+			discarded = append(discarded, prev)
+		}
+		kept[tableKey] = cur
+	}
+	sort.Slice(discarded, func(i, j int) bool {
+		return discarded[i].Key < discarded[j].Key
+	})
 
+	opm := make(map[string]map[string]map[string]map[string]Operation)
+	for _, k := range kept {
+		op := k.Op
 		if _, ok := opm[op.Task]; !ok {
 			opm[op.Task] = make(map[string]map[string]map[string]Operation)
 		}
@@ -164,17 +485,85 @@ func GetAllOperations(cli *clientv3.Client) (map[string]map[string]map[string]ma
 		}
 		opm[op.Task][op.Source][op.UpSchema][op.UpTable] = op
 	}
+	return opm, discarded, resp.Header.Revision, nil
+}
 
-	return opm, resp.Header.Revision, nil
+// operationsFromKVs decodes shard DDL lock operations from key-values got from etcd.
+func operationsFromKVs(kvs []*mvccpb.KeyValue) (map[string]map[string]map[string]map[string]Operation, error) {
+	opm := make(map[string]map[string]map[string]map[string]Operation)
+	for _, kv := range kvs {
+		op, err := operationFromValue(string(kv.Value))
+		if err != nil {
+			return nil, err
+		}
+
+		if _, ok := opm[op.Task]; !ok {
+			opm[op.Task] = make(map[string]map[string]map[string]Operation)
+		}
+		if _, ok := opm[op.Task][op.Source]; !ok {
+			opm[op.Task][op.Source] = make(map[string]map[string]Operation)
+		}
+		if _, ok := opm[op.Task][op.Source][op.UpSchema]; !ok {
+			opm[op.Task][op.Source][op.UpSchema] = make(map[string]Operation)
+		}
+		opm[op.Task][op.Source][op.UpSchema][op.UpTable] = op
+	}
+	return opm, nil
+}
+
+// RangeOperations calls `fn` for each shard DDL operation in etcd in the order of keys,
+// operations are read page by page with at most `pageSize` operations in a page (no limit if `pageSize` <= 0),
+// so the memory is bounded even if there are many operations.
+// all pages are read at the same revision as the first page, and the revision is returned.
+// if `fn` returns an error, the range stops and the error is returned.
+// This function should often be called by DM-master.
+func RangeOperations(cli etcdutil.KVClient, pageSize int64, fn func(Operation) error) (int64, error) {
+	var (
+		prefix = common.ShardDDLOptimismOperationKeyAdapter.Path()
+		end    = clientv3.GetPrefixRangeEnd(prefix)
+		key    = prefix
+		rev    int64
+	)
+	for {
+		opts := []clientv3.OpOption{clientv3.WithRange(end)}
+		if pageSize > 0 {
+			opts = append(opts, clientv3.WithLimit(pageSize))
+		}
+		if rev > 0 {
+			opts = append(opts, clientv3.WithRev(rev))
+		}
+		respTxn, _, err := etcdutil.DoOpsInOneTxnWithRetry(cli, clientv3.OpGet(key, opts...))
+		if err != nil {
+			return 0, err
+		}
+		resp := respTxn.Responses[0].GetResponseRange()
+		if rev == 0 {
+			rev = resp.Header.Revision
+		}
+
+		for _, kv := range resp.Kvs {
+			op, err2 := operationFromValue(string(kv.Value))
+			if err2 != nil {
+				return 0, err2
+			}
+			if err2 = fn(op); err2 != nil {
+				return 0, err2
+			}
+		}
+		if !resp.More || len(resp.Kvs) == 0 {
+			return rev, nil
+		}
+		key = string(resp.Kvs[len(resp.Kvs)-1].Key) + "\x00" // the next key after the last one.
+	}
 }
 
 // WatchOperationPut watches PUT operations for DDL lock operation.
 // If want to watch all operations matching, pass empty string for `task`, `source`, `upSchema` and `upTable`.
 // This function can be called by DM-worker and DM-master.
-func WatchOperationPut(ctx context.Context, cli *clientv3.Client,
+func WatchOperationPut(ctx context.Context, cli etcdutil.KVClient,
 	task, source, upSchema, upTable string, revision int64,
 	outCh chan<- Operation, errCh chan<- error) {
-	ch := cli.Watch(ctx, common.ShardDDLOptimismOperationKeyAdapter.Encode(task, source, upSchema, upTable),
+	ch := cli.Watch(ctx, operationKey(task, source, upSchema, upTable),
 		clientv3.WithPrefix(), clientv3.WithRev(revision))
 
 	for {
@@ -195,7 +584,7 @@ func WatchOperationPut(ctx context.Context, cli *clientv3.Client,
 					continue
 				}
 
-				op, err := operationFromJSON(string(ev.Kv.Value))
+				op, err := operationFromValue(string(ev.Kv.Value))
 				if err != nil {
 					select {
 					case errCh <- err:
@@ -216,5 +605,5 @@ func WatchOperationPut(ctx context.Context, cli *clientv3.Client,
 
 // deleteOperationOp returns a DELETE etcd operation for Operation.
 func deleteOperationOp(op Operation) clientv3.Op {
-	return clientv3.OpDelete(common.ShardDDLOptimismOperationKeyAdapter.Encode(op.Task, op.Source, op.UpSchema, op.UpTable))
+	return clientv3.OpDelete(operationKey(op.Task, op.Source, op.UpSchema, op.UpTable))
 }
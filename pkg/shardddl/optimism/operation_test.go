@@ -15,9 +15,15 @@ package optimism
 
 import (
 	"context"
+	"fmt"
 	"time"
 
 	. "github.com/pingcap/check"
+	"github.com/pingcap/errors"
+
+	"github.com/pingcap/dm/dm/common"
+	"github.com/pingcap/dm/pkg/etcdutil"
+	"github.com/pingcap/dm/pkg/terror"
 )
 
 func (t *testForEtcd) TestOperationJSON(c *C) {
@@ -27,12 +33,49 @@ func (t *testForEtcd) TestOperationJSON(c *C) {
 
 	j, err := o1.toJSON()
 	c.Assert(err, IsNil)
-	c.Assert(j, Equals, `{"id":"test-ID","task":"test","source":"mysql-replica-1","up-schema":"db-1","up-table":"tbl-1","ddls":["ALTER TABLE tbl ADD COLUMN c1 INT"],"conflict-stage":"detected","done":true}`)
+	c.Assert(j, Equals, `{"id":"test-ID","task":"test","source":"mysql-replica-1","up-schema":"db-1","up-table":"tbl-1","ddls":["ALTER TABLE tbl ADD COLUMN c1 INT"],"conflict-stage":"detected","done":true,"version":1}`)
 	c.Assert(j, Equals, o1.String())
 
 	o2, err := operationFromJSON(j)
 	c.Assert(err, IsNil)
 	c.Assert(o2, DeepEquals, o1)
+
+	// with retry information.
+	o3 := o1.WithRetry(errors.New("Error 1105: timeout")).WithRetry(errors.New("Error 1205: lock wait timeout"))
+	c.Assert(o1.RetryCount, Equals, 0) // not changed.
+	c.Assert(o3.RetryCount, Equals, 2)
+	c.Assert(o3.LastError, Equals, "Error 1205: lock wait timeout")
+	j, err = o3.toJSON()
+	c.Assert(err, IsNil)
+	c.Assert(j, Equals, `{"id":"test-ID","task":"test","source":"mysql-replica-1","up-schema":"db-1","up-table":"tbl-1","ddls":["ALTER TABLE tbl ADD COLUMN c1 INT"],"conflict-stage":"detected","done":true,"retry-count":2,"last-error":"Error 1205: lock wait timeout","version":1}`)
+	o4, err := operationFromJSON(j)
+	c.Assert(err, IsNil)
+	c.Assert(o4, DeepEquals, o3)
+
+	// retry without an error keeps the last error.
+	o4 = o3.WithRetry(nil)
+	c.Assert(o4.RetryCount, Equals, 3)
+	c.Assert(o4.LastError, Equals, o3.LastError)
+
+	// operations without retry information (like those putted before) have zero values.
+	o5, err := operationFromJSON(`{"id":"test-ID","task":"test","source":"mysql-replica-1","up-schema":"db-1","up-table":"tbl-1","ddls":[],"conflict-stage":"none","done":false}`)
+	c.Assert(err, IsNil)
+	c.Assert(o5.RetryCount, Equals, 0)
+	c.Assert(o5.LastError, Equals, "")
+	c.Assert(o5.Version, Equals, CurrentOperationVersion)
+
+	// missing fields are defaulted for operations written before the version introduced.
+	o6, err := operationFromJSON(`{"id":"test-ID","task":"test","source":"mysql-replica-1","up-schema":"db-1","up-table":"tbl-1","done":false}`)
+	c.Assert(err, IsNil)
+	c.Assert(o6.ConflictStage, Equals, ConflictNone)
+	c.Assert(o6.DDLs, DeepEquals, []string{})
+	c.Assert(o6.Version, Equals, CurrentOperationVersion)
+
+	// operations with a newer version are kept as is.
+	o7, err := operationFromJSON(`{"id":"test-ID","new-field":"xxx","version":100}`)
+	c.Assert(err, IsNil)
+	c.Assert(o7.ConflictStage, Equals, ConflictStage(""))
+	c.Assert(o7.Version, Equals, 100)
 }
 
 func (t *testForEtcd) TestOperationEtcd(c *C) {
@@ -53,10 +96,10 @@ func (t *testForEtcd) TestOperationEtcd(c *C) {
 	)
 
 	// put the same keys twice.
-	rev1, succ, err := PutOperation(etcdTestCli, false, op11)
+	rev1, succ, _, err := PutOperation(etcdTestCli, false, op11)
 	c.Assert(err, IsNil)
 	c.Assert(succ, IsTrue)
-	rev2, succ, err := PutOperation(etcdTestCli, false, op11)
+	rev2, succ, _, err := PutOperation(etcdTestCli, false, op11)
 	c.Assert(err, IsNil)
 	c.Assert(succ, IsTrue)
 	c.Assert(rev2, Greater, rev1)
@@ -76,7 +119,7 @@ func (t *testForEtcd) TestOperationEtcd(c *C) {
 	c.Assert(<-wch, DeepEquals, op11)
 
 	// put for another task.
-	rev3, succ, err := PutOperation(etcdTestCli, false, op21)
+	rev3, succ, _, err := PutOperation(etcdTestCli, false, op21)
 	c.Assert(err, IsNil)
 	c.Assert(succ, IsTrue)
 
@@ -109,7 +152,7 @@ func (t *testForEtcd) TestOperationEtcd(c *C) {
 
 	// put for `skipDone` with `done` in etcd, the operations should not be skipped.
 	// case: kv's "the `done` field is not `true`".
-	rev5, succ, err := PutOperation(etcdTestCli, true, op11)
+	rev5, succ, _, err := PutOperation(etcdTestCli, true, op11)
 	c.Assert(err, IsNil)
 	c.Assert(succ, IsTrue)
 	c.Assert(rev5, Greater, rev4)
@@ -126,7 +169,7 @@ func (t *testForEtcd) TestOperationEtcd(c *C) {
 
 	// put for `skipDone` with `done` in etcd, the operations should not be skipped.
 	// case: kv "not exist".
-	rev6, succ, err := PutOperation(etcdTestCli, true, op11)
+	rev6, succ, _, err := PutOperation(etcdTestCli, true, op11)
 	c.Assert(err, IsNil)
 	c.Assert(succ, IsTrue)
 
@@ -139,15 +182,430 @@ func (t *testForEtcd) TestOperationEtcd(c *C) {
 	// update op11 to `done`.
 	op11c := op11
 	op11c.Done = true
-	rev7, succ, err := PutOperation(etcdTestCli, true, op11c)
+	rev7, succ, modRev7, err := PutOperation(etcdTestCli, true, op11c)
 	c.Assert(err, IsNil)
 	c.Assert(succ, IsTrue)
 	c.Assert(rev7, Greater, rev6)
+	c.Assert(modRev7, Equals, rev7)
 
 	// put for `skipDone` with `done` in etcd, the operations should be skipped.
 	// case: kv's ("exist" and "the `done` field is `true`").
-	rev8, succ, err := PutOperation(etcdTestCli, true, op11)
+	rev8, succ, modRev8, err := PutOperation(etcdTestCli, true, op11)
 	c.Assert(err, IsNil)
 	c.Assert(succ, IsFalse)
 	c.Assert(rev8, Equals, rev7)
+	c.Assert(modRev8, Equals, modRev7) // the mod revision of the existing one.
+
+	// get the mod revision of the operation.
+	modRev, exist, err := GetOperationRev(etcdTestCli, op11)
+	c.Assert(err, IsNil)
+	c.Assert(exist, IsTrue)
+	c.Assert(modRev, Equals, modRev7)
+
+	// get the mod revision of a not-existing operation.
+	op11c.Source = "not-exist"
+	modRev, exist, err = GetOperationRev(etcdTestCli, op11c)
+	c.Assert(err, IsNil)
+	c.Assert(exist, IsFalse)
+	c.Assert(modRev, Equals, int64(0))
+}
+
+func (t *testForEtcd) TestPutOperationSkipDoneOldVersion(c *C) {
+	var (
+		cli = etcdutil.NewMemClient()
+		op  = NewOperation("test-ID", "test", "mysql-replica-1", "db-1", "tbl-1", []string{
+			"ALTER TABLE tbl ADD COLUMN c1 INT",
+		}, ConflictNone, false)
+		key = operationKey(op.Task, op.Source, op.UpSchema, op.UpTable)
+	)
+	defer cli.Close()
+
+	// the done operation written before the version introduced.
+	putResp, err := cli.Put(context.Background(), key, `{"id":"test-ID","task":"test","source":"mysql-replica-1","up-schema":"db-1","up-table":"tbl-1","ddls":["ALTER TABLE tbl ADD COLUMN c1 INT"],"conflict-stage":"none","done":true}`)
+	c.Assert(err, IsNil)
+
+	// not overwritten with `skipDone`.
+	_, putted, modRev, err := PutOperation(cli, true, op)
+	c.Assert(err, IsNil)
+	c.Assert(putted, IsFalse)
+	c.Assert(modRev, Equals, putResp.Header.Revision)
+	opm, _, err := GetAllOperations(cli)
+	c.Assert(err, IsNil)
+	c.Assert(opm[op.Task][op.Source][op.UpSchema][op.UpTable].Done, IsTrue)
+
+	// overwritten if it's not the same operation.
+	op2 := op
+	op2.DDLs = []string{"ALTER TABLE tbl ADD COLUMN c2 INT"}
+	_, putted, _, err = PutOperation(cli, true, op2)
+	c.Assert(err, IsNil)
+	c.Assert(putted, IsTrue)
+	opm, _, err = GetAllOperations(cli)
+	c.Assert(err, IsNil)
+	c.Assert(opm[op.Task][op.Source][op.UpSchema][op.UpTable], DeepEquals, op2)
+}
+
+func (t *testForEtcd) TestPutOperationSkipDoneWithRetry(c *C) {
+	var (
+		cli = etcdutil.NewMemClient()
+		op  = NewOperation("test-ID", "test", "mysql-replica-1", "db-1", "tbl-1", []string{
+			"ALTER TABLE tbl ADD COLUMN c1 INT",
+		}, ConflictNone, false)
+	)
+	defer cli.Close()
+
+	// the operation is done by DM-worker after retried.
+	opDone := op.WithRetry(errors.New("Error 1105: timeout"))
+	opDone.Done = true
+	c.Assert(opDone.RetryCount, Equals, 1)
+	_, putted, modRev, err := PutOperation(cli, false, opDone)
+	c.Assert(err, IsNil)
+	c.Assert(putted, IsTrue)
+
+	// not overwritten with `skipDone`.
+	_, putted, modRev2, err := PutOperation(cli, true, op)
+	c.Assert(err, IsNil)
+	c.Assert(putted, IsFalse)
+	c.Assert(modRev2, Equals, modRev)
+	opm, _, err := GetAllOperations(cli)
+	c.Assert(err, IsNil)
+	c.Assert(opm[op.Task][op.Source][op.UpSchema][op.UpTable], DeepEquals, opDone)
+}
+
+func (t *testForEtcd) TestGetAllOperationsCtx(c *C) {
+	defer clearTestInfoOperation(c)
+
+	op := NewOperation("test-ID", "test", "mysql-replica-1", "db-1", "tbl-1",
+		[]string{"ALTER TABLE tbl ADD COLUMN c1 INT"}, ConflictNone, false)
+	_, _, _, err := PutOperation(etcdTestCli, false, op)
+	c.Assert(err, IsNil)
+
+	// get with a valid context.
+	opm, _, err := GetAllOperationsCtx(context.Background(), etcdTestCli)
+	c.Assert(err, IsNil)
+	c.Assert(opm[op.Task][op.Source][op.UpSchema][op.UpTable], DeepEquals, op)
+
+	// get with a canceled context.
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	opm, _, err = GetAllOperationsCtx(ctx, etcdTestCli)
+	c.Assert(err, NotNil)
+	c.Assert(opm, IsNil)
+}
+
+func (t *testForEtcd) TestGetAllOperationsDedup(c *C) {
+	var (
+		cli    = etcdutil.NewMemClient()
+		prefix = common.ShardDDLOptimismOperationKeyAdapter.Path()
+		op1    = NewOperation("test-ID", "test", "mysql-replica-1", "db-1", "tbl-1",
+			[]string{"ALTER TABLE tbl ADD COLUMN c1 INT"}, ConflictNone, false)
+		op2 = NewOperation("test-ID", "test", "mysql-replica-1", "db-1", "tbl-2",
+			[]string{"ALTER TABLE tbl ADD COLUMN c1 INT"}, ConflictNone, false)
+		putRaw = func(key string, op Operation) int64 {
+			value, err := op.toJSON()
+			c.Assert(err, IsNil)
+			resp, err := cli.Put(context.Background(), key, value)
+			c.Assert(err, IsNil)
+			return resp.Header.Revision
+		}
+	)
+	defer cli.Close()
+
+	// no operations.
+	opm, discarded, _, err := GetAllOperationsDedup(cli)
+	c.Assert(err, IsNil)
+	c.Assert(opm, HasLen, 0)
+	c.Assert(discarded, HasLen, 0)
+
+	// a stale duplicate put with a legacy key before the operation put with the right key.
+	op1Old := op1
+	op1Old.DDLs = []string{}
+	legacyRev := putRaw(prefix+"legacy-1", op1Old)
+	_, _, _, err = PutOperation(cli, false, op1)
+	c.Assert(err, IsNil)
+	rev, _, _, err := PutOperation(cli, false, op2)
+	c.Assert(err, IsNil)
+
+	opm, discarded, rev2, err := GetAllOperationsDedup(cli)
+	c.Assert(err, IsNil)
+	c.Assert(rev2, Equals, rev)
+	c.Assert(opm[op1.Task][op1.Source][op1.UpSchema], HasLen, 2)
+	c.Assert(opm[op1.Task][op1.Source][op1.UpSchema][op1.UpTable], DeepEquals, op1)
+	c.Assert(opm[op2.Task][op2.Source][op2.UpSchema][op2.UpTable], DeepEquals, op2)
+	c.Assert(discarded, DeepEquals, []DiscardedOperation{{Key: prefix + "legacy-1", ModRevision: legacyRev, Op: op1Old}})
+
+	// a newer duplicate put with another legacy key wins.
+	op1Done := op1
+	op1Done.Done = true
+	putRaw(prefix+"legacy-2", op1Done)
+	opm, discarded, _, err = GetAllOperationsDedup(cli)
+	c.Assert(err, IsNil)
+	c.Assert(opm[op1.Task][op1.Source][op1.UpSchema][op1.UpTable], DeepEquals, op1Done)
+	c.Assert(discarded, HasLen, 2)
+	c.Assert(discarded[0].Key, Equals, common.ShardDDLOptimismOperationKeyAdapter.Encode(op1.Task, op1.Source, op1.UpSchema, op1.UpTable))
+	c.Assert(discarded[0].Op, DeepEquals, op1)
+	c.Assert(discarded[1].Key, Equals, prefix+"legacy-1")
+
+	// clean up discarded operations.
+	for _, d := range discarded {
+		_, err = cli.Delete(context.Background(), d.Key)
+		c.Assert(err, IsNil)
+	}
+	opm, discarded, _, err = GetAllOperationsDedup(cli)
+	c.Assert(err, IsNil)
+	c.Assert(opm[op1.Task][op1.Source][op1.UpSchema][op1.UpTable], DeepEquals, op1Done)
+	c.Assert(discarded, HasLen, 0)
+
+	// the undecodable value.
+	_, err = cli.Put(context.Background(), prefix+"invalid", "invalid")
+	c.Assert(err, IsNil)
+	_, _, _, err = GetAllOperationsDedup(cli)
+	c.Assert(err, NotNil)
+}
+
+func (t *testForEtcd) TestOperationExists(c *C) {
+	defer clearTestInfoOperation(c)
+
+	op := NewOperation("test-ID", "test", "mysql-replica-1", "db-1", "tbl-1",
+		[]string{"ALTER TABLE tbl ADD COLUMN c1 INT"}, ConflictNone, false)
+
+	// not exists.
+	exist, rev, err := OperationExists(etcdTestCli, op.Task, op.Source, op.UpSchema, op.UpTable)
+	c.Assert(err, IsNil)
+	c.Assert(exist, IsFalse)
+	c.Assert(rev, Greater, int64(0))
+
+	// exists after PUT.
+	putRev, _, _, err := PutOperation(etcdTestCli, false, op)
+	c.Assert(err, IsNil)
+	exist, rev, err = OperationExists(etcdTestCli, op.Task, op.Source, op.UpSchema, op.UpTable)
+	c.Assert(err, IsNil)
+	c.Assert(exist, IsTrue)
+	c.Assert(rev, Equals, putRev)
+
+	// the info of the same table is not the operation.
+	exist, _, err = InfoExists(etcdTestCli, op.Task, op.Source, op.UpSchema, op.UpTable)
+	c.Assert(err, IsNil)
+	c.Assert(exist, IsFalse)
+
+	// not exists after DELETE.
+	_, err = DeleteInfosOperations(etcdTestCli, nil, []Operation{op})
+	c.Assert(err, IsNil)
+	exist, _, err = OperationExists(etcdTestCli, op.Task, op.Source, op.UpSchema, op.UpTable)
+	c.Assert(err, IsNil)
+	c.Assert(exist, IsFalse)
+}
+
+func (t *testForEtcd) TestRangeOperations(c *C) {
+	defer clearTestInfoOperation(c)
+
+	var (
+		ID       = "test-`foo`.`bar`"
+		task     = "test"
+		source   = "mysql-replica-1"
+		upSchema = "foo_1"
+		DDLs     = []string{"ALTER TABLE bar ADD COLUMN c1 INT"}
+		ops      = make(map[string]Operation)
+		collect  = func(got map[string]Operation) func(Operation) error {
+			return func(op Operation) error {
+				_, ok := got[op.UpTable]
+				c.Assert(ok, IsFalse) // no duplicate operations across pages.
+				got[op.UpTable] = op
+				return nil
+			}
+		}
+	)
+
+	// no operations.
+	got := make(map[string]Operation)
+	rev, err := RangeOperations(etcdTestCli, 2, collect(got))
+	c.Assert(err, IsNil)
+	c.Assert(rev, Greater, int64(0))
+	c.Assert(got, HasLen, 0)
+
+	for i := 1; i <= 5; i++ {
+		op := NewOperation(ID, task, source, upSchema, fmt.Sprintf("bar_%d", i), DDLs, ConflictNone, false)
+		_, _, _, err = PutOperation(etcdTestCli, false, op)
+		c.Assert(err, IsNil)
+		ops[op.UpTable] = op
+	}
+
+	// range with different page sizes.
+	for _, pageSize := range []int64{0, 1, 2, 5, 10} {
+		got = make(map[string]Operation)
+		_, err = RangeOperations(etcdTestCli, pageSize, collect(got))
+		c.Assert(err, IsNil)
+		c.Assert(got, DeepEquals, ops)
+	}
+
+	// operations putted during the range are not got, because all pages are read at the same revision.
+	var (
+		newOp  = NewOperation(ID, task, source, upSchema, "bar_6", DDLs, ConflictNone, false)
+		putted bool
+	)
+	got = make(map[string]Operation)
+	rev, err = RangeOperations(etcdTestCli, 2, func(op Operation) error {
+		if !putted {
+			_, _, _, err2 := PutOperation(etcdTestCli, false, newOp)
+			c.Assert(err2, IsNil)
+			putted = true
+		}
+		return collect(got)(op)
+	})
+	c.Assert(err, IsNil)
+	c.Assert(got, DeepEquals, ops)
+	_, rev2, err := GetAllOperations(etcdTestCli)
+	c.Assert(err, IsNil)
+	c.Assert(rev2, Greater, rev)
+
+	// stop if `fn` returns an error.
+	var count int
+	_, err = RangeOperations(etcdTestCli, 2, func(op Operation) error {
+		count++
+		return errors.New("stop")
+	})
+	c.Assert(err, ErrorMatches, "stop")
+	c.Assert(count, Equals, 1)
+}
+
+func (t *testForEtcd) TestPutOperations(c *C) {
+	defer clearTestInfoOperation(c)
+
+	var (
+		ID     = "test-put-operations-`foo`.`bar`"
+		task   = "test-put-operations"
+		DDLs   = []string{"ALTER TABLE bar ADD COLUMN c1 INT"}
+		op1    = NewOperation(ID, task, "mysql-replica-1", "foo", "bar", DDLs, ConflictResolved, false)
+		op2    = NewOperation(ID, task, "mysql-replica-2", "foo", "bar", DDLs, ConflictResolved, false)
+		op3    = NewOperation(ID, task, "mysql-replica-3", "foo", "bar", DDLs, ConflictResolved, false)
+		getOps = func() map[string]Operation {
+			opm, _, err := GetAllOperations(etcdTestCli)
+			c.Assert(err, IsNil)
+			ops := make(map[string]Operation)
+			for source, opm2 := range opm[task] {
+				ops[source] = opm2["foo"]["bar"]
+			}
+			return ops
+		}
+	)
+
+	// no operations.
+	rev0, err := PutOperations(etcdTestCli, false, nil)
+	c.Assert(err, IsNil)
+	c.Assert(rev0, Greater, int64(0))
+
+	// put multiple operations in one transaction.
+	rev1, err := PutOperations(etcdTestCli, true, []Operation{op1, op2})
+	c.Assert(err, IsNil)
+	c.Assert(rev1, Equals, rev0+1)
+	c.Assert(getOps(), DeepEquals, map[string]Operation{op1.Source: op1, op2.Source: op2})
+
+	// op1 is done by the DM-worker.
+	op1Done := op1
+	op1Done.Done = true
+	_, _, _, err = PutOperation(etcdTestCli, false, op1Done)
+	c.Assert(err, IsNil)
+
+	// with `skipDone`, op1 is skipped but others are still putted.
+	rev2, err := PutOperations(etcdTestCli, true, []Operation{op1, op2, op3})
+	c.Assert(err, IsNil)
+	c.Assert(getOps(), DeepEquals, map[string]Operation{op1.Source: op1Done, op2.Source: op2, op3.Source: op3})
+	rev, exist, err := GetOperationRev(etcdTestCli, op2)
+	c.Assert(err, IsNil)
+	c.Assert(exist, IsTrue)
+	c.Assert(rev, Equals, rev2)
+
+	// op2 is done by the DM-worker after retried, and written with another codec.
+	SetCodec(CodecGob)
+	op2Done := op2.WithRetry(errors.New("Error 1105: timeout"))
+	op2Done.Done = true
+	_, _, _, err = PutOperation(etcdTestCli, false, op2Done)
+	SetCodec(CodecJSON)
+	c.Assert(err, IsNil)
+
+	// with `skipDone`, both op1 and op2 are skipped.
+	_, err = PutOperations(etcdTestCli, true, []Operation{op1, op2, op3})
+	c.Assert(err, IsNil)
+	c.Assert(getOps(), DeepEquals, map[string]Operation{op1.Source: op1Done, op2.Source: op2Done, op3.Source: op3})
+
+	// without `skipDone`, op1 is overwritten.
+	_, err = PutOperations(etcdTestCli, false, []Operation{op1})
+	c.Assert(err, IsNil)
+	c.Assert(getOps()[op1.Source], DeepEquals, op1)
+}
+
+func (t *testForEtcd) TestPutOperationsChunks(c *C) {
+	var (
+		cli  = etcdutil.NewMemClient()
+		task = "test-put-operations-chunks"
+		ops  = make([]Operation, 0, 2*maxOpsPerTxn+1)
+	)
+	defer cli.Close()
+
+	for i := 0; i < cap(ops); i++ {
+		ops = append(ops, NewOperation("ID", task, "mysql-replica-1", "foo", fmt.Sprintf("bar_%d", i),
+			[]string{"ALTER TABLE bar ADD COLUMN c1 INT"}, ConflictNone, false))
+	}
+	for _, skipDone := range []bool{false, true} {
+		rev0, err := PutOperations(cli, skipDone, nil)
+		c.Assert(err, IsNil)
+		rev, err := PutOperations(cli, skipDone, ops)
+		c.Assert(err, IsNil)
+		c.Assert(rev, Equals, rev0+3) // 3 chunks.
+
+		opm, _, err := GetAllOperations(cli)
+		c.Assert(err, IsNil)
+		c.Assert(opm[task]["mysql-replica-1"]["foo"], HasLen, len(ops))
+	}
+}
+
+func (t *testForEtcd) TestGetOperationsForLock(c *C) {
+	var (
+		cli    = etcdutil.NewMemClient()
+		DDLs   = []string{"ALTER TABLE bar ADD COLUMN c1 INT"}
+		ID1    = "task-1-`foo`.`bar`"
+		ID2    = "task-1-`foo`.`baz`"
+		op11   = NewOperation(ID1, "task-1", "mysql-replica-1", "foo", "bar_1", DDLs, ConflictNone, false)
+		op12   = NewOperation(ID1, "task-1", "mysql-replica-2", "foo", "bar_1", DDLs, ConflictNone, true)
+		op13   = NewOperation(ID2, "task-1", "mysql-replica-1", "foo", "baz_1", DDLs, ConflictNone, false)
+		op21   = NewOperation("task-11-`foo`.`bar`", "task-11", "mysql-replica-1", "foo", "bar_1", DDLs, ConflictNone, false)
+		allOps = []Operation{op11, op12, op13, op21}
+	)
+	defer cli.Close()
+
+	_, _, err := GetOperationsForLock(cli, "invalid")
+	c.Assert(terror.ErrShardDDLOptimismInvalidLockID.Equal(err), IsTrue)
+
+	ops, _, err := GetOperationsForLock(cli, ID1)
+	c.Assert(err, IsNil)
+	c.Assert(ops, HasLen, 0)
+
+	rev, err := PutOperations(cli, false, allOps)
+	c.Assert(err, IsNil)
+	ops, rev2, err := GetOperationsForLock(cli, ID1)
+	c.Assert(err, IsNil)
+	c.Assert(rev2, Equals, rev)
+	c.Assert(ops, DeepEquals, []Operation{op11, op12})
+	ops, _, err = GetOperationsForLock(cli, ID2)
+	c.Assert(err, IsNil)
+	c.Assert(ops, DeepEquals, []Operation{op13})
+
+	// operations of the task with the same prefix are not read at all.
+	invalidKey := operationKey("task-11", "mysql-replica-1", "foo", "bar_2")
+	_, err = cli.Put(context.Background(), invalidKey, "invalid")
+	c.Assert(err, IsNil)
+	ops, _, err = GetOperationsForLock(cli, ID1)
+	c.Assert(err, IsNil)
+	c.Assert(ops, DeepEquals, []Operation{op11, op12})
+	_, err = cli.Delete(context.Background(), invalidKey)
+	c.Assert(err, IsNil)
+
+	// clean up the lock.
+	_, err = DeleteInfosOperations(cli, nil, []Operation{op11, op12})
+	c.Assert(err, IsNil)
+	ops, _, err = GetOperationsForLock(cli, ID1)
+	c.Assert(err, IsNil)
+	c.Assert(ops, HasLen, 0)
+	opm, _, err := GetAllOperations(cli)
+	c.Assert(err, IsNil)
+	c.Assert(opm, HasLen, 2)
 }
@@ -14,14 +14,24 @@
 package optimism
 
 import (
+	"context"
+	"fmt"
+
+	"github.com/pingcap/errors"
+	"github.com/pingcap/tidb-tools/pkg/dbutil"
 	"go.etcd.io/etcd/clientv3"
+	"go.etcd.io/etcd/clientv3/clientv3util"
+	v3rpc "go.etcd.io/etcd/etcdserver/api/v3rpc/rpctypes"
+	"go.etcd.io/etcd/mvcc/mvccpb"
 
+	"github.com/pingcap/dm/dm/common"
 	"github.com/pingcap/dm/pkg/etcdutil"
+	"github.com/pingcap/dm/pkg/terror"
 )
 
 // PutSourceTablesInfo puts source tables and a shard DDL info.
 // This function is often used in DM-worker when handling `CREATE TABLE`.
-func PutSourceTablesInfo(cli *clientv3.Client, st SourceTables, info Info) (int64, error) {
+func PutSourceTablesInfo(cli etcdutil.KVClient, st SourceTables, info Info) (int64, error) {
 	stOp, err := putSourceTablesOp(st)
 	if err != nil {
 		return 0, err
@@ -34,9 +44,35 @@ func PutSourceTablesInfo(cli *clientv3.Client, st SourceTables, info Info) (int6
 	return rev, err
 }
 
+// PutSourceTablesInfoCAS puts source tables and a shard DDL info only if the mod revision of
+// the source tables in etcd is still `expectedRev` (0 means the source tables not exist).
+// it returns whether the CAS succeeded, this is used to avoid racing with a concurrent table removal.
+// This function is often used in DM-worker when reporting a shard DDL info with updated source tables.
+func PutSourceTablesInfoCAS(cli etcdutil.KVClient, st SourceTables, info Info, expectedRev int64) (rev int64, succeeded bool, err error) {
+	stOp, err := putSourceTablesOp(st)
+	if err != nil {
+		return 0, false, err
+	}
+	infoOp, err := putInfoOp(info)
+	if err != nil {
+		return 0, false, err
+	}
+	key := common.ShardDDLOptimismSourceTablesKeyAdapter.Encode(st.Task, st.Source)
+	cmp := clientv3.Compare(clientv3.ModRevision(key), "=", expectedRev)
+
+	ctx, cancel := context.WithTimeout(cli.Ctx(), etcdutil.DefaultRequestTimeout)
+	defer cancel()
+
+	resp, err := cli.Txn(ctx).If(cmp).Then(stOp, infoOp).Commit()
+	if err != nil {
+		return 0, false, err
+	}
+	return resp.Header.Revision, resp.Succeeded, nil
+}
+
 // PutSourceTablesDeleteInfo puts source tables and deletes a shard DDL info.
 // This function is often used in DM-worker when handling `DROP TABLE`.
-func PutSourceTablesDeleteInfo(cli *clientv3.Client, st SourceTables, info Info) (int64, error) {
+func PutSourceTablesDeleteInfo(cli etcdutil.KVClient, st SourceTables, info Info) (int64, error) {
 	stOp, err := putSourceTablesOp(st)
 	if err != nil {
 		return 0, err
@@ -48,7 +84,7 @@ func PutSourceTablesDeleteInfo(cli *clientv3.Client, st SourceTables, info Info)
 
 // DeleteInfosOperations deletes the shard DDL infos and operations in etcd.
 // This function should often be called by DM-master when removing the lock.
-func DeleteInfosOperations(cli *clientv3.Client, infos []Info, ops []Operation) (int64, error) {
+func DeleteInfosOperations(cli etcdutil.KVClient, infos []Info, ops []Operation) (int64, error) {
 	opsDel := make([]clientv3.Op, 0, len(infos)+len(ops))
 	for _, info := range infos {
 		opsDel = append(opsDel, deleteInfoOp(info))
@@ -59,3 +95,203 @@ func DeleteInfosOperations(cli *clientv3.Client, infos []Info, ops []Operation)
 	_, rev, err := etcdutil.DoOpsInOneTxnWithRetry(cli, opsDel...)
 	return rev, err
 }
+
+// deleteInfosOperationsIfNotModified deletes the shard DDL infos and operations in etcd in one transaction,
+// only if none of them has been changed (put, or deleted) since read at the beginning of this call.
+// it returns whether deleted and the revision of etcd.
+func deleteInfosOperationsIfNotModified(cli etcdutil.KVClient, infos []Info, ops []Operation) (bool, int64, error) {
+	keys := make([]string, 0, len(infos)+len(ops))
+	for _, info := range infos {
+		keys = append(keys, infoKey(info.Task, info.Source, info.UpSchema, info.UpTable))
+	}
+	for _, op := range ops {
+		keys = append(keys, operationKey(op.Task, op.Source, op.UpSchema, op.UpTable))
+	}
+	opsGet := make([]clientv3.Op, 0, len(keys))
+	for _, key := range keys {
+		opsGet = append(opsGet, clientv3.OpGet(key, clientv3.WithKeysOnly()))
+	}
+
+	ctx, cancel := context.WithTimeout(cli.Ctx(), etcdutil.DefaultRequestTimeout)
+	defer cancel()
+
+	resp, err := cli.Txn(ctx).Then(opsGet...).Commit()
+	if err != nil {
+		return false, 0, err
+	}
+	cmps := make([]clientv3.Cmp, 0, len(keys))
+	opsDel := make([]clientv3.Op, 0, len(keys))
+	for i, key := range keys {
+		if kvs := resp.Responses[i].GetResponseRange().Kvs; len(kvs) > 0 {
+			cmps = append(cmps, clientv3.Compare(clientv3.ModRevision(key), "=", kvs[0].ModRevision))
+		} else {
+			cmps = append(cmps, clientv3util.KeyMissing(key))
+		}
+		opsDel = append(opsDel, clientv3.OpDelete(key))
+	}
+
+	resp, err = cli.Txn(ctx).If(cmps...).Then(opsDel...).Commit()
+	if err != nil {
+		return false, 0, err
+	}
+	return resp.Succeeded, resp.Header.Revision, nil
+}
+
+// UpgradeInfosOperations upgrades shard DDL infos and operations written with older versions in etcd to the current versions,
+// each key-value is upgraded only if it has not been changed since read, so newer writes are never overwritten.
+// values can't be decoded or written with the current (or newer) versions are skipped.
+// it returns the count of key-values upgraded and the revision of etcd.
+// This function should often be called by DM-master after upgraded, then old values are not left in etcd.
+func UpgradeInfosOperations(cli etcdutil.KVClient) (upgraded int, rev int64, err error) {
+	respTxn, rev, err := etcdutil.DoOpsInOneTxnWithRetry(cli,
+		clientv3.OpGet(common.ShardDDLOptimismInfoKeyAdapter.Path(), clientv3.WithPrefix()),
+		clientv3.OpGet(common.ShardDDLOptimismOperationKeyAdapter.Path(), clientv3.WithPrefix()))
+	if err != nil {
+		return 0, 0, err
+	}
+
+	put := func(kv *mvccpb.KeyValue, value string) error {
+		succeeded, rev2, err2 := putIfNotModified(cli, kv, value)
+		if err2 != nil {
+			return err2
+		}
+		rev = rev2
+		if succeeded {
+			upgraded++
+		}
+		return nil
+	}
+
+	for _, kv := range respTxn.Responses[0].GetResponseRange().Kvs {
+		var info Info
+		if decodeValue(string(kv.Value), &info) != nil || !info.upgrade() {
+			continue
+		}
+		value, err := info.encode()
+		if err != nil {
+			return upgraded, rev, err
+		}
+		if err = put(kv, value); err != nil {
+			return upgraded, rev, err
+		}
+	}
+	for _, kv := range respTxn.Responses[1].GetResponseRange().Kvs {
+		var op Operation
+		if decodeValue(string(kv.Value), &op) != nil || !op.upgrade() {
+			continue
+		}
+		value, err := op.encode()
+		if err != nil {
+			return upgraded, rev, err
+		}
+		if err = put(kv, value); err != nil {
+			return upgraded, rev, err
+		}
+	}
+	return upgraded, rev, nil
+}
+
+// putIfNotModified puts the value for the key only if the mod revision of the key is still the same as `kv`.
+func putIfNotModified(cli etcdutil.KVClient, kv *mvccpb.KeyValue, value string) (bool, int64, error) {
+	key := string(kv.Key)
+	cmp := clientv3.Compare(clientv3.ModRevision(key), "=", kv.ModRevision)
+
+	ctx, cancel := context.WithTimeout(cli.Ctx(), etcdutil.DefaultRequestTimeout)
+	defer cancel()
+
+	resp, err := cli.Txn(ctx).If(cmp).Then(clientv3.OpPut(key, value)).Commit()
+	if err != nil {
+		return false, 0, err
+	}
+	return resp.Succeeded, resp.Header.Revision, nil
+}
+
+// ValidateBootstrap checks the consistency of shard DDL info, shard DDL lock operation and source tables got when bootstrapping,
+// and returns human-readable findings for inconsistencies (often left by a crashed predecessor).
+// `ifm`, `opm` and `stm` are often the results of `GetAllInfo`, `GetAllOperations` and `GetAllSourceTables`.
+// NOTE: this is only a diagnostic, nothing is repaired. findings are in a stable order:
+//   - an operation without a matching info (for the same table), or with a lock ID mismatched with the info.
+//   - an info whose upstream table doesn't exist in the source tables.
+func ValidateBootstrap(ifm map[string]map[string]map[string]map[string]Info,
+	opm map[string]map[string]map[string]map[string]Operation, stm map[string]map[string]SourceTables) []string {
+	var findings []string
+	for _, task := range sortedKeys(opm) {
+		for _, source := range sortedKeys(opm[task]) {
+			for _, schema := range sortedKeys(opm[task][source]) {
+				for _, table := range sortedKeys(opm[task][source][schema]) {
+					op := opm[task][source][schema][table]
+					info, ok := ifm[task][source][schema][table]
+					if !ok {
+						findings = append(findings, fmt.Sprintf("operation of lock %s for table %s of source %s in task %s has no matching shard DDL info",
+							op.ID, dbutil.TableName(schema, table), source, task))
+					} else if lockID := genDDLLockID(info); lockID != op.ID {
+						findings = append(findings, fmt.Sprintf("operation of lock %s for table %s of source %s in task %s mismatches with the lock %s of shard DDL info",
+							op.ID, dbutil.TableName(schema, table), source, task, lockID))
+					}
+				}
+			}
+		}
+	}
+	for _, task := range sortedKeys(ifm) {
+		for _, source := range sortedKeys(ifm[task]) {
+			for _, schema := range sortedKeys(ifm[task][source]) {
+				for _, table := range sortedKeys(ifm[task][source][schema]) {
+					if _, ok := stm[task][source].Tables[schema][table]; !ok {
+						findings = append(findings, fmt.Sprintf("table %s of shard DDL info in task %s not found in source tables of source %s",
+							dbutil.TableName(schema, table), task, source))
+					}
+				}
+			}
+		}
+	}
+	return findings
+}
+
+// ReconstructAtRev reconstructs the lock keeper and the table keeper from shard DDL info, shard DDL lock operation
+// and source tables at the historical revision `rev` in etcd, in the same way as DM-master recovering locks when starting.
+// the returned keepers are throwaway, they are often used for debugging (like a postmortem).
+// conflicts detected when reconstructing are kept in the locks, but other errors are returned.
+// NOTE: the revision must not be compacted, otherwise `ErrShardDDLOptimismRevisionCompacted` is returned.
+func ReconstructAtRev(cli etcdutil.KVClient, rev int64) (*LockKeeper, *TableKeeper, error) {
+	ctx, cancel := context.WithTimeout(cli.Ctx(), etcdutil.DefaultRequestTimeout)
+	defer cancel()
+
+	resp, err := cli.Txn(ctx).Then(
+		clientv3.OpGet(common.ShardDDLOptimismSourceTablesKeyAdapter.Path(), clientv3.WithPrefix(), clientv3.WithRev(rev)),
+		clientv3.OpGet(common.ShardDDLOptimismInfoKeyAdapter.Path(), clientv3.WithPrefix(), clientv3.WithRev(rev)),
+		clientv3.OpGet(common.ShardDDLOptimismOperationKeyAdapter.Path(), clientv3.WithPrefix(), clientv3.WithRev(rev)),
+	).Commit()
+	if err != nil {
+		if errors.Cause(err) == v3rpc.ErrCompacted {
+			return nil, nil, terror.ErrShardDDLOptimismRevisionCompacted.Delegate(err, rev)
+		}
+		return nil, nil, err
+	}
+
+	stm, err := sourceTablesFromKVs(resp.Responses[0].GetResponseRange().Kvs)
+	if err != nil {
+		return nil, nil, err
+	}
+	ifm, _, err := infosFromKVs(resp.Responses[1].GetResponseRange().Kvs, false)
+	if err != nil {
+		return nil, nil, err
+	}
+	opm, err := operationsFromKVs(resp.Responses[2].GetResponseRange().Kvs)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	tk := NewTableKeeper()
+	tk.Init(stm)
+	lk := NewLockKeeper()
+	err = lk.reconstruct(ifm, opm, stm, func(_ Info, res SyncResult, err2 error) error {
+		if res.Conflict != nil {
+			return nil // conflicts are kept in the locks.
+		}
+		return err2
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+	return lk, tk, nil
+}
@@ -14,7 +14,15 @@
 package optimism
 
 import (
+	"context"
+
 	. "github.com/pingcap/check"
+	"github.com/pingcap/parser"
+	"github.com/pingcap/tidb/util/mock"
+
+	"github.com/pingcap/dm/dm/common"
+	"github.com/pingcap/dm/pkg/etcdutil"
+	"github.com/pingcap/dm/pkg/terror"
 )
 
 func (t *testForEtcd) TestDeleteInfosOperations(c *C) {
@@ -39,7 +47,7 @@ func (t *testForEtcd) TestDeleteInfosOperations(c *C) {
 	c.Assert(ifm[task][source][upSchema][upTable], DeepEquals, info)
 
 	// put operation.
-	_, _, err = PutOperation(etcdTestCli, false, op)
+	_, _, _, err = PutOperation(etcdTestCli, false, op)
 	c.Assert(err, IsNil)
 	opm, _, err := GetAllOperations(etcdTestCli)
 	c.Assert(err, IsNil)
@@ -115,3 +123,235 @@ func (t *testForEtcd) TestSourceTablesInfo(c *C) {
 	c.Assert(rev6, Equals, rev4)
 	c.Assert(ifm, HasLen, 0)
 }
+
+func (t *testForEtcd) TestSourceTablesInfoCAS(c *C) {
+	defer clearTestInfoOperation(c)
+
+	var (
+		task     = "task"
+		source   = "mysql-replica-1"
+		upSchema = "foo-1"
+		upTable  = "bar-1"
+		st1      = NewSourceTables(task, source, map[string]map[string]struct{}{
+			"db": {"tbl-1": struct{}{}, "tbl-2": struct{}{}},
+		})
+		st2 = NewSourceTables(task, source, map[string]map[string]struct{}{
+			"db": {"tbl-1": struct{}{}},
+		})
+		i11 = NewInfo(task, source, upSchema, upTable, "foo", "bar",
+			[]string{"ALTER TABLE bar ADD COLUMN c1 INT"}, nil, nil)
+	)
+
+	// put with CAS when source tables not exist.
+	rev1, succ, err := PutSourceTablesInfoCAS(etcdTestCli, st1, i11, 0)
+	c.Assert(err, IsNil)
+	c.Assert(succ, IsTrue)
+
+	// source tables changed concurrently, e.g. a table removed.
+	rev2, err := PutSourceTables(etcdTestCli, st2)
+	c.Assert(err, IsNil)
+	c.Assert(rev2, Greater, rev1)
+
+	// CAS failed with the old revision.
+	_, succ, err = PutSourceTablesInfoCAS(etcdTestCli, st1, i11, rev1)
+	c.Assert(err, IsNil)
+	c.Assert(succ, IsFalse)
+	stm, _, err := GetAllSourceTables(etcdTestCli)
+	c.Assert(err, IsNil)
+	c.Assert(stm[task][source], DeepEquals, st2)
+
+	// CAS succeeded with the latest revision.
+	rev3, succ, err := PutSourceTablesInfoCAS(etcdTestCli, st1, i11, rev2)
+	c.Assert(err, IsNil)
+	c.Assert(succ, IsTrue)
+	c.Assert(rev3, Greater, rev2)
+	stm, _, err = GetAllSourceTables(etcdTestCli)
+	c.Assert(err, IsNil)
+	c.Assert(stm[task][source], DeepEquals, st1)
+	ifm, _, err := GetAllInfo(etcdTestCli)
+	c.Assert(err, IsNil)
+	c.Assert(ifm[task][source][upSchema][upTable], DeepEquals, i11)
+}
+
+func (t *testForEtcd) TestUpgradeInfosOperations(c *C) {
+	defer clearTestInfoOperation(c)
+
+	var (
+		task     = "test"
+		source   = "mysql-replica-1"
+		upSchema = "foo-1"
+		DDLs     = []string{"ALTER TABLE bar ADD COLUMN c1 INT"}
+		info1    = NewInfo(task, source, upSchema, "bar-1", "foo", "bar", DDLs, nil, nil)
+		info2    = NewInfo(task, source, upSchema, "bar-2", "foo", "bar", DDLs, nil, nil)
+		op1      = NewOperation("test-ID", task, source, upSchema, "bar-1", DDLs, ConflictNone, false)
+		op2      = NewOperation("test-ID", task, source, upSchema, "bar-2", DDLs, ConflictNone, false)
+
+		infoKey1 = common.ShardDDLOptimismInfoKeyAdapter.Encode(task, source, upSchema, info1.UpTable)
+		infoKey3 = common.ShardDDLOptimismInfoKeyAdapter.Encode(task, source, upSchema, "bar-3")
+		opKey1   = common.ShardDDLOptimismOperationKeyAdapter.Encode(task, source, upSchema, op1.UpTable)
+	)
+
+	// nothing to upgrade.
+	upgraded, _, err := UpgradeInfosOperations(etcdTestCli)
+	c.Assert(err, IsNil)
+	c.Assert(upgraded, Equals, 0)
+
+	// info1 and op1 are written without the version, info2 and op2 are written with the current version.
+	oldInfo1 := `{"task":"test","source":"mysql-replica-1","up-schema":"foo-1","up-table":"bar-1","down-schema":"foo","down-table":"bar","ddls":["ALTER TABLE bar ADD COLUMN c1 INT"],"table-info-before":null,"table-info-after":null}`
+	oldOp1 := `{"id":"test-ID","task":"test","source":"mysql-replica-1","up-schema":"foo-1","up-table":"bar-1","ddls":["ALTER TABLE bar ADD COLUMN c1 INT"],"conflict-stage":"none","done":false}`
+	_, err = etcdTestCli.Put(context.Background(), infoKey1, oldInfo1)
+	c.Assert(err, IsNil)
+	_, err = etcdTestCli.Put(context.Background(), opKey1, oldOp1)
+	c.Assert(err, IsNil)
+	_, err = etcdTestCli.Put(context.Background(), infoKey3, "not-a-json")
+	c.Assert(err, IsNil)
+	_, err = PutInfo(etcdTestCli, info2)
+	c.Assert(err, IsNil)
+	_, _, _, err = PutOperation(etcdTestCli, false, op2)
+	c.Assert(err, IsNil)
+
+	// old values are upgraded, others are skipped.
+	upgraded, rev, err := UpgradeInfosOperations(etcdTestCli)
+	c.Assert(err, IsNil)
+	c.Assert(upgraded, Equals, 2)
+	resp, err := etcdTestCli.Get(context.Background(), infoKey1)
+	c.Assert(err, IsNil)
+	c.Assert(resp.Kvs[0].ModRevision, Equals, rev-1)
+	c.Assert(string(resp.Kvs[0].Value), Equals, info1.String())
+	resp, err = etcdTestCli.Get(context.Background(), opKey1)
+	c.Assert(err, IsNil)
+	c.Assert(resp.Kvs[0].ModRevision, Equals, rev)
+	c.Assert(string(resp.Kvs[0].Value), Equals, op1.String())
+	resp, err = etcdTestCli.Get(context.Background(), infoKey3)
+	c.Assert(err, IsNil)
+	c.Assert(string(resp.Kvs[0].Value), Equals, "not-a-json")
+
+	// upgrade again, nothing changed.
+	upgraded, _, err = UpgradeInfosOperations(etcdTestCli)
+	c.Assert(err, IsNil)
+	c.Assert(upgraded, Equals, 0)
+}
+
+func (t *testForEtcd) TestValidateBootstrap(c *C) {
+	var (
+		task     = "test-validate-bootstrap"
+		source1  = "mysql-replica-1"
+		source2  = "mysql-replica-2"
+		upSchema = "foo-1"
+		upTable1 = "bar-1"
+		upTable2 = "bar-2"
+		DDLs     = []string{"ALTER TABLE bar ADD COLUMN c1 INT"}
+		i11      = NewInfo(task, source1, upSchema, upTable1, "foo", "bar", DDLs, nil, nil)
+		i12      = NewInfo(task, source1, upSchema, upTable2, "foo", "bar", DDLs, nil, nil)
+		i21      = NewInfo(task, source2, upSchema, upTable1, "foo", "bar", DDLs, nil, nil)
+		lockID   = genDDLLockID(i11)
+		op11     = NewOperation(lockID, task, source1, upSchema, upTable1, DDLs, ConflictNone, false)
+		op12     = NewOperation("another-ID", task, source1, upSchema, upTable2, DDLs, ConflictNone, false)
+		op22     = NewOperation(lockID, task, source2, upSchema, upTable2, DDLs, ConflictNone, false)
+
+		ifm = map[string]map[string]map[string]map[string]Info{
+			task: {
+				source1: {upSchema: {upTable1: i11, upTable2: i12}},
+				source2: {upSchema: {upTable1: i21}},
+			},
+		}
+		opm = map[string]map[string]map[string]map[string]Operation{
+			task: {source1: {upSchema: {upTable1: op11}}},
+		}
+		stm = map[string]map[string]SourceTables{
+			task: {
+				source1: NewSourceTablesBuilder(task, source1).AddTable(upSchema, upTable1).AddTable(upSchema, upTable2).Build(),
+				source2: NewSourceTablesBuilder(task, source2).AddTable(upSchema, upTable1).Build(),
+			},
+		}
+	)
+
+	// consistent.
+	c.Assert(ValidateBootstrap(nil, nil, nil), HasLen, 0)
+	c.Assert(ValidateBootstrap(ifm, opm, stm), HasLen, 0)
+
+	// inconsistent.
+	opm[task][source1][upSchema][upTable2] = op12
+	opm[task][source2] = map[string]map[string]Operation{upSchema: {upTable2: op22}}
+	delete(stm[task], source2)
+	c.Assert(ValidateBootstrap(ifm, opm, stm), DeepEquals, []string{
+		"operation of lock another-ID for table `foo-1`.`bar-2` of source mysql-replica-1 in task test-validate-bootstrap mismatches with the lock " + lockID + " of shard DDL info",
+		"operation of lock " + lockID + " for table `foo-1`.`bar-2` of source mysql-replica-2 in task test-validate-bootstrap has no matching shard DDL info",
+		"table `foo-1`.`bar-1` of shard DDL info in task test-validate-bootstrap not found in source tables of source mysql-replica-2",
+	})
+}
+
+func (t *testForEtcd) TestReconstructAtRev(c *C) {
+	var (
+		cli        = etcdutil.NewMemClient()
+		task       = "test-reconstruct-at-rev"
+		source1    = "mysql-replica-1"
+		source2    = "mysql-replica-2"
+		upSchema   = "foo-1"
+		upTable    = "bar-1"
+		downSchema = "foo"
+		downTable  = "bar"
+		DDLs       = []string{"ALTER TABLE bar ADD COLUMN c1 INT"}
+
+		p           = parser.New()
+		se          = mock.NewContext()
+		tblID int64 = 111
+		ti0         = createTableInfo(c, p, se, tblID, `CREATE TABLE bar (id INT PRIMARY KEY)`)
+		ti1         = createTableInfo(c, p, se, tblID, `CREATE TABLE bar (id INT PRIMARY KEY, c1 INT)`)
+
+		st1 = NewSourceTablesBuilder(task, source1).AddTable(upSchema, upTable).Build()
+		st2 = NewSourceTablesBuilder(task, source2).AddTable(upSchema, upTable).Build()
+		i1  = NewInfo(task, source1, upSchema, upTable, downSchema, downTable, DDLs, ti0, ti1)
+		i2  = NewInfo(task, source2, upSchema, upTable, downSchema, downTable, DDLs, ti0, ti1)
+	)
+	defer cli.Close()
+
+	// nothing in etcd.
+	rev0, err := PutSourceTables(cli, st2)
+	c.Assert(err, IsNil)
+	lk, tk, err := ReconstructAtRev(cli, rev0)
+	c.Assert(err, IsNil)
+	c.Assert(lk.Locks(), HasLen, 0)
+	c.Assert(tk.FindTables(task), DeepEquals, []SourceTables{st2})
+
+	// the first info.
+	rev1, err := PutSourceTablesInfo(cli, st1, i1)
+	c.Assert(err, IsNil)
+
+	// all infos and operations done.
+	_, err = PutInfo(cli, i2)
+	c.Assert(err, IsNil)
+	lockID := genDDLLockID(i1)
+	op1 := NewOperation(lockID, task, source1, upSchema, upTable, DDLs, ConflictNone, true)
+	op2 := NewOperation(lockID, task, source2, upSchema, upTable, DDLs, ConflictNone, true)
+	_, _, _, err = PutOperation(cli, false, op1)
+	c.Assert(err, IsNil)
+	rev2, _, _, err := PutOperation(cli, false, op2)
+	c.Assert(err, IsNil)
+
+	// the view at the first info.
+	lk, tk, err = ReconstructAtRev(cli, rev1)
+	c.Assert(err, IsNil)
+	c.Assert(tk.FindTables(task), DeepEquals, []SourceTables{st1, st2})
+	c.Assert(lk.LockIDs(), DeepEquals, []string{lockID})
+	synced, remain := lk.FindLock(lockID).IsSynced()
+	c.Assert(synced, IsFalse)
+	c.Assert(remain, Equals, 1)
+
+	// the latest view.
+	lk, _, err = ReconstructAtRev(cli, rev2)
+	c.Assert(err, IsNil)
+	synced, _ = lk.FindLock(lockID).IsSynced()
+	c.Assert(synced, IsTrue)
+	c.Assert(lk.FindLock(lockID).IsResolved(), IsTrue)
+
+	// the revision has been compacted.
+	_, err = cli.Compact(context.Background(), rev1)
+	c.Assert(err, IsNil)
+	_, _, err = ReconstructAtRev(cli, rev0)
+	c.Assert(terror.ErrShardDDLOptimismRevisionCompacted.Equal(err), IsTrue)
+	_, _, err = ReconstructAtRev(cli, rev1)
+	c.Assert(err, IsNil)
+	_, _, err = ReconstructAtRev(cli, rev2)
+	c.Assert(err, IsNil)
+}
@@ -0,0 +1,598 @@
+// Copyright 2020 PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package optimism
+
+import (
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+
+	"github.com/pingcap/parser/format"
+	"github.com/pingcap/parser/model"
+	"github.com/pingcap/parser/mysql"
+	"github.com/pingcap/parser/types"
+	"github.com/pingcap/tidb-tools/pkg/schemacmp"
+)
+
+// joinTableInfo joins multiple table info into one table info,
+// it tries to follow the same rules as `schemacmp.Table.Join`:
+//   - columns: union of all columns, for a column existing in multiple tables, the larger one is used.
+//     for a NOT NULL column without default value missing in some tables, the standard default value is used if valid.
+//   - indexes: intersection of all indexes, an index is kept only if all tables have the same one.
+// NOTE: some flags (like key flags) may differ from the joined `schemacmp.Table`,
+// the caller should check the restored schema of the returned table info if needed.
+func joinTableInfo(tis []*model.TableInfo) *model.TableInfo {
+	if len(tis) == 0 {
+		return nil
+	}
+
+	joined := tis[0].Clone()
+	colCount := make(map[string]int, len(joined.Columns)) // column name -> count of tables having the column.
+	for _, col := range joined.Columns {
+		colCount[col.Name.L]++
+	}
+	for _, ti := range tis[1:] {
+		for _, col := range ti.Columns {
+			colCount[col.Name.L]++
+			var idx = -1
+			for i, col2 := range joined.Columns {
+				if col2.Name.L == col.Name.L {
+					idx = i
+					break
+				}
+			}
+			if idx < 0 {
+				joined.Columns = append(joined.Columns, col.Clone())
+			} else if cmp, err := compareColumnInfo(col, joined.Columns[idx]); err == nil && cmp > 0 {
+				joined.Columns[idx] = col.Clone()
+			}
+		}
+
+		indices := make([]*model.IndexInfo, 0, len(joined.Indices))
+		for _, index := range joined.Indices {
+			if index2 := ti.FindIndexByName(index.Name.L); index2 != nil && indexDefinition(index) == indexDefinition(index2) {
+				indices = append(indices, index)
+			}
+		}
+		joined.Indices = indices
+	}
+
+	for i, col := range joined.Columns {
+		col.Offset = i
+		if colCount[col.Name.L] < len(tis) && mysql.HasNotNullFlag(col.Flag) &&
+			col.GetDefaultValue() == nil && !col.IsGenerated() {
+			// rows from tables without this column can still be inserted with the standard default value.
+			// NOTE: columns without a valid standard default value are kept as is, see `hasStandardDefaultValue`.
+			if defVal, ok := standardDefaultValue(col); ok {
+				_ = col.SetDefaultValue(defVal)
+				col.Flag &^= mysql.NoDefaultValueFlag
+			}
+		}
+	}
+	return joined
+}
+
+// standardDefaultValue returns the standard default value for a NOT NULL column,
+// the same as `schemacmp` used when joining a NOT NULL column with a missing column.
+// it returns false if the column has no valid standard default value, see `hasStandardDefaultValue`.
+func standardDefaultValue(col *model.ColumnInfo) (interface{}, bool) {
+	if !hasStandardDefaultValue(col) {
+		return nil, false
+	}
+
+	var tail string
+	if col.Decimal > 0 {
+		tail = "." + strings.Repeat("0", col.Decimal)
+	}
+
+	switch col.Tp {
+	case mysql.TypeTiny, mysql.TypeInt24, mysql.TypeShort, mysql.TypeLong, mysql.TypeLonglong,
+		mysql.TypeFloat, mysql.TypeDouble, mysql.TypeNewDecimal:
+		return "0", true
+	case mysql.TypeDuration:
+		return "00:00:00" + tail, true
+	case mysql.TypeYear:
+		return "0000", true
+	case mysql.TypeEnum:
+		if len(col.Elems) > 0 {
+			return col.Elems[0], true
+		}
+		return "", true
+	default:
+		return "", true
+	}
+}
+
+// hasStandardDefaultValue returns whether the standard default value of the column can be used in the downstream.
+// BLOB/TEXT/JSON/GEOMETRY columns can't have a default value, and zero dates are rejected in the strict SQL mode,
+// so a NOT NULL column of these types can't be added to only some tables without an explicit default value.
+func hasStandardDefaultValue(col *model.ColumnInfo) bool {
+	switch col.Tp {
+	case mysql.TypeTinyBlob, mysql.TypeMediumBlob, mysql.TypeLongBlob, mysql.TypeBlob,
+		mysql.TypeJSON, mysql.TypeGeometry,
+		mysql.TypeDate, mysql.TypeNewDate, mysql.TypeDatetime, mysql.TypeTimestamp:
+		return false
+	}
+	return true
+}
+
+// classifyConflict classifies the conflict detected when joining table info `a` with `b`.
+func classifyConflict(a, b *model.TableInfo) ConflictType {
+	if a == nil || b == nil {
+		return ConflictTypeUnknown
+	}
+
+	for _, col := range a.Columns {
+		col2 := model.FindColumnInfo(b.Columns, col.Name.L)
+		if col2 == nil {
+			continue
+		}
+		if _, err := compareColumnInfo(col, col2); err == nil {
+			continue
+		}
+		switch {
+		case col.IsGenerated() || col2.IsGenerated():
+			return ConflictTypeGeneratedColumn
+		case col.Tp != col2.Tp || col.Flen != col2.Flen || col.Decimal != col2.Decimal:
+			return ConflictTypeColumnType
+		case !strings.EqualFold(col.Charset, col2.Charset) || !strings.EqualFold(col.Collate, col2.Collate):
+			return ConflictTypeColumnCharset
+		case fmt.Sprintf("%v", col.GetDefaultValue()) != fmt.Sprintf("%v", col2.GetDefaultValue()):
+			return ConflictTypeColumnDefault
+		default:
+			return ConflictTypeColumnType
+		}
+	}
+
+	for _, index := range a.Indices {
+		if index2 := b.FindIndexByName(index.Name.L); index2 != nil && indexDefinition(index) != indexDefinition(index2) {
+			return ConflictTypeIncompatibleIndex
+		}
+	}
+
+	// a column missing in one table but referenced by indexes in another table.
+	if isColumnReferencedByMissing(a, b) || isColumnReferencedByMissing(b, a) {
+		return ConflictTypeDropReferencedColumn
+	}
+	return ConflictTypeUnknown
+}
+
+// charsetConflict returns the description of the first column in `a` which has a different charset or collation
+// with the one in `b`, e.g. "charset utf8 of column c1 conflicts with utf8mb4", empty if no such column.
+func charsetConflict(a, b *model.TableInfo) string {
+	if a == nil || b == nil {
+		return ""
+	}
+	for _, col := range a.Columns {
+		col2 := model.FindColumnInfo(b.Columns, col.Name.L)
+		if col2 == nil {
+			continue
+		}
+		if !strings.EqualFold(col.Charset, col2.Charset) {
+			return fmt.Sprintf("charset %s of column %s conflicts with %s", col.Charset, col.Name.O, col2.Charset)
+		}
+		if !strings.EqualFold(col.Collate, col2.Collate) {
+			return fmt.Sprintf("collation %s of column %s conflicts with %s", col.Collate, col.Name.O, col2.Collate)
+		}
+	}
+	return ""
+}
+
+// normalizeCollation returns a copy of the table info with the charset and collation of the table
+// and all non-binary string columns replaced by `charset` and `collation`, `ti` itself is not changed.
+func normalizeCollation(ti *model.TableInfo, charset, collation string) *model.TableInfo {
+	if ti == nil {
+		return nil
+	}
+	ti = ti.Clone()
+	ti.Charset, ti.Collate = charset, collation
+	for _, col := range ti.Columns {
+		if types.HasCharset(&col.FieldType) {
+			col.Charset, col.Collate = charset, collation
+		}
+	}
+	return ti
+}
+
+// conflictIndex returns the index added or changed from `oldTI` to `newTI` which has the same name
+// but a different definition with an index in `other`, nil if no such index.
+// NOTE: `schemacmp` only keeps indexes existing in all tables when joining, so we check these indexes explicitly.
+func conflictIndex(oldTI, newTI, other *model.TableInfo) *model.IndexInfo {
+	if newTI == nil || other == nil {
+		return nil
+	}
+	for _, index := range newTI.Indices {
+		if oldTI != nil {
+			if oldIndex := oldTI.FindIndexByName(index.Name.L); oldIndex != nil && indexDefinition(oldIndex) == indexDefinition(index) {
+				continue // not changed.
+			}
+		}
+		if index2 := other.FindIndexByName(index.Name.L); index2 != nil && indexDefinition(index) != indexDefinition(index2) {
+			return index
+		}
+	}
+	return nil
+}
+
+// indexColumnsReordered returns whether two indexes have the same key type and the same columns but in different orders.
+func indexColumnsReordered(a, b *model.IndexInfo) bool {
+	if a == nil || b == nil || a.Primary != b.Primary || a.Unique != b.Unique || len(a.Columns) != len(b.Columns) {
+		return false
+	}
+	reordered := false
+	for i, col := range a.Columns {
+		if col.Name.L != b.Columns[i].Name.L {
+			reordered = true
+		}
+		found := false
+		for _, col2 := range b.Columns {
+			if col.Name.L == col2.Name.L && col.Length == col2.Length {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return reordered
+}
+
+// indexColumnOrder returns the comma separated column names of the index in order, like `(a, b)`.
+func indexColumnOrder(index *model.IndexInfo) string {
+	names := make([]string, 0, len(index.Columns))
+	for _, col := range index.Columns {
+		names = append(names, col.Name.O)
+	}
+	return "(" + strings.Join(names, ", ") + ")"
+}
+
+// isColumnReferencedByMissing returns whether any index in `a` references a column not exists in `b`.
+func isColumnReferencedByMissing(a, b *model.TableInfo) bool {
+	for _, index := range a.Indices {
+		for _, col := range index.Columns {
+			if model.FindColumnInfo(b.Columns, col.Name.L) == nil {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// missingColumns returns names of columns in `a` but not in `b`, in the order of columns in `a`.
+func missingColumns(a, b *model.TableInfo) []string {
+	names := make([]string, 0)
+	if a == nil {
+		return names
+	}
+	for _, col := range a.Columns {
+		if b == nil || model.FindColumnInfo(b.Columns, col.Name.L) == nil {
+			names = append(names, col.Name.O)
+		}
+	}
+	return names
+}
+
+// compareColumnInfo compares two column info with the same rules as `schemacmp.Table.Compare`.
+func compareColumnInfo(a, b *model.ColumnInfo) (int, error) {
+	ta := schemacmp.Encode(&model.TableInfo{Columns: []*model.ColumnInfo{a}})
+	tb := schemacmp.Encode(&model.TableInfo{Columns: []*model.ColumnInfo{b}})
+	return ta.Compare(tb)
+}
+
+// integerTypeRanks and floatTypeRanks are the orders of numeric types used to widen column types.
+var (
+	integerTypeRanks = map[byte]int{
+		mysql.TypeTiny:     1,
+		mysql.TypeShort:    2,
+		mysql.TypeInt24:    3,
+		mysql.TypeLong:     4,
+		mysql.TypeLonglong: 5,
+	}
+	floatTypeRanks = map[byte]int{
+		mysql.TypeFloat:  1,
+		mysql.TypeDouble: 2,
+	}
+)
+
+// sameColumnType returns whether two columns have the same type, other attributes are not compared.
+func sameColumnType(a, b *model.ColumnInfo) bool {
+	return a.Tp == b.Tp && a.Flen == b.Flen && a.Decimal == b.Decimal &&
+		mysql.HasUnsignedFlag(a.Flag) == mysql.HasUnsignedFlag(b.Flag)
+}
+
+// widenColumnType returns a copy of column `a` with the type widened to hold values of both `a` and `b`,
+// it returns false if the types can't be widened to each other. the compatibility matrix is:
+//   - integers: TINYINT < SMALLINT < MEDIUMINT < INT < BIGINT.
+//   - floating-point numbers: FLOAT < DOUBLE.
+//   - fixed-point numbers: DECIMAL(M, D) is widened to have both the max integer digits (M - D) and the max scale (D),
+//     e.g. DECIMAL(10, 2) and DECIMAL(8, 4) are widened to DECIMAL(12, 4).
+//   - both of them MUST be signed or unsigned, and types of different families are incompatible.
+// other types (e.g. strings with different lengths) are not widened here, they are handled by joining schemas as before.
+func widenColumnType(a, b *model.ColumnInfo) (*model.ColumnInfo, bool) {
+	if mysql.HasUnsignedFlag(a.Flag) != mysql.HasUnsignedFlag(b.Flag) {
+		return nil, false
+	}
+
+	w := a.Clone()
+	rankA, okA := integerTypeRanks[a.Tp]
+	rankB, okB := integerTypeRanks[b.Tp]
+	if !okA || !okB {
+		rankA, okA = floatTypeRanks[a.Tp]
+		rankB, okB = floatTypeRanks[b.Tp]
+	}
+	switch {
+	case okA && okB:
+		if rankB > rankA || (rankB == rankA && b.Flen > a.Flen) {
+			w.Tp, w.Flen, w.Decimal = b.Tp, b.Flen, b.Decimal
+		}
+	case a.Tp == mysql.TypeNewDecimal && b.Tp == mysql.TypeNewDecimal:
+		digits, scale := a.Flen-a.Decimal, a.Decimal
+		if b.Flen-b.Decimal > digits {
+			digits = b.Flen - b.Decimal
+		}
+		if b.Decimal > scale {
+			scale = b.Decimal
+		}
+		w.Flen, w.Decimal = digits+scale, scale
+	default:
+		return nil, false
+	}
+	return w, true
+}
+
+// narrowedColumn returns the first column whose type is narrowed from `oldTI` to `newTI` by the compatibility matrix
+// of `widenColumnType`, and the column before narrowed. nil is returned if no column narrowed.
+func narrowedColumn(oldTI, newTI *model.TableInfo) (*model.ColumnInfo, *model.ColumnInfo) {
+	if oldTI == nil || newTI == nil {
+		return nil, nil
+	}
+	for _, col := range newTI.Columns {
+		oldCol := model.FindColumnInfo(oldTI.Columns, col.Name.L)
+		if oldCol == nil || sameColumnType(oldCol, col) {
+			continue
+		}
+		if w, ok := widenColumnType(col, oldCol); ok && !sameColumnType(w, col) {
+			return col, oldCol
+		}
+	}
+	return nil, nil
+}
+
+// widenTableInfo returns the table info with types of columns widened to the ones in `widest`,
+// `ti` itself is returned if no column needs to be widened.
+func widenTableInfo(ti *model.TableInfo, widest map[string]*model.ColumnInfo) *model.TableInfo {
+	var widened *model.TableInfo
+	for i, col := range ti.Columns {
+		w, ok := widest[col.Name.L]
+		if !ok || sameColumnType(w, col) {
+			continue
+		}
+		if widened == nil {
+			widened = ti.Clone()
+		}
+		widened.Columns[i].Tp, widened.Columns[i].Flen, widened.Columns[i].Decimal = w.Tp, w.Flen, w.Decimal
+	}
+	if widened == nil {
+		return ti
+	}
+	return widened
+}
+
+// encodeTable encodes the table info for the coordination with the auto-increment value (`AUTO_INCREMENT = N`) ignored,
+// because the value is not a part of the schema and differs between sharding tables naturally,
+// e.g. after `ALTER TABLE t AUTO_INCREMENT = 1000` in one of the sharding tables.
+func encodeTable(ti *model.TableInfo) schemacmp.Table {
+	if ti != nil && ti.AutoIncID != 0 {
+		clone := *ti
+		clone.AutoIncID = 0
+		ti = &clone
+	}
+	return schemacmp.Encode(ti)
+}
+
+// diffTableInfo returns DDLs to change the schema of table `tableName` from `from` to `to`.
+// these DDLs are in the following order:
+//   1. DROP INDEX
+//   2. DROP COLUMN
+//   3. ADD COLUMN (generated columns are added after other columns, because they may reference other columns)
+//   4. MODIFY COLUMN
+//   5. ADD INDEX
+func diffTableInfo(tableName string, from, to *model.TableInfo) []string {
+	var (
+		dropIndexes   []string
+		dropColumns   []string
+		addColumns    []string
+		addGenColumns []string
+		modColumns    []string
+		addIndexes    []string
+	)
+
+	for _, index := range from.Indices {
+		if index2 := to.FindIndexByName(index.Name.L); index2 == nil || indexDefinition(index) != indexDefinition(index2) {
+			if index.Primary {
+				dropIndexes = append(dropIndexes, fmt.Sprintf("ALTER TABLE %s DROP PRIMARY KEY", tableName))
+			} else {
+				dropIndexes = append(dropIndexes, fmt.Sprintf("ALTER TABLE %s DROP INDEX %s", tableName, quoteName(index.Name.O)))
+			}
+		}
+	}
+	for _, index := range to.Indices {
+		if index2 := from.FindIndexByName(index.Name.L); index2 == nil || indexDefinition(index) != indexDefinition(index2) {
+			addIndexes = append(addIndexes, fmt.Sprintf("ALTER TABLE %s ADD %s", tableName, indexDefinition(index)))
+		}
+	}
+
+	for _, col := range from.Columns {
+		if model.FindColumnInfo(to.Columns, col.Name.L) == nil {
+			dropColumns = append(dropColumns, fmt.Sprintf("ALTER TABLE %s DROP COLUMN %s", tableName, quoteName(col.Name.O)))
+		}
+	}
+	for _, col := range to.Columns {
+		col2 := model.FindColumnInfo(from.Columns, col.Name.L)
+		if col2 == nil {
+			ddl := fmt.Sprintf("ALTER TABLE %s ADD COLUMN %s", tableName, columnDefinition(col))
+			if col.IsGenerated() {
+				addGenColumns = append(addGenColumns, ddl)
+			} else {
+				addColumns = append(addColumns, ddl)
+			}
+		} else if def := columnDefinition(col); def != columnDefinition(col2) {
+			modColumns = append(modColumns, fmt.Sprintf("ALTER TABLE %s MODIFY COLUMN %s", tableName, def))
+		}
+	}
+
+	ddls := make([]string, 0, len(dropIndexes)+len(dropColumns)+len(addColumns)+len(addGenColumns)+len(modColumns)+len(addIndexes))
+	ddls = append(ddls, dropIndexes...)
+	ddls = append(ddls, dropColumns...)
+	ddls = append(ddls, addColumns...)
+	ddls = append(ddls, addGenColumns...)
+	ddls = append(ddls, modColumns...)
+	ddls = append(ddls, addIndexes...)
+	return ddls
+}
+
+// columnDefinition returns the column definition used in `ADD COLUMN` or `MODIFY COLUMN`.
+func columnDefinition(col *model.ColumnInfo) string {
+	var sb strings.Builder
+	ctx := format.NewRestoreCtx(format.DefaultRestoreFlags, &sb)
+
+	ctx.WriteName(col.Name.O)
+	ctx.WritePlain(" ")
+	_ = col.FieldType.Restore(ctx)
+	if col.IsGenerated() {
+		ctx.WriteKeyWord(" GENERATED ALWAYS AS ")
+		ctx.WritePlainf("(%s)", col.GeneratedExprString)
+		if col.GeneratedStored {
+			ctx.WriteKeyWord(" STORED")
+		} else {
+			ctx.WriteKeyWord(" VIRTUAL")
+		}
+	}
+	if mysql.HasNotNullFlag(col.Flag) {
+		ctx.WriteKeyWord(" NOT NULL")
+	}
+	if defVal := col.GetDefaultValue(); defVal != nil {
+		ctx.WriteKeyWord(" DEFAULT ")
+		if s, ok := defVal.(string); ok {
+			if strings.EqualFold(s, "CURRENT_TIMESTAMP") {
+				ctx.WriteKeyWord(s)
+			} else {
+				ctx.WriteString(s)
+			}
+		} else {
+			ctx.WritePlainf("%v", defVal)
+		}
+	}
+	if mysql.HasAutoIncrementFlag(col.Flag) {
+		ctx.WriteKeyWord(" AUTO_INCREMENT")
+	}
+	if len(col.Comment) > 0 {
+		ctx.WriteKeyWord(" COMMENT ")
+		ctx.WriteString(col.Comment)
+	}
+	return sb.String()
+}
+
+// indexDefinition returns the index definition used in `ADD INDEX`.
+func indexDefinition(index *model.IndexInfo) string {
+	var sb strings.Builder
+	ctx := format.NewRestoreCtx(format.DefaultRestoreFlags, &sb)
+
+	switch {
+	case index.Primary:
+		ctx.WriteKeyWord("PRIMARY KEY")
+	case index.Unique:
+		ctx.WriteKeyWord("UNIQUE INDEX ")
+		ctx.WriteName(index.Name.O)
+	default:
+		ctx.WriteKeyWord("INDEX ")
+		ctx.WriteName(index.Name.O)
+	}
+	ctx.WritePlain("(")
+	for i, col := range index.Columns {
+		if i != 0 {
+			ctx.WritePlain(", ")
+		}
+		ctx.WriteName(col.Name.O)
+		if col.Length > 0 {
+			ctx.WritePlainf("(%d)", col.Length)
+		}
+	}
+	ctx.WritePlain(")")
+	return sb.String()
+}
+
+// createTableDefinition returns the `CREATE TABLE` statement of table `tableName` with the schema of `ti`.
+// columns and indexes are in the same order as in `ti`, the primary key is always the first index.
+func createTableDefinition(tableName string, ti *model.TableInfo) string {
+	defs := make([]string, 0, len(ti.Columns)+len(ti.Indices)+1)
+	for _, col := range ti.Columns {
+		defs = append(defs, columnDefinition(col))
+	}
+	if ti.PKIsHandle {
+		// the integer primary key is not in the indexes.
+		if pk := ti.GetPkColInfo(); pk != nil {
+			defs = append(defs, fmt.Sprintf("PRIMARY KEY (%s)", quoteName(pk.Name.O)))
+		}
+	}
+	for _, index := range ti.Indices {
+		if index.Primary {
+			defs = append(defs, indexDefinition(index))
+		}
+	}
+	for _, index := range ti.Indices {
+		if !index.Primary {
+			defs = append(defs, indexDefinition(index))
+		}
+	}
+
+	var sb strings.Builder
+	ctx := format.NewRestoreCtx(format.DefaultRestoreFlags, &sb)
+	ctx.WriteKeyWord("CREATE TABLE ")
+	ctx.WritePlain(tableName)
+	ctx.WritePlain(" (\n  ")
+	ctx.WritePlain(strings.Join(defs, ",\n  "))
+	ctx.WritePlain("\n)")
+	if len(ti.Charset) > 0 {
+		ctx.WriteKeyWord(" DEFAULT CHARSET=")
+		ctx.WritePlain(ti.Charset)
+	}
+	if len(ti.Collate) > 0 {
+		ctx.WriteKeyWord(" COLLATE=")
+		ctx.WritePlain(ti.Collate)
+	}
+	if len(ti.Comment) > 0 {
+		ctx.WriteKeyWord(" COMMENT=")
+		ctx.WriteString(ti.Comment)
+	}
+	return sb.String()
+}
+
+// quoteName quotes the name with backticks.
+func quoteName(name string) string {
+	return "`" + strings.Replace(name, "`", "``", -1) + "`"
+}
+
+// sortedKeys returns the sorted keys of a map with string keys.
+func sortedKeys(m interface{}) []string {
+	keys := reflect.ValueOf(m).MapKeys()
+	ret := make([]string, 0, len(keys))
+	for _, key := range keys {
+		ret = append(ret, key.String())
+	}
+	sort.Strings(ret)
+	return ret
+}
@@ -0,0 +1,272 @@
+// Copyright 2020 PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package optimism
+
+import (
+	. "github.com/pingcap/check"
+	"github.com/pingcap/parser"
+	"github.com/pingcap/parser/model"
+	"github.com/pingcap/tidb-tools/pkg/schemacmp"
+	"github.com/pingcap/tidb/util/mock"
+)
+
+type testSchema struct{}
+
+var _ = Suite(&testSchema{})
+
+func (t *testSchema) TestJoinTableInfo(c *C) {
+	var (
+		p           = parser.New()
+		se          = mock.NewContext()
+		tblID int64 = 111
+		ti1         = createTableInfo(c, p, se, tblID, `CREATE TABLE bar (id INT PRIMARY KEY, c1 INT, INDEX idx1(c1))`)
+		ti2         = createTableInfo(c, p, se, tblID, `CREATE TABLE bar (id INT PRIMARY KEY, c1 INT, c2 VARCHAR(20), INDEX idx1(c1))`)
+		ti3         = createTableInfo(c, p, se, tblID, `CREATE TABLE bar (id INT PRIMARY KEY, c2 VARCHAR(10), c3 INT)`)
+	)
+
+	c.Assert(joinTableInfo(nil), IsNil)
+
+	tis := []*model.TableInfo{ti1, ti2, ti3}
+	joined := joinTableInfo(tis)
+	c.Assert(joined.Columns, HasLen, 4)
+	c.Assert(joined.Indices, HasLen, 0) // `idx1` not exists in ti3.
+
+	// the joined table info should restore to the same schema as joined by `schemacmp`.
+	joinedT := schemacmp.Encode(ti1)
+	for _, ti := range tis[1:] {
+		var err error
+		joinedT, err = joinedT.Join(schemacmp.Encode(ti))
+		c.Assert(err, IsNil)
+	}
+	c.Assert(schemacmp.Encode(joined).String(), Equals, joinedT.String())
+}
+
+func (t *testSchema) TestDiffTableInfo(c *C) {
+	var (
+		p           = parser.New()
+		se          = mock.NewContext()
+		tblID int64 = 111
+		tbl         = "`foo`.`bar`"
+		ti1         = createTableInfo(c, p, se, tblID, `CREATE TABLE bar (id INT PRIMARY KEY, c1 INT, c2 INT, INDEX idx1(c1))`)
+		ti2         = createTableInfo(c, p, se, tblID, `CREATE TABLE bar (id INT PRIMARY KEY, c1 BIGINT, c3 INT NOT NULL DEFAULT 1, UNIQUE INDEX idx2(c1, c3))`)
+	)
+
+	c.Assert(diffTableInfo(tbl, ti1, ti1), HasLen, 0)
+	c.Assert(diffTableInfo(tbl, ti1, ti2), DeepEquals, []string{
+		"ALTER TABLE `foo`.`bar` DROP INDEX `idx1`",
+		"ALTER TABLE `foo`.`bar` DROP COLUMN `c2`",
+		"ALTER TABLE `foo`.`bar` ADD COLUMN `c3` INT(11) NOT NULL DEFAULT '1'",
+		"ALTER TABLE `foo`.`bar` MODIFY COLUMN `c1` BIGINT(20)",
+		"ALTER TABLE `foo`.`bar` ADD UNIQUE INDEX `idx2`(`c1`, `c3`)",
+	})
+
+	// generated columns are added after other columns.
+	ti3 := createTableInfo(c, p, se, tblID, `CREATE TABLE bar (id INT PRIMARY KEY)`)
+	ti4 := createTableInfo(c, p, se, tblID, `CREATE TABLE bar (id INT PRIMARY KEY, g1 INT AS (c1 + 1) STORED, c1 INT, g2 INT AS (c1 + 2) VIRTUAL)`)
+	c.Assert(diffTableInfo(tbl, ti3, ti4), DeepEquals, []string{
+		"ALTER TABLE `foo`.`bar` ADD COLUMN `c1` INT(11)",
+		"ALTER TABLE `foo`.`bar` ADD COLUMN `g1` INT(11) GENERATED ALWAYS AS (`c1` + 1) STORED",
+		"ALTER TABLE `foo`.`bar` ADD COLUMN `g2` INT(11) GENERATED ALWAYS AS (`c1` + 2) VIRTUAL",
+	})
+}
+
+func (t *testSchema) TestClassifyConflict(c *C) {
+	var (
+		p           = parser.New()
+		se          = mock.NewContext()
+		tblID int64 = 111
+		ti0         = createTableInfo(c, p, se, tblID, `CREATE TABLE bar (id INT PRIMARY KEY, c1 INT, INDEX idx1(c1))`)
+		cases       = []struct {
+			sql string
+			tp  ConflictType
+		}{
+			{`CREATE TABLE bar (id INT PRIMARY KEY, c1 INT, INDEX idx1(c1))`, ConflictTypeUnknown},
+			{`CREATE TABLE bar (id INT PRIMARY KEY, c1 TEXT, INDEX idx1(c1(10)))`, ConflictTypeColumnType},
+			{`CREATE TABLE bar (id INT PRIMARY KEY, c1 INT DEFAULT 1, INDEX idx1(c1))`, ConflictTypeUnknown},
+			{`CREATE TABLE bar (id INT PRIMARY KEY, c1 INT AS (id + 1), INDEX idx1(c1))`, ConflictTypeGeneratedColumn},
+			{`CREATE TABLE bar (id INT PRIMARY KEY, c1 INT, INDEX idx1(id))`, ConflictTypeIncompatibleIndex},
+			{`CREATE TABLE bar (id INT PRIMARY KEY, c2 INT)`, ConflictTypeDropReferencedColumn},
+		}
+	)
+
+	c.Assert(classifyConflict(nil, ti0), Equals, ConflictTypeUnknown)
+	for _, cs := range cases {
+		ti := createTableInfo(c, p, se, tblID, cs.sql)
+		c.Assert(classifyConflict(ti0, ti), Equals, cs.tp, Commentf("sql: %s", cs.sql))
+	}
+
+	// different default values.
+	ti1 := createTableInfo(c, p, se, tblID, `CREATE TABLE bar (id INT PRIMARY KEY, c1 INT DEFAULT 1)`)
+	ti2 := createTableInfo(c, p, se, tblID, `CREATE TABLE bar (id INT PRIMARY KEY, c1 INT DEFAULT 2)`)
+	c.Assert(classifyConflict(ti1, ti2), Equals, ConflictTypeColumnDefault)
+
+	// different charsets or collations.
+	ti3 := createTableInfo(c, p, se, tblID, `CREATE TABLE bar (id INT PRIMARY KEY, c1 VARCHAR(10) CHARACTER SET utf8mb4)`)
+	ti4 := createTableInfo(c, p, se, tblID, `CREATE TABLE bar (id INT PRIMARY KEY, c1 VARCHAR(10) CHARACTER SET latin1)`)
+	ti5 := createTableInfo(c, p, se, tblID, `CREATE TABLE bar (id INT PRIMARY KEY, c1 VARCHAR(10) CHARACTER SET utf8mb4 COLLATE utf8mb4_general_ci)`)
+	ti6 := createTableInfo(c, p, se, tblID, `CREATE TABLE bar (id INT PRIMARY KEY, c1 VARCHAR(20) CHARACTER SET latin1)`)
+	c.Assert(classifyConflict(ti3, ti4), Equals, ConflictTypeColumnCharset)
+	c.Assert(classifyConflict(ti3, ti5), Equals, ConflictTypeColumnCharset)
+	c.Assert(classifyConflict(ti3, ti6), Equals, ConflictTypeColumnType) // the type is also different.
+}
+
+func (t *testSchema) TestCharsetConflict(c *C) {
+	var (
+		p           = parser.New()
+		se          = mock.NewContext()
+		tblID int64 = 111
+		ti0         = createTableInfo(c, p, se, tblID, `CREATE TABLE bar (id INT PRIMARY KEY, c1 VARCHAR(10) CHARACTER SET utf8mb4)`)
+		ti1         = createTableInfo(c, p, se, tblID, `CREATE TABLE bar (id INT PRIMARY KEY, c1 VARCHAR(10) CHARACTER SET latin1)`)
+		ti2         = createTableInfo(c, p, se, tblID, `CREATE TABLE bar (id INT PRIMARY KEY, c1 VARCHAR(10) CHARACTER SET utf8mb4 COLLATE utf8mb4_general_ci)`)
+		ti3         = createTableInfo(c, p, se, tblID, `CREATE TABLE bar (id INT PRIMARY KEY, c2 VARCHAR(10) CHARACTER SET latin1)`)
+	)
+
+	c.Assert(charsetConflict(ti0, ti1), Equals, "charset utf8mb4 of column c1 conflicts with latin1")
+	c.Assert(charsetConflict(ti1, ti0), Equals, "charset latin1 of column c1 conflicts with utf8mb4")
+	c.Assert(charsetConflict(ti0, ti2), Equals, "collation utf8mb4_bin of column c1 conflicts with utf8mb4_general_ci")
+	c.Assert(charsetConflict(ti0, ti0), Equals, "")
+	c.Assert(charsetConflict(ti0, ti3), Equals, "") // no common columns.
+	c.Assert(charsetConflict(nil, ti0), Equals, "")
+}
+
+func (t *testSchema) TestNormalizeCollation(c *C) {
+	var (
+		p           = parser.New()
+		se          = mock.NewContext()
+		tblID int64 = 111
+		ti0         = createTableInfo(c, p, se, tblID, `CREATE TABLE bar (id INT PRIMARY KEY, c1 VARCHAR(10), c2 TEXT CHARACTER SET latin1,
+c3 VARBINARY(10), c4 ENUM('a', 'b')) DEFAULT CHARSET = utf8mb4`)
+		ti1 = createTableInfo(c, p, se, tblID, `CREATE TABLE bar (id INT PRIMARY KEY, c1 VARCHAR(10) COLLATE utf8mb4_general_ci)`)
+	)
+	c.Assert(charsetConflict(ti0, ti1), Equals, "collation utf8mb4_bin of column c1 conflicts with utf8mb4_general_ci")
+
+	ti2 := normalizeCollation(ti0, "utf8mb4", "utf8mb4_general_ci")
+	c.Assert(ti2.Charset, Equals, "utf8mb4")
+	c.Assert(ti2.Collate, Equals, "utf8mb4_general_ci")
+	for _, col := range []string{"c1", "c2", "c4"} {
+		c.Assert(model.FindColumnInfo(ti2.Columns, col).Charset, Equals, "utf8mb4")
+		c.Assert(model.FindColumnInfo(ti2.Columns, col).Collate, Equals, "utf8mb4_general_ci")
+	}
+	c.Assert(model.FindColumnInfo(ti2.Columns, "c3").Charset, Equals, "binary") // binary strings are kept.
+	c.Assert(charsetConflict(ti2, normalizeCollation(ti1, "utf8mb4", "utf8mb4_general_ci")), Equals, "")
+	c.Assert(model.FindColumnInfo(ti0.Columns, "c1").Collate, Equals, "utf8mb4_bin") // not changed.
+	c.Assert(normalizeCollation(nil, "utf8mb4", "utf8mb4_general_ci"), IsNil)
+}
+
+func (t *testSchema) TestConflictIndex(c *C) {
+	var (
+		p           = parser.New()
+		se          = mock.NewContext()
+		tblID int64 = 111
+		ti0         = createTableInfo(c, p, se, tblID, `CREATE TABLE bar (id INT PRIMARY KEY, c1 INT, c2 INT)`)
+		ti1         = createTableInfo(c, p, se, tblID, `CREATE TABLE bar (id INT PRIMARY KEY, c1 INT, c2 INT, INDEX idx1(c1))`)
+		ti2         = createTableInfo(c, p, se, tblID, `CREATE TABLE bar (id INT PRIMARY KEY, c1 INT, c2 INT, INDEX idx1(c2))`)
+		ti3         = createTableInfo(c, p, se, tblID, `CREATE TABLE bar (id INT PRIMARY KEY, c1 INT, c2 INT, INDEX idx1(c1), INDEX idx2(c2))`)
+	)
+
+	c.Assert(conflictIndex(ti0, nil, ti2), IsNil)
+	c.Assert(conflictIndex(ti0, ti1, nil), IsNil)
+	c.Assert(conflictIndex(ti0, ti1, ti0), IsNil) // not exist in other.
+	c.Assert(conflictIndex(ti0, ti1, ti1), IsNil) // the same definition.
+	c.Assert(conflictIndex(ti0, ti1, ti2).Name.O, Equals, "idx1")
+	c.Assert(conflictIndex(nil, ti1, ti2).Name.O, Equals, "idx1")
+	c.Assert(conflictIndex(ti1, ti3, ti2), IsNil) // `idx1` not changed.
+}
+
+func (t *testSchema) TestIndexColumnsReordered(c *C) {
+	var (
+		p           = parser.New()
+		se          = mock.NewContext()
+		tblID int64 = 111
+		ti0         = createTableInfo(c, p, se, tblID, `CREATE TABLE bar (id INT PRIMARY KEY, c1 INT, c2 INT, c3 VARCHAR(20), INDEX idx1(c1, c2))`)
+		ti1         = createTableInfo(c, p, se, tblID, `CREATE TABLE bar (id INT PRIMARY KEY, c1 INT, c2 INT, c3 VARCHAR(20), INDEX idx1(c2, c1))`)
+		ti2         = createTableInfo(c, p, se, tblID, `CREATE TABLE bar (id INT PRIMARY KEY, c1 INT, c2 INT, c3 VARCHAR(20), UNIQUE INDEX idx1(c2, c1))`)
+		ti3         = createTableInfo(c, p, se, tblID, `CREATE TABLE bar (id INT PRIMARY KEY, c1 INT, c2 INT, c3 VARCHAR(20), INDEX idx1(c2, c3))`)
+		ti4         = createTableInfo(c, p, se, tblID, `CREATE TABLE bar (id INT PRIMARY KEY, c1 INT, c2 INT, c3 VARCHAR(20), INDEX idx1(c1, c2, c3))`)
+		ti5         = createTableInfo(c, p, se, tblID, `CREATE TABLE bar (id INT PRIMARY KEY, c1 INT, c2 INT, c3 VARCHAR(20), INDEX idx1(c3(10), c1))`)
+		ti6         = createTableInfo(c, p, se, tblID, `CREATE TABLE bar (id INT PRIMARY KEY, c1 INT, c2 INT, c3 VARCHAR(20), INDEX idx1(c1, c3(5)))`)
+		ti7         = createTableInfo(c, p, se, tblID, `CREATE TABLE bar (id INT PRIMARY KEY, c1 INT, c2 INT, c3 VARCHAR(20), INDEX idx1(c1, c3(10)))`)
+		idx         = func(ti *model.TableInfo) *model.IndexInfo { return ti.FindIndexByName("idx1") }
+	)
+
+	c.Assert(indexColumnsReordered(idx(ti0), idx(ti1)), IsTrue)
+	c.Assert(indexColumnsReordered(idx(ti1), idx(ti0)), IsTrue)
+	c.Assert(indexColumnsReordered(idx(ti0), idx(ti0)), IsFalse) // the same order.
+	c.Assert(indexColumnsReordered(idx(ti0), idx(ti2)), IsFalse) // different key types.
+	c.Assert(indexColumnsReordered(idx(ti0), idx(ti3)), IsFalse) // different columns.
+	c.Assert(indexColumnsReordered(idx(ti0), idx(ti4)), IsFalse) // different numbers of columns.
+	c.Assert(indexColumnsReordered(idx(ti5), idx(ti6)), IsFalse) // different prefix lengths.
+	c.Assert(indexColumnsReordered(idx(ti5), idx(ti7)), IsTrue)
+	c.Assert(indexColumnsReordered(nil, idx(ti0)), IsFalse)
+
+	c.Assert(indexColumnOrder(idx(ti0)), Equals, "(c1, c2)")
+	c.Assert(indexColumnOrder(idx(ti5)), Equals, "(c3, c1)")
+}
+
+func (t *testSchema) TestWidenColumnType(c *C) {
+	var (
+		p           = parser.New()
+		se          = mock.NewContext()
+		tblID int64 = 111
+		col         = func(tp string) *model.ColumnInfo {
+			ti := createTableInfo(c, p, se, tblID, `CREATE TABLE bar (id INT PRIMARY KEY, c1 `+tp+`)`)
+			return model.FindColumnInfo(ti.Columns, "c1")
+		}
+		cases = []struct {
+			a, b    string
+			widened string // empty if incompatible.
+		}{
+			{"INT", "BIGINT", "bigint(20)"},
+			{"BIGINT", "INT", "bigint(20)"},
+			{"TINYINT", "MEDIUMINT", "mediumint(9)"},
+			{"INT", "INT", "int(11)"},
+			{"INT UNSIGNED", "BIGINT UNSIGNED", "bigint(20)"},
+			{"FLOAT", "DOUBLE", "double"},
+			{"DECIMAL(10,2)", "DECIMAL(12,2)", "decimal(12,2)"},
+			{"DECIMAL(10,2)", "DECIMAL(8,4)", "decimal(12,4)"},
+			{"INT", "INT UNSIGNED", ""},
+			{"INT", "DOUBLE", ""},
+			{"INT", "VARCHAR(10)", ""},
+			{"VARCHAR(10)", "VARCHAR(20)", ""},
+		}
+	)
+
+	for _, cs := range cases {
+		a, b := col(cs.a), col(cs.b)
+		w, ok := widenColumnType(a, b)
+		c.Assert(ok, Equals, cs.widened != "", Commentf("%s and %s", cs.a, cs.b))
+		if ok {
+			c.Assert(w.FieldType.CompactStr(), Equals, cs.widened, Commentf("%s and %s", cs.a, cs.b))
+			c.Assert(w.Name.L, Equals, "c1")
+			c.Assert(a.FieldType.CompactStr(), Equals, col(cs.a).FieldType.CompactStr()) // `a` is not changed.
+		}
+	}
+
+	// narrowed columns.
+	var (
+		ti0 = createTableInfo(c, p, se, tblID, `CREATE TABLE bar (id INT PRIMARY KEY, c1 BIGINT, c2 DECIMAL(10,2))`)
+		ti1 = createTableInfo(c, p, se, tblID, `CREATE TABLE bar (id INT PRIMARY KEY, c1 INT, c2 DECIMAL(10,2))`)
+		ti2 = createTableInfo(c, p, se, tblID, `CREATE TABLE bar (id INT PRIMARY KEY, c1 BIGINT, c2 DECIMAL(10,4))`)
+		ti3 = createTableInfo(c, p, se, tblID, `CREATE TABLE bar (id INT PRIMARY KEY, c1 BIGINT, c2 DECIMAL(14,4))`)
+	)
+	narrowed, old := narrowedColumn(ti0, ti1)
+	c.Assert(narrowed.Name.L, Equals, "c1")
+	c.Assert(old.FieldType.CompactStr(), Equals, "bigint(20)")
+	narrowed, _ = narrowedColumn(ti0, ti2) // the integer digits narrowed.
+	c.Assert(narrowed.Name.L, Equals, "c2")
+	narrowed, _ = narrowedColumn(ti0, ti3)
+	c.Assert(narrowed, IsNil)
+	narrowed, _ = narrowedColumn(ti1, ti0)
+	c.Assert(narrowed, IsNil)
+}
@@ -15,9 +15,16 @@ package optimism
 
 import (
 	"context"
+	"encoding/binary"
 	"encoding/json"
 	"fmt"
+	"hash/fnv"
+	"path"
+	"regexp"
+	"sort"
+	"strings"
 
+	"github.com/pingcap/tidb-tools/pkg/dbutil"
 	"go.etcd.io/etcd/clientv3"
 	"go.etcd.io/etcd/mvcc/mvccpb"
 
@@ -41,6 +48,9 @@ type SourceTables struct {
 	// only used to report to the caller of the watcher, do not marsh it.
 	// if it's true, it means the SourceTables has been deleted in etcd.
 	IsDeleted bool `json:"-"`
+	// only used to report to the caller of the watcher, do not marsh it.
+	// the mod revision of the PUT/DELETE event in etcd, 0 if not got from the watcher.
+	Revision int64 `json:"-"`
 }
 
 // NewSourceTables creates a new SourceTables instances.
@@ -52,6 +62,104 @@ func NewSourceTables(task, source string, tables map[string]map[string]struct{})
 	}
 }
 
+// SourceTablesBuilder used to build SourceTables conveniently.
+type SourceTablesBuilder struct {
+	st SourceTables
+}
+
+// NewSourceTablesBuilder creates a new SourceTablesBuilder instance.
+func NewSourceTablesBuilder(task, source string) *SourceTablesBuilder {
+	return &SourceTablesBuilder{
+		st: NewSourceTables(task, source, map[string]map[string]struct{}{}),
+	}
+}
+
+// AddTable adds a table into the SourceTables to build.
+func (b *SourceTablesBuilder) AddTable(schema, table string) *SourceTablesBuilder {
+	b.st.AddTable(schema, table)
+	return b
+}
+
+// AddSchema adds tables in a schema into the SourceTables to build.
+// NOTE: a schema without any tables is not added, the same as removing the last table in `RemoveTable`.
+func (b *SourceTablesBuilder) AddSchema(schema string, tables ...string) *SourceTablesBuilder {
+	for _, table := range tables {
+		b.st.AddTable(schema, table)
+	}
+	return b
+}
+
+// Build returns the built SourceTables.
+// the builder can be reused after built, and changes after built do not affect the returned one.
+func (b *SourceTablesBuilder) Build() SourceTables {
+	return b.st.DeepCopy()
+}
+
+// DeepCopy returns a fully independent copy of SourceTables, nested maps of tables are not shared,
+// so changes to the copy do not affect the original one, and vice versa.
+// this is often used when handing SourceTables to other goroutines.
+func (st SourceTables) DeepCopy() SourceTables {
+	clone := st
+	if st.Tables == nil {
+		return clone
+	}
+	clone.Tables = make(map[string]map[string]struct{}, len(st.Tables))
+	for schema, tables := range st.Tables {
+		clone.Tables[schema] = make(map[string]struct{}, len(tables))
+		for table := range tables {
+			clone.Tables[schema][table] = struct{}{}
+		}
+	}
+	return clone
+}
+
+// Equal returns whether two SourceTables have the same task, source and tables.
+// NOTE: `IsDeleted` and `Revision` are not compared because they're only used to report to the caller of the watcher.
+func (st SourceTables) Equal(other SourceTables) bool {
+	if st.Task != other.Task || st.Source != other.Source || len(st.Tables) != len(other.Tables) {
+		return false
+	}
+	for schema, tables := range st.Tables {
+		otherTables, ok := other.Tables[schema]
+		if !ok || len(tables) != len(otherTables) {
+			return false
+		}
+		for table := range tables {
+			if _, ok := otherTables[table]; !ok {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// Hash returns a hash of the task, source and tables, it's often used to detect whether tables changed cheaply.
+// the same content always has the same hash no matter the order of maps,
+// NOTE: `IsDeleted` and `Revision` are not hashed, the same as `Equal`.
+func (st SourceTables) Hash() uint64 {
+	h := fnv.New64a()
+	write := func(s string) {
+		// write the length before the string to avoid ambiguity like ("ab", "c") and ("a", "bc").
+		_ = binary.Write(h, binary.BigEndian, uint64(len(s)))
+		_, _ = h.Write([]byte(s))
+	}
+	write(st.Task)
+	write(st.Source)
+	for _, schema := range st.Schemas() {
+		tables := make([]string, 0, len(st.Tables[schema]))
+		for table := range st.Tables[schema] {
+			tables = append(tables, table)
+		}
+		sort.Strings(tables)
+		write(schema)
+		_ = binary.Write(h, binary.BigEndian, uint64(len(tables)))
+		for _, table := range tables {
+			write(table)
+		}
+	}
+	return h.Sum64()
+}
+
 // String implements Stringer interface.
 func (st SourceTables) String() string {
 	s, _ := st.toJSON()
@@ -80,6 +188,18 @@ func (st *SourceTables) AddTable(schema, table string) bool {
 	return false
 }
 
+// AddTables adds tables in the schema into SourceTables.
+// it returns the number of tables newly added (not exist before).
+func (st *SourceTables) AddTables(schema string, tables ...string) int {
+	added := 0
+	for _, table := range tables {
+		if st.AddTable(schema, table) {
+			added++
+		}
+	}
+	return added
+}
+
 // RemoveTable removes a table from SourceTables.
 // it returns whether removed (exist before).
 func (st *SourceTables) RemoveTable(schema, table string) bool {
@@ -96,15 +216,135 @@ func (st *SourceTables) RemoveTable(schema, table string) bool {
 	return true
 }
 
+// Schemas returns the sorted schema names in SourceTables.
+func (st SourceTables) Schemas() []string {
+	schemas := make([]string, 0, len(st.Tables))
+	for schema := range st.Tables {
+		schemas = append(schemas, schema)
+	}
+	sort.Strings(schemas)
+	return schemas
+}
+
+// FilterSchemas returns a new SourceTables containing only the schemas whose name matches `pattern`.
+// a pattern starting with `~` is a regular expression (the same as the block & allow list),
+// otherwise it's a glob pattern with the syntax of `path.Match` (like `shard_*` or `db_?`).
+// NOTE: an invalid pattern matches no schema, and the original SourceTables is not changed.
+func (st SourceTables) FilterSchemas(pattern string) SourceTables {
+	var match func(schema string) bool
+	if strings.HasPrefix(pattern, "~") {
+		reg, err := regexp.Compile(pattern[1:])
+		if err != nil {
+			match = func(string) bool { return false }
+		} else {
+			match = reg.MatchString
+		}
+	} else {
+		match = func(schema string) bool {
+			ok, err := path.Match(pattern, schema)
+			return err == nil && ok
+		}
+	}
+
+	b := NewSourceTablesBuilder(st.Task, st.Source)
+	for schema, tables := range st.Tables {
+		if !match(schema) {
+			continue
+		}
+		for table := range tables {
+			b.AddTable(schema, table)
+		}
+	}
+	return b.Build()
+}
+
+// Diff returns tables need to be added and removed to change `st` into `other`,
+// tables are in the form of `schema`.`table` and sorted, which can be applied by `TableKeeper.ApplyDiff`.
+func (st SourceTables) Diff(other SourceTables) (added, removed []string) {
+	added, removed = make([]string, 0), make([]string, 0)
+	for schema, tables := range other.Tables {
+		for table := range tables {
+			if _, ok := st.Tables[schema][table]; !ok {
+				added = append(added, dbutil.TableName(schema, table))
+			}
+		}
+	}
+	for schema, tables := range st.Tables {
+		for table := range tables {
+			if _, ok := other.Tables[schema][table]; !ok {
+				removed = append(removed, dbutil.TableName(schema, table))
+			}
+		}
+	}
+	sort.Strings(added)
+	sort.Strings(removed)
+	return added, removed
+}
+
+// Subtract returns a new SourceTables containing tables in `st` but not in `other`,
+// the task and source of `other` are ignored. schemas without any tables left are not included.
+func (st SourceTables) Subtract(other SourceTables) SourceTables {
+	b := NewSourceTablesBuilder(st.Task, st.Source)
+	for schema, tables := range st.Tables {
+		for table := range tables {
+			if _, ok := other.Tables[schema][table]; !ok {
+				b.AddTable(schema, table)
+			}
+		}
+	}
+	return b.Build()
+}
+
 // sourceTablesFromJSON constructs SourceTables from its JSON represent.
 func sourceTablesFromJSON(s string) (st SourceTables, err error) {
 	err = json.Unmarshal([]byte(s), &st)
 	return
 }
 
+// sourceTablesGob is the gob represent of SourceTables, gob can't encode `struct{}` in the map.
+type sourceTablesGob struct {
+	Task   string
+	Source string
+	Tables map[string][]string
+}
+
+// encode returns the represent of SourceTables put into etcd, encoded by the codec set by `SetCodec`.
+func (st SourceTables) encode() (string, error) {
+	if valueCodec != CodecGob {
+		return st.toJSON()
+	}
+	stg := sourceTablesGob{Task: st.Task, Source: st.Source, Tables: make(map[string][]string, len(st.Tables))}
+	for schema, tables := range st.Tables {
+		stg.Tables[schema] = make([]string, 0, len(tables))
+		for table := range tables {
+			stg.Tables[schema] = append(stg.Tables[schema], table)
+		}
+	}
+	return encodeGob(stg)
+}
+
+// sourceTablesFromValue constructs SourceTables from its represent in etcd, which may be encoded by any codec.
+func sourceTablesFromValue(s string) (st SourceTables, err error) {
+	if !isGobValue(s) {
+		return sourceTablesFromJSON(s)
+	}
+	var stg sourceTablesGob
+	if err = decodeGob(s, &stg); err != nil {
+		return
+	}
+	st = SourceTables{Task: stg.Task, Source: stg.Source, Tables: make(map[string]map[string]struct{}, len(stg.Tables))}
+	for schema, tables := range stg.Tables {
+		st.Tables[schema] = make(map[string]struct{}, len(tables))
+		for _, table := range tables {
+			st.Tables[schema][table] = struct{}{}
+		}
+	}
+	return
+}
+
 // PutSourceTables puts source tables into etcd.
 // This function should often be called by DM-worker.
-func PutSourceTables(cli *clientv3.Client, st SourceTables) (int64, error) {
+func PutSourceTables(cli etcdutil.KVClient, st SourceTables) (int64, error) {
 	op, err := putSourceTablesOp(st)
 	if err != nil {
 		return 0, err
@@ -115,7 +355,7 @@ func PutSourceTables(cli *clientv3.Client, st SourceTables) (int64, error) {
 
 // DeleteSourceTables deletes the source tables in etcd.
 // This function should often be called by DM-worker.
-func DeleteSourceTables(cli *clientv3.Client, st SourceTables) (int64, error) {
+func DeleteSourceTables(cli etcdutil.KVClient, st SourceTables) (int64, error) {
 	key := common.ShardDDLOptimismSourceTablesKeyAdapter.Encode(st.Task, st.Source)
 	_, rev, err := etcdutil.DoOpsInOneTxnWithRetry(cli, clientv3.OpDelete(key))
 	return rev, err
@@ -124,18 +364,32 @@ func DeleteSourceTables(cli *clientv3.Client, st SourceTables) (int64, error) {
 // GetAllSourceTables gets all source tables in etcd currently.
 // This function should often be called by DM-master.
 // k/k/v: task-name -> source-ID -> source tables.
-func GetAllSourceTables(cli *clientv3.Client) (map[string]map[string]SourceTables, int64, error) {
-	respTxn, _, err := etcdutil.DoOpsInOneTxnWithRetry(cli, clientv3.OpGet(common.ShardDDLOptimismSourceTablesKeyAdapter.Path(), clientv3.WithPrefix()))
+func GetAllSourceTables(cli etcdutil.KVClient) (map[string]map[string]SourceTables, int64, error) {
+	return GetAllSourceTablesCtx(cli.Ctx(), cli)
+}
+
+// GetAllSourceTablesCtx is the same as `GetAllSourceTables` but honors the deadline/cancellation of `ctx`.
+func GetAllSourceTablesCtx(ctx context.Context, cli etcdutil.KVClient) (map[string]map[string]SourceTables, int64, error) {
+	respTxn, _, err := etcdutil.DoOpsInOneTxnWithRetryCtx(ctx, cli, clientv3.OpGet(common.ShardDDLOptimismSourceTablesKeyAdapter.Path(), clientv3.WithPrefix()))
 	if err != nil {
 		return nil, 0, err
 	}
 	resp := respTxn.Responses[0].GetResponseRange()
 
+	stm, err := sourceTablesFromKVs(resp.Kvs)
+	if err != nil {
+		return nil, 0, err
+	}
+	return stm, resp.Header.Revision, nil
+}
+
+// sourceTablesFromKVs decodes source tables from key-values got from etcd.
+func sourceTablesFromKVs(kvs []*mvccpb.KeyValue) (map[string]map[string]SourceTables, error) {
 	stm := make(map[string]map[string]SourceTables)
-	for _, kv := range resp.Kvs {
-		st, err2 := sourceTablesFromJSON(string(kv.Value))
-		if err2 != nil {
-			return nil, 0, err2
+	for _, kv := range kvs {
+		st, err := sourceTablesFromValue(string(kv.Value))
+		if err != nil {
+			return nil, err
 		}
 
 		if _, ok := stm[st.Task]; !ok {
@@ -143,13 +397,12 @@ func GetAllSourceTables(cli *clientv3.Client) (map[string]map[string]SourceTable
 		}
 		stm[st.Task][st.Source] = st
 	}
-
-	return stm, resp.Header.Revision, nil
+	return stm, nil
 }
 
 // WatchSourceTables watches PUT & DELETE operations for source tables.
 // This function should often be called by DM-master.
-func WatchSourceTables(ctx context.Context, cli *clientv3.Client, revision int64,
+func WatchSourceTables(ctx context.Context, cli etcdutil.KVClient, revision int64,
 	outCh chan<- SourceTables, errCh chan<- error) {
 	ch := cli.Watch(ctx, common.ShardDDLOptimismSourceTablesKeyAdapter.Path(),
 		clientv3.WithPrefix(), clientv3.WithRev(revision))
@@ -175,7 +428,7 @@ func WatchSourceTables(ctx context.Context, cli *clientv3.Client, revision int64
 
 				switch ev.Type {
 				case mvccpb.PUT:
-					st, err = sourceTablesFromJSON(string(ev.Kv.Value))
+					st, err = sourceTablesFromValue(string(ev.Kv.Value))
 				case mvccpb.DELETE:
 					st, err = sourceTablesFromKey(string(ev.Kv.Key))
 					st.IsDeleted = true
@@ -183,6 +436,7 @@ func WatchSourceTables(ctx context.Context, cli *clientv3.Client, revision int64
 					// this should not happen.
 					err = fmt.Errorf("unsupported ectd event type %v", ev.Type)
 				}
+				st.Revision = ev.Kv.ModRevision
 
 				if err != nil {
 					select {
@@ -216,7 +470,7 @@ func sourceTablesFromKey(key string) (SourceTables, error) {
 
 // putSourceTablesOp returns a PUT etcd operation for source tables.
 func putSourceTablesOp(st SourceTables) (clientv3.Op, error) {
-	value, err := st.toJSON()
+	value, err := st.encode()
 	if err != nil {
 		return clientv3.Op{}, err
 	}
@@ -54,6 +54,240 @@ func (t *testForEtcd) TestSourceTablesAddRemove(c *C) {
 	c.Assert(st.RemoveTable(db, tbl), IsTrue)
 	c.Assert(st.RemoveTable(db, tbl), IsFalse)
 	c.Assert(st.Tables, HasLen, 0)
+
+	// add a mix of new and existing tables.
+	c.Assert(st.AddTables(db), Equals, 0)
+	c.Assert(st.Tables, HasLen, 0)
+	c.Assert(st.AddTables(db, tbl), Equals, 1)
+	c.Assert(st.AddTables(db, tbl, "bar-2", "bar-3", "bar-2"), Equals, 2)
+	c.Assert(st.AddTables(db, tbl, "bar-3"), Equals, 0)
+	c.Assert(st.Tables[db], HasLen, 3)
+}
+
+func (t *testForEtcd) TestSourceTablesSchemas(c *C) {
+	st := NewSourceTables("task", "mysql-replica-1", map[string]map[string]struct{}{})
+	c.Assert(st.Schemas(), HasLen, 0)
+
+	c.Assert(st.AddTable("db-2", "tbl-1"), IsTrue)
+	c.Assert(st.AddTable("db-1", "tbl-1"), IsTrue)
+	c.Assert(st.AddTable("db-1", "tbl-2"), IsTrue)
+	c.Assert(st.Schemas(), DeepEquals, []string{"db-1", "db-2"})
+
+	c.Assert(st.RemoveTable("db-2", "tbl-1"), IsTrue)
+	c.Assert(st.Schemas(), DeepEquals, []string{"db-1"})
+}
+
+func (t *testForEtcd) TestSourceTablesBuilder(c *C) {
+	var (
+		task   = "task"
+		source = "mysql-replica-1"
+		b      = NewSourceTablesBuilder(task, source)
+	)
+
+	// build without tables.
+	st := b.Build()
+	c.Assert(st.Equal(NewSourceTables(task, source, map[string]map[string]struct{}{})), IsTrue)
+	c.Assert(st.Equal(NewSourceTables(task, "mysql-replica-2", map[string]map[string]struct{}{})), IsFalse)
+
+	// build with tables.
+	st = b.AddTable("db-1", "tbl-1").AddSchema("db-2", "tbl-1", "tbl-2").AddSchema("db-3").AddTable("db-1", "tbl-1").Build()
+	expected := NewSourceTables(task, source, map[string]map[string]struct{}{
+		"db-1": {"tbl-1": struct{}{}},
+		"db-2": {"tbl-1": struct{}{}, "tbl-2": struct{}{}},
+	})
+	c.Assert(st.Equal(expected), IsTrue)
+	c.Assert(expected.Equal(st), IsTrue)
+	c.Assert(st, DeepEquals, expected)
+
+	// changes after built do not affect the built one.
+	b.AddTable("db-2", "tbl-3")
+	c.Assert(st.Equal(expected), IsTrue)
+	st2 := b.Build()
+	c.Assert(st2.Equal(st), IsFalse)
+	c.Assert(st.Equal(st2), IsFalse)
+
+	// `IsDeleted` is not compared.
+	st2 = b.Build()
+	st2.IsDeleted = true
+	c.Assert(st2.Equal(b.Build()), IsTrue)
+
+	// different tables in the same schema.
+	st = NewSourceTablesBuilder(task, source).AddSchema("db-1", "tbl-1").Build()
+	st2 = NewSourceTablesBuilder(task, source).AddSchema("db-1", "tbl-2").Build()
+	c.Assert(st.Equal(st2), IsFalse)
+}
+
+func (t *testForEtcd) TestSourceTablesHash(c *C) {
+	var (
+		task   = "task"
+		source = "mysql-replica-1"
+		st1    = NewSourceTablesBuilder(task, source).AddSchema("db-1", "tbl-1", "tbl-2").AddSchema("db-2", "tbl-1").Build()
+		st2    = NewSourceTablesBuilder(task, source).AddSchema("db-2", "tbl-1").AddSchema("db-1", "tbl-2", "tbl-1").Build()
+	)
+
+	// the same content has the same hash regardless of the order.
+	c.Assert(st1.Hash(), Equals, st2.Hash())
+	hash := st1.Hash()
+	for i := 0; i < 10; i++ {
+		c.Assert(st1.Hash(), Equals, hash) // the order of maps is random for each iteration.
+	}
+	st2.IsDeleted = true
+	c.Assert(st2.Hash(), Equals, st1.Hash())
+
+	// different content has different hashes.
+	c.Assert(st2.AddTable("db-1", "tbl-3"), IsTrue)
+	c.Assert(st2.Hash(), Not(Equals), st1.Hash())
+	c.Assert(st2.RemoveTable("db-1", "tbl-3"), IsTrue)
+	c.Assert(st2.Hash(), Equals, st1.Hash())
+	others := []SourceTables{
+		NewSourceTablesBuilder("task-2", source).AddSchema("db-1", "tbl-1", "tbl-2").AddSchema("db-2", "tbl-1").Build(),
+		NewSourceTablesBuilder(task, "mysql-replica-2").AddSchema("db-1", "tbl-1", "tbl-2").AddSchema("db-2", "tbl-1").Build(),
+		NewSourceTablesBuilder(task, source).AddSchema("db-1", "tbl-1", "tbl-2").Build(),
+		NewSourceTablesBuilder(task, source).AddSchema("db-1", "tbl-1").AddSchema("db-2", "tbl-1", "tbl-2").Build(),
+		NewSourceTablesBuilder(task, source).AddSchema("db-1", "tbl-1", "tbl-2", "db-2", "tbl-1").Build(),
+		NewSourceTables(task, source, map[string]map[string]struct{}{}),
+	}
+	for _, other := range others {
+		c.Assert(other.Hash(), Not(Equals), st1.Hash(), Commentf("%s", other))
+	}
+}
+
+func (t *testForEtcd) TestSourceTablesFilterSchemas(c *C) {
+	var (
+		task   = "task"
+		source = "mysql-replica-1"
+		st     = NewSourceTablesBuilder(task, source).
+			AddSchema("shard_1", "tbl-1", "tbl-2").
+			AddSchema("shard_2", "tbl-1").
+			AddSchema("shard_10", "tbl-1").
+			AddSchema("other", "tbl-1").Build()
+		origin = NewSourceTablesBuilder(task, source).
+			AddSchema("shard_1", "tbl-1", "tbl-2").
+			AddSchema("shard_2", "tbl-1").
+			AddSchema("shard_10", "tbl-1").
+			AddSchema("other", "tbl-1").Build()
+	)
+
+	cases := []struct {
+		pattern string
+		schemas []string
+	}{
+		{"shard_*", []string{"shard_1", "shard_10", "shard_2"}}, // glob.
+		{"shard_?", []string{"shard_1", "shard_2"}},
+		{"other", []string{"other"}},
+		{"not-exist", []string{}},
+		{"[", []string{}},                                // invalid glob.
+		{"~^shard_\\d$", []string{"shard_1", "shard_2"}}, // regex.
+		{"~shard", []string{"shard_1", "shard_10", "shard_2"}},
+		{"~^$", []string{}},
+		{"~(", []string{}}, // invalid regex.
+	}
+	for _, cs := range cases {
+		filtered := st.FilterSchemas(cs.pattern)
+		c.Assert(filtered.Task, Equals, task)
+		c.Assert(filtered.Source, Equals, source)
+		c.Assert(filtered.Schemas(), DeepEquals, cs.schemas, Commentf("pattern %s", cs.pattern))
+	}
+
+	// tables are kept, and the original one is not changed.
+	filtered := st.FilterSchemas("shard_1")
+	c.Assert(filtered.Equal(NewSourceTablesBuilder(task, source).AddSchema("shard_1", "tbl-1", "tbl-2").Build()), IsTrue)
+	c.Assert(filtered.AddTable("shard_1", "tbl-3"), IsTrue)
+	c.Assert(st.Equal(origin), IsTrue)
+}
+
+func (t *testForEtcd) TestSourceTablesDiff(c *C) {
+	var (
+		task   = "task"
+		source = "mysql-replica-1"
+		st1    = NewSourceTablesBuilder(task, source).
+			AddSchema("db-1", "tbl-1", "tbl-2").
+			AddSchema("db-2", "tbl-1").Build()
+		st2 = NewSourceTablesBuilder(task, source).
+			AddSchema("db-1", "tbl-2", "tbl-3").
+			AddSchema("db-3", "tbl-1").Build()
+	)
+
+	added, removed := st1.Diff(st2)
+	c.Assert(added, DeepEquals, []string{"`db-1`.`tbl-3`", "`db-3`.`tbl-1`"})
+	c.Assert(removed, DeepEquals, []string{"`db-1`.`tbl-1`", "`db-2`.`tbl-1`"})
+
+	// reversed.
+	added, removed = st2.Diff(st1)
+	c.Assert(added, DeepEquals, []string{"`db-1`.`tbl-1`", "`db-2`.`tbl-1`"})
+	c.Assert(removed, DeepEquals, []string{"`db-1`.`tbl-3`", "`db-3`.`tbl-1`"})
+
+	// no difference.
+	added, removed = st1.Diff(st1)
+	c.Assert(added, HasLen, 0)
+	c.Assert(removed, HasLen, 0)
+}
+
+func (t *testForEtcd) TestSourceTablesSubtract(c *C) {
+	var (
+		task   = "task"
+		source = "mysql-replica-1"
+		st1    = NewSourceTablesBuilder(task, source).
+			AddSchema("db-1", "tbl-1", "tbl-2").
+			AddSchema("db-2", "tbl-1").Build()
+		st2 = NewSourceTablesBuilder(task, source).
+			AddSchema("db-1", "tbl-2", "tbl-3").
+			AddSchema("db-2", "tbl-1").Build()
+		st3 = NewSourceTablesBuilder(task, "mysql-replica-2").
+			AddSchema("db-3", "tbl-1").Build()
+	)
+
+	// overlapping.
+	st := st1.Subtract(st2)
+	c.Assert(st, DeepEquals, NewSourceTablesBuilder(task, source).AddSchema("db-1", "tbl-1").Build())
+	st = st2.Subtract(st1)
+	c.Assert(st, DeepEquals, NewSourceTablesBuilder(task, source).AddSchema("db-1", "tbl-3").Build())
+
+	// disjoint.
+	c.Assert(st1.Subtract(st3), DeepEquals, st1)
+	c.Assert(st3.Subtract(st1), DeepEquals, st3)
+
+	// nothing left.
+	st = st1.Subtract(st1)
+	c.Assert(st.Task, Equals, task)
+	c.Assert(st.Source, Equals, source)
+	c.Assert(st.Tables, HasLen, 0)
+
+	// the original ones are not changed.
+	c.Assert(st1.Tables["db-1"], HasLen, 2)
+	c.Assert(st2.Tables["db-1"], HasLen, 2)
+}
+
+func (t *testForEtcd) TestSourceTablesDeepCopy(c *C) {
+	var (
+		task   = "task"
+		source = "mysql-replica-1"
+		st1    = NewSourceTablesBuilder(task, source).
+			AddSchema("db-1", "tbl-1", "tbl-2").
+			AddSchema("db-2", "tbl-1").Build()
+	)
+
+	st2 := st1.DeepCopy()
+	c.Assert(st2, DeepEquals, st1)
+
+	// mutating the copy doesn't affect the original one.
+	c.Assert(st2.AddTable("db-1", "tbl-3"), IsTrue)
+	c.Assert(st2.AddTable("db-3", "tbl-1"), IsTrue)
+	c.Assert(st2.RemoveTable("db-2", "tbl-1"), IsTrue)
+	c.Assert(st1.Tables, DeepEquals, map[string]map[string]struct{}{
+		"db-1": {"tbl-1": struct{}{}, "tbl-2": struct{}{}},
+		"db-2": {"tbl-1": struct{}{}},
+	})
+
+	// and vice versa.
+	st2 = st1.DeepCopy()
+	c.Assert(st1.RemoveTable("db-1", "tbl-1"), IsTrue)
+	c.Assert(st2.Tables["db-1"], HasLen, 2)
+
+	// nil tables and the deleted flag are kept.
+	st3 := NewSourceTables(task, source, nil)
+	st3.IsDeleted = true
+	c.Assert(st3.DeepCopy(), DeepEquals, st3)
 }
 
 func (t *testForEtcd) TestSourceTablesEtcd(c *C) {
@@ -97,8 +331,9 @@ func (t *testForEtcd) TestSourceTablesEtcd(c *C) {
 	close(wch)
 	close(ech)
 
-	// get two source tables.
+	// get two source tables, with revisions of the events.
 	c.Assert(len(wch), Equals, 2)
+	st1.Revision, st2.Revision = rev1, rev2
 	c.Assert(<-wch, DeepEquals, st1)
 	c.Assert(<-wch, DeepEquals, st2)
 	c.Assert(len(ech), Equals, 0)
@@ -128,5 +363,28 @@ func (t *testForEtcd) TestSourceTablesEtcd(c *C) {
 	c.Assert(std.IsDeleted, IsTrue)
 	c.Assert(std.Task, Equals, st2.Task)
 	c.Assert(std.Source, Equals, st2.Source)
+	c.Assert(std.Revision, Equals, rev4)
 	c.Assert(len(ech), Equals, 0)
 }
+
+func (t *testForEtcd) TestGetAllSourceTablesCtx(c *C) {
+	defer clearTestInfoOperation(c)
+
+	st := NewSourceTables("task", "mysql-replica-1", map[string]map[string]struct{}{
+		"db": {"tbl-1": struct{}{}},
+	})
+	_, err := PutSourceTables(etcdTestCli, st)
+	c.Assert(err, IsNil)
+
+	// get with a valid context.
+	stm, _, err := GetAllSourceTablesCtx(context.Background(), etcdTestCli)
+	c.Assert(err, IsNil)
+	c.Assert(stm[st.Task][st.Source], DeepEquals, st)
+
+	// get with a canceled context.
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	stm, _, err = GetAllSourceTablesCtx(ctx, etcdTestCli)
+	c.Assert(err, NotNil)
+	c.Assert(stm, IsNil)
+}
@@ -152,6 +152,24 @@ const (
 
 	// pkg/shardddl/optimism
 	codeShardDDLOptimismTrySyncFail
+	codeShardDDLOptimismOutOfOrderDDL
+	codeShardDDLOptimismSourceNotFound
+	codeShardDDLOptimismLockNotFound
+	codeShardDDLOptimismParseDDL
+	codeShardDDLOptimismRewriteDDL
+	codeShardDDLOptimismTaskPaused
+	codeShardDDLOptimismTooManyLocks
+	codeShardDDLOptimismLockNotResolved
+	codeShardDDLOptimismRevisionCompacted
+	codeShardDDLOptimismForeignKeyNotSupported
+	codeShardDDLOptimismRateLimited
+	codeShardDDLOptimismLockRemoved
+	codeShardDDLOptimismDDLNotFound
+	codeShardDDLOptimismLockNotSynced
+	codeShardDDLOptimismInvalidLockID
+	codeShardDDLOptimismUnknownCollation
+	codeShardDDLOptimismPaused
+	codeShardDDLOptimismLockIDCollision
 )
 
 // Config related error code list
@@ -680,7 +698,25 @@ var (
 	ErrDecodeEtcdKeyFail = New(codeDecodeEtcdKeyFail, ClassFunctional, ScopeInternal, LevelMedium, "fail to decode etcd key: %s")
 
 	// pkg/shardddl/optimism
-	ErrShardDDLOptimismTrySyncFail = New(codeShardDDLOptimismTrySyncFail, ClassFunctional, ScopeInternal, LevelMedium, "fail to try sync the optimistic shard ddl lock %s: %s")
+	ErrShardDDLOptimismTrySyncFail            = New(codeShardDDLOptimismTrySyncFail, ClassFunctional, ScopeInternal, LevelMedium, "fail to try sync the optimistic shard ddl lock %s: %s")
+	ErrShardDDLOptimismOutOfOrderDDL          = New(codeShardDDLOptimismOutOfOrderDDL, ClassFunctional, ScopeInternal, LevelMedium, "the shard ddl info with sequence %d for table %s of source %s is out of order in the optimistic shard ddl lock %s, the latest sequence is %d")
+	ErrShardDDLOptimismSourceNotFound         = New(codeShardDDLOptimismSourceNotFound, ClassFunctional, ScopeInternal, LevelMedium, "source %s not found in the optimistic shard ddl lock %s")
+	ErrShardDDLOptimismLockNotFound           = New(codeShardDDLOptimismLockNotFound, ClassFunctional, ScopeInternal, LevelMedium, "optimistic shard ddl lock %s not found")
+	ErrShardDDLOptimismParseDDL               = New(codeShardDDLOptimismParseDDL, ClassFunctional, ScopeInternal, LevelMedium, "fail to parse the shard ddl %s for the optimistic shard ddl lock %s")
+	ErrShardDDLOptimismRewriteDDL             = New(codeShardDDLOptimismRewriteDDL, ClassFunctional, ScopeInternal, LevelMedium, "fail to rewrite the shard ddl %s for the optimistic shard ddl lock %s")
+	ErrShardDDLOptimismTaskPaused             = New(codeShardDDLOptimismTaskPaused, ClassFunctional, ScopeInternal, LevelMedium, "optimistic shard ddl of task %s is paused")
+	ErrShardDDLOptimismTooManyLocks           = New(codeShardDDLOptimismTooManyLocks, ClassFunctional, ScopeInternal, LevelMedium, "fail to create the optimistic shard ddl lock %s, the number of locks of task %s reaches the limit %d")
+	ErrShardDDLOptimismLockNotResolved        = New(codeShardDDLOptimismLockNotResolved, ClassFunctional, ScopeInternal, LevelMedium, "optimistic shard ddl lock %s is not resolved, some tables are still syncing")
+	ErrShardDDLOptimismRevisionCompacted      = New(codeShardDDLOptimismRevisionCompacted, ClassFunctional, ScopeInternal, LevelMedium, "the revision %d of optimistic shard ddl data in etcd has been compacted")
+	ErrShardDDLOptimismForeignKeyNotSupported = New(codeShardDDLOptimismForeignKeyNotSupported, ClassFunctional, ScopeInternal, LevelMedium, "foreign key DDL %s is not supported in the optimistic shard ddl lock %s")
+	ErrShardDDLOptimismRateLimited            = New(codeShardDDLOptimismRateLimited, ClassFunctional, ScopeInternal, LevelLow, "creating optimistic shard ddl lock %s is rate limited for task %s, please retry later")
+	ErrShardDDLOptimismLockRemoved            = New(codeShardDDLOptimismLockRemoved, ClassFunctional, ScopeInternal, LevelMedium, "optimistic shard ddl lock %s has been removed")
+	ErrShardDDLOptimismDDLNotFound            = New(codeShardDDLOptimismDDLNotFound, ClassFunctional, ScopeInternal, LevelMedium, "DDL %s not found in shard DDL infos of the optimistic shard ddl lock %s")
+	ErrShardDDLOptimismLockNotSynced          = New(codeShardDDLOptimismLockNotSynced, ClassFunctional, ScopeInternal, LevelMedium, "optimistic shard ddl lock %s is not synced, %d tables remain")
+	ErrShardDDLOptimismInvalidLockID          = New(codeShardDDLOptimismInvalidLockID, ClassFunctional, ScopeInternal, LevelMedium, "invalid optimistic shard ddl lock ID %s")
+	ErrShardDDLOptimismUnknownCollation       = New(codeShardDDLOptimismUnknownCollation, ClassFunctional, ScopeInternal, LevelMedium, "unknown downstream collation %s for optimistic shard ddl locks")
+	ErrShardDDLOptimismPaused                 = New(codeShardDDLOptimismPaused, ClassFunctional, ScopeInternal, LevelMedium, "optimistic shard ddl is paused for all tasks")
+	ErrShardDDLOptimismLockIDCollision        = New(codeShardDDLOptimismLockIDCollision, ClassFunctional, ScopeInternal, LevelHigh, "optimistic shard ddl lock %s of task %s for downstream table %s collides with the shard ddl info of task %s for downstream table %s")
 
 	// Config related error
 	ErrConfigCheckItemNotSupport    = New(codeConfigCheckItemNotSupport, ClassConfig, ScopeInternal, LevelMedium, "checking item %s is not supported\n%s")
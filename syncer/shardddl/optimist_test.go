@@ -117,7 +117,7 @@ func (t *testOptimist) TestOptimist(c *C) {
 	c.Assert(*info1c, DeepEquals, info1)
 
 	// put the lock operation.
-	rev2, putted, err := optimism.PutOperation(etcdTestCli, false, op1)
+	rev2, putted, _, err := optimism.PutOperation(etcdTestCli, false, op1)
 	c.Assert(err, IsNil)
 	c.Assert(rev2, Greater, rev1)
 	c.Assert(putted, IsTrue)
@@ -183,7 +183,7 @@ func (t *testOptimist) TestOptimist(c *C) {
 	c.Assert(o.PendingOperation(), IsNil)
 
 	// put another lock operation.
-	rev6, putted, err := optimism.PutOperation(etcdTestCli, false, op2)
+	rev6, putted, _, err := optimism.PutOperation(etcdTestCli, false, op2)
 	c.Assert(err, IsNil)
 	c.Assert(rev6, Greater, rev5)
 	c.Assert(putted, IsTrue)